@@ -1,3 +1,13 @@
 module github.com/pdxiv/frugalpromproxy
 
 go 1.16
+
+require (
+	github.com/golang/snappy v0.0.4
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/net v0.0.0-20211209124913-491a49abca63
+	gopkg.in/yaml.v3 v3.0.1
+	k8s.io/api v0.21.14
+	k8s.io/apimachinery v0.21.14
+	k8s.io/client-go v0.21.14
+)
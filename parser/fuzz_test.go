@@ -0,0 +1,52 @@
+//go:build go1.18
+// +build go1.18
+
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		nodeExporterExposition,
+		kubeStateMetricsExposition,
+		clientJavaExposition,
+		"up 1\n",
+		"up{a=\"1\",} 1 1622548800000\n",
+		"# TYPE a{b=\"c\"} gauge\n# HELP a \n",
+		"x{ b = \"\\\\\" , a=\"}\" } NaN -5\n",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, exposition string) {
+		checkRoundTrip(t, exposition)
+	})
+}
+
+func FuzzParseLabels(f *testing.F) {
+	for _, seed := range []string{``, `a="1"`, `b="2", a="x\"y",`, `a="\n"`} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, block string) {
+		labels, ok := ParseLabels(block)
+		if !ok {
+			return
+		}
+		// The labels of a block that parsed parse as a series, sorted
+		_, series, ok := ParseSeriesLine(`up{` + block + `} 1`)
+		if !ok {
+			t.Fatalf(`%q parsed as labels but not in a series`, block)
+		}
+		again, ok := ParseLabels(series.Labels)
+		if !ok || len(again) != len(labels) {
+			t.Fatalf(`%q gave the labels %q, which parse as %v`, block, series.Labels, again)
+		}
+		for i := range labels {
+			if labels[i] != again[i] || i > 0 && strings.Compare(labels[i-1].Name, labels[i].Name) >= 0 {
+				t.Fatalf(`%q gave %v, then %v`, block, labels, again)
+			}
+		}
+	})
+}
@@ -0,0 +1,189 @@
+// Package parser reads the Prometheus text exposition format the way
+// frugalpromproxy does: series lines, and HELP and TYPE comments. Other
+// comments and blank lines are skipped, anything else is reported as a
+// ParseError and skipped as well.
+//
+// The parser is deliberately lenient, and differs from the Prometheus one:
+//   - A family without a TYPE comment has an empty Type.
+//   - A series appearing twice keeps its last value, in the position where
+//     it first appeared.
+//   - A series appearing twice also keeps the timestamp of its last line,
+//     or none if that line had none.
+//   - Series of histograms and summaries (like _bucket, _sum and _count)
+//     are families of their own, named like the series.
+//   - Label values may hold any character, with \\, \" and \n escaped, so
+//     braces, commas and escaped quotes in them don't end the label block.
+//     Spaces around the labels and a trailing comma are allowed, and left
+//     out of Series.Labels. Other escapes and a label given twice make the
+//     line a ParseError.
+//   - Series.Labels has the labels sorted by name, so a series is the same
+//     whatever order the upstream gives its labels in.
+//   - Values take an exponent with a lowercase e only, so a value like
+//     1.5E8, as client_java writes them, makes the line a ParseError.
+//   - A line longer than bufio.MaxScanTokenSize ends the parse with a
+//     ParseError, everything before it is returned.
+package parser
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Regex patterns for the HELP and TYPE comments, series lines are split by
+// matchSeries
+var (
+	typePattern = regexp.MustCompile(`^# TYPE ([a-zA-Z_:][a-zA-Z0-9_:]*(?:\{[^\}]+\})?) (counter|gauge|histogram|summary|untyped)$`)
+	helpPattern = regexp.MustCompile(`^# HELP ([a-zA-Z_:][a-zA-Z0-9_:]*(?:\{[^\}]+\})?) (.*)$`)
+)
+
+// Family is a metric family: its HELP and TYPE, and its series in the order
+// they first appeared
+type Family struct {
+	Name   string
+	Help   string
+	Type   string // counter, gauge, histogram, summary, untyped or empty
+	Series []Series
+}
+
+// Series is one series of a family
+type Series struct {
+	// As in the exposition without the braces, sorted by name and the values
+	// still escaped. ParseLabels splits them.
+	Labels string
+	Value  float64
+	// Milliseconds since the epoch as in the exposition, 0 when the line
+	// had no timestamp
+	Timestamp int64
+}
+
+// ParseError is a line that couldn't be parsed
+type ParseError struct {
+	Line int // Starting at 1
+	Text string
+	Err  error // Why the parse stopped, nil for a skipped line
+}
+
+func (err ParseError) Error() string {
+	if err.Err != nil {
+		return fmt.Sprintf(`line %d: %v`, err.Line, err.Err)
+	}
+	return fmt.Sprintf(`line %d: can't parse %q`, err.Line, err.Text)
+}
+
+// Parse reads an exposition, returning its families in the order they first
+// appeared and the lines that couldn't be parsed
+func Parse(r io.Reader) ([]Family, []ParseError) {
+	families, errors, _ := parse(r)
+	return families, errors
+}
+
+// ParseCounting is Parse, also returning the number of lines that aren't
+// blank, to put the number of errors in proportion
+func ParseCounting(r io.Reader) ([]Family, []ParseError, int) {
+	return parse(r)
+}
+
+func parse(r io.Reader) ([]Family, []ParseError, int) {
+	var families []Family
+	var errors []ParseError
+	position := make(map[string]int)        // Of a family in families
+	seen := make(map[string]map[string]int) // Position of a series in its family
+	family := func(name string) *Family {
+		at, ok := position[name]
+		if !ok {
+			at = len(families)
+			position[name] = at
+			families = append(families, Family{Name: name})
+			seen[name] = make(map[string]int)
+		}
+		return &families[at]
+	}
+
+	scanner := bufio.NewScanner(r)
+	var lines, number int
+	for scanner.Scan() {
+		number++
+		text := scanner.Text()
+
+		// Only comments start with #, so a line is matched against one
+		// pattern at most
+		var matched bool
+		switch {
+		case strings.HasPrefix(text, `# TYPE `):
+			if typeResult := typePattern.FindStringSubmatch(text); len(typeResult) > 0 {
+				family(typeResult[1]).Type = typeResult[2]
+				matched = true
+			}
+		case strings.HasPrefix(text, `# HELP `):
+			if helpResult := helpPattern.FindStringSubmatch(text); len(helpResult) > 0 {
+				family(helpResult[1]).Help = helpResult[2]
+				matched = true
+			}
+		case strings.HasPrefix(text, `#`):
+		default:
+			if name, labels, number, timestamp, ok := matchSeries(text); ok {
+				matched = true
+				if series, ok := newSeries(labels, number, timestamp); ok {
+					parent := family(name)
+					if at, ok := seen[parent.Name][labels]; ok {
+						parent.Series[at] = series
+					} else {
+						seen[parent.Name][labels] = len(parent.Series)
+						parent.Series = append(parent.Series, series)
+					}
+				}
+			}
+		}
+
+		// Anything that isn't blank, a comment or matched above is garbage
+		if strings.TrimSpace(text) != `` {
+			lines++
+			if !matched && !strings.HasPrefix(text, `#`) {
+				errors = append(errors, ParseError{Line: number, Text: text})
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		errors = append(errors, ParseError{Line: number + 1, Err: err})
+	}
+	return families, errors, lines
+}
+
+// ParseSeries splits a single series line into the metric name, the labels
+// without the braces and the value. A timestamp is dropped.
+func ParseSeries(line string) (name, labels string, value float64, ok bool) {
+	name, series, ok := ParseSeriesLine(line)
+	return name, series.Labels, series.Value, ok
+}
+
+// ParseSeriesLine splits a single series line into the metric name and the
+// series, with its timestamp
+func ParseSeriesLine(line string) (name string, series Series, ok bool) {
+	name, labels, value, timestamp, ok := matchSeries(line)
+	if !ok {
+		return ``, Series{}, false
+	}
+	if series, ok = newSeries(labels, value, timestamp); !ok {
+		return ``, Series{}, false
+	}
+	return name, series, true
+}
+
+// A series from the text of a line split by matchSeries
+func newSeries(labels, value, timestamp string) (Series, bool) {
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return Series{}, false
+	}
+	series := Series{Labels: labels, Value: number}
+	if timestamp != `` {
+		if series.Timestamp, err = strconv.ParseInt(timestamp, 10, 64); err != nil {
+			return Series{}, false
+		}
+	}
+	return series, true
+}
@@ -0,0 +1,375 @@
+package parser
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Trimmed from node_exporter 1.1.2
+const nodeExporterExposition = `# HELP go_gc_duration_seconds A summary of the pause duration of garbage collection cycles.
+# TYPE go_gc_duration_seconds summary
+go_gc_duration_seconds{quantile="0"} 2.6528e-05
+go_gc_duration_seconds{quantile="0.25"} 4.3339e-05
+go_gc_duration_seconds{quantile="0.5"} 6.4245e-05
+go_gc_duration_seconds{quantile="0.75"} 9.7417e-05
+go_gc_duration_seconds{quantile="1"} 0.002306806
+go_gc_duration_seconds_sum 0.314159265
+go_gc_duration_seconds_count 2684
+# HELP go_goroutines Number of goroutines that currently exist.
+# TYPE go_goroutines gauge
+go_goroutines 8
+# HELP node_cpu_seconds_total Seconds the CPUs spent in each mode.
+# TYPE node_cpu_seconds_total counter
+node_cpu_seconds_total{cpu="0",mode="idle"} 1.23466547e+06
+node_cpu_seconds_total{cpu="0",mode="iowait"} 1571.46
+node_cpu_seconds_total{cpu="0",mode="irq"} 0
+node_cpu_seconds_total{cpu="0",mode="system"} 4153.83
+node_cpu_seconds_total{cpu="0",mode="user"} 12648.23
+node_cpu_seconds_total{cpu="1",mode="idle"} 1.23594938e+06
+node_cpu_seconds_total{cpu="1",mode="user"} 12812.06
+# HELP node_filesystem_avail_bytes Filesystem space available to non-root users in bytes.
+# TYPE node_filesystem_avail_bytes gauge
+node_filesystem_avail_bytes{device="/dev/sda1",fstype="ext4",mountpoint="/"} 2.7862339584e+10
+node_filesystem_avail_bytes{device="tmpfs",fstype="tmpfs",mountpoint="/run"} 8.25049088e+08
+# HELP node_load1 1m load average.
+# TYPE node_load1 gauge
+node_load1 0.52
+# HELP node_network_receive_bytes_total Network device statistic receive_bytes.
+# TYPE node_network_receive_bytes_total counter
+node_network_receive_bytes_total{device="eth0"} 9.8813582e+08
+node_network_receive_bytes_total{device="lo"} 1.0752734e+07
+# HELP node_scrape_collector_duration_seconds node_exporter: Duration of a collector scrape.
+# TYPE node_scrape_collector_duration_seconds gauge
+node_scrape_collector_duration_seconds{collector="cpu"} 0.000452147
+node_scrape_collector_duration_seconds{collector="filesystem"} 0.001203372
+# HELP node_scrape_collector_success node_exporter: Whether a collector succeeded.
+# TYPE node_scrape_collector_success gauge
+node_scrape_collector_success{collector="cpu"} 1
+node_scrape_collector_success{collector="filesystem"} 1
+# HELP node_uname_info Labeled system information as provided by the uname system call.
+# TYPE node_uname_info gauge
+node_uname_info{domainname="(none)",machine="x86_64",nodename="web-1",release="5.4.0-74-generic",sysname="Linux",version="#83-Ubuntu SMP Sat May 8 02:35:39 UTC 2021"} 1
+# HELP process_start_time_seconds Start time of the process since unix epoch in seconds.
+# TYPE process_start_time_seconds gauge
+process_start_time_seconds 1.62254880053e+09
+# HELP promhttp_metric_handler_requests_total Total number of scrapes by HTTP status code.
+# TYPE promhttp_metric_handler_requests_total counter
+promhttp_metric_handler_requests_total{code="200"} 2679
+promhttp_metric_handler_requests_total{code="500"} 0
+promhttp_metric_handler_requests_total{code="503"} 0
+`
+
+// Trimmed from kube-state-metrics 2.0.0, which doesn't sort its labels
+const kubeStateMetricsExposition = `# HELP kube_deployment_status_replicas_available The number of available replicas per deployment.
+# TYPE kube_deployment_status_replicas_available gauge
+kube_deployment_status_replicas_available{namespace="kube-system",deployment="coredns"} 2
+kube_deployment_status_replicas_available{namespace="default",deployment="web"} 3
+# HELP kube_pod_info Information about pod.
+# TYPE kube_pod_info gauge
+kube_pod_info{namespace="default",pod="web-6d4cf56db6-8tzkx",uid="0d6f4b3c-1b6e-4e0b-9a8e-2b1d6a5b7c11",host_ip="10.0.1.12",pod_ip="10.244.1.7",node="worker-1",created_by_kind="ReplicaSet",created_by_name="web-6d4cf56db6",priority_class="",host_network="false"} 1
+kube_pod_info{namespace="kube-system",pod="coredns-74ff55c5b-2xk9q",uid="9a3e1c2d-4b5f-4a6b-8c7d-0e1f2a3b4c5d",host_ip="10.0.1.11",pod_ip="10.244.0.3",node="control-plane",created_by_kind="ReplicaSet",created_by_name="coredns-74ff55c5b",priority_class="system-cluster-critical",host_network="false"} 1
+# HELP kube_pod_container_status_waiting_reason Describes the reason the container is currently in waiting state.
+# TYPE kube_pod_container_status_waiting_reason gauge
+kube_pod_container_status_waiting_reason{namespace="default",pod="batch-7c9d8-abcde",uid="5c6d7e8f-9a0b-4c1d-8e2f-3a4b5c6d7e8f",container="job",reason="CrashLoopBackOff"} 1
+# HELP kube_pod_status_phase The pods current phase.
+# TYPE kube_pod_status_phase gauge
+kube_pod_status_phase{namespace="default",pod="web-6d4cf56db6-8tzkx",uid="0d6f4b3c-1b6e-4e0b-9a8e-2b1d6a5b7c11",phase="Pending"} 0
+kube_pod_status_phase{namespace="default",pod="web-6d4cf56db6-8tzkx",uid="0d6f4b3c-1b6e-4e0b-9a8e-2b1d6a5b7c11",phase="Running"} 1
+kube_pod_status_phase{namespace="default",pod="web-6d4cf56db6-8tzkx",uid="0d6f4b3c-1b6e-4e0b-9a8e-2b1d6a5b7c11",phase="Failed"} 0
+# HELP kube_node_labels Kubernetes labels converted to Prometheus labels.
+# TYPE kube_node_labels gauge
+kube_node_labels{node="worker-1",label_kubernetes_io_arch="amd64",label_kubernetes_io_hostname="worker-1",label_node_role_kubernetes_io_worker=""} 1
+# HELP kube_node_status_capacity The capacity for different resources of a node.
+# TYPE kube_node_status_capacity gauge
+kube_node_status_capacity{node="worker-1",resource="cpu",unit="core"} 4
+kube_node_status_capacity{node="worker-1",resource="memory",unit="byte"} 1.6653774848e+10
+`
+
+// Trimmed from client_java 0.10.0, which writes values with a decimal point
+// and escapes its HELP texts
+const clientJavaExposition = `# HELP jvm_info VM version info
+# TYPE jvm_info gauge
+jvm_info{runtime="OpenJDK Runtime Environment",vendor="AdoptOpenJDK",version="11.0.11+9",} 1.0
+# HELP jvm_memory_bytes_used Used bytes of a given JVM memory area.
+# TYPE jvm_memory_bytes_used gauge
+jvm_memory_bytes_used{area="heap",} 1.18489112E8
+jvm_memory_bytes_used{area="nonheap",} 9.1327112E7
+# HELP jvm_threads_current Current thread count of a JVM
+# TYPE jvm_threads_current gauge
+jvm_threads_current 23.0
+# HELP jvm_gc_collection_seconds Time spent in a given JVM garbage collector in seconds.
+# TYPE jvm_gc_collection_seconds summary
+jvm_gc_collection_seconds_count{gc="G1 Young Generation",} 47.0
+jvm_gc_collection_seconds_sum{gc="G1 Young Generation",} 0.412
+jvm_gc_collection_seconds_count{gc="G1 Old Generation",} 0.0
+jvm_gc_collection_seconds_sum{gc="G1 Old Generation",} 0.0
+# HELP http_server_requests_seconds Request latency in seconds, with "quotes" and a \\ backslash.
+# TYPE http_server_requests_seconds histogram
+http_server_requests_seconds_bucket{method="GET",uri="/api/orders/{id}",le="0.005",} 12.0
+http_server_requests_seconds_bucket{method="GET",uri="/api/orders/{id}",le="0.05",} 140.0
+http_server_requests_seconds_bucket{method="GET",uri="/api/orders/{id}",le="0.5",} 151.0
+http_server_requests_seconds_bucket{method="GET",uri="/api/orders/{id}",le="+Inf",} 152.0
+http_server_requests_seconds_count{method="GET",uri="/api/orders/{id}",} 152.0
+http_server_requests_seconds_sum{method="GET",uri="/api/orders/{id}",} 4.87
+# HELP process_cpu_seconds_total Total user and system CPU time spent in seconds.
+# TYPE process_cpu_seconds_total counter
+process_cpu_seconds_total 31.47
+# HELP app_last_message Last message logged, escaped.
+# TYPE app_last_message gauge
+app_last_message{text="said \"hi\", then\nleft",} 1.0
+`
+
+// Render families in the text format, one HELP for every family so
+// families without series or comments survive
+func render(families []Family) string {
+	var b strings.Builder
+	for _, family := range families {
+		b.WriteString(`# HELP ` + family.Name + ` ` + family.Help + "\n")
+		if family.Type != `` {
+			b.WriteString(`# TYPE ` + family.Name + ` ` + family.Type + "\n")
+		}
+		for _, series := range family.Series {
+			b.WriteString(family.Name)
+			if series.Labels != `` {
+				b.WriteString(`{` + series.Labels + `}`)
+			}
+			b.WriteString(` ` + strconv.FormatFloat(series.Value, 'g', -1, 64))
+			if series.Timestamp != 0 {
+				b.WriteString(` ` + strconv.FormatInt(series.Timestamp, 10))
+			}
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
+
+// Parsing what was rendered from a parse gives the same families, without
+// errors
+func checkRoundTrip(t *testing.T, exposition string) {
+	t.Helper()
+	families, _ := Parse(strings.NewReader(exposition))
+	rendered := render(families)
+	again, errors := Parse(strings.NewReader(rendered))
+	if len(errors) > 0 {
+		t.Fatalf("rendered\n%s\nhas errors %v", rendered, errors)
+	}
+	if renderedAgain := render(again); renderedAgain != rendered {
+		t.Fatalf("rendered\n%s\nrendered after parsing it again\n%s", rendered, renderedAgain)
+	}
+}
+
+func familyByName(families []Family, name string) (Family, bool) {
+	for _, family := range families {
+		if family.Name == name {
+			return family, true
+		}
+	}
+	return Family{}, false
+}
+
+func TestParseReadsRealExpositions(t *testing.T) {
+	for name, corpus := range map[string]struct {
+		exposition string
+		families   int
+		rejected   int
+		series     map[string]Series // The first series of some families
+		types      map[string]string
+	}{
+		`node_exporter`: {nodeExporterExposition, 13, 0, map[string]Series{
+			`node_cpu_seconds_total`: {Labels: `cpu="0",mode="idle"`, Value: 1.23466547e+06},
+			`go_gc_duration_seconds`: {Labels: `quantile="0"`, Value: 2.6528e-05},
+			`node_uname_info`:        {Labels: `domainname="(none)",machine="x86_64",nodename="web-1",release="5.4.0-74-generic",sysname="Linux",version="#83-Ubuntu SMP Sat May 8 02:35:39 UTC 2021"`, Value: 1},
+		}, map[string]string{`go_gc_duration_seconds`: `summary`, `go_gc_duration_seconds_sum`: ``, `node_load1`: `gauge`}},
+		`kube-state-metrics`: {kubeStateMetricsExposition, 6, 0, map[string]Series{
+			`kube_pod_status_phase`:                     {Labels: `namespace="default",phase="Pending",pod="web-6d4cf56db6-8tzkx",uid="0d6f4b3c-1b6e-4e0b-9a8e-2b1d6a5b7c11"`},
+			`kube_node_labels`:                          {Labels: `label_kubernetes_io_arch="amd64",label_kubernetes_io_hostname="worker-1",label_node_role_kubernetes_io_worker="",node="worker-1"`, Value: 1},
+			`kube_node_status_capacity`:                 {Labels: `node="worker-1",resource="cpu",unit="core"`, Value: 4},
+			`kube_deployment_status_replicas_available`: {Labels: `deployment="coredns",namespace="kube-system"`, Value: 2},
+		}, map[string]string{`kube_pod_info`: `gauge`}},
+		`client_java`: {clientJavaExposition, 12, 2, map[string]Series{
+			`jvm_info`:                            {Labels: `runtime="OpenJDK Runtime Environment",vendor="AdoptOpenJDK",version="11.0.11+9"`, Value: 1},
+			`jvm_threads_current`:                 {Value: 23},
+			`http_server_requests_seconds_bucket`: {Labels: `le="0.005",method="GET",uri="/api/orders/{id}"`, Value: 12},
+			`app_last_message`:                    {Labels: `text="said \"hi\", then\nleft"`, Value: 1},
+		}, map[string]string{`http_server_requests_seconds`: `histogram`, `jvm_gc_collection_seconds`: `summary`, `process_cpu_seconds_total`: `counter`}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			families, errors := Parse(strings.NewReader(corpus.exposition))
+			if len(errors) != corpus.rejected {
+				t.Errorf(`errors %v`, errors)
+			}
+			if len(families) != corpus.families {
+				t.Errorf(`%d families, expected %d`, len(families), corpus.families)
+			}
+			for name, expected := range corpus.series {
+				family, ok := familyByName(families, name)
+				if !ok || len(family.Series) == 0 || family.Series[0] != expected {
+					t.Errorf(`%s: %+v, expected the first series %+v`, name, family, expected)
+				}
+			}
+			for name, expected := range corpus.types {
+				if family, _ := familyByName(families, name); family.Type != expected {
+					t.Errorf(`%s has the type %q, expected %q`, name, family.Type, expected)
+				}
+			}
+			checkRoundTrip(t, corpus.exposition)
+		})
+	}
+}
+
+// client_java writes exponents with a capital E, which the parser doesn't
+// take, unlike the Prometheus one
+func TestCapitalExponentsAreRejected(t *testing.T) {
+	families, errors := Parse(strings.NewReader(clientJavaExposition))
+	if family, _ := familyByName(families, `jvm_memory_bytes_used`); len(family.Series) != 0 {
+		t.Errorf(`series with a capital E parsed: %+v`, family.Series)
+	}
+	if len(errors) != 2 || errors[0].Text != `jvm_memory_bytes_used{area="heap",} 1.18489112E8` {
+		t.Errorf(`errors %v`, errors)
+	}
+}
+
+func TestParseDocumentedDifferences(t *testing.T) {
+	families, errors := Parse(strings.NewReader(`untyped_metric 1
+repeated{a="1"} 1 1000
+repeated{a="2"} 2
+repeated{a="1"} 3
+# TYPE latency histogram
+latency_bucket{le="+Inf"} 2
+latency_sum 0.5
+spaced{ b = "2" , a="1", } 4
+`))
+	if len(errors) != 0 {
+		t.Errorf(`errors %v`, errors)
+	}
+	if family, _ := familyByName(families, `untyped_metric`); family.Type != `` {
+		t.Errorf(`a family without TYPE has the type %q`, family.Type)
+	}
+	if family, _ := familyByName(families, `repeated`); len(family.Series) != 2 || family.Series[0] != (Series{Labels: `a="1"`, Value: 3}) {
+		t.Errorf(`a repeated series gave %+v`, family.Series)
+	}
+	for _, name := range []string{`latency`, `latency_bucket`, `latency_sum`} {
+		if _, ok := familyByName(families, name); !ok {
+			t.Errorf(`no family %s`, name)
+		}
+	}
+	if family, _ := familyByName(families, `spaced`); len(family.Series) != 1 || family.Series[0].Labels != `a="1",b="2"` {
+		t.Errorf(`labels with spaces and a trailing comma gave %+v`, family.Series)
+	}
+}
+
+func TestParseReportsLinesItCantRead(t *testing.T) {
+	_, errors, lines := ParseCounting(strings.NewReader(`ok 1
+
+# some comment
+repeated_label{a="1",a="2"} 1
+bad_escape{a="\t"} 1
+no_value
+ok{a="1"} 1 notatimestamp
+`))
+	if lines != 6 {
+		t.Errorf(`%d lines counted`, lines)
+	}
+	var numbers []int
+	for _, err := range errors {
+		numbers = append(numbers, err.Line)
+	}
+	if len(numbers) != 4 || numbers[0] != 4 || numbers[3] != 7 {
+		t.Errorf(`errors on lines %v`, numbers)
+	}
+	if message := errors[2].Error(); message != `line 6: can't parse "no_value"` {
+		t.Errorf(`message %s`, message)
+	}
+}
+
+func TestParseStopsAtLinesTooLong(t *testing.T) {
+	exposition := "before 1\nlong{a=\"" + strings.Repeat(`x`, 70000) + "\"} 1\nafter 1\n"
+	families, errors := Parse(strings.NewReader(exposition))
+	if len(families) != 1 || families[0].Name != `before` {
+		t.Errorf(`families %v`, families)
+	}
+	if len(errors) != 1 || errors[0].Err == nil || errors[0].Line != 2 {
+		t.Errorf(`errors %v`, errors)
+	}
+}
+
+func TestParseSeriesLine(t *testing.T) {
+	name, series, ok := ParseSeriesLine(`http_requests_total{path="/",code="200"} -Inf -1622548800000`)
+	if !ok || name != `http_requests_total` || series.Labels != `code="200",path="/"` || !math.IsInf(series.Value, -1) || series.Timestamp != -1622548800000 {
+		t.Errorf(`%s %+v %v`, name, series, ok)
+	}
+	if name, labels, value, ok := ParseSeries(`up 1 1622548800000`); !ok || name != `up` || labels != `` || value != 1 {
+		t.Errorf(`%s %s %v %v`, name, labels, value, ok)
+	}
+	for _, line := range []string{``, `1up 1`, `up`, `up  1`, `up 1.`, `up 1e5`, `up 1 1.5`, `up{a="1" 1`, `up{a=1} 1`} {
+		if _, _, ok := ParseSeriesLine(line); ok {
+			t.Errorf(`%q parsed`, line)
+		}
+	}
+}
+
+func TestParseLabelsUnescapes(t *testing.T) {
+	labels, ok := ParseLabels(`z="last", a="x\"y\\z\nw",`)
+	if !ok || len(labels) != 2 || labels[0] != (Label{Name: `a`, Value: "x\"y\\z\nw"}) || labels[1] != (Label{Name: `z`, Value: `last`}) {
+		t.Errorf(`labels %+v %v`, labels, ok)
+	}
+	for _, block := range []string{`a="1"} b="2"`, `a="1",a="2"`, `a="\x"`, `="1"`} {
+		if _, ok := ParseLabels(block); ok {
+			t.Errorf(`%s parsed`, block)
+		}
+	}
+}
+
+func BenchmarkParseNodeExporter(b *testing.B) {
+	exposition := strings.Repeat(nodeExporterExposition, 50)
+	b.SetBytes(int64(len(exposition)))
+	for i := 0; i < b.N; i++ {
+		Parse(strings.NewReader(exposition))
+	}
+}
+
+// The label values of the exposition format documentation, and worse
+func TestLabelValuesMayHoldAnything(t *testing.T) {
+	for _, test := range []struct {
+		line   string
+		labels string
+		values []string
+	}{
+		{`errors_total{message="unexpected \"}\" in input"} 3`, `message="unexpected \"}\" in input"`, []string{`unexpected "}" in input`}},
+		{`msdos_file_access_time_seconds{error="Cannot find file:\n\"FILE.TXT\"",path="C:\\DIR\\FILE.TXT"} 1.458255915e+09`, `error="Cannot find file:\n\"FILE.TXT\"",path="C:\\DIR\\FILE.TXT"`, []string{"Cannot find file:\n\"FILE.TXT\"", `C:\DIR\FILE.TXT`}},
+		{`query_total{a="x=1,y=2",b="{}"} 1`, `a="x=1,y=2",b="{}"`, []string{`x=1,y=2`, `{}`}},
+		{`trailing_backslash{a="\\"} 1`, `a="\\"`, []string{`\`}},
+		{`spaced{ a = "1" , b="2", } 1`, `a="1",b="2"`, []string{`1`, `2`}},
+		{`empty{} 1`, ``, nil},
+	} {
+		_, series, ok := ParseSeriesLine(test.line)
+		if !ok || series.Labels != test.labels || series.Value == 0 {
+			t.Errorf(`%s gave %+v %v`, test.line, series, ok)
+			continue
+		}
+		labels, ok := ParseLabels(series.Labels)
+		var values []string
+		for _, label := range labels {
+			values = append(values, label.Value)
+		}
+		if !ok || strings.Join(values, `|`) != strings.Join(test.values, `|`) {
+			t.Errorf(`%s has the values %q`, test.line, values)
+		}
+	}
+
+	for _, line := range []string{
+		`unterminated{a="1} 1`,
+		`unescaped_quote{a="say "hi""} 1`,
+		`tab_escape{a="\t"} 1`,
+		`no_comma{a="1"b="2"} 1`,
+		`repeated{a="1",a="2"} 1`,
+		`unquoted{a=1} 1`,
+		`double_comma{a="1",,b="2"} 1`,
+	} {
+		if _, _, ok := ParseSeriesLine(line); ok {
+			t.Errorf(`%s parsed`, line)
+		}
+	}
+}
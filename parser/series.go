@@ -0,0 +1,243 @@
+package parser
+
+import (
+	"sort"
+	"strings"
+)
+
+// matchSeries splits a series line like the pattern
+//
+//	^([a-zA-Z_:][a-zA-Z0-9_:]*)(?:\{(.*)\})? ([+-]Inf|NaN|-?[0-9]+(?:\.\d+)?(?:e[+-]\d+)?)(?: (-?\d+))?$
+//
+// would, without the regexp engine, which took most of the time of parsing
+// large expositions. The label block is read by scanLabels, so braces and
+// quotes in label values don't end it, and is returned in its canonical
+// form. The timestamp is empty for a line without one.
+func matchSeries(text string) (name, labels, value, timestamp string, ok bool) {
+	if text == `` || !isNameStart(text[0]) {
+		return ``, ``, ``, ``, false
+	}
+	i := 1
+	for i < len(text) && isNameChar(text[i]) {
+		i++
+	}
+	name = text[:i]
+	if i < len(text) && text[i] == '{' {
+		var end int
+		if labels, end, ok = scanLabels(text, i+1); !ok {
+			return ``, ``, ``, ``, false
+		}
+		i = end + 1
+	}
+	if i >= len(text) || text[i] != ' ' {
+		return ``, ``, ``, ``, false
+	}
+	value = text[i+1:]
+	if space := strings.IndexByte(value, ' '); space >= 0 {
+		timestamp = value[space+1:]
+		if !isInteger(timestamp) {
+			return ``, ``, ``, ``, false
+		}
+		value = value[:space]
+	}
+	if !isValue(value) {
+		return ``, ``, ``, ``, false
+	}
+	return name, labels, value, timestamp, true
+}
+
+func isNameStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == ':'
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || isDigit(c)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// One or more digits
+func isDigits(text string) bool {
+	if text == `` {
+		return false
+	}
+	for i := 0; i < len(text); i++ {
+		if !isDigit(text[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// -?\d+
+func isInteger(text string) bool {
+	return isDigits(strings.TrimPrefix(text, `-`))
+}
+
+// [+-]Inf|NaN|-?[0-9]+(?:\.\d+)?(?:e[+-]\d+)?
+func isValue(text string) bool {
+	switch text {
+	case `+Inf`, `-Inf`, `NaN`:
+		return true
+	}
+	text = strings.TrimPrefix(text, `-`)
+	if exponent := strings.IndexByte(text, 'e'); exponent >= 0 {
+		digits := text[exponent+1:]
+		if digits == `` || digits[0] != '+' && digits[0] != '-' || !isDigits(digits[1:]) {
+			return false
+		}
+		text = text[:exponent]
+	}
+	if dot := strings.IndexByte(text, '.'); dot >= 0 {
+		if !isDigits(text[dot+1:]) {
+			return false
+		}
+		text = text[:dot]
+	}
+	return isDigits(text)
+}
+
+// Label is a label of a series, with the value unescaped
+type Label struct {
+	Name  string
+	Value string
+}
+
+// ParseLabels splits the contents of a label block, like a="1",b="x\"y",
+// into its labels sorted by name, unescaping the values
+func ParseLabels(block string) ([]Label, bool) {
+	canonical, end, ok := scanLabels(block+`}`, 0)
+	if !ok || end != len(block) {
+		return nil, false
+	}
+	var labels []Label
+	for i := 0; i < len(canonical); {
+		equals := strings.IndexByte(canonical[i:], '=')
+		label := Label{Name: canonical[i : i+equals]}
+		value := make([]byte, 0, 16)
+		j := i + equals + 2 // After ="
+		for ; canonical[j] != '"'; j++ {
+			if canonical[j] == '\\' {
+				j++
+				if canonical[j] == 'n' {
+					value = append(value, '\n')
+					continue
+				}
+			}
+			value = append(value, canonical[j])
+		}
+		label.Value = string(value)
+		labels = append(labels, label)
+		i = j + 2 // After the quote and the comma
+	}
+	return labels, true
+}
+
+// Read the label block of a series line, starting after its {, up to the
+// closing }. Pairs are name="value", the value quoted with \\, \" and \n as
+// the only escapes, separated by commas and optionally followed by one.
+// Returns the block with the pairs sorted by name, without the spaces around
+// them and the trailing comma, which is the block itself for most upstreams,
+// and the position of the closing }. A label name given twice makes the
+// block invalid.
+func scanLabels(text string, start int) (string, int, bool) {
+	end, tidy, ok := walkLabels(text, start, nil)
+	if !ok {
+		return ``, 0, false
+	}
+	if tidy {
+		return text[start:end], end, true
+	}
+	var pairs []string
+	walkLabels(text, start, &pairs)
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i][:strings.IndexByte(pairs[i], '=')] < pairs[j][:strings.IndexByte(pairs[j], '=')]
+	})
+	return strings.Join(pairs, `,`), end, true
+}
+
+// Check a label block, returning the position of its closing } and whether
+// it is in its canonical form already, sorted and without spaces. With
+// pairs, the pairs are collected in their canonical form, unsorted.
+func walkLabels(text string, start int, pairs *[]string) (int, bool, bool) {
+	tidy := true
+	var seen [16]string
+	names := seen[:0] // For finding repeated names, few blocks have many
+	i := start
+	skipSpaces := func() {
+		for i < len(text) && (text[i] == ' ' || text[i] == '\t') {
+			i++
+			tidy = false
+		}
+	}
+	for {
+		skipSpaces()
+		if i < len(text) && text[i] == '}' {
+			// After a comma, or an empty block
+			tidy = tidy && (i == start || text[i-1] != ',')
+			return i, tidy, true
+		}
+		if i >= len(text) || !isLabelNameStart(text[i]) {
+			return 0, false, false
+		}
+		nameStart := i
+		for i < len(text) && isLabelNameChar(text[i]) {
+			i++
+		}
+		name := text[nameStart:i]
+		for _, seen := range names {
+			if seen == name {
+				return 0, false, false
+			}
+		}
+		if len(names) > 0 && name < names[len(names)-1] {
+			tidy = false
+		}
+		names = append(names, name)
+		skipSpaces()
+		if i >= len(text) || text[i] != '=' {
+			return 0, false, false
+		}
+		i++
+		skipSpaces()
+		if i >= len(text) || text[i] != '"' {
+			return 0, false, false
+		}
+		valueStart := i
+		for i++; i < len(text) && text[i] != '"'; i++ {
+			if text[i] != '\\' {
+				continue
+			}
+			i++
+			if i >= len(text) || text[i] != '\\' && text[i] != '"' && text[i] != 'n' {
+				return 0, false, false
+			}
+		}
+		if i >= len(text) {
+			return 0, false, false
+		}
+		i++
+		if pairs != nil {
+			*pairs = append(*pairs, name+`=`+text[valueStart:i])
+		}
+		skipSpaces()
+		switch {
+		case i < len(text) && text[i] == ',':
+			i++
+		case i < len(text) && text[i] == '}':
+			return i, tidy, true
+		default:
+			return 0, false, false
+		}
+	}
+}
+
+func isLabelNameStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+func isLabelNameChar(c byte) bool {
+	return isLabelNameStart(c) || isDigit(c)
+}
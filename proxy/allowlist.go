@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often a listener logs rejected connections at most
+const rejectLogInterval = time.Minute
+
+// Comma separated, repeatable command line flag holding CIDR ranges
+type cidrList []*net.IPNet
+
+func (list *cidrList) String() string {
+	ranges := make([]string, len(*list))
+	for i, network := range *list {
+		ranges[i] = network.String()
+	}
+	return strings.Join(ranges, `,`)
+}
+
+func (list *cidrList) Set(value string) error {
+	for _, element := range strings.Split(value, `,`) {
+		element = strings.TrimSpace(element)
+		if element == `` {
+			continue
+		}
+		// A bare address is shorthand for a single host range
+		if !strings.Contains(element, `/`) {
+			if ip := net.ParseIP(element); ip != nil && ip.To4() != nil {
+				element += `/32`
+			} else {
+				element += `/128`
+			}
+		}
+		_, network, err := net.ParseCIDR(element)
+		if err != nil {
+			return err
+		}
+		*list = append(*list, network)
+	}
+	return nil
+}
+
+func (list cidrList) contains(ip net.IP) bool {
+	for _, network := range list {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Source address allowlist for one listener
+type accessPolicy struct {
+	name           string
+	allowed        cidrList
+	trustedProxies cidrList
+	clock          Clock // Throttling the rejection log
+
+	mu         sync.Mutex
+	lastLog    time.Time
+	unreported int
+}
+
+// The address of the client, only looking at X-Forwarded-For when the
+// connection comes from a trusted proxy
+func (policy *accessPolicy) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !policy.trustedProxies.contains(ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values(`X-Forwarded-For`) {
+		hops = append(hops, strings.Split(header, `,`)...)
+	}
+	// Walk from the closest hop outwards, the first address not belonging to
+	// one of our proxies is the client
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			return ip
+		}
+		ip = hop
+		if !policy.trustedProxies.contains(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func (policy *accessPolicy) wrap(next http.Handler) http.Handler {
+	if len(policy.allowed) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := policy.clientIP(r)
+		if ip == nil || !policy.allowed.contains(ip) {
+			deniedConnections.inc(policy.name)
+			policy.logRejection(r.RemoteAddr, ip)
+			http.Error(w, `forbidden`, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (policy *accessPolicy) logRejection(remoteAddr string, ip net.IP) {
+	policy.mu.Lock()
+	defer policy.mu.Unlock()
+
+	now := policy.clock.Now()
+	if now.Sub(policy.lastLog) < rejectLogInterval {
+		policy.unreported++
+		return
+	}
+	if policy.unreported > 0 {
+		log.Printf("%s: %d more requests rejected by the allowlist since the last report", policy.name, policy.unreported)
+	}
+	log.Printf("%s: rejected request from %s (client %v) not in allowlist", policy.name, remoteAddr, ip)
+	policy.lastLog = now
+	policy.unreported = 0
+}
+
+// Allowlists of single listeners, replacing -allow-cidr for them, keyed by
+// the listen address as given on the command line, like 19100
+var listenerCIDRs = listenerCIDRLists{}
+
+// Repeatable listen=ranges flag, the ranges comma separated
+type listenerCIDRLists map[string]cidrList
+
+func (lists listenerCIDRLists) String() string {
+	var pairs []string
+	for address, list := range lists {
+		pairs = append(pairs, address+`=`+list.String())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ` `)
+}
+
+func (lists listenerCIDRLists) Set(value string) error {
+	address, ranges, err := splitListenerValue(value)
+	if err != nil {
+		return err
+	}
+	list := lists[address]
+	if err := list.Set(ranges); err != nil {
+		return err
+	}
+	lists[address] = list
+	return nil
+}
+
+// Split a listen=value flag, writing the listen address the way the
+// listeners are looked up
+func splitListenerValue(value string) (string, string, error) {
+	equals := strings.Index(value, `=`)
+	if equals < 1 {
+		return ``, ``, fmt.Errorf(`%s isn't a listen=value pair`, value)
+	}
+	address, err := parseListenAddress(value[:equals])
+	if err != nil || !address.validPort() {
+		return ``, ``, fmt.Errorf(`%q isn't a listen port or address`, value[:equals])
+	}
+	return address.String(), value[equals+1:], nil
+}
+
+// The ranges allowed to connect to a listener
+func listenerAllowedCIDRs(address listenAddress) cidrList {
+	if allowed, ok := listenerCIDRs[address.String()]; ok {
+		return allowed
+	}
+	return allowedCIDRs
+}
+
+// Check that the listener flags name listen addresses that exist
+func validateListenerOverrides(listenAddresses []listenAddress) error {
+	known := make(map[string]bool)
+	for _, address := range listenAddresses {
+		known[address.String()] = true
+	}
+	for address := range listenerCIDRs {
+		if !known[address] {
+			return fmt.Errorf(`-listener-allow-cidr: no listener on %s`, address)
+		}
+	}
+	for address := range listenerClientNames {
+		if !known[address] {
+			return fmt.Errorf(`-listener-tls-client-allowed-names: no listener on %s`, address)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func mustCIDRs(t *testing.T, value string) cidrList {
+	t.Helper()
+	var list cidrList
+	if err := list.Set(value); err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestCIDRListTakesBareAddresses(t *testing.T) {
+	list := mustCIDRs(t, `10.0.0.0/8, 192.168.1.7,2001:db8::1`)
+	if got := list.String(); got != `10.0.0.0/8,192.168.1.7/32,2001:db8::1/128` {
+		t.Errorf(`parsed as %s`, got)
+	}
+	for address, expected := range map[string]bool{`10.200.0.1`: true, `192.168.1.7`: true, `192.168.1.8`: false, `2001:db8::1`: true, `2001:db8::2`: false} {
+		if list.contains(net.ParseIP(address)) != expected {
+			t.Errorf(`%s contained: %v`, address, !expected)
+		}
+	}
+	if err := (&cidrList{}).Set(`10.0.0.0/33`); err == nil {
+		t.Error(`an invalid range was accepted`)
+	}
+}
+
+func TestForwardedForIsOnlyTrustedFromTrustedProxies(t *testing.T) {
+	policy := &accessPolicy{name: `:19100`, trustedProxies: mustCIDRs(t, `10.0.0.0/8`)}
+	for _, c := range []struct {
+		remote, forwarded, client string
+	}{
+		{`192.168.1.1:5000`, `172.16.0.1`, `192.168.1.1`},
+		{`10.0.0.1:5000`, `172.16.0.1`, `172.16.0.1`},
+		{`10.0.0.1:5000`, `172.16.0.1, 10.0.0.2`, `172.16.0.1`},
+		// A client can't hide behind an address it made up itself
+		{`10.0.0.1:5000`, `10.9.9.9, 172.16.0.1`, `172.16.0.1`},
+		{`10.0.0.1:5000`, `garbage`, `10.0.0.1`},
+		{`10.0.0.1:5000`, ``, `10.0.0.1`},
+	} {
+		r := httptest.NewRequest(http.MethodGet, `/metrics`, nil)
+		r.RemoteAddr = c.remote
+		if c.forwarded != `` {
+			r.Header.Set(`X-Forwarded-For`, c.forwarded)
+		}
+		if client := policy.clientIP(r); client.String() != c.client {
+			t.Errorf(`%s forwarding for %q: client %v, expected %s`, c.remote, c.forwarded, client, c.client)
+		}
+	}
+}
+
+func TestAccessPolicyRejectsClientsOutsideTheAllowlist(t *testing.T) {
+	policy := &accessPolicy{name: `:19100`, allowed: mustCIDRs(t, `192.168.0.0/16`), clock: newFakeClock()}
+	handler := policy.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for remote, expected := range map[string]int{`192.168.3.4:5000`: http.StatusOK, `10.1.1.1:5000`: http.StatusForbidden, `@`: http.StatusForbidden} {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, `/metrics`, nil)
+		r.RemoteAddr = remote
+		handler.ServeHTTP(recorder, r)
+		if recorder.Code != expected {
+			t.Errorf(`%s answered %d, expected %d`, remote, recorder.Code, expected)
+		}
+	}
+}
+
+func TestRejectionsAreLoggedOncePerInterval(t *testing.T) {
+	logged := captureLog(t)
+	clock := newFakeClock()
+	policy := &accessPolicy{name: `:19100`, clock: clock}
+	reject := func() { policy.logRejection(`10.1.1.1:5000`, net.ParseIP(`10.1.1.1`)) }
+
+	reject()
+	reject()
+	reject()
+	if rejections := strings.Count(logged.String(), `rejected request`); rejections != 1 {
+		t.Errorf("logged %d rejections within a minute\n%s", rejections, logged)
+	}
+	clock.Advance(rejectLogInterval)
+	reject()
+	if !strings.Contains(logged.String(), `2 more requests rejected`) || strings.Count(logged.String(), `rejected request`) != 2 {
+		t.Errorf("after a minute logged\n%s", logged)
+	}
+}
@@ -0,0 +1,477 @@
+// Package proxy implements frugalpromproxy: it passes on the metrics of an
+// exporter, leaving out the series whose value hasn't changed for a long
+// time. Main runs the command line, New embeds the proxy in another program.
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pdxiv/frugalpromproxy/staleness"
+)
+
+// Target is an upstream served by a Proxy
+type Target struct {
+	Name string
+	// The first URL is the primary, the others are failed over to in turn
+	Upstreams []string
+	// Run on every scrape before staleness is decided, in this order
+	Transformers []Transformer
+	// Sent as the Host header instead of the host of the upstream URL, for
+	// upstreams behind a virtual-host routing proxy
+	HostHeader string
+	// Sent for SNI and checked against the upstream's certificate instead of
+	// the host of the upstream URL. Needs https upstreams.
+	ServerName string
+	// Samples a scrape may have after the transformers, zero means no
+	// limit. Above it the scrape fails, or with SampleLimitTruncate the
+	// families that fit in the order of their names are served.
+	SampleLimit         int
+	SampleLimitTruncate bool
+	// Override Config.StaleThreshold and Config.StartLive for this target.
+	// Zero keeps the threshold of the config, a negative one never
+	// suppresses.
+	StaleThreshold int64
+	StartLive      bool
+
+	// What an entry of the -config file can give besides, unset for the
+	// targets of New
+	params      url.Values
+	paths       []string // Scraped together, when there are several
+	names       *nameFilter
+	credentials *credentials
+	startStale  bool
+}
+
+// Config describes the targets of an embedded Proxy. Settings left at their
+// zero value behave like the command line flag left out.
+type Config struct {
+	Targets []Target
+
+	// Scrape the targets in the background at this interval and serve the
+	// latest result. Zero scrapes the upstream on every request.
+	ScrapeInterval time.Duration
+
+	// Maximum time for an upstream fetch. Zero means 10 seconds, a negative
+	// value no limit besides the scraper's own timeout.
+	ScrapeTimeout time.Duration
+
+	// Scrapes a value may stay the same before it is suppressed, for the
+	// metric names without a staleness policy of their own. Zero means 240,
+	// a negative value never suppresses anything.
+	StaleThreshold int64
+
+	// Forget the state of series missing from the upstream for this long.
+	// Zero means an hour, a negative value keeps it while the target is
+	// served.
+	ForgetSeriesAfter time.Duration
+
+	// Log a warning when the stale threshold at the observed scrape
+	// interval only suppresses values unchanged for longer than this. Zero
+	// means an hour, a negative value never warns.
+	SuppressionDelayWarning time.Duration
+
+	// Handle the wall clock moving this much more or less than the time
+	// that passed between two scrapes as a clock jump, if the Clock is a
+	// MonotonicClock. Zero means 30 seconds, a negative value never looks
+	// for jumps.
+	ClockJumpThreshold time.Duration
+
+	// Pass every series on at first, instead of starting out with them
+	// suppressed until their value changes
+	StartLive bool
+
+	// Count a series whose upstream timestamp moved as changed, even when
+	// its value stayed the same
+	TimestampIsChange bool
+
+	// Staleness policies for metric name patterns, written like the
+	// -staleness-policy flag, e.g. node_cpu_*=unchanged:threshold=20.
+	// Policies registered with RegisterStalenessPolicy can be used here.
+	StalenessPolicies []string
+
+	// Where the proxy gets the time from, nil means the real clock. Tests
+	// can pass a fake one to step through staleness and schedules.
+	Clock Clock
+
+	// Maximum number of upstream fetches of the proxy running at the same
+	// time. Zero means 8, a negative value unlimited.
+	MaxConcurrentScrapes int
+}
+
+// Option changes a Config, for building one in code:
+//
+//	p, err := proxy.New(proxy.Config{},
+//		proxy.WithTarget(proxy.Target{Name: `node`, Upstreams: []string{`http://localhost:9100/metrics`}}),
+//		proxy.WithStaleThreshold(120),
+//	)
+type Option func(*Config)
+
+// WithTarget adds a target
+func WithTarget(target Target) Option {
+	return func(cfg *Config) { cfg.Targets = append(cfg.Targets, target) }
+}
+
+// WithScrapeInterval scrapes the targets in the background
+func WithScrapeInterval(interval time.Duration) Option {
+	return func(cfg *Config) { cfg.ScrapeInterval = interval }
+}
+
+// WithScrapeTimeout limits the time of an upstream fetch
+func WithScrapeTimeout(timeout time.Duration) Option {
+	return func(cfg *Config) { cfg.ScrapeTimeout = timeout }
+}
+
+// WithStaleThreshold sets the scrapes a value may stay the same before it is
+// suppressed
+func WithStaleThreshold(scrapes int64) Option {
+	return func(cfg *Config) { cfg.StaleThreshold = scrapes }
+}
+
+// WithStalenessPolicy adds a staleness policy rule, like up=never
+func WithStalenessPolicy(rule string) Option {
+	return func(cfg *Config) { cfg.StalenessPolicies = append(cfg.StalenessPolicies, rule) }
+}
+
+// WithClock replaces the real clock
+func WithClock(clock Clock) Option {
+	return func(cfg *Config) { cfg.Clock = clock }
+}
+
+// WithMaxConcurrentScrapes limits the upstream fetches running at the same
+// time
+func WithMaxConcurrentScrapes(limit int) Option {
+	return func(cfg *Config) { cfg.MaxConcurrentScrapes = limit }
+}
+
+// Validate reports the first problem of the config, the same way New does
+func (cfg Config) Validate() error {
+	if len(cfg.Targets) == 0 {
+		return fmt.Errorf(`no targets configured`)
+	}
+	names := make(map[string]bool, len(cfg.Targets))
+	for _, target := range cfg.Targets {
+		if target.Name == `` {
+			return fmt.Errorf(`a target has no name`)
+		}
+		if names[target.Name] {
+			return fmt.Errorf(`target %s is configured twice`, target.Name)
+		}
+		names[target.Name] = true
+		if len(target.Upstreams) == 0 {
+			return fmt.Errorf(`target %s has no upstream`, target.Name)
+		}
+		for _, upstream := range target.Upstreams {
+			parsed, err := url.Parse(upstream)
+			if err != nil {
+				return fmt.Errorf(`target %s: %w`, target.Name, err)
+			}
+			if (parsed.Scheme != `http` && parsed.Scheme != `https`) || parsed.Host == `` {
+				return fmt.Errorf(`target %s: upstream %s isn't an http or https URL`, target.Name, upstream)
+			}
+		}
+		if err := validateHostOverride(target); err != nil {
+			return err
+		}
+		if target.SampleLimit < 0 {
+			return fmt.Errorf(`target %s: negative sample limit %d`, target.Name, target.SampleLimit)
+		}
+	}
+	if cfg.ScrapeInterval < 0 {
+		return fmt.Errorf(`negative scrape interval`)
+	}
+	_, err := cfg.stalenessRules()
+	return err
+}
+
+func (cfg Config) stalenessRules() (staleness.Rules, error) {
+	var rules staleness.Rules
+	for _, rule := range cfg.StalenessPolicies {
+		if err := rules.Set(rule); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// Proxy filters the metrics of a fixed set of targets, each keeping its own
+// staleness state. Its handlers can be mounted on any mux. Every Proxy has
+// its own settings and targets, so several of them can run in one process,
+// even with targets of the same name. The self-metrics are the exception:
+// they are kept for the whole process and labelled by target name only, so
+// the targets of the same name add up in them.
+type Proxy struct {
+	mu       sync.RWMutex
+	settings *proxySettings // Of the last config, for the targets created with it
+	targets  map[string]*ScrapeTarget
+}
+
+// New applies the options to cfg, validates it and creates the targets.
+// With a ScrapeInterval the background scrapes start right away and run
+// until Run returns.
+func New(cfg Config, options ...Option) (*Proxy, error) {
+	for _, option := range options {
+		option(&cfg)
+	}
+	return newProxy(cfg, cfg.settings())
+}
+
+// A proxy whose targets get settings other than the ones of its config,
+// like the ones of the command line for a -config file
+func newProxy(cfg Config, settings *proxySettings) (*Proxy, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	proxy := &Proxy{settings: settings, targets: make(map[string]*ScrapeTarget, len(cfg.Targets))}
+	for _, target := range cfg.Targets {
+		proxy.targets[target.Name] = newTarget(target, settings)
+	}
+	return proxy, nil
+}
+
+// Reload replaces the config of the proxy. A target scraped on the same
+// upstreams, with the same Host header and server name, as before keeps the
+// state of its series, even when its transformers or the staleness settings
+// changed. Targets with other upstreams start over, like new ones. The scrape interval, timeout and
+// other durations of a kept target don't change, and neither does the
+// limit on concurrent upstream fetches.
+func (proxy *Proxy) Reload(cfg Config, options ...Option) error {
+	for _, option := range options {
+		option(&cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	settings := cfg.settings()
+	proxy.mu.RLock()
+	settings.fetches, settings.targets = proxy.settings.fetches, proxy.settings.targets
+	proxy.mu.RUnlock()
+	retired, err := proxy.reload(cfg, settings)
+	for _, scrapeTarget := range retired {
+		scrapeTarget.close()
+	}
+	return err
+}
+
+// Replace the targets like Reload, with the given settings for the new
+// ones. The targets that were replaced or removed are returned instead of
+// closed, so a caller can first stop routing requests to them.
+func (proxy *Proxy) reload(cfg Config, settings *proxySettings) ([]*ScrapeTarget, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	proxy.settings = settings
+	var diff reloadDiff
+	var retired []*ScrapeTarget
+	targets := make(map[string]*ScrapeTarget, len(cfg.Targets))
+	for _, target := range cfg.Targets {
+		previous, ok := proxy.targets[target.Name]
+		switch {
+		case ok && previous.sameSource(target):
+			previous.setUnchangedDefaults(target, settings)
+			previous.reconfigure(settings.stalenessRules, append([]Transformer(nil), target.Transformers...))
+			previous.setSampleLimit(target)
+			previous.setOverrides(target, settings)
+			targets[target.Name] = previous
+			diff.kept = append(diff.kept, target.Name)
+			continue
+		case ok:
+			retired = append(retired, previous)
+			diff.reset = append(diff.reset, target.Name)
+		default:
+			diff.added = append(diff.added, target.Name)
+		}
+		targets[target.Name] = newTarget(target, settings)
+	}
+	for name, scrapeTarget := range proxy.targets {
+		if _, ok := targets[name]; !ok {
+			retired = append(retired, scrapeTarget)
+			diff.removed = append(diff.removed, name)
+		}
+	}
+	sort.Strings(diff.removed)
+	proxy.targets = targets
+	log.Printf("reload: %v", diff)
+	return retired, nil
+}
+
+// The settings of the targets of a validated config. Zero values get the
+// defaults of the command line flags.
+func (cfg Config) settings() *proxySettings {
+	rules, _ := cfg.stalenessRules()
+	settings := &proxySettings{
+		stalenessRules: rules,
+		staleness: staleness.Defaults{
+			Threshold:         defaultStaleThreshold,
+			StartStale:        !cfg.StartLive,
+			TimestampIsChange: cfg.TimestampIsChange,
+			SuppressCounters:  true,
+		},
+		forgetSeriesAfter:       time.Hour,
+		suppressionDelayWarning: time.Hour,
+		clockJumpThreshold:      30 * time.Second,
+		scrapeInterval:          cfg.ScrapeInterval,
+		scrapeTimeout:           defaultScrapeTimeout,
+		scrapeTimeoutOffset:     500 * time.Millisecond,
+		dnsRefreshInterval:      30 * time.Second,
+		dnsAddressFamily:        `ip`,
+		clock:                   realClock{},
+	}
+	if cfg.Clock != nil {
+		settings.clock = cfg.Clock
+	}
+	if cfg.StaleThreshold != 0 {
+		settings.staleness.Threshold = cfg.StaleThreshold
+	}
+	if cfg.ForgetSeriesAfter != 0 {
+		settings.forgetSeriesAfter = cfg.ForgetSeriesAfter
+	}
+	if cfg.SuppressionDelayWarning != 0 {
+		settings.suppressionDelayWarning = cfg.SuppressionDelayWarning
+	}
+	if cfg.ClockJumpThreshold != 0 {
+		settings.clockJumpThreshold = cfg.ClockJumpThreshold
+	}
+	if cfg.ScrapeInterval > 0 {
+		settings.scrapeJitter = 500 * time.Millisecond
+	}
+	if cfg.ScrapeTimeout != 0 {
+		settings.scrapeTimeout = cfg.ScrapeTimeout
+	}
+	limit := cfg.MaxConcurrentScrapes
+	if limit == 0 {
+		limit = 8
+	}
+	settings.fetches = newFetchLimiter(limit)
+	settings.targets = &targetRegistry{}
+	return settings
+}
+
+func newTarget(target Target, settings *proxySettings) *ScrapeTarget {
+	scrapeTarget := unstartedScrapeTarget(target.Name, append([]string(nil), target.Upstreams...), settings)
+	scrapeTarget.setUnchangedDefaults(target, settings)
+	policies := newStalenessPolicies(target.Name, settings.stalenessRules, scrapeTarget.defaults)
+	scrapeTarget.configMutex.Lock()
+	previous := scrapeTarget.staleness
+	scrapeTarget.staleness, scrapeTarget.transformers = policies, append([]Transformer(nil), target.Transformers...)
+	scrapeTarget.configMutex.Unlock()
+	previous.Close()
+	scrapeTarget.setSampleLimit(target)
+	scrapeTarget.setOverrides(target, settings)
+	scrapeTarget.params = target.params
+	if len(target.paths) > 1 {
+		scrapeTarget.paths = target.paths
+	}
+	scrapeTarget.hostHeader = target.HostHeader
+	if target.ServerName != `` {
+		scrapeTarget.useServerName(target.ServerName)
+	}
+	scrapeTarget.start()
+	return scrapeTarget
+}
+
+// The threshold and start_stale of the target's unchanged policies, taking
+// effect when the policies are built again
+func (scrapeTarget *ScrapeTarget) setUnchangedDefaults(target Target, settings *proxySettings) {
+	defaults := settings.stalenessDefaults(target.Name)
+	if target.StaleThreshold != 0 {
+		defaults.Threshold = target.StaleThreshold
+	}
+	if target.StartLive {
+		defaults.StartStale = false
+	}
+	if target.startStale {
+		defaults.StartStale = true
+	}
+	scrapeTarget.configMutex.Lock()
+	scrapeTarget.defaults = defaults
+	scrapeTarget.configMutex.Unlock()
+}
+
+// The name filter and upstream credentials of the target, or else the ones
+// of the settings. After the name filter changed, the next scrape forgets
+// the series it now drops.
+func (scrapeTarget *ScrapeTarget) setOverrides(target Target, settings *proxySettings) {
+	names, auth := settings.names, settings.credentials
+	if target.names != nil {
+		names = *target.names
+	}
+	if target.credentials != nil {
+		auth = *target.credentials
+	}
+	scrapeTarget.configMutex.Lock()
+	defer scrapeTarget.configMutex.Unlock()
+	if names.keep.String() != scrapeTarget.names.keep.String() || names.drop.String() != scrapeTarget.names.drop.String() {
+		scrapeTarget.pruneState = true
+	}
+	scrapeTarget.names, scrapeTarget.credentials = names, auth
+}
+
+func (scrapeTarget *ScrapeTarget) setSampleLimit(target Target) {
+	scrapeTarget.configMutex.Lock()
+	scrapeTarget.sampleLimit, scrapeTarget.sampleLimitFailClosed = target.SampleLimit, !target.SampleLimitTruncate
+	scrapeTarget.configMutex.Unlock()
+}
+
+func (proxy *Proxy) target(name string) (*ScrapeTarget, bool) {
+	proxy.mu.RLock()
+	defer proxy.mu.RUnlock()
+	scrapeTarget, ok := proxy.targets[name]
+	return scrapeTarget, ok
+}
+
+// Handler serves the filtered metrics of the named target. Unknown targets
+// answer 404. The target is looked up on every request, so the handler
+// follows reloads.
+func (proxy *Proxy) Handler(target string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scrapeTarget, ok := proxy.target(target)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		scrapeTarget.handler(w, r)
+	})
+}
+
+// Scrape scrapes the named target now, without an HTTP request, see
+// ScrapeTarget.Scrape
+func (proxy *Proxy) Scrape(ctx context.Context, target string) (*ScrapeResult, error) {
+	scrapeTarget, ok := proxy.target(target)
+	if !ok {
+		return nil, fmt.Errorf(`unknown target %s`, target)
+	}
+	return scrapeTarget.Scrape(ctx)
+}
+
+// Targets returns the names of the proxy's targets, sorted
+func (proxy *Proxy) Targets() []string {
+	proxy.mu.RLock()
+	defer proxy.mu.RUnlock()
+	names := make([]string, 0, len(proxy.targets))
+	for name := range proxy.targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Run blocks until ctx is done, then stops the background scrapes and
+// forgets the targets. The proxy can't be used afterwards.
+func (proxy *Proxy) Run(ctx context.Context) error {
+	<-ctx.Done()
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	for _, scrapeTarget := range proxy.targets {
+		scrapeTarget.close()
+	}
+	return ctx.Err()
+}
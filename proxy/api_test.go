@@ -0,0 +1,108 @@
+package proxy_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pdxiv/frugalpromproxy/proxy"
+)
+
+// An exporter whose series never change
+func constantExporter(t *testing.T) *httptest.Server {
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "# TYPE up gauge\nup 1\n")
+	}))
+	t.Cleanup(exporter.Close)
+	return exporter
+}
+
+func scrapeTimes(t *testing.T, p *proxy.Proxy, target string, times int) *proxy.ScrapeResult {
+	t.Helper()
+	var result *proxy.ScrapeResult
+	for i := 0; i < times; i++ {
+		var err error
+		if result, err = p.Scrape(context.Background(), target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return result
+}
+
+func TestProxiesHaveTheirOwnSettings(t *testing.T) {
+	exporter := constantExporter(t)
+	target := proxy.WithTarget(proxy.Target{Name: `node`, Upstreams: []string{exporter.URL}})
+	strict, err := proxy.New(proxy.Config{StartLive: true, StaleThreshold: 1}, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lenient, err := proxy.New(proxy.Config{StartLive: true, StaleThreshold: 100}, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result := scrapeTimes(t, strict, `node`, 3); result.Suppressed != 1 {
+		t.Errorf(`a threshold of 1 suppressed %d series on the third scrape, expected 1`, result.Suppressed)
+	}
+	if result := scrapeTimes(t, lenient, `node`, 3); result.Forwarded != 1 {
+		t.Errorf(`a threshold of 100 forwarded %d series on the third scrape, expected 1`, result.Forwarded)
+	}
+}
+
+func TestReloadKeepsTheStateOfKeptTargets(t *testing.T) {
+	exporter := constantExporter(t)
+	cfg := proxy.Config{StartLive: true, StaleThreshold: 1, Targets: []proxy.Target{{Name: `node`, Upstreams: []string{exporter.URL}}}}
+	p, err := proxy.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := scrapeTimes(t, p, `node`, 3); result.Suppressed != 1 {
+		t.Fatalf(`suppressed %d series, expected 1`, result.Suppressed)
+	}
+
+	cfg.StalenessPolicies = []string{`other_*=never`}
+	if err := p.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if result := scrapeTimes(t, p, `node`, 1); result.Suppressed != 1 {
+		t.Errorf(`a kept target suppressed %d series after the reload, expected 1`, result.Suppressed)
+	}
+
+	other := constantExporter(t)
+	cfg.Targets[0].Upstreams = []string{other.URL}
+	if err := p.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if result := scrapeTimes(t, p, `node`, 1); result.Forwarded != 1 {
+		t.Errorf(`a target with another upstream forwarded %d series after the reload, expected 1`, result.Forwarded)
+	}
+}
+
+func TestNewRejectsInvalidConfigs(t *testing.T) {
+	for name, cfg := range map[string]proxy.Config{
+		`no targets`:     {},
+		`no upstream`:    {Targets: []proxy.Target{{Name: `node`}}},
+		`not http`:       {Targets: []proxy.Target{{Name: `node`, Upstreams: []string{`ftp://localhost/metrics`}}}},
+		`duplicate name`: {Targets: []proxy.Target{{Name: `node`, Upstreams: []string{`http://a/metrics`}}, {Name: `node`, Upstreams: []string{`http://b/metrics`}}}},
+		`unknown policy`: {Targets: []proxy.Target{{Name: `node`, Upstreams: []string{`http://a/metrics`}}}, StalenessPolicies: []string{`up=sometimes`}},
+	} {
+		if _, err := proxy.New(cfg); err == nil {
+			t.Errorf(`%s: no error`, name)
+		}
+	}
+}
+
+func TestHandlerAnswers404ForUnknownTargets(t *testing.T) {
+	exporter := constantExporter(t)
+	p, err := proxy.New(proxy.Config{}, proxy.WithTarget(proxy.Target{Name: `node`, Upstreams: []string{exporter.URL}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	p.Handler(`other`).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf(`answered %d, expected 404`, recorder.Code)
+	}
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Environment variables taking precedence over the password and token files
+// of the command line, so secrets needn't be written to disk and never show
+// up in ps
+const (
+	upstreamPasswordEnv    = `FRUGALPROMPROXY_UPSTREAM_PASSWORD`
+	upstreamBearerTokenEnv = `FRUGALPROMPROXY_UPSTREAM_BEARER_TOKEN`
+	listenPasswordEnv      = `FRUGALPROMPROXY_LISTEN_PASSWORD`
+	listenBearerTokenEnv   = `FRUGALPROMPROXY_LISTEN_BEARER_TOKEN`
+)
+
+// Basic authentication or a bearer token, never both. The zero value is no
+// authentication.
+type credentials struct {
+	username    string
+	password    string
+	bearerToken string
+}
+
+// Credentials with the password and token read from the environment
+// variables, or else from the files
+func loadCredentials(username, passwordFile, passwordEnv, tokenFile, tokenEnv string) (credentials, error) {
+	password, err := readSecret(passwordFile, passwordEnv)
+	if err != nil {
+		return credentials{}, err
+	}
+	token, err := readSecret(tokenFile, tokenEnv)
+	if err != nil {
+		return credentials{}, err
+	}
+	if token != `` && (username != `` || password != ``) {
+		return credentials{}, errors.New(`basic authentication and a bearer token can't be combined`)
+	}
+	if password != `` && username == `` {
+		return credentials{}, errors.New(`a password needs a username`)
+	}
+	return credentials{username: username, password: password, bearerToken: token}, nil
+}
+
+// The value of an environment variable, or else the contents of a file
+func readSecret(file, env string) (string, error) {
+	if value := os.Getenv(env); env != `` && value != `` {
+		return value, nil
+	}
+	if file == `` {
+		return ``, nil
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return ``, err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+func (auth credentials) isSet() bool {
+	return auth.username != `` || auth.bearerToken != ``
+}
+
+// Add the credentials to a request to an upstream
+func (auth credentials) apply(req *http.Request) {
+	switch {
+	case auth.bearerToken != ``:
+		req.Header.Set(`Authorization`, `Bearer `+auth.bearerToken)
+	case auth.username != ``:
+		req.SetBasicAuth(auth.username, auth.password)
+	}
+}
+
+// Whether a request carries the credentials. Username and password are both
+// compared, so the time taken doesn't tell which one was wrong.
+func (auth credentials) match(r *http.Request) bool {
+	if auth.bearerToken != `` {
+		return subtle.ConstantTimeCompare([]byte(r.Header.Get(`Authorization`)), []byte(`Bearer `+auth.bearerToken)) == 1
+	}
+	username, password, ok := r.BasicAuth()
+	usernameMatches := subtle.ConstantTimeCompare([]byte(username), []byte(auth.username))
+	passwordMatches := subtle.ConstantTimeCompare([]byte(password), []byte(auth.password))
+	return ok && usernameMatches&passwordMatches == 1
+}
+
+// Sent to the upstreams of every target without credentials of its own in
+// the config file
+var upstreamCredentials credentials
+
+// Required from every request to the listeners, if set
+var listenCredentials credentials
+
+var unauthorizedRequests = selfMetrics.newCounterVec(`frugalpromproxy_unauthorized_requests_total`, `Requests rejected for missing or wrong credentials.`, `listener`)
+
+// Answer requests without the listener credentials with a 401. /-/healthy
+// stays open for liveness probes, and /push/ when it has a token of its own,
+// as do CORS preflight requests, which browsers send without credentials.
+func requireCredentials(name string, next http.Handler) http.Handler {
+	if !listenCredentials.isSet() {
+		return next
+	}
+	challenge := `Basic realm="frugalpromproxy", charset="UTF-8"`
+	if listenCredentials.bearerToken != `` {
+		challenge = `Bearer realm="frugalpromproxy"`
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		open := r.URL.Path == healthyPath ||
+			strings.HasPrefix(r.URL.Path, pushPath) && pushed != nil && pushed.token != `` ||
+			r.Method == http.MethodOptions && cors != nil
+		if !open && !listenCredentials.match(r) {
+			unauthorizedRequests.inc(name)
+			w.Header().Set(`WWW-Authenticate`, challenge)
+			http.Error(w, `unauthorized`, http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecretsFromTheEnvironmentComeFirst(t *testing.T) {
+	file := filepath.Join(t.TempDir(), `password`)
+	if err := ioutil.WriteFile(file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	const env = `FRUGALPROMPROXY_TEST_PASSWORD`
+	defer os.Unsetenv(env)
+
+	if auth, err := loadCredentials(`prometheus`, file, env, ``, ``); err != nil || auth.password != `from-file` {
+		t.Errorf(`from the file %+v, %v`, auth, err)
+	}
+	os.Setenv(env, `from-env`)
+	if auth, err := loadCredentials(`prometheus`, file, env, ``, ``); err != nil || auth.password != `from-env` {
+		t.Errorf(`from the environment %+v, %v`, auth, err)
+	}
+	if _, err := loadCredentials(`prometheus`, ``, env, file, ``); err == nil {
+		t.Error(`basic authentication and a bearer token were combined`)
+	}
+	if _, err := loadCredentials(``, ``, env, ``, ``); err == nil {
+		t.Error(`took a password without a username`)
+	}
+	if _, err := loadCredentials(`prometheus`, filepath.Join(t.TempDir(), `missing`), ``, ``, ``); err == nil {
+		t.Error(`took a missing password file`)
+	}
+}
+
+// An exporter answering only requests with the Authorization header
+func newAuthenticatedExporter(t *testing.T, authorization string) string {
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(`Authorization`) != authorization {
+			w.Header().Set(`WWW-Authenticate`, `Basic realm="node"`)
+			http.Error(w, `unauthorized`, http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("node_load1 0.5\n"))
+	}))
+	t.Cleanup(exporter.Close)
+	return exporter.URL
+}
+
+func TestUpstreamsAreSentTheCredentials(t *testing.T) {
+	for _, test := range []struct {
+		auth          credentials
+		authorization string
+	}{
+		{credentials{username: `prometheus`, password: `s3cret`}, `Basic cHJvbWV0aGV1czpzM2NyZXQ=`},
+		{credentials{bearerToken: `s3cret`}, `Bearer s3cret`},
+	} {
+		logged := captureLog(t)
+		useCommandLineSettings(t)
+		commandLine.staleness.StartStale = false
+		upstream := newAuthenticatedExporter(t, test.authorization)
+
+		commandLine.credentials = test.auth
+		scrapeTarget := newScrapeTarget(`node`, []string{upstream}, commandLine)
+		if code, served := servedSeries(scrapeTarget); code != http.StatusOK || served != `node_load1 0.5` {
+			t.Errorf("with %s answered %d\n%s", test.authorization, code, served)
+		}
+		scrapeTarget.close()
+
+		// Wrong credentials fail the scrape without showing up anywhere
+		wrong := test.auth
+		if wrong.bearerToken != `` {
+			wrong.bearerToken += `wr0ng`
+		} else {
+			wrong.password += `wr0ng`
+		}
+		commandLine.credentials = wrong
+		scrapeTarget = newScrapeTarget(`node`, []string{upstream}, commandLine)
+		response := httptest.NewRecorder()
+		scrapeTarget.handler(response, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+		scrapeTarget.close()
+		if response.Code != http.StatusBadGateway || !strings.Contains(response.Body.String(), `401`) {
+			t.Errorf("with wrong credentials answered %d\n%s", response.Code, response.Body)
+		}
+		if strings.Contains(response.Body.String()+logged.String(), `wr0ng`) || strings.Contains(response.Body.String()+logged.String(), `s3cret`) {
+			t.Errorf("a secret was given away\n%s%s", response.Body, logged)
+		}
+	}
+}
+
+func TestListenersRequireTheCredentials(t *testing.T) {
+	defer func(auth credentials) { listenCredentials = auth }(listenCredentials)
+	served := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	request := func(path, authorization string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if authorization != `` {
+			r.Header.Set(`Authorization`, authorization)
+		}
+		requireCredentials(`:19100`, served).ServeHTTP(response, r)
+		return response
+	}
+
+	listenCredentials = credentials{}
+	if code := request(basePath, ``).Code; code != http.StatusOK {
+		t.Errorf(`without credentials configured answered %d`, code)
+	}
+
+	listenCredentials = credentials{username: `prometheus`, password: `s3cret`}
+	rejected := selfMetricValue(unauthorizedRequests.selfMetric, `:19100`)
+	for _, authorization := range []string{``, `Basic cHJvbWV0aGV1czp3cjBuZw==`, `Bearer s3cret`} {
+		response := request(basePath, authorization)
+		if response.Code != http.StatusUnauthorized || response.Header().Get(`WWW-Authenticate`) != `Basic realm="frugalpromproxy", charset="UTF-8"` {
+			t.Errorf(`with %q answered %d, challenged %q`, authorization, response.Code, response.Header().Get(`WWW-Authenticate`))
+		}
+	}
+	if selfMetricValue(unauthorizedRequests.selfMetric, `:19100`) != rejected+3 {
+		t.Error(`the rejected requests weren't counted`)
+	}
+	if code := request(basePath, `Basic cHJvbWV0aGV1czpzM2NyZXQ=`).Code; code != http.StatusOK {
+		t.Errorf(`with the credentials answered %d`, code)
+	}
+	if code := request(healthyPath, ``).Code; code != http.StatusOK {
+		t.Errorf(`%s answered %d`, healthyPath, code)
+	}
+
+	listenCredentials = credentials{bearerToken: `s3cret`}
+	if response := request(basePath, ``); response.Code != http.StatusUnauthorized || response.Header().Get(`WWW-Authenticate`) != `Bearer realm="frugalpromproxy"` {
+		t.Errorf(`without the token answered %d, challenged %q`, response.Code, response.Header().Get(`WWW-Authenticate`))
+	}
+	if code := request(basePath, `Bearer s3cret`).Code; code != http.StatusOK {
+		t.Errorf(`with the token answered %d`, code)
+	}
+}
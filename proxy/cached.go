@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Answer a scrape the upstream failed with the output of the last
+// successful scrape, as long as that isn't older than maxCacheAge
+var (
+	serveStaleOnError bool
+	maxCacheAge       time.Duration
+)
+
+// Set on an answer replayed from the last successful scrape, next to Age
+const cachedHeader = `X-Frugalpromproxy-Cached`
+
+var cachedAnswers = selfMetrics.newCounterVec(`frugalpromproxy_cached_answers_total`, `Scrapes answered with the output of an earlier scrape because the upstream failed.`, `target`)
+
+// The output of the last successful scrape on request
+type cachedOutput struct {
+	key      string // Of the upstream request, a request with other parameters or headers doesn't get it
+	families []outputFamily
+	at       time.Time
+}
+
+func (scrapeTarget *ScrapeTarget) setCached(request upstreamRequest, families []outputFamily) {
+	if !serveStaleOnError {
+		return
+	}
+	scrapeTarget.cachedMutex.Lock()
+	scrapeTarget.cached = &cachedOutput{key: request.key(), families: families, at: scrapeTarget.now()}
+	scrapeTarget.cachedMutex.Unlock()
+}
+
+// The output to replay for a request that failed with err, and its age. Only
+// an upstream that couldn't be reached, answered with another status than
+// 200 or took too long has its output replayed.
+func (scrapeTarget *ScrapeTarget) cachedFamilies(request upstreamRequest, err error) ([]outputFamily, time.Duration, bool) {
+	var status *ErrUpstreamStatus
+	if !serveStaleOnError || !errors.Is(err, ErrUpstreamUnreachable) && !errors.As(err, &status) && !errors.Is(err, ErrScrapeTimedOut) {
+		return nil, 0, false
+	}
+	scrapeTarget.cachedMutex.Lock()
+	cached := scrapeTarget.cached
+	scrapeTarget.cachedMutex.Unlock()
+	if cached == nil || cached.key != request.key() {
+		return nil, 0, false
+	}
+	age := scrapeTarget.since(cached.at)
+	if maxCacheAge > 0 && age > maxCacheAge {
+		return nil, 0, false
+	}
+	return cached.families, age, true
+}
+
+// Count a failed scrape and answer it with the cached output, returning
+// false when there is none to replay
+func (scrapeTarget *ScrapeTarget) answerCached(w http.ResponseWriter, r *http.Request, err error) bool {
+	families, age, ok := scrapeTarget.cachedFamilies(scrapeTarget.servedRequest(r), err)
+	if !ok {
+		return false
+	}
+	scrapeTarget.countError(err)
+	cachedAnswers.inc(scrapeTarget.name)
+	log.Printf("%s: scrape failed, answering with the output of %v ago: %v", scrapeTarget.name, age.Round(time.Second), err)
+	w.Header().Set(cachedHeader, `true`)
+	w.Header().Set(`Age`, strconv.Itoa(int(age.Seconds())))
+	counted := &countingWriter{ResponseWriter: w}
+	writeFamilies(counted, r, families, scrapeTarget.now())
+	servedBytes.add(float64(counted.bytes), []string{scrapeTarget.name})
+	return true
+}
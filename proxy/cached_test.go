@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFailedScrapesAreAnsweredFromTheCacheUntilItIsTooOld(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.Threshold = -1
+	clock := newFakeClock()
+	commandLine.clock = clock
+	defer func(serve bool, age time.Duration) { serveStaleOnError, maxCacheAge = serve, age }(serveStaleOnError, maxCacheAge)
+	serveStaleOnError, maxCacheAge = true, time.Minute
+	exporter, upstream := newFakeExporter(t, "node_load1 0.5\n")
+	scrapeTarget := newScrapeTarget(`node`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+	scrape := func() *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		scrapeTarget.handler(response, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+		return response
+	}
+	answers, failures := selfMetricValue(cachedAnswers.selfMetric, `node`), selfMetricValue(scrapeErrors.selfMetric, `node`, `status`)
+
+	// The upstream is up
+	live := scrape()
+	if live.Code != http.StatusOK || live.Header().Get(cachedHeader) != `` {
+		t.Fatalf(`answered %d, cached %q`, live.Code, live.Header().Get(cachedHeader))
+	}
+
+	// Down within the maximum age
+	exporter.fail(http.StatusServiceUnavailable)
+	clock.Advance(30 * time.Second)
+	replayed := scrape()
+	if replayed.Code != http.StatusOK || replayed.Header().Get(cachedHeader) != `true` || replayed.Header().Get(`Age`) != `30` || replayed.Body.String() != live.Body.String() {
+		t.Errorf("answered %d, cached %q, age %q\n%s", replayed.Code, replayed.Header().Get(cachedHeader), replayed.Header().Get(`Age`), replayed.Body)
+	}
+	if selfMetricValue(cachedAnswers.selfMetric, `node`) != answers+1 || selfMetricValue(scrapeErrors.selfMetric, `node`, `status`) != failures+1 {
+		t.Error(`the answer from the cache wasn't counted as one and as a scrape error`)
+	}
+
+	// Down past the maximum age
+	clock.Advance(time.Minute)
+	if expired := scrape(); expired.Code != http.StatusBadGateway || expired.Header().Get(cachedHeader) != `` {
+		t.Errorf(`past the maximum age answered %d, cached %q`, expired.Code, expired.Header().Get(cachedHeader))
+	}
+}
+
+func TestTheCacheIsOnlyUsedWhenAskedFor(t *testing.T) {
+	useCommandLineSettings(t)
+	exporter, upstream := newFakeExporter(t, "node_load1 0.5\n")
+	scrapeTarget := newScrapeTarget(`node`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+	servedSeries(scrapeTarget)
+	exporter.fail(http.StatusServiceUnavailable)
+	if code, _ := servedSeries(scrapeTarget); code != http.StatusBadGateway {
+		t.Errorf(`without -serve-stale-on-error answered %d`, code)
+	}
+}
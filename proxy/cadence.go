@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"log"
+	"time"
+)
+
+// Warn when the stale threshold times the observed scrape interval delays
+// suppression longer than this, 0 never warns
+var suppressionDelayWarning time.Duration
+
+// Weight of the latest interval in the rolling average
+const cadenceSmoothing = 0.2
+
+var impliedSuppressionDelay = selfMetrics.newGaugeVec(`frugalpromproxy_implied_suppression_delay_seconds`, `How long a value of the target stays the same before it is suppressed, the stale threshold times the average time between scrapes.`, `target`)
+
+// Fold the time since the previous scrape into the average interval, and
+// report the delay the target's threshold implies at that cadence. The
+// interval across a clock jump is left out. Called with the stateMutex
+// held, once per upstream fetch.
+func (scrapeTarget *ScrapeTarget) observeCadence(now time.Time, jumped bool) {
+	previous := scrapeTarget.lastScrapeAt
+	scrapeTarget.lastScrapeAt = now
+	if previous.IsZero() || !now.After(previous) || jumped {
+		return
+	}
+	interval := now.Sub(previous)
+	if scrapeTarget.averageInterval == 0 {
+		scrapeTarget.averageInterval = interval
+	} else {
+		scrapeTarget.averageInterval += time.Duration(cadenceSmoothing * float64(interval-scrapeTarget.averageInterval))
+	}
+
+	scrapeTarget.configMutex.Lock()
+	threshold := scrapeTarget.defaults.Threshold
+	scrapeTarget.configMutex.Unlock()
+	if threshold <= 0 {
+		impliedSuppressionDelay.set(0, scrapeTarget.name)
+		return
+	}
+	delay := time.Duration(threshold) * scrapeTarget.averageInterval
+	impliedSuppressionDelay.set(delay.Seconds(), scrapeTarget.name)
+
+	warning := scrapeTarget.settings.suppressionDelayWarning
+	tooLong := warning > 0 && delay > warning
+	if tooLong && !scrapeTarget.delayWarned {
+		log.Printf("%s: scraped every %v on average, a stale threshold of %d scrapes only suppresses values unchanged for %v, more than %v", scrapeTarget.name, scrapeTarget.averageInterval.Round(time.Second), threshold, delay.Round(time.Second), warning)
+	}
+	scrapeTarget.delayWarned = tooLong
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The log written while the test runs, by any goroutine
+func captureLog(t *testing.T) *bytes.Buffer {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &logged
+}
+
+func TestTheImpliedDelayFollowsTheScrapeCadence(t *testing.T) {
+	logged := captureLog(t)
+	clock := newFakeClock()
+	_, upstream := newFakeExporter(t, "up 1\n")
+	scrapeTarget := newFakeClockProxy(t, clock, Config{StaleThreshold: 240}, upstream).targets[`node`]
+	delay := func() float64 { return selfMetricValue(impliedSuppressionDelay.selfMetric, `node`) }
+	cadence := func(interval time.Duration, scrapes int) {
+		for i := 0; i < scrapes; i++ {
+			clock.Advance(interval)
+			scrapeTarget.observeCadence(clock.Now(), false)
+		}
+	}
+
+	// 240 scrapes of 10s are 40 minutes
+	scrapeTarget.observeCadence(clock.Now(), false)
+	cadence(10*time.Second, 5)
+	if delay() != 2400 || strings.Contains(logged.String(), `stale threshold`) {
+		t.Fatalf("every 10s the delay is %gs, logged %s", delay(), logged)
+	}
+
+	// The average moves a fifth of the way to 60s, to 20s
+	cadence(time.Minute, 1)
+	if delay() != 4800 || !strings.Contains(logged.String(), `node: scraped every 20s on average, a stale threshold of 240 scrapes only suppresses values unchanged for 1h20m0s, more than 1h0m0s`) {
+		t.Errorf("every 60s the delay is %gs, logged %s", delay(), logged)
+	}
+	logged.Reset()
+	cadence(time.Minute, 3)
+	if strings.Contains(logged.String(), `stale threshold`) {
+		t.Errorf(`warned again: %s`, logged)
+	}
+
+	// An interval across a clock jump is left out
+	before := delay()
+	clock.Advance(time.Hour)
+	scrapeTarget.observeCadence(clock.Now(), true)
+	if delay() != before {
+		t.Errorf(`a clock jump changed the delay from %gs to %gs`, before, delay())
+	}
+}
+
+func TestTheDelayWarningCanBeTurnedOff(t *testing.T) {
+	logged := captureLog(t)
+	clock := newFakeClock()
+	_, upstream := newFakeExporter(t, "up 1\n")
+	scrapeTarget := newFakeClockProxy(t, clock, Config{StaleThreshold: 240, SuppressionDelayWarning: -1}, upstream).targets[`node`]
+	for i := 0; i < 3; i++ {
+		scrapeTarget.observeCadence(clock.Now(), false)
+		clock.Advance(time.Minute)
+	}
+	if strings.Contains(logged.String(), `stale threshold`) || selfMetricValue(impliedSuppressionDelay.selfMetric, `node`) != 14400 {
+		t.Errorf(`without a warning logged %s`, logged)
+	}
+}
+
+func TestTargetsThatNeverSuppressHaveNoDelay(t *testing.T) {
+	clock := newFakeClock()
+	_, upstream := newFakeExporter(t, "up 1\n")
+	scrapeTarget := newFakeClockProxy(t, clock, Config{StaleThreshold: -1}, upstream).targets[`node`]
+	for i := 0; i < 3; i++ {
+		scrapeTarget.observeCadence(clock.Now(), false)
+		clock.Advance(time.Minute)
+	}
+	if delay := selfMetricValue(impliedSuppressionDelay.selfMetric, `node`); delay != 0 {
+		t.Errorf(`the delay is %gs`, delay)
+	}
+}
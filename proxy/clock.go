@@ -0,0 +1,61 @@
+package proxy
+
+import "time"
+
+// Clock is where everything time dependent gets the time from: staleness,
+// schedules, TTLs, caches, rate limits and retries. Programs embedding the
+// proxy can replace it, e.g. with a fake clock in their tests.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a time.Timer of a Clock
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// Ticker is a time.Ticker of a Clock
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// The clock of the command line, and of what only it runs, like discovery
+// and pushes. The targets of a Proxy use the one of its settings.
+var clock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTimer(d time.Duration) Timer         { return realTimer{time.NewTimer(d)} }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+
+type realTimer struct{ timer *time.Timer }
+
+func (timer realTimer) C() <-chan time.Time { return timer.timer.C }
+func (timer realTimer) Stop() bool          { return timer.timer.Stop() }
+
+type realTicker struct{ ticker *time.Ticker }
+
+func (ticker realTicker) C() <-chan time.Time { return ticker.ticker.C }
+func (ticker realTicker) Stop()               { ticker.ticker.Stop() }
+
+// How long ago t was, according to the clock
+func since(t time.Time) time.Duration {
+	return clock.Now().Sub(t)
+}
+
+// The time according to the clock of the target's settings
+func (scrapeTarget *ScrapeTarget) now() time.Time {
+	return scrapeTarget.settings.clock.Now()
+}
+
+// How long ago t was, according to the clock of the target's settings
+func (scrapeTarget *ScrapeTarget) since(t time.Time) time.Duration {
+	return scrapeTarget.now().Sub(t)
+}
@@ -0,0 +1,338 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A clock that only moves when told to. Its wall clock can also jump
+// without the monotonic time moving along, like after a suspend.
+type fakeClock struct {
+	mu        sync.Mutex
+	now       time.Time
+	monotonic time.Duration
+	waiters   []*fakeWaiter
+}
+
+// A timer or a ticker of the fake clock, a ticker has a period
+type fakeWaiter struct {
+	at     time.Time
+	period time.Duration
+	c      chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.now
+}
+
+func (clock *fakeClock) Monotonic() time.Duration {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.monotonic
+}
+
+func (clock *fakeClock) wait(d, period time.Duration) *fakeWaiter {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	waiter := &fakeWaiter{at: clock.now.Add(d), period: period, c: make(chan time.Time, 1)}
+	clock.waiters = append(clock.waiters, waiter)
+	return waiter
+}
+
+func (clock *fakeClock) stop(waiter *fakeWaiter) bool {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	for i, other := range clock.waiters {
+		if other == waiter {
+			clock.waiters = append(clock.waiters[:i], clock.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (clock *fakeClock) After(d time.Duration) <-chan time.Time {
+	return clock.wait(d, 0).c
+}
+
+func (clock *fakeClock) NewTimer(d time.Duration) Timer {
+	return fakeTimer{clock, clock.wait(d, 0)}
+}
+
+func (clock *fakeClock) NewTicker(d time.Duration) Ticker {
+	return fakeTicker{clock, clock.wait(d, d)}
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	waiter *fakeWaiter
+}
+
+func (timer fakeTimer) C() <-chan time.Time { return timer.waiter.c }
+func (timer fakeTimer) Stop() bool          { return timer.clock.stop(timer.waiter) }
+
+type fakeTicker struct {
+	clock  *fakeClock
+	waiter *fakeWaiter
+}
+
+func (ticker fakeTicker) C() <-chan time.Time { return ticker.waiter.c }
+func (ticker fakeTicker) Stop()               { ticker.clock.stop(ticker.waiter) }
+
+// Move the wall clock and the monotonic time forward, firing the timers
+// and tickers that are due
+func (clock *fakeClock) Advance(d time.Duration) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	clock.now = clock.now.Add(d)
+	clock.monotonic += d
+	var waiting []*fakeWaiter
+	for _, waiter := range clock.waiters {
+		if waiter.at.After(clock.now) {
+			waiting = append(waiting, waiter)
+			continue
+		}
+		select {
+		case waiter.c <- clock.now:
+		default:
+		}
+		if waiter.period > 0 {
+			for !waiter.at.After(clock.now) {
+				waiter.at = waiter.at.Add(waiter.period)
+			}
+			waiting = append(waiting, waiter)
+		}
+	}
+	clock.waiters = waiting
+}
+
+// Move the wall clock only
+func (clock *fakeClock) Jump(d time.Duration) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	clock.now = clock.now.Add(d)
+}
+
+// Block until n timers or tickers are waiting, so a goroutine has reached
+// its wait before the clock is advanced
+func (clock *fakeClock) waitForWaiters(t *testing.T, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		clock.mu.Lock()
+		waiting := len(clock.waiters)
+		clock.mu.Unlock()
+		if waiting >= n {
+			return
+		}
+	}
+	t.Fatalf(`%d timers never started waiting`, n)
+}
+
+// An exporter serving a body that can be changed, counting its scrapes
+type fakeExporter struct {
+	mu      sync.Mutex
+	body    string
+	status  int // 0 answers 200
+	scrapes int32
+}
+
+func newFakeExporter(t *testing.T, body string) (*fakeExporter, string) {
+	exporter := &fakeExporter{body: body}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&exporter.scrapes, 1)
+		exporter.mu.Lock()
+		defer exporter.mu.Unlock()
+		if exporter.status != 0 {
+			w.WriteHeader(exporter.status)
+		}
+		io.WriteString(w, exporter.body)
+	}))
+	t.Cleanup(server.Close)
+	return exporter, server.URL
+}
+
+func (exporter *fakeExporter) serve(body string) {
+	exporter.mu.Lock()
+	exporter.body, exporter.status = body, 0
+	exporter.mu.Unlock()
+}
+
+func (exporter *fakeExporter) fail(status int) {
+	exporter.mu.Lock()
+	exporter.status = status
+	exporter.mu.Unlock()
+}
+
+func newFakeClockProxy(t *testing.T, clock *fakeClock, cfg Config, upstream string) *Proxy {
+	t.Helper()
+	cfg.Clock = clock
+	cfg.Targets = []Target{{Name: `node`, Upstreams: []string{upstream}}}
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, scrapeTarget := range p.targets {
+			scrapeTarget.close()
+		}
+	})
+	return p
+}
+
+func scrapeNode(t *testing.T, p *Proxy) *ScrapeResult {
+	t.Helper()
+	result, err := p.Scrape(context.Background(), `node`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func forwarded(result *ScrapeResult, name string) bool {
+	for _, family := range result.families {
+		if family.name == name && len(family.lines) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func TestScrapeLoopScrapesOnTheSlotsOfTheClock(t *testing.T) {
+	clock := newFakeClock()
+	exporter, upstream := newFakeExporter(t, "up 1\n")
+	newFakeClockProxy(t, clock, Config{ScrapeInterval: time.Minute}, upstream)
+
+	for scrapes := int32(1); scrapes <= 3; scrapes++ {
+		clock.waitForWaiters(t, 1)
+		if got := atomic.LoadInt32(&exporter.scrapes); got != scrapes-1 {
+			t.Fatalf(`scraped %d times before slot %d`, got, scrapes)
+		}
+		// A slot and the most jitter later
+		clock.Advance(time.Minute + time.Second)
+		for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&exporter.scrapes) < scrapes; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf(`slot %d wasn't scraped`, scrapes)
+			}
+		}
+	}
+}
+
+func TestVanishedSeriesAreForgottenAfterForgetSeriesAfter(t *testing.T) {
+	clock := newFakeClock()
+	exporter, upstream := newFakeExporter(t, "up 1\ngone 1\n")
+	p := newFakeClockProxy(t, clock, Config{StartLive: true, StaleThreshold: 1, ForgetSeriesAfter: time.Minute}, upstream)
+	for i := 0; i < 3; i++ {
+		scrapeNode(t, p)
+	}
+
+	exporter.serve("up 1\n")
+	scrapeNode(t, p)
+	clock.Advance(59 * time.Second)
+	scrapeNode(t, p)
+	exporter.serve("up 1\ngone 1\n")
+	if forwarded(scrapeNode(t, p), `gone`) {
+		t.Fatal(`a series missing for less than a minute was forwarded as a new one`)
+	}
+
+	exporter.serve("up 1\n")
+	scrapeNode(t, p)
+	clock.Advance(2 * time.Minute)
+	scrapeNode(t, p)
+	exporter.serve("up 1\ngone 1\n")
+	if !forwarded(scrapeNode(t, p), `gone`) {
+		t.Error(`a series missing for two minutes wasn't forgotten`)
+	}
+}
+
+func TestClockJumpsDontForgetSeries(t *testing.T) {
+	clock := newFakeClock()
+	exporter, upstream := newFakeExporter(t, "up 1\ngone 1\n")
+	p := newFakeClockProxy(t, clock, Config{StartLive: true, StaleThreshold: 1, ForgetSeriesAfter: time.Minute}, upstream)
+	for i := 0; i < 3; i++ {
+		scrapeNode(t, p)
+	}
+
+	exporter.serve("up 1\n")
+	scrapeNode(t, p)
+	clock.Jump(2 * time.Hour)
+	scrapeNode(t, p)
+	clock.Advance(time.Second)
+	scrapeNode(t, p)
+	exporter.serve("up 1\ngone 1\n")
+	if forwarded(scrapeNode(t, p), `gone`) {
+		t.Error(`a jump of the wall clock made a series be forgotten`)
+	}
+}
+
+func TestCachedOutputExpiresWithTheClock(t *testing.T) {
+	defer func(serve bool, age time.Duration) { serveStaleOnError, maxCacheAge = serve, age }(serveStaleOnError, maxCacheAge)
+	serveStaleOnError, maxCacheAge = true, time.Minute
+	clock := newFakeClock()
+	scrapeTarget := &ScrapeTarget{name: `node`, settings: &proxySettings{clock: clock}}
+	request := upstreamRequest{}
+	scrapeTarget.setCached(request, []outputFamily{{name: `up`, lines: []string{"up 1\n"}}})
+
+	clock.Advance(30 * time.Second)
+	if _, age, ok := scrapeTarget.cachedFamilies(request, ErrUpstreamUnreachable); !ok || age != 30*time.Second {
+		t.Errorf(`cached output of 30s ago: %v %v, expected true 30s`, ok, age)
+	}
+	clock.Advance(31 * time.Second)
+	if _, _, ok := scrapeTarget.cachedFamilies(request, ErrUpstreamUnreachable); ok {
+		t.Error(`cached output older than -max-cache-age was replayed`)
+	}
+}
+
+func TestRateLimitRefillsWithTheClock(t *testing.T) {
+	clock := newFakeClock()
+	handler := newListenerRateLimit(`:19100`, 0.5, 1, clock).wrap(func(w http.ResponseWriter, r *http.Request) {})
+	status := func() (int, string) {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+		return recorder.Code, recorder.Header().Get(`Retry-After`)
+	}
+
+	if code, _ := status(); code != http.StatusOK {
+		t.Fatalf(`first request answered %d`, code)
+	}
+	if code, retry := status(); code != http.StatusTooManyRequests || retry != `2` {
+		t.Fatalf(`second request answered %d with Retry-After %q, expected 429 and 2`, code, retry)
+	}
+	clock.Advance(time.Second)
+	if code, _ := status(); code != http.StatusTooManyRequests {
+		t.Fatalf(`request after half a token answered %d`, code)
+	}
+	clock.Advance(time.Second)
+	if code, _ := status(); code != http.StatusOK {
+		t.Errorf(`request after a refill answered %d`, code)
+	}
+}
+
+func TestNextSlotIsOffsetIntoTheInterval(t *testing.T) {
+	schedule := newScrapeSchedule(`node`, time.Minute, 0)
+	now := newFakeClock().Now()
+	next := schedule.nextAfter(now)
+	if !next.After(now) || next.Sub(now) > time.Minute {
+		t.Fatalf(`next slot %v isn't within a minute after %v`, next, now)
+	}
+	if offset := next.Sub(next.Truncate(time.Minute)); offset != staggerOffset(`node`, time.Minute) {
+		t.Errorf(`slot offset %v, expected %v`, offset, staggerOffset(`node`, time.Minute))
+	}
+	if after := schedule.nextAfter(next); after.Sub(next) != time.Minute {
+		t.Errorf(`slots %v apart, expected a minute`, after.Sub(next))
+	}
+	if schedule.nextScrape() != next.Add(time.Minute) {
+		t.Errorf(`next scrape %v, expected the last slot handed out`, schedule.nextScrape())
+	}
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"log"
+	"time"
+
+	"github.com/pdxiv/frugalpromproxy/staleness"
+)
+
+// MonotonicClock is a Clock that can also tell how much time really passed,
+// whatever its wall clock does. The real clock is one. With it the proxy
+// notices when the wall clock jumps between two scrapes, like on a box
+// whose NTP corrects it by minutes, and fake clocks implementing it can
+// simulate jumps in tests.
+type MonotonicClock interface {
+	Clock
+	// Time passed since a fixed point, never going backwards
+	Monotonic() time.Duration
+}
+
+// Differences between wall clock and monotonic time between two scrapes
+// above this are handled as clock jumps, 0 never looks for them
+var clockJumpThreshold time.Duration
+
+var clockJumps = selfMetrics.newCounterVec(`frugalpromproxy_clock_jumps_total`, `Times the wall clock jumped between two scrapes of the target by more than -clock-jump-threshold, by direction: forward or backward.`, `target`, `direction`)
+
+// Monotonic readings of the real clock count from here
+var processStart = time.Now()
+
+func (realClock) Monotonic() time.Duration { return time.Since(processStart) }
+
+// Compare how far the wall clock moved since the previous scrape with the
+// time that really passed. A jump above the threshold is logged, and
+// the wall clock times of the series are moved along with the clock, so
+// the jump isn't taken for time the series were missing or unforwarded.
+// Returns whether the clock jumped, the scrape then leaves the vanished
+// series alone. Called with the stateMutex held, once per upstream fetch.
+func (scrapeTarget *ScrapeTarget) detectClockJump(policies *staleness.Policies, now time.Time) bool {
+	monotonicClock, ok := scrapeTarget.settings.clock.(MonotonicClock)
+	if !ok {
+		return false
+	}
+	monotonic := monotonicClock.Monotonic()
+	previousWall, previousMonotonic := scrapeTarget.lastWall, scrapeTarget.lastMonotonic
+	scrapeTarget.lastWall, scrapeTarget.lastMonotonic = now, monotonic
+	threshold := scrapeTarget.settings.clockJumpThreshold
+	if previousWall.IsZero() || threshold <= 0 {
+		return false
+	}
+
+	// Round(0) drops the monotonic reading time.Now keeps, so Sub compares
+	// the wall clock times
+	jump := now.Round(0).Sub(previousWall.Round(0)) - (monotonic - previousMonotonic)
+	if jump <= threshold && jump >= -threshold {
+		return false
+	}
+	direction, size := `forward`, jump
+	if jump < 0 {
+		direction, size = `backward`, -jump
+	}
+	clockJumps.inc(scrapeTarget.name, direction)
+	log.Printf("%s: the wall clock jumped %s by %v since the previous scrape, moving the series times along and leaving the vanished series alone for this scrape", scrapeTarget.name, direction, size.Round(time.Second))
+	policies.ShiftTimes(jump)
+	return true
+}
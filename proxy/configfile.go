@@ -0,0 +1,382 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+)
+
+// YAML file holding the targets, instead of the upstream and listen
+// arguments
+var configFile string
+
+// The targets of a config file, like
+//
+//	targets:
+//	  - upstream: http://localhost:9100/metrics
+//	    listen: 19100
+//	    stale_threshold: 60
+//	    drop: ['go_.*', 'process_.*']
+//	  - upstream: 8080
+//	    listen: 19100
+//	    path: /app/metrics
+//	    start_stale: false
+//	    username: scraper
+//	    password_env: APP_METRICS_PASSWORD
+//	  - upstream: https://10.0.0.7:8443/metrics
+//	    listen: 19101
+//	    server_name: app.example
+type configFileContents struct {
+	Targets []configFileTarget `yaml:"targets"`
+}
+
+type configFileTarget struct {
+	// Written like an upstream argument, so it can fail over, merge and
+	// scrape several paths the same way
+	Upstream string `yaml:"upstream"`
+	// Listen port or address, optionally with the path like a listen
+	// argument. A Unix socket takes its path from path.
+	Listen string `yaml:"listen"`
+	Path   string `yaml:"path"`
+	// Override -stale-threshold and -start-stale
+	StaleThreshold *int64 `yaml:"stale_threshold"`
+	StartStale     *bool  `yaml:"start_stale"`
+	// Replace -keep and -drop
+	Keep []string `yaml:"keep"`
+	Drop []string `yaml:"drop"`
+	// Replace the -upstream-username, -upstream-password-file and
+	// -upstream-bearer-token-file credentials. The secrets are taken from
+	// the environment variables named by password_env and bearer_token_env
+	// when those are set, and else from the files.
+	Username        string `yaml:"username"`
+	PasswordFile    string `yaml:"password_file"`
+	PasswordEnv     string `yaml:"password_env"`
+	BearerTokenFile string `yaml:"bearer_token_file"`
+	BearerTokenEnv  string `yaml:"bearer_token_env"`
+	// Override -target-host-header and -target-server-name
+	HostHeader string `yaml:"host_header"`
+	ServerName string `yaml:"server_name"`
+}
+
+// What a config file describes: the targets of its Proxy, and the routes
+// of every listen address
+type loadedConfig struct {
+	config          Config
+	listenAddresses []listenAddress
+	routeTables     map[listenAddress][]route
+}
+
+// Read and check a config file. An error names the target entry it is
+// about, counting from 1.
+func loadConfigFile(path string) (*loadedConfig, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var parsed configFileContents
+	decoder := yaml.NewDecoder(bytes.NewReader(contents))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&parsed); err != nil {
+		return nil, fmt.Errorf(`%s: %v`, path, err)
+	}
+	if len(parsed.Targets) == 0 {
+		return nil, fmt.Errorf(`%s: no targets`, path)
+	}
+
+	loaded := &loadedConfig{routeTables: make(map[listenAddress][]route)}
+	routedBy := make(map[string]int) // Entry of a listen port and path
+	named := make(map[string]bool)
+	for i, entry := range parsed.Targets {
+		number := i + 1
+		fail := func(err error) error {
+			return fmt.Errorf(`%s: target %d (upstream %q): %v`, path, number, entry.Upstream, err)
+		}
+		if entry.Upstream == `` {
+			return nil, fail(fmt.Errorf(`no upstream`))
+		}
+		upstreams, err := parseUpstreamArgument(entry.Upstream)
+		if err != nil {
+			return nil, fail(err)
+		}
+		listen := entry.Listen
+		unixSocket := strings.HasPrefix(listen, unixSocketPrefix)
+		if entry.Path != `` && !unixSocket {
+			if strings.Contains(listen, `/`) {
+				return nil, fail(fmt.Errorf(`listen %s already has a path`, listen))
+			}
+			listen += `/` + strings.TrimPrefix(entry.Path, `/`)
+		}
+		address, routePath, err := parseListenArgument(listen)
+		if err != nil || !address.validPort() {
+			return nil, fail(fmt.Errorf(`%q isn't a listen port or address`, entry.Listen))
+		}
+		if entry.Path != `` && unixSocket {
+			routePath = `/` + strings.TrimPrefix(entry.Path, `/`)
+		}
+		routed := address.String() + routePath
+		if first, ok := routedBy[routed]; ok {
+			return nil, fail(fmt.Errorf(`%s is already the listen address of target %d`, routed, first))
+		}
+		routedBy[routed] = number
+
+		target, err := entry.target()
+		if err != nil {
+			return nil, fail(err)
+		}
+		route := route{path: routePath, sources: upstreams}
+		for _, upstream := range upstreams {
+			target.Name, err = configTargetName(upstream, routed, named)
+			if err != nil {
+				return nil, fail(err)
+			}
+			target.Upstreams, target.params, target.paths = upstream.urls(), upstream.params, upstream.paths
+			target.HostHeader, target.ServerName = entry.HostHeader, entry.ServerName
+			if target.HostHeader == `` {
+				target.HostHeader = targetHostHeaders[target.Name]
+			}
+			if target.ServerName == `` {
+				target.ServerName = targetServerNames[target.Name]
+			}
+			if err := validateHostOverride(target); err != nil {
+				return nil, fail(err)
+			}
+			loaded.config.Targets = append(loaded.config.Targets, target)
+			route.targets = append(route.targets, target.Name)
+		}
+		if _, ok := loaded.routeTables[address]; !ok {
+			loaded.listenAddresses = append(loaded.listenAddresses, address)
+		}
+		loaded.routeTables[address] = append(loaded.routeTables[address], route)
+	}
+	if err := loaded.config.Validate(); err != nil {
+		return nil, fmt.Errorf(`%s: %v`, path, err)
+	}
+	return loaded, nil
+}
+
+// The settings of an entry, for each of its upstreams
+func (entry configFileTarget) target() (Target, error) {
+	var target Target
+	if entry.StaleThreshold != nil {
+		target.StaleThreshold = *entry.StaleThreshold
+		// 0 never suppresses, like -stale-threshold 0, where a Target takes
+		// 0 for the threshold of its config
+		if target.StaleThreshold == 0 {
+			target.StaleThreshold = -1
+		}
+	}
+	if entry.StartStale != nil {
+		target.StartLive, target.startStale = !*entry.StartStale, *entry.StartStale
+	}
+	if entry.Keep != nil || entry.Drop != nil {
+		var names nameFilter
+		for _, pattern := range entry.Keep {
+			if err := names.keep.Set(pattern); err != nil {
+				return Target{}, err
+			}
+		}
+		for _, pattern := range entry.Drop {
+			if err := names.drop.Set(pattern); err != nil {
+				return Target{}, err
+			}
+		}
+		target.names = &names
+	}
+	auth, err := loadCredentials(entry.Username, entry.PasswordFile, entry.PasswordEnv, entry.BearerTokenFile, entry.BearerTokenEnv)
+	if err != nil {
+		return Target{}, err
+	}
+	if auth.isSet() {
+		target.credentials = &auth
+	}
+	return target, nil
+}
+
+// The target name of an upstream: its host like on the command line, which
+// the -target-* flags and the state files go by. When another entry has the
+// name already, its path and parameters are added, and then the listen
+// address of the entry.
+func configTargetName(upstream upstreamSpec, routed string, named map[string]bool) (string, error) {
+	key := upstream.key()
+	key = key[strings.Index(key, `://`)+3:]
+	for _, name := range []string{upstream.name(), key, key + `@` + routed} {
+		if !named[name] {
+			named[name] = true
+			return name, nil
+		}
+	}
+	return ``, fmt.Errorf(`%s is scraped twice for the same listen address`, key)
+}
+
+func (scrapeTarget *ScrapeTarget) currentCredentials() credentials {
+	scrapeTarget.configMutex.Lock()
+	defer scrapeTarget.configMutex.Unlock()
+	return scrapeTarget.credentials
+}
+
+// The routes as printRoutes shows them, to tell whether a reload changed
+// them
+func routesText(listenAddresses []listenAddress, routeTables map[listenAddress][]route) string {
+	var text bytes.Buffer
+	printRoutes(&text, listenAddresses, routeTables)
+	return text.String()
+}
+
+// A mux a reload can replace while its listener keeps running
+type reloadableMux struct {
+	mu  sync.RWMutex
+	mux *http.ServeMux
+}
+
+func (reloadable *reloadableMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reloadable.mu.RLock()
+	mux := reloadable.mux
+	reloadable.mu.RUnlock()
+	mux.ServeHTTP(w, r)
+}
+
+func (reloadable *reloadableMux) set(mux *http.ServeMux) {
+	reloadable.mu.Lock()
+	reloadable.mux = mux
+	reloadable.mu.Unlock()
+}
+
+// The listeners of a config file, and the proxy of its targets with the
+// settings of the command line
+type configListeners struct {
+	path    string
+	proxy   *Proxy
+	loaded  *loadedConfig
+	muxes   map[listenAddress]*reloadableMux
+	servers map[listenAddress]*http.Server
+}
+
+// Create the targets of a loaded config file and start its listeners
+func serveConfigFile(path string, loaded *loadedConfig) (*configListeners, error) {
+	proxy, err := newProxy(loaded.config, commandLine)
+	if err != nil {
+		return nil, fmt.Errorf(`%s: %v`, path, err)
+	}
+	served := &configListeners{path: path, proxy: proxy, loaded: loaded, muxes: make(map[listenAddress]*reloadableMux), servers: make(map[listenAddress]*http.Server)}
+	for _, address := range loaded.listenAddresses {
+		if err := served.listen(address); err != nil {
+			return nil, err
+		}
+	}
+	return served, nil
+}
+
+func (served *configListeners) listen(address listenAddress) error {
+	bound, err := address.listen()
+	if err != nil {
+		return err
+	}
+	mux := &reloadableMux{mux: served.mux(address)}
+	server := newListenerServer(address.name(), address, mux)
+	served.muxes[address], served.servers[address] = mux, server
+	go func() {
+		if err := serveOn(bound, server); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	return nil
+}
+
+// The routes of a listen address, on the current targets of the proxy
+func (served *configListeners) mux(address listenAddress) *http.ServeMux {
+	routes := served.loaded.routeTables[address]
+	mux := http.NewServeMux()
+	for _, route := range routes {
+		route.register(mux, address, served.proxy.targetsNamed(route.targets))
+	}
+	mux.HandleFunc(`/`, routeNotFound(routes))
+	handleCommonEndpoints(address.name(), mux)
+	return mux
+}
+
+func (proxy *Proxy) targetsNamed(names []string) []*ScrapeTarget {
+	proxy.mu.RLock()
+	defer proxy.mu.RUnlock()
+	targets := make([]*ScrapeTarget, len(names))
+	for i, name := range names {
+		targets[i] = proxy.targets[name]
+	}
+	return targets
+}
+
+// Read the config file again on every SIGHUP and apply it like
+// Proxy.Reload: targets on the same upstreams keep the state of their
+// series, changed ones start over. Password and token files are read again
+// too. Listeners of added addresses are started and the ones of removed
+// addresses stopped, the others get the new routes without dropping their
+// connections. A file that doesn't load keeps everything as it was.
+func (served *configListeners) reloadOnHangup() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		if err := served.reload(); err != nil {
+			log.Printf("reload: %v, keeping the previous config", err)
+		}
+	}
+}
+
+func (served *configListeners) reload() error {
+	loaded, err := loadConfigFile(served.path)
+	if err != nil {
+		return err
+	}
+	if err := validateRoutes(loaded.listenAddresses, loaded.routeTables, discoveryPort, allowDuplicateUpstreams); err != nil {
+		return fmt.Errorf(`%s: %v`, served.path, err)
+	}
+	retired, err := served.proxy.reload(loaded.config, commandLine)
+	if err != nil {
+		return fmt.Errorf(`%s: %v`, served.path, err)
+	}
+	previous := served.loaded
+	served.loaded = loaded
+	for _, address := range loaded.listenAddresses {
+		if mux, ok := served.muxes[address]; ok {
+			mux.set(served.mux(address))
+			continue
+		}
+		if err := served.listen(address); err != nil {
+			log.Printf("reload: not listening on %s: %v", address, err)
+			continue
+		}
+		log.Printf("reload: listening on %s", address)
+	}
+	for address, server := range served.servers {
+		if _, ok := loaded.routeTables[address]; ok {
+			continue
+		}
+		delete(served.muxes, address)
+		delete(served.servers, address)
+		log.Printf("reload: no longer listening on %s", address)
+		go func(server *http.Server) {
+			ctx, cancel := context.Background(), context.CancelFunc(func() {})
+			if shutdownGracePeriod > 0 {
+				ctx, cancel = context.WithTimeout(ctx, shutdownGracePeriod)
+			}
+			defer cancel()
+			shutdownListener(ctx, server)
+		}(server)
+	}
+	// No route leads to them anymore
+	for _, scrapeTarget := range retired {
+		scrapeTarget.close()
+	}
+	if routesText(previous.listenAddresses, previous.routeTables) != routesText(loaded.listenAddresses, loaded.routeTables) {
+		printRoutes(os.Stdout, loaded.listenAddresses, loaded.routeTables)
+	}
+	return nil
+}
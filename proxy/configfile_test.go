@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigFileTargetsAreNamedLikeOnTheCommandLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `targets.yaml`)
+	writeConfigFile(t, path, `targets:
+  - upstream: 9100
+    listen: 19100
+    stale_threshold: 0
+    start_stale: false
+    drop: ['go_.*']
+  - upstream: 9100/federate?match[]=up
+    listen: 19100
+    path: /federate
+  - upstream: 9100
+    listen: 19101
+  - upstream: 9100
+    listen: 19102
+`)
+	loaded, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, target := range loaded.config.Targets {
+		names = append(names, target.Name)
+	}
+	if got := strings.Join(names, ` `); got != `localhost:9100 localhost:9100/federate?match%5B%5D=up localhost:9100/metrics localhost:9100/metrics@19102/metrics` {
+		t.Errorf(`targets named %s`, got)
+	}
+	first := loaded.config.Targets[0]
+	if first.StaleThreshold != -1 || !first.StartLive || first.names == nil || first.names.drop.String() != `go_.*` {
+		t.Errorf(`settings of the first entry: threshold %d, start live %v, names %v`, first.StaleThreshold, first.StartLive, first.names)
+	}
+	if loaded.config.Targets[1].params.Get(`match[]`) != `up` {
+		t.Errorf(`parameters of the second entry: %v`, loaded.config.Targets[1].params)
+	}
+	if len(loaded.listenAddresses) != 3 || len(loaded.routeTables[listenAddress{port: 19100}]) != 2 {
+		t.Errorf(`routes %v`, loaded.routeTables)
+	}
+}
+
+func TestConfigFileErrorsNameTheEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `targets.yaml`)
+	for contents, expected := range map[string]string{
+		"targets: []\n": `no targets`,
+		"targets:\n  - upstream: 9100\n    listen: 19100\n  - upstream: 9200\n    listen: 19100\n":  `target 2 (upstream "9200"): 19100/metrics is already the listen address of target 1`,
+		"targets:\n  - upstream: ftp://node/metrics\n    listen: 19100\n":                           `target 1`,
+		"targets:\n  - upstream: 9100\n    listen: 19100\n    threshold: 3\n":                       `field threshold not found`,
+		"targets:\n  - upstream: 9100\n    listen: 19100\n    password_file: /nonexistent/secret\n": `target 1`,
+	} {
+		writeConfigFile(t, path, contents)
+		if _, err := loadConfigFile(path); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q: error %v, expected %s", contents, err, expected)
+		}
+	}
+}
+
+func TestConfigFileOverridesTheHostHeaderAndServerName(t *testing.T) {
+	defer func(headers, names targetStrings) { targetHostHeaders, targetServerNames = headers, names }(targetHostHeaders, targetServerNames)
+	targetHostHeaders, targetServerNames = targetStrings{}, targetStrings{}
+	if err := targetHostHeaders.Set(`10.0.0.5:8443=flag.example,10.0.0.6:8443=other.example`); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), `targets.yaml`)
+	writeConfigFile(t, path, `targets:
+  - upstream: https://10.0.0.5:8443/metrics
+    listen: 19100
+    host_header: node.example
+    server_name: node.example
+  - upstream: https://10.0.0.6:8443/metrics
+    listen: 19101
+`)
+	loaded, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target := loaded.config.Targets[0]; target.HostHeader != `node.example` || target.ServerName != `node.example` {
+		t.Errorf(`the entry's overrides became %q and %q`, target.HostHeader, target.ServerName)
+	}
+	if target := loaded.config.Targets[1]; target.HostHeader != `other.example` || target.ServerName != `` {
+		t.Errorf(`the flag's overrides became %q and %q`, target.HostHeader, target.ServerName)
+	}
+
+	writeConfigFile(t, path, "targets:\n  - upstream: 9100\n    listen: 19100\n    server_name: node.example\n")
+	if _, err := loadConfigFile(path); err == nil || !strings.Contains(err.Error(), `target 1`) || !strings.Contains(err.Error(), `needs https`) {
+		t.Errorf(`a server name for an http upstream: %v`, err)
+	}
+}
+
+// A client of the listeners on Unix sockets in dir
+func unixSocketClient(dir string) *http.Client {
+	return &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, `unix`, filepath.Join(dir, strings.TrimSuffix(address, `:80`)+`.sock`))
+	}}}
+}
+
+func get(t *testing.T, client *http.Client, url string) (int, string) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+// The settings of a command line with only the defaults of the variables
+func useCommandLineSettings(t *testing.T) {
+	previous := commandLine
+	commandLine = commandLineSettings()
+	commandLine.fetches = newFetchLimiter(0)
+	t.Cleanup(func() { commandLine = previous })
+}
+
+func TestConfigFileReloadChangesTargetsAndListeners(t *testing.T) {
+	useCommandLineSettings(t)
+	_, node := newFakeExporter(t, "node_load1 0.5\n")
+	_, app := newFakeExporter(t, "app_requests_total 7\n")
+	dir := t.TempDir()
+	path := filepath.Join(dir, `targets.yaml`)
+	writeConfigFile(t, path, `targets:
+  - upstream: `+node+`/metrics
+    listen: unix://`+dir+`/one.sock
+    start_stale: false
+`)
+	loaded, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served, err := serveConfigFile(path, loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, server := range served.servers {
+			shutdownListener(context.Background(), server)
+		}
+		for _, scrapeTarget := range served.proxy.targets {
+			scrapeTarget.close()
+		}
+	})
+	client := unixSocketClient(dir)
+	if code, body := get(t, client, `http://one/metrics`); !strings.Contains(body, `node_load1 0.5`) {
+		t.Fatalf(`before the reload: %d %s`, code, body)
+	}
+
+	writeConfigFile(t, path, `targets:
+  - upstream: `+app+`/metrics
+    listen: unix://`+dir+`/two.sock
+    path: /app
+    start_stale: false
+`)
+	if err := served.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, body := get(t, client, `http://two/app`); !strings.Contains(body, `app_requests_total 7`) {
+		t.Errorf(`a target on a listen address added by the reload answered %s`, body)
+	}
+	if code, _ := get(t, client, `http://one/metrics`); code != 0 {
+		t.Errorf(`a listener the reload removed answered %d`, code)
+	}
+	if targets := served.proxy.Targets(); len(targets) != 1 || !strings.HasPrefix(app, `http://`+targets[0]) {
+		t.Errorf(`targets after the reload: %v`, targets)
+	}
+
+	writeConfigFile(t, path, "targets:\n  - upstream: 9100\n    listen: 19100\n    bogus: true\n")
+	if err := served.reload(); err == nil {
+		t.Fatal(`a file that doesn't load was applied`)
+	}
+	if _, body := get(t, client, `http://two/app`); !strings.Contains(body, `app_requests_total 7`) {
+		t.Errorf(`a failed reload changed the routes: %s`, body)
+	}
+}
@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// How long a blocking query waits for changes before Consul answers anyway
+const consulWait = 5 * time.Minute
+
+// Consul's HTTP API, shared by discovery and registration
+type consulClient struct {
+	address    string // e.g. http://localhost:8500
+	token      string
+	datacenter string
+	client     *http.Client
+}
+
+// Finds exporters registered in the Consul catalog, either the listed
+// services or all services carrying the tag. Every service is followed with
+// blocking queries, and a failing query keeps the last known targets.
+type consulDiscovery struct {
+	consul       *consulClient
+	services     []string
+	tag          string
+	pathTemplate *template.Template
+	router       *discoveryRouter
+}
+
+type consulServiceEntry struct {
+	Node struct {
+		Node       string `json:"Node"`
+		Address    string `json:"Address"`
+		Datacenter string `json:"Datacenter"`
+	} `json:"Node"`
+	Service struct {
+		ID      string            `json:"ID"`
+		Service string            `json:"Service"`
+		Tags    []string          `json:"Tags"`
+		Address string            `json:"Address"`
+		Port    int               `json:"Port"`
+		Meta    map[string]string `json:"Meta"`
+	} `json:"Service"`
+}
+
+func newConsulClient(address, token, datacenter string) *consulClient {
+	if !strings.Contains(address, `://`) {
+		address = `http://` + address
+	}
+	return &consulClient{
+		address:    strings.TrimRight(address, `/`),
+		token:      token,
+		datacenter: datacenter,
+		client:     &http.Client{Timeout: consulWait + time.Minute},
+	}
+}
+
+func (consul *consulClient) do(method, path string, query url.Values, body io.Reader) (*http.Response, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	if consul.datacenter != `` {
+		query.Set(`dc`, consul.datacenter)
+	}
+	req, err := http.NewRequest(method, consul.address+path+`?`+query.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	if consul.token != `` {
+		req.Header.Set(`X-Consul-Token`, consul.token)
+	}
+	resp, err := consul.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf(`consul returned %s for %s`, resp.Status, path)
+	}
+	return resp, nil
+}
+
+// Run a blocking query, decoding the answer into result. Returns the index
+// to pass to the next query.
+func (consul *consulClient) blockingQuery(path string, query url.Values, index uint64, result interface{}) (uint64, error) {
+	query.Set(`index`, strconv.FormatUint(index, 10))
+	query.Set(`wait`, consulWait.String())
+	resp, err := consul.do(http.MethodGet, path, query, nil)
+	if err != nil {
+		return index, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return index, err
+	}
+	next, err := strconv.ParseUint(resp.Header.Get(`X-Consul-Index`), 10, 64)
+	if err != nil {
+		return 0, nil
+	}
+	// Consul asks clients to start over when the index goes backwards
+	if next < index {
+		return 0, nil
+	}
+	return next, nil
+}
+
+func (discovery *consulDiscovery) run() {
+	if len(discovery.services) > 0 {
+		for _, service := range discovery.services {
+			go discovery.watchService(service, nil)
+		}
+		return
+	}
+	discovery.watchCatalog()
+}
+
+// Follow the catalog, starting and stopping service watches as services with
+// the tag come and go
+func (discovery *consulDiscovery) watchCatalog() {
+	watches := make(map[string]chan struct{})
+	var index uint64
+	for {
+		var services map[string][]string
+		next, err := discovery.consul.blockingQuery(`/v1/catalog/services`, url.Values{}, index, &services)
+		if err != nil {
+			log.Printf("consul_sd: %v", err)
+			<-clock.After(5 * time.Second)
+			continue
+		}
+		index = next
+
+		for service, tags := range services {
+			if _, ok := watches[service]; ok || !hasTag(tags, discovery.tag) {
+				continue
+			}
+			watches[service] = make(chan struct{})
+			go discovery.watchService(service, watches[service])
+		}
+		for service, stop := range watches {
+			if tags, ok := services[service]; !ok || !hasTag(tags, discovery.tag) {
+				close(stop)
+				delete(watches, service)
+			}
+		}
+	}
+}
+
+// Follow the healthy instances of one service until stopped
+func (discovery *consulDiscovery) watchService(service string, stop chan struct{}) {
+	source := `consul_sd/` + service
+	var index uint64
+	for {
+		query := url.Values{}
+		query.Set(`passing`, `true`)
+		if discovery.tag != `` {
+			query.Set(`tag`, discovery.tag)
+		}
+		var entries []consulServiceEntry
+		next, err := discovery.consul.blockingQuery(`/v1/health/service/`+url.PathEscape(service), query, index, &entries)
+
+		select {
+		case <-stop:
+			discovery.router.update(source, discovery.pathTemplate, nil)
+			return
+		default:
+		}
+		if err != nil {
+			log.Printf("%s: %v, keeping the last known targets", source, err)
+			<-clock.After(5 * time.Second)
+			continue
+		}
+		index = next
+
+		discovered := make([]discoveredTarget, 0, len(entries))
+		for _, entry := range entries {
+			discovered = append(discovered, consulTarget(entry))
+		}
+		discovery.router.update(source, discovery.pathTemplate, discovered)
+	}
+}
+
+func consulTarget(entry consulServiceEntry) discoveredTarget {
+	address := entry.Service.Address
+	if address == `` {
+		address = entry.Node.Address
+	}
+	labels := make(map[string]string, len(entry.Service.Meta)+2)
+	for name, value := range entry.Service.Meta {
+		labels[name] = value
+	}
+	labels[`service`] = entry.Service.Service
+	labels[`node`] = entry.Node.Node
+
+	return discoveredTarget{
+		url: `http://` + net.JoinHostPort(address, strconv.Itoa(entry.Service.Port)) + basePath,
+		meta: map[string]string{
+			`service`:    entry.Service.Service,
+			`id`:         entry.Service.ID,
+			`node`:       entry.Node.Node,
+			`datacenter`: entry.Node.Datacenter,
+			`address`:    address,
+			`port`:       strconv.Itoa(entry.Service.Port),
+		},
+		labels: labels,
+	}
+}
+
+func hasTag(tags []string, tag string) bool {
+	if tag == `` {
+		return true
+	}
+	for _, candidate := range tags {
+		if candidate == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// A Consul agent answering blocking queries for the health of services and
+// for the catalog. A query with the current index waits for a change.
+type fakeConsul struct {
+	mu       sync.Mutex
+	index    uint64
+	changed  chan struct{}
+	done     chan struct{}
+	services map[string][]consulServiceEntry
+	requests []*http.Request
+}
+
+func newFakeConsul(t *testing.T) (*fakeConsul, string) {
+	consul := &fakeConsul{index: 1, changed: make(chan struct{}), done: make(chan struct{}), services: make(map[string][]consulServiceEntry)}
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/v1/catalog/services`, func(w http.ResponseWriter, r *http.Request) {
+		consul.answer(w, r, func() interface{} {
+			catalog := make(map[string][]string)
+			for service, entries := range consul.services {
+				tags := []string{}
+				for _, entry := range entries {
+					tags = append(tags, entry.Service.Tags...)
+				}
+				catalog[service] = tags
+			}
+			return catalog
+		})
+	})
+	mux.HandleFunc(`/v1/health/service/`, func(w http.ResponseWriter, r *http.Request) {
+		consul.answer(w, r, func() interface{} {
+			entries := []consulServiceEntry{}
+			for _, entry := range consul.services[r.URL.Path[len(`/v1/health/service/`):]] {
+				if tag := r.URL.Query().Get(`tag`); hasTag(entry.Service.Tags, tag) {
+					entries = append(entries, entry)
+				}
+			}
+			return entries
+		})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	// Waiting queries would keep Close from returning
+	t.Cleanup(func() { close(consul.done) })
+	return consul, server.URL
+}
+
+func (consul *fakeConsul) answer(w http.ResponseWriter, r *http.Request, result func() interface{}) {
+	consul.mu.Lock()
+	consul.requests = append(consul.requests, r)
+	index, _ := strconv.ParseUint(r.URL.Query().Get(`index`), 10, 64)
+	if index >= consul.index {
+		changed := consul.changed
+		consul.mu.Unlock()
+		select {
+		case <-changed:
+		case <-consul.done:
+			return
+		}
+		consul.mu.Lock()
+	}
+	defer consul.mu.Unlock()
+	w.Header().Set(`X-Consul-Index`, strconv.FormatUint(consul.index, 10))
+	json.NewEncoder(w).Encode(result())
+}
+
+// Replace the instances of a service, waking up the waiting queries
+func (consul *fakeConsul) register(service string, entries ...consulServiceEntry) {
+	consul.mu.Lock()
+	defer consul.mu.Unlock()
+	if len(entries) == 0 {
+		delete(consul.services, service)
+	} else {
+		consul.services[service] = entries
+	}
+	consul.index++
+	close(consul.changed)
+	consul.changed = make(chan struct{})
+}
+
+func (consul *fakeConsul) lastRequest() *http.Request {
+	consul.mu.Lock()
+	defer consul.mu.Unlock()
+	return consul.requests[len(consul.requests)-1]
+}
+
+func consulInstance(service, node, address string, port int, tags ...string) consulServiceEntry {
+	var entry consulServiceEntry
+	entry.Node.Node, entry.Node.Address, entry.Node.Datacenter = node, `10.0.0.1`, `dc1`
+	entry.Service.ID, entry.Service.Service, entry.Service.Address, entry.Service.Port = service+`-`+node, service, address, port
+	entry.Service.Tags = tags
+	return entry
+}
+
+func newTestConsulDiscovery(address string, services ...string) (*consulDiscovery, *discoveryRouter) {
+	router := newDiscoveryRouter(time.Hour)
+	return &consulDiscovery{
+		consul:       newConsulClient(address, `secret`, `dc1`),
+		services:     services,
+		tag:          `prometheus`,
+		pathTemplate: template.Must(template.New(`path`).Parse(`/{{.service}}/{{.node}}/metrics`)),
+		router:       router,
+	}, router
+}
+
+func TestConsulDiscoveryFollowsTheHealthyInstances(t *testing.T) {
+	useCommandLineSettings(t)
+	consul, address := newFakeConsul(t)
+	consul.register(`node`, consulInstance(`node`, `a`, `10.0.1.1`, 9100, `prometheus`), consulInstance(`node`, `b`, `10.0.1.2`, 9100))
+	discovery, router := newTestConsulDiscovery(address, `node`)
+	discovery.run()
+	waitForRoutes(t, router, `/node/a/metrics=http://10.0.1.1:9100/metrics`)
+
+	request := consul.lastRequest()
+	if request.Header.Get(`X-Consul-Token`) != `secret` || request.URL.Query().Get(`dc`) != `dc1` || request.URL.Query().Get(`passing`) != `true` {
+		t.Errorf(`queried %s with token %q`, request.URL, request.Header.Get(`X-Consul-Token`))
+	}
+
+	consul.register(`node`, consulInstance(`node`, `a`, `10.0.1.1`, 9100, `prometheus`), consulInstance(`node`, `c`, ``, 9200, `prometheus`))
+	waitForRoutes(t, router, `/node/a/metrics=http://10.0.1.1:9100/metrics`, `/node/c/metrics=http://10.0.0.1:9200/metrics`)
+
+	consul.register(`node`, consulInstance(`node`, `c`, ``, 9200, `prometheus`))
+	waitForRoutes(t, router, `/node/c/metrics=http://10.0.0.1:9200/metrics`)
+}
+
+func TestConsulDiscoveryFollowsTheServicesWithTheTag(t *testing.T) {
+	useCommandLineSettings(t)
+	consul, address := newFakeConsul(t)
+	consul.register(`node`, consulInstance(`node`, `a`, `10.0.1.1`, 9100, `prometheus`))
+	consul.register(`db`, consulInstance(`db`, `a`, `10.0.1.1`, 5432))
+	discovery, router := newTestConsulDiscovery(address)
+	go discovery.run()
+	waitForRoutes(t, router, `/node/a/metrics=http://10.0.1.1:9100/metrics`)
+
+	consul.register(`redis`, consulInstance(`redis`, `b`, `10.0.1.2`, 9121, `prometheus`))
+	waitForRoutes(t, router, `/node/a/metrics=http://10.0.1.1:9100/metrics`, `/redis/b/metrics=http://10.0.1.2:9121/metrics`)
+
+	consul.register(`node`)
+	waitForRoutes(t, router, `/redis/b/metrics=http://10.0.1.2:9121/metrics`)
+}
+
+func TestConsulTargetsCarryTheServiceMeta(t *testing.T) {
+	entry := consulInstance(`node`, `a`, `10.0.1.1`, 9100)
+	entry.Service.Meta = map[string]string{`rack`: `r1`, `service`: `overridden`}
+	target := consulTarget(entry)
+	if target.labels[`rack`] != `r1` || target.labels[`service`] != `node` || target.labels[`node`] != `a` {
+		t.Errorf(`labels %v`, target.labels)
+	}
+	if target.meta[`id`] != `node-a` || target.meta[`datacenter`] != `dc1` || target.meta[`port`] != `9100` {
+		t.Errorf(`meta %v`, target.meta)
+	}
+}
+
+func TestConsulIndexGoingBackwardsStartsOver(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`X-Consul-Index`, `5`)
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	consul := newConsulClient(server.URL, ``, ``)
+	var result map[string][]string
+	if next, err := consul.blockingQuery(`/v1/catalog/services`, url.Values{}, 3, &result); err != nil || next != 5 {
+		t.Errorf(`index 3 answered with 5 continued at %d: %v`, next, err)
+	}
+	if next, err := consul.blockingQuery(`/v1/catalog/services`, url.Values{}, 9, &result); err != nil || next != 0 {
+		t.Errorf(`index 9 answered with 5 continued at %d: %v`, next, err)
+	}
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// How often the registrations are checked, to re-register after Consul lost them
+const consulRegisterCheckInterval = 30 * time.Second
+
+// Registers the proxy's listeners as services in Consul, so Prometheus can
+// discover the proxies instead of the exporters behind them
+type consulRegistration struct {
+	consul  *consulClient
+	name    string
+	tags    []string
+	address string // How Consul reaches the proxy, empty means the agent's address
+	ports   []int
+	stop    chan struct{}
+}
+
+type consulServiceDefinition struct {
+	ID      string                `json:"ID"`
+	Name    string                `json:"Name"`
+	Tags    []string              `json:"Tags,omitempty"`
+	Address string                `json:"Address,omitempty"`
+	Port    int                   `json:"Port"`
+	Check   consulCheckDefinition `json:"Check"`
+}
+
+type consulCheckDefinition struct {
+	HTTP                           string `json:"HTTP"`
+	Interval                       string `json:"Interval"`
+	Timeout                        string `json:"Timeout"`
+	TLSSkipVerify                  bool   `json:"TLSSkipVerify,omitempty"`
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter"`
+}
+
+func (registration *consulRegistration) serviceID(port int) string {
+	return registration.name + `-` + strconv.Itoa(port)
+}
+
+func (registration *consulRegistration) definition(port int) consulServiceDefinition {
+	scheme := `http`
+	if tlsConfig != nil {
+		scheme = `https`
+	}
+	checkHost := registration.address
+	if checkHost == `` {
+		checkHost = `127.0.0.1`
+	}
+	return consulServiceDefinition{
+		ID:      registration.serviceID(port),
+		Name:    registration.name,
+		Tags:    registration.tags,
+		Address: registration.address,
+		Port:    port,
+		Check: consulCheckDefinition{
+			HTTP:                           scheme + `://` + net.JoinHostPort(checkHost, strconv.Itoa(port)) + healthyPath,
+			Interval:                       `15s`,
+			Timeout:                        `5s`,
+			TLSSkipVerify:                  tlsConfig != nil,
+			DeregisterCriticalServiceAfter: `1h`,
+		},
+	}
+}
+
+func (registration *consulRegistration) register(port int) error {
+	body, err := json.Marshal(registration.definition(port))
+	if err != nil {
+		return err
+	}
+	resp, err := registration.consul.do(http.MethodPut, `/v1/agent/service/register`, nil, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Register all listeners, and keep them registered until deregister is
+// called, for instance when the Consul agent restarted and forgot them
+func (registration *consulRegistration) start() {
+	registration.stop = make(chan struct{})
+	for _, port := range registration.ports {
+		if err := registration.register(port); err != nil {
+			log.Printf("consul: registering %s: %v", registration.serviceID(port), err)
+		}
+	}
+
+	go func() {
+		ticker := clock.NewTicker(consulRegisterCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-registration.stop:
+				return
+			case <-ticker.C():
+			}
+			for _, port := range registration.ports {
+				resp, err := registration.consul.do(http.MethodGet, `/v1/agent/service/`+registration.serviceID(port), nil, nil)
+				if err == nil {
+					resp.Body.Close()
+					continue
+				}
+				log.Printf("consul: %s is not registered (%v), registering again", registration.serviceID(port), err)
+				if err := registration.register(port); err != nil {
+					log.Printf("consul: registering %s: %v", registration.serviceID(port), err)
+				}
+			}
+		}
+	}()
+}
+
+func (registration *consulRegistration) deregister() {
+	close(registration.stop)
+	for _, port := range registration.ports {
+		resp, err := registration.consul.do(http.MethodPut, `/v1/agent/service/deregister/`+registration.serviceID(port), nil, nil)
+		if err != nil {
+			log.Printf("consul: deregistering %s: %v", registration.serviceID(port), err)
+			continue
+		}
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A Consul agent keeping the services registered with it
+type fakeConsulAgent struct {
+	mu       sync.Mutex
+	services map[string]consulServiceDefinition
+	tokens   []string
+}
+
+func newFakeConsulAgent(t *testing.T) (*fakeConsulAgent, string) {
+	agent := &fakeConsulAgent{services: make(map[string]consulServiceDefinition)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agent.mu.Lock()
+		defer agent.mu.Unlock()
+		agent.tokens = append(agent.tokens, r.Header.Get(`X-Consul-Token`))
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == `/v1/agent/service/register`:
+			var definition consulServiceDefinition
+			if err := json.NewDecoder(r.Body).Decode(&definition); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			agent.services[definition.ID] = definition
+		case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, `/v1/agent/service/deregister/`):
+			delete(agent.services, strings.TrimPrefix(r.URL.Path, `/v1/agent/service/deregister/`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return agent, server.URL
+}
+
+func (agent *fakeConsulAgent) registered() map[string]consulServiceDefinition {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	services := make(map[string]consulServiceDefinition, len(agent.services))
+	for id, definition := range agent.services {
+		services[id] = definition
+	}
+	return services
+}
+
+func TestListenersAreRegisteredUntilShutdown(t *testing.T) {
+	agent, address := newFakeConsulAgent(t)
+	registration := &consulRegistration{
+		consul: newConsulClient(address, `secret`, ``),
+		name:   `frugalpromproxy`,
+		tags:   []string{`node`},
+		ports:  []int{19100, 19101},
+	}
+	registration.start()
+	services := agent.registered()
+	if len(services) != 2 {
+		t.Fatalf(`registered %v`, services)
+	}
+	service := services[`frugalpromproxy-19101`]
+	if service.Name != `frugalpromproxy` || service.Port != 19101 || len(service.Tags) != 1 || service.Address != `` {
+		t.Errorf(`registered %+v`, service)
+	}
+	if service.Check.HTTP != `http://127.0.0.1:19101`+healthyPath || service.Check.TLSSkipVerify {
+		t.Errorf(`health check %+v`, service.Check)
+	}
+
+	registration.deregister()
+	if services := agent.registered(); len(services) != 0 {
+		t.Errorf(`still registered after shutdown: %v`, services)
+	}
+	for _, token := range agent.tokens {
+		if token != `secret` {
+			t.Errorf(`a request carried the token %q`, token)
+		}
+	}
+}
+
+func TestHealthChecksUseTheRegisteredAddressAndTLS(t *testing.T) {
+	defer func(config *tls.Config) { tlsConfig = config }(tlsConfig)
+	tlsConfig = &tls.Config{}
+	registration := &consulRegistration{name: `frugalpromproxy`, address: `proxy.example`}
+	definition := registration.definition(19100)
+	if definition.Address != `proxy.example` || definition.Check.HTTP != `https://proxy.example:19100`+healthyPath || !definition.Check.TLSSkipVerify {
+		t.Errorf(`definition %+v`, definition)
+	}
+}
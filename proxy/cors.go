@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS for the admin and debug endpoints, so browser based tools can use
+// them. Never applied to the proxied metrics.
+type corsPolicy struct {
+	origins     []string // * allows any origin
+	methods     string
+	headers     string
+	maxAge      time.Duration
+	credentials bool
+}
+
+// CORS of the admin endpoints, nil when disabled
+var cors *corsPolicy
+
+func newCORSPolicy(origins, methods, headers string, maxAge time.Duration, credentials bool) (*corsPolicy, error) {
+	policy := &corsPolicy{methods: methods, headers: headers, maxAge: maxAge, credentials: credentials}
+	for _, origin := range strings.Split(origins, `,`) {
+		if origin = strings.TrimSpace(origin); origin != `` {
+			policy.origins = append(policy.origins, origin)
+		}
+	}
+	if credentials && policy.allowsAny() {
+		return nil, errors.New(`CORS can't allow credentials for any origin, list the origins instead of *`)
+	}
+	return policy, nil
+}
+
+func (policy *corsPolicy) allowsAny() bool {
+	for _, origin := range policy.origins {
+		if origin == `*` {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy *corsPolicy) allows(origin string) bool {
+	for _, allowed := range policy.origins {
+		if allowed == `*` || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// Add the CORS headers, and answer preflight requests
+func (policy *corsPolicy) wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get(`Origin`)
+		if origin == `` {
+			next(w, r)
+			return
+		}
+		w.Header().Add(`Vary`, `Origin`)
+		allowed := policy.allows(origin)
+		if allowed {
+			w.Header().Set(`Access-Control-Allow-Origin`, origin)
+			if policy.credentials {
+				w.Header().Set(`Access-Control-Allow-Credentials`, `true`)
+			}
+		}
+
+		if r.Method != http.MethodOptions || r.Header.Get(`Access-Control-Request-Method`) == `` {
+			next(w, r)
+			return
+		}
+		if !allowed {
+			http.Error(w, `origin not allowed`, http.StatusForbidden)
+			return
+		}
+		w.Header().Set(`Access-Control-Allow-Methods`, policy.methods)
+		if policy.headers != `` {
+			w.Header().Set(`Access-Control-Allow-Headers`, policy.headers)
+		}
+		if policy.maxAge > 0 {
+			w.Header().Set(`Access-Control-Max-Age`, strconv.Itoa(int(policy.maxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Wrap an admin or debug endpoint with the CORS policy, if there is one
+func adminEndpoint(handler http.HandlerFunc) http.HandlerFunc {
+	if cors == nil {
+		return handler
+	}
+	return cors.wrap(handler)
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func corsRequest(t *testing.T, policy *corsPolicy, method, origin string, preflight bool) *httptest.ResponseRecorder {
+	t.Helper()
+	handler := policy.wrap(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, `targets`) })
+	r := httptest.NewRequest(method, targetsPath, nil)
+	if origin != `` {
+		r.Header.Set(`Origin`, origin)
+	}
+	if preflight {
+		r.Header.Set(`Access-Control-Request-Method`, http.MethodGet)
+	}
+	recorder := httptest.NewRecorder()
+	handler(recorder, r)
+	return recorder
+}
+
+func TestCORSPreflightIsAnswered(t *testing.T) {
+	policy, err := newCORSPolicy(`https://dash.example.com`, `GET, HEAD`, `Authorization`, 10*time.Minute, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := corsRequest(t, policy, http.MethodOptions, `https://dash.example.com`, true)
+	if recorder.Code != http.StatusNoContent || recorder.Body.Len() != 0 {
+		t.Errorf(`preflight answered %d %q`, recorder.Code, recorder.Body.String())
+	}
+	for header, expected := range map[string]string{
+		`Access-Control-Allow-Origin`:      `https://dash.example.com`,
+		`Access-Control-Allow-Credentials`: `true`,
+		`Access-Control-Allow-Methods`:     `GET, HEAD`,
+		`Access-Control-Allow-Headers`:     `Authorization`,
+		`Access-Control-Max-Age`:           `600`,
+		`Vary`:                             `Origin`,
+	} {
+		if got := recorder.Header().Get(header); got != expected {
+			t.Errorf(`%s: %q, expected %q`, header, got, expected)
+		}
+	}
+}
+
+func TestCORSAllowsListedOrigins(t *testing.T) {
+	policy, err := newCORSPolicy(`https://a.example.com, https://dash.example.com`, `GET`, ``, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := corsRequest(t, policy, http.MethodGet, `https://dash.example.com`, false)
+	if recorder.Body.String() != `targets` || recorder.Header().Get(`Access-Control-Allow-Origin`) != `https://dash.example.com` {
+		t.Errorf(`allowed origin got %q with headers %v`, recorder.Body.String(), recorder.Header())
+	}
+	if recorder.Header().Get(`Access-Control-Allow-Credentials`) != `` {
+		t.Error(`credentials allowed without being configured`)
+	}
+
+	wildcard, err := newCORSPolicy(`*`, `GET`, ``, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorder := corsRequest(t, wildcard, http.MethodGet, `https://elsewhere.example.com`, false); recorder.Header().Get(`Access-Control-Allow-Origin`) != `https://elsewhere.example.com` {
+		t.Errorf(`* didn't allow an origin: %v`, recorder.Header())
+	}
+}
+
+func TestCORSLeavesOutDisallowedOrigins(t *testing.T) {
+	policy, err := newCORSPolicy(`https://dash.example.com`, `GET`, ``, time.Minute, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := corsRequest(t, policy, http.MethodGet, `https://evil.example.com`, false)
+	if recorder.Header().Get(`Access-Control-Allow-Origin`) != `` {
+		t.Errorf(`disallowed origin got %v`, recorder.Header())
+	}
+	recorder = corsRequest(t, policy, http.MethodOptions, `https://evil.example.com`, true)
+	if recorder.Code != http.StatusForbidden || recorder.Header().Get(`Access-Control-Allow-Methods`) != `` {
+		t.Errorf(`disallowed preflight answered %d with %v`, recorder.Code, recorder.Header())
+	}
+
+	// Requests from outside a browser carry no origin
+	recorder = corsRequest(t, policy, http.MethodGet, ``, false)
+	if recorder.Body.String() != `targets` || recorder.Header().Get(`Vary`) != `` {
+		t.Errorf(`a request without an origin got %q with %v`, recorder.Body.String(), recorder.Header())
+	}
+}
+
+func TestCORSRejectsCredentialsForAnyOrigin(t *testing.T) {
+	if _, err := newCORSPolicy(`https://dash.example.com, *`, `GET`, ``, 0, true); err == nil {
+		t.Error(`* with credentials was accepted`)
+	}
+}
+
+func TestAdminEndpointsAreUnwrappedWithoutCORS(t *testing.T) {
+	defer func(policy *corsPolicy) { cors = policy }(cors)
+	cors = nil
+	handler := adminEndpoint(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, `targets`) })
+	r := httptest.NewRequest(http.MethodGet, targetsPath, nil)
+	r.Header.Set(`Origin`, `https://dash.example.com`)
+	recorder := httptest.NewRecorder()
+	handler(recorder, r)
+	if len(recorder.Header()[`Access-Control-Allow-Origin`]) != 0 || len(recorder.Header()[`Vary`]) != 0 {
+		t.Errorf(`CORS headers without a policy: %v`, recorder.Header())
+	}
+}
@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pdxiv/frugalpromproxy/parser"
+)
+
+// Scrapes of a target kept for ?since= requests, 0 disables them
+var deltaJournalSize int
+
+// Scrapes older than this are dropped from the journal
+var deltaJournalTTL time.Duration
+
+const (
+	// Response header with the cursor to pass as ?since= next time
+	deltaCursorHeader = `X-Frugalpromproxy-Cursor`
+	// Response header telling whether the response is incremental or full
+	deltaHeader = `X-Frugalpromproxy-Delta`
+)
+
+// The series each scrape of a target passed on that changed since the scrape
+// before, so a poller can ask for only what changed since its last request
+type deltaJournal struct {
+	size  int
+	ttl   time.Duration
+	epoch string // Tells cursors of an earlier journal apart, like from before a restart
+
+	mu      sync.Mutex
+	seq     uint64
+	entries []deltaEntry      // Oldest first
+	latest  []outputFamily    // Everything the last scrape passed on
+	lines   map[string]string // Series line of the last scrape by series, for spotting changes
+}
+
+type deltaEntry struct {
+	seq      uint64
+	at       time.Time
+	families []outputFamily // Only the changed series
+}
+
+func newDeltaJournal(size int, ttl time.Duration) *deltaJournal {
+	return &deltaJournal{size: size, ttl: ttl, epoch: strconv.FormatInt(clock.Now().UnixNano(), 36), lines: make(map[string]string)}
+}
+
+// A series line without its value and timestamp, like name{labels}
+func seriesID(line string) string {
+	line = strings.TrimRight(line, "\n")
+	name, labels, _, ok := parser.ParseSeries(line)
+	if !ok {
+		return line
+	}
+	if labels == `` {
+		return name
+	}
+	return name + `{` + labels + `}`
+}
+
+// Add a scrape to the journal. A histogram or summary that changed is
+// journaled as a whole.
+func (journal *deltaJournal) record(families []outputFamily, now time.Time) {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	lines := make(map[string]string, len(journal.lines))
+	var changed []outputFamily
+	for _, family := range families {
+		delta := family
+		delta.lines = nil
+		for _, line := range family.lines {
+			id := seriesID(line)
+			lines[id] = line
+			if journal.lines[id] != line {
+				delta.lines = append(delta.lines, line)
+			}
+		}
+		if len(delta.lines) > 0 && len(childSuffixes[family.metricType]) > 0 {
+			delta.lines = family.lines
+		}
+		if len(delta.lines) > 0 {
+			changed = append(changed, delta)
+		}
+	}
+	journal.lines = lines
+	journal.latest = families
+	journal.seq++
+	journal.entries = append(journal.entries, deltaEntry{seq: journal.seq, at: now, families: changed})
+
+	drop := len(journal.entries) - journal.size
+	if drop < 0 {
+		drop = 0
+	}
+	for drop < len(journal.entries) && journal.ttl > 0 && now.Sub(journal.entries[drop].at) > journal.ttl {
+		drop++
+	}
+	if drop > 0 {
+		journal.entries = append([]deltaEntry(nil), journal.entries[drop:]...)
+	}
+}
+
+func (journal *deltaJournal) cursor() string {
+	return journal.epoch + `.` + strconv.FormatUint(journal.seq, 10)
+}
+
+// The series that changed after the cursor and the cursor to use next time.
+// An unknown cursor, or one older than the journal, gets everything the last
+// scrape passed on instead, which incremental reports as false.
+func (journal *deltaJournal) since(cursor string) (families []outputFamily, next string, incremental bool) {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	seq, ok := journal.parseCursor(cursor)
+	if !ok {
+		return journal.latest, journal.cursor(), false
+	}
+
+	// Merged in the order the families and series first changed, later
+	// values replacing earlier ones
+	var merged []outputFamily
+	positions := make(map[string]int)     // Of a family in merged
+	linePositions := make(map[string]int) // Of a series in its family
+	for _, entry := range journal.entries {
+		if entry.seq <= seq {
+			continue
+		}
+		for _, family := range entry.families {
+			position, ok := positions[family.name]
+			if !ok {
+				position = len(merged)
+				positions[family.name] = position
+				merged = append(merged, outputFamily{name: family.name, help: family.help, metricType: family.metricType})
+			}
+			for _, line := range family.lines {
+				id := seriesID(line)
+				if at, ok := linePositions[id]; ok {
+					merged[position].lines[at] = line
+					continue
+				}
+				linePositions[id] = len(merged[position].lines)
+				merged[position].lines = append(merged[position].lines, line)
+			}
+		}
+	}
+	return merged, journal.cursor(), true
+}
+
+// The sequence number of a cursor of this journal, as long as the journal
+// still has every scrape after it
+func (journal *deltaJournal) parseCursor(cursor string) (uint64, bool) {
+	dot := strings.LastIndex(cursor, `.`)
+	if dot < 0 || cursor[:dot] != journal.epoch {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(cursor[dot+1:], 10, 64)
+	if err != nil || seq > journal.seq {
+		return 0, false
+	}
+	if seq < journal.seq && (len(journal.entries) == 0 || journal.entries[0].seq > seq+1) {
+		return 0, false
+	}
+	return seq, true
+}
+
+// Answer a ?since= request with the series changed since the cursor, after
+// scraping like any request
+func (scrapeTarget *ScrapeTarget) deltaHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := scrapeTarget.families(r); err != nil {
+		scrapeTarget.scrapeFailed(w, err)
+		return
+	}
+	families, cursor, incremental := scrapeTarget.journal.since(r.URL.Query().Get(`since`))
+	w.Header().Set(deltaCursorHeader, cursor)
+	if incremental {
+		w.Header().Set(deltaHeader, `incremental`)
+	} else {
+		w.Header().Set(deltaHeader, `full`)
+	}
+	counted := &countingWriter{ResponseWriter: w}
+	writeFamilies(counted, r, families, scrapeTarget.now())
+	servedBytes.add(float64(counted.bytes), []string{scrapeTarget.name})
+}
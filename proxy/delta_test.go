@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const deltaExposition = `node_load1 0.5
+node_memory_free_bytes 1024
+# TYPE latency histogram
+latency_bucket{le="1"} 2
+latency_bucket{le="+Inf"} 3
+latency_sum 1.5
+latency_count 3
+`
+
+type deltaResponse struct {
+	kind, cursor, series string
+}
+
+func newDeltaTarget(t *testing.T, size int, ttl time.Duration) (*fakeClock, *fakeExporter, *ScrapeTarget) {
+	clock := newFakeClock()
+	exporter, upstream := newFakeExporter(t, deltaExposition)
+	scrapeTarget := newFakeClockProxy(t, clock, Config{StaleThreshold: -1}, upstream).targets[`node`]
+	scrapeTarget.journal = newDeltaJournal(size, ttl)
+	return clock, exporter, scrapeTarget
+}
+
+func fetchSince(scrapeTarget *ScrapeTarget, cursor string) deltaResponse {
+	response := httptest.NewRecorder()
+	scrapeTarget.handler(response, httptest.NewRequest(http.MethodGet, `/metrics?since=`+url.QueryEscape(cursor), nil))
+	return deltaResponse{response.Header().Get(deltaHeader), response.Header().Get(deltaCursorHeader), strings.Join(seriesLines(response.Body.String()), "\n")}
+}
+
+func TestDeltasHaveOnlyTheChangedSeries(t *testing.T) {
+	_, exporter, scrapeTarget := newDeltaTarget(t, 10, time.Hour)
+
+	first := fetchSince(scrapeTarget, ``)
+	if first.kind != `full` || first.cursor == `` || first.series != strings.Join(seriesLines(deltaExposition), "\n") {
+		t.Fatalf(`the first fetch %+v`, first)
+	}
+
+	exporter.serve(strings.Replace(deltaExposition, `node_load1 0.5`, `node_load1 0.6`, 1))
+	second := fetchSince(scrapeTarget, first.cursor)
+	if second.kind != `incremental` || second.series != `node_load1 0.6` || second.cursor == first.cursor {
+		t.Errorf(`after node_load1 changed %+v`, second)
+	}
+	if unchanged := fetchSince(scrapeTarget, second.cursor); unchanged.kind != `incremental` || unchanged.series != `` {
+		t.Errorf(`without changes %+v`, unchanged)
+	}
+
+	// Changes of several scrapes are merged, and a histogram is sent whole
+	exporter.serve(strings.Replace(deltaExposition, `latency_count 3`, `latency_count 4`, 1))
+	fetchSince(scrapeTarget, second.cursor)
+	exporter.serve(strings.Replace(deltaExposition, `latency_count 3`, `latency_count 5`, 1))
+	merged := fetchSince(scrapeTarget, second.cursor)
+	expected := "latency_bucket{le=\"+Inf\"} 3\nlatency_bucket{le=\"1\"} 2\nlatency_count 5\nlatency_sum 1.5\nnode_load1 0.5"
+	if merged.kind != `incremental` || merged.series != expected {
+		t.Errorf("since two scrapes %s\n%s\nexpected\n%s", merged.kind, merged.series, expected)
+	}
+}
+
+func TestOldAndUnknownCursorsGetEverything(t *testing.T) {
+	clock, exporter, scrapeTarget := newDeltaTarget(t, 3, time.Hour)
+	full := strings.Join(seriesLines(deltaExposition), "\n")
+	first := fetchSince(scrapeTarget, ``)
+
+	for _, cursor := range []string{`bogus`, `1.1`, first.cursor + `0`} {
+		if response := fetchSince(scrapeTarget, cursor); response.kind != `full` || response.series != full {
+			t.Errorf(`cursor %s got %+v`, cursor, response)
+		}
+	}
+
+	// Only the last 3 scrapes are kept
+	for i := 0; i < 3; i++ {
+		exporter.serve(strings.Replace(deltaExposition, `node_load1 0.5`, `node_load1 0.`+strconv.Itoa(6+i), 1))
+		fetchSince(scrapeTarget, ``)
+	}
+	if response := fetchSince(scrapeTarget, first.cursor); response.kind != `full` || !strings.Contains(response.series, `node_load1 0.8`) {
+		t.Errorf(`a cursor older than the journal got %+v`, response)
+	}
+
+	// The scrape after the cursor expires
+	latest := fetchSince(scrapeTarget, ``)
+	fetchSince(scrapeTarget, ``)
+	clock.Advance(2 * time.Hour)
+	if response := fetchSince(scrapeTarget, latest.cursor); response.kind != `full` {
+		t.Errorf(`a cursor older than the TTL got %+v`, response)
+	}
+	// Another journal, like after a restart
+	if _, _, incremental := newDeltaJournal(3, time.Hour).since(latest.cursor); incremental {
+		t.Error(`a cursor of another journal was taken`)
+	}
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pdxiv/frugalpromproxy/parser"
+	"github.com/pdxiv/frugalpromproxy/staleness"
+)
+
+// What the diff subcommand found out about one series
+type diffSeries struct {
+	Series           string `json:"series"`
+	Served           bool   `json:"served"`
+	Reason           string `json:"reason,omitempty"` // Why it was suppressed
+	UnchangedScrapes int64  `json:"unchanged_scrapes"`
+}
+
+type diffReport struct {
+	Scrapes     int          `json:"scrapes"`
+	InputBytes  int          `json:"input_bytes"`
+	OutputBytes int          `json:"output_bytes"`
+	Series      []diffSeries `json:"series"` // As of the last scrape
+}
+
+// Run the diff subcommand: feed a sequence of scrapes through the
+// staleness filter offline, and report what would have been suppressed
+func diffCommand(arguments []string) {
+	flags := flag.NewFlagSet(`diff`, flag.ExitOnError)
+	url := flags.String(`url`, ``, `Upstream to scrape, e.g. http://localhost:9100/metrics`)
+	directory := flags.String(`dir`, ``, `Directory with recorded responses to use instead of scraping, as written by -record-directory`)
+	scrapes := flags.Int(`scrapes`, 10, `Number of scrapes (or recordings) to run through the filter`)
+	interval := flags.Duration(`interval`, 15*time.Second, `Time between scrapes of -url`)
+	format := flags.String(`format`, `table`, `Output format: table or json`)
+	flags.Parse(arguments)
+
+	var bodies []func() (string, error)
+	switch {
+	case *directory != ``:
+		files, err := filepath.Glob(filepath.Join(*directory, `*.prom`))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		sort.Strings(files)
+		for _, file := range files {
+			file := file
+			bodies = append(bodies, func() (string, error) {
+				body, err := ioutil.ReadFile(file)
+				return string(body), err
+			})
+		}
+	case *url != ``:
+		for i := 0; i < *scrapes; i++ {
+			first := i == 0
+			bodies = append(bodies, func() (string, error) {
+				if !first {
+					<-clock.After(*interval)
+				}
+				return fetchBody(*url)
+			})
+		}
+	default:
+		fmt.Println(`diff needs -url or -dir`)
+		os.Exit(2)
+	}
+	if len(bodies) > *scrapes {
+		bodies = bodies[:*scrapes]
+	}
+
+	report, err := runDiff(bodies)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *format == `json` {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent(``, `  `)
+		encoder.Encode(report)
+		return
+	}
+	report.printTable()
+}
+
+func fetchBody(url string) (string, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return ``, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+// Process the bodies in order with a target of its own, that is never
+// served or registered
+func runDiff(bodies []func() (string, error)) (*diffReport, error) {
+	settings := commandLineSettings()
+	scrapeTarget := &ScrapeTarget{name: `diff`, settings: settings, defaults: settings.staleness}
+	scrapeTarget.staleness = staleness.New(`diff`, settings.stalenessRules, scrapeTarget.defaults, nil)
+	report := &diffReport{}
+	var body string
+	result := &ScrapeResult{}
+	for _, next := range bodies {
+		var err error
+		if body, err = next(); err != nil {
+			return nil, err
+		}
+		if result, err = scrapeTarget.process(body, ``); err != nil {
+			return nil, err
+		}
+		report.Scrapes++
+		report.InputBytes += len(body)
+		report.OutputBytes += renderedSize(result.families)
+	}
+
+	served := make(map[string]bool)
+	for _, family := range result.families {
+		for _, line := range family.lines {
+			served[seriesID(line)] = true
+		}
+	}
+
+	// Classify every series of the last scrape
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		name, labels, _, ok := parser.ParseSeries(scanner.Text())
+		if !ok {
+			continue
+		}
+		key := name
+		if labels != `` {
+			key += `{` + labels + `}`
+		}
+		series := diffSeries{Series: key, Served: served[key]}
+		_, policyName := scrapeTarget.staleness.Policy(name)
+		unchanged, threshold, isUnchanged := scrapeTarget.staleness.Unchanged(SeriesKey{Name: name, Labels: labels})
+		series.UnchangedScrapes = unchanged
+		switch {
+		case series.Served:
+		case isUnchanged && unchanged > threshold:
+			series.Reason = fmt.Sprintf(`unchanged for more than %d scrapes`, threshold)
+		default:
+			series.Reason = `suppressed by the ` + policyName + ` policy`
+		}
+		report.Series = append(report.Series, series)
+	}
+	return report, nil
+}
+
+func (report *diffReport) printTable() {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "SERIES\tSTATUS\tUNCHANGED\tREASON")
+	for _, series := range report.Series {
+		status := `served`
+		if !series.Served {
+			status = `suppressed`
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%s\n", series.Series, status, series.UnchangedScrapes, series.Reason)
+	}
+	writer.Flush()
+
+	saved := 0.0
+	if report.InputBytes > 0 {
+		saved = 100 * (1 - float64(report.OutputBytes)/float64(report.InputBytes))
+	}
+	fmt.Printf("\n%d scrapes, %d bytes in, %d bytes out, %.1f%% saved\n", report.Scrapes, report.InputBytes, report.OutputBytes, saved)
+}
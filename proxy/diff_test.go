@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/pdxiv/frugalpromproxy/staleness"
+)
+
+func useStaleness(t *testing.T, threshold int64, start bool, rules ...string) {
+	previousThreshold, previousStart, previousRules := staleThreshold, startStale, stalenessPolicyRules
+	t.Cleanup(func() {
+		staleThreshold, startStale, stalenessPolicyRules = previousThreshold, previousStart, previousRules
+	})
+	staleThreshold, startStale, stalenessPolicyRules = threshold, start, staleness.Rules{}
+	for _, rule := range rules {
+		if err := stalenessPolicyRules.Set(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func diffBodies(bodies ...string) []func() (string, error) {
+	var next []func() (string, error)
+	for _, body := range bodies {
+		body := body
+		next = append(next, func() (string, error) { return body, nil })
+	}
+	return next
+}
+
+func TestDiffSortsSeriesIntoServedAndSuppressed(t *testing.T) {
+	useStaleness(t, 1, false, `kept_*=never`)
+	report, err := runDiff(diffBodies(
+		"idle 1\nidle{disk=\"a\"} 2\nkept_up 1\nbusy 1\n",
+		"idle 1\nidle{disk=\"a\"} 2\nkept_up 1\nbusy 2\n",
+		"idle 1\nidle{disk=\"a\"} 2\nkept_up 1\nbusy 3\n",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Scrapes != 3 || report.InputBytes != 123 || report.OutputBytes == 0 {
+		t.Errorf(`%d scrapes, %d bytes in and %d out`, report.Scrapes, report.InputBytes, report.OutputBytes)
+	}
+
+	bySeries := make(map[string]diffSeries)
+	for _, series := range report.Series {
+		bySeries[series.Series] = series
+	}
+	for _, name := range []string{`idle`, `idle{disk="a"}`} {
+		if series := bySeries[name]; series.Served || series.Reason != `unchanged for more than 1 scrapes` || series.UnchangedScrapes != 2 {
+			t.Errorf(`%s: %+v`, name, series)
+		}
+	}
+	for _, name := range []string{`kept_up`, `busy`} {
+		if series := bySeries[name]; !series.Served || series.Reason != `` {
+			t.Errorf(`%s: %+v`, name, series)
+		}
+	}
+
+	encoded, err := json.Marshal(report)
+	if err != nil || !strings.Contains(string(encoded), `{"series":"idle","served":false,"reason":"unchanged for more than 1 scrapes","unchanged_scrapes":2}`) {
+		t.Errorf(`JSON report %s: %v`, encoded, err)
+	}
+}
+
+func TestDiffCountsNewSeriesAsUnchangedWhenStartingStale(t *testing.T) {
+	useStaleness(t, 5, true)
+	report, err := runDiff(diffBodies("new_series 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if series := report.Series[0]; series.Served || series.Reason != `unchanged for more than 5 scrapes` {
+		t.Errorf(`a series starting out stale: %+v`, series)
+	}
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// A target found by service discovery
+type discoveredTarget struct {
+	url    string
+	meta   map[string]string // Available to the listen path template
+	labels map[string]string // Added to every series of the target
+}
+
+// Serves the targets found by the discovery sources on one listener, each
+// under a path rendered from the source's template. Targets that disappear
+// are kept for a grace period, so a pod or container that comes back soon
+// doesn't lose its staleness state.
+type discoveryRouter struct {
+	grace time.Duration
+
+	mu      sync.RWMutex
+	routes  map[string]*discoveryRoute // By listen path
+	retired map[string]*discoveryRoute // By upstream URL
+}
+
+type discoveryRoute struct {
+	source       string
+	path         string
+	url          string
+	scrapeTarget *ScrapeTarget
+	handler      http.HandlerFunc
+	retiredAt    time.Time
+}
+
+func newDiscoveryRouter(grace time.Duration) *discoveryRouter {
+	return &discoveryRouter{
+		grace:   grace,
+		routes:  make(map[string]*discoveryRoute),
+		retired: make(map[string]*discoveryRoute),
+	}
+}
+
+func (router *discoveryRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	router.mu.RLock()
+	route, ok := router.routes[r.URL.Path]
+	router.mu.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	route.handler(w, r)
+}
+
+// Render the listen path of a discovered target
+func discoveryPath(pathTemplate *template.Template, target discoveredTarget) (string, error) {
+	var path bytes.Buffer
+	if err := pathTemplate.Execute(&path, target.meta); err != nil {
+		return ``, err
+	}
+	return `/` + strings.TrimLeft(path.String(), `/`), nil
+}
+
+// Replace the targets of one discovery source with the ones it currently sees
+func (router *discoveryRouter) update(source string, pathTemplate *template.Template, discovered []discoveredTarget) {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for _, target := range discovered {
+		path, err := discoveryPath(pathTemplate, target)
+		if err != nil {
+			log.Printf("%s: no listen path for %s: %v", source, target.url, err)
+			continue
+		}
+		if existing, ok := router.routes[path]; ok {
+			if existing.source != source {
+				log.Printf("%s: listen path %s for %s is already used by %s", source, path, target.url, existing.source)
+				continue
+			}
+			if existing.url == target.url {
+				existing.scrapeTarget.setStaticLabels(target.labels)
+				seen[path] = true
+				continue
+			}
+			router.retire(existing)
+		}
+		seen[path] = true
+
+		route, ok := router.retired[target.url]
+		if ok {
+			delete(router.retired, target.url)
+			route.path = path
+			log.Printf("%s: %s is back at %s", source, target.url, path)
+		} else {
+			scrapeTarget := newScrapeTarget(source+`:`+strings.TrimLeft(path, `/`), []string{target.url}, commandLine)
+			route = &discoveryRoute{
+				source:       source,
+				path:         path,
+				url:          target.url,
+				scrapeTarget: scrapeTarget,
+				handler:      scrapeTarget.handler,
+			}
+			log.Printf("%s: serving %s at %s", source, target.url, path)
+		}
+		route.scrapeTarget.setStaticLabels(target.labels)
+		router.routes[path] = route
+	}
+
+	for path, route := range router.routes {
+		if route.source == source && !seen[path] {
+			router.retire(route)
+		}
+	}
+	router.sweep()
+}
+
+// Must be called with the lock held
+func (router *discoveryRouter) retire(route *discoveryRoute) {
+	log.Printf("%s: %s at %s went away", route.source, route.url, route.path)
+	delete(router.routes, route.path)
+	route.retiredAt = clock.Now()
+	if previous, ok := router.retired[route.url]; ok {
+		previous.scrapeTarget.close()
+	}
+	router.retired[route.url] = route
+	go func() {
+		<-clock.After(router.grace)
+		router.mu.Lock()
+		router.sweep()
+		router.mu.Unlock()
+	}()
+}
+
+// Drop targets that have been gone for longer than the grace period. Must be
+// called with the lock held.
+func (router *discoveryRouter) sweep() {
+	for url, route := range router.retired {
+		if since(route.retiredAt) >= router.grace {
+			route.scrapeTarget.close()
+			delete(router.retired, url)
+		}
+	}
+}
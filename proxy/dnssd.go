@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Finds exporters published as DNS SRV records, looking the names up again
+// on every refresh. A failed lookup keeps the targets of the previous one.
+type dnsDiscovery struct {
+	names        []string
+	refresh      time.Duration
+	lookupSRV    func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	pathTemplate *template.Template
+	router       *discoveryRouter
+}
+
+func (discovery *dnsDiscovery) run() {
+	for {
+		for _, name := range discovery.names {
+			discovery.resolve(name)
+		}
+		<-clock.After(discovery.refresh)
+	}
+}
+
+func (discovery *dnsDiscovery) resolve(name string) {
+	source := `dns_sd/` + name
+	ctx, cancel := context.WithTimeout(context.Background(), discovery.refresh)
+	defer cancel()
+
+	_, records, err := discovery.lookupSRV(ctx, ``, ``, name)
+	if err != nil {
+		log.Printf("%s: %v, keeping the last known targets", source, err)
+		return
+	}
+
+	discovered := make([]discoveredTarget, 0, len(records))
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target, `.`)
+		port := strconv.Itoa(int(record.Port))
+		discovered = append(discovered, discoveredTarget{
+			url: `http://` + net.JoinHostPort(host, port) + basePath,
+			meta: map[string]string{
+				`name`: name,
+				`host`: host,
+				`port`: port,
+			},
+			labels: map[string]string{`srv_name`: name},
+		})
+	}
+	discovery.router.update(source, discovery.pathTemplate, discovered)
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// A resolver answering SRV lookups with records that can be changed
+type fakeSRV struct {
+	mu      sync.Mutex
+	records map[string][]*net.SRV
+	err     error
+}
+
+func (resolver *fakeSRV) lookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	resolver.mu.Lock()
+	defer resolver.mu.Unlock()
+	if resolver.err != nil {
+		return ``, nil, resolver.err
+	}
+	return name, resolver.records[name], nil
+}
+
+func (resolver *fakeSRV) set(name string, err error, records ...*net.SRV) {
+	resolver.mu.Lock()
+	defer resolver.mu.Unlock()
+	resolver.records[name], resolver.err = records, err
+}
+
+func newTestDNSDiscovery(resolver *fakeSRV) (*dnsDiscovery, *discoveryRouter) {
+	router := newDiscoveryRouter(time.Hour)
+	return &dnsDiscovery{
+		names:        []string{`_metrics._tcp.site.example`},
+		refresh:      time.Minute,
+		lookupSRV:    resolver.lookupSRV,
+		pathTemplate: template.Must(template.New(`path`).Parse(`/{{.host}}/{{.port}}/metrics`)),
+		router:       router,
+	}, router
+}
+
+func TestDNSDiscoveryFollowsTheRecords(t *testing.T) {
+	useCommandLineSettings(t)
+	const name = `_metrics._tcp.site.example`
+	resolver := &fakeSRV{records: make(map[string][]*net.SRV)}
+	resolver.set(name, nil, &net.SRV{Target: `a.site.example.`, Port: 9100})
+	discovery, router := newTestDNSDiscovery(resolver)
+
+	discovery.resolve(name)
+	waitForRoutes(t, router, `/a.site.example/9100/metrics=http://a.site.example:9100/metrics`)
+	router.mu.RLock()
+	kept := router.routes[`/a.site.example/9100/metrics`].scrapeTarget
+	router.mu.RUnlock()
+	if labels := kept.currentStaticLabels(); !strings.Contains(labels, `srv_name="`+name+`"`) {
+		t.Errorf(`static labels %s`, labels)
+	}
+
+	resolver.set(name, nil, &net.SRV{Target: `a.site.example.`, Port: 9100}, &net.SRV{Target: `b.site.example.`, Port: 9100})
+	discovery.resolve(name)
+	waitForRoutes(t, router, `/a.site.example/9100/metrics=http://a.site.example:9100/metrics`, `/b.site.example/9100/metrics=http://b.site.example:9100/metrics`)
+	router.mu.RLock()
+	same := router.routes[`/a.site.example/9100/metrics`].scrapeTarget == kept
+	router.mu.RUnlock()
+	if !same {
+		t.Error(`a target in both lookups lost its state`)
+	}
+
+	resolver.set(name, errors.New(`server misbehaving`))
+	discovery.resolve(name)
+	waitForRoutes(t, router, `/a.site.example/9100/metrics=http://a.site.example:9100/metrics`, `/b.site.example/9100/metrics=http://b.site.example:9100/metrics`)
+
+	resolver.set(name, nil, &net.SRV{Target: `b.site.example.`, Port: 9100})
+	discovery.resolve(name)
+	waitForRoutes(t, router, `/b.site.example/9100/metrics=http://b.site.example:9100/metrics`)
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// How often the full container list is fetched, on top of following events
+const dockerReconcileInterval = time.Minute
+
+// Finds containers labelled for scraping through the Docker API. Container
+// events trigger an update right away, and the full list is fetched
+// periodically in case an event was missed.
+type dockerDiscovery struct {
+	client       *http.Client
+	labelPrefix  string // e.g. prometheus, for prometheus.scrape and prometheus.port
+	pathTemplate *template.Template
+	router       *discoveryRouter
+}
+
+type dockerContainer struct {
+	ID              string            `json:"Id"`
+	Names           []string          `json:"Names"`
+	Image           string            `json:"Image"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+func newDockerDiscovery(socket string, router *discoveryRouter) *dockerDiscovery {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, `unix`, socket)
+		},
+	}
+	return &dockerDiscovery{client: &http.Client{Transport: transport}, router: router}
+}
+
+// The host part doesn't matter, every request goes to the socket
+func (discovery *dockerDiscovery) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, `http://docker`+path+`?`+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := discovery.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf(`docker returned %s for %s`, resp.Status, path)
+	}
+	return resp, nil
+}
+
+func (discovery *dockerDiscovery) run() {
+	changed := make(chan struct{}, 1)
+	go discovery.followEvents(changed)
+
+	ticker := clock.NewTicker(dockerReconcileInterval)
+	defer ticker.Stop()
+	for {
+		if err := discovery.reconcile(); err != nil {
+			log.Printf("docker_sd: %v, keeping the last known targets", err)
+		}
+		select {
+		case <-changed:
+		case <-ticker.C():
+		}
+	}
+}
+
+// Signal every container start or stop, reconnecting when the stream breaks
+func (discovery *dockerDiscovery) followEvents(changed chan<- struct{}) {
+	filters, _ := json.Marshal(map[string][]string{
+		`type`:  {`container`},
+		`event`: {`start`, `die`, `stop`, `destroy`},
+	})
+	query := url.Values{}
+	query.Set(`filters`, string(filters))
+	for {
+		resp, err := discovery.get(context.Background(), `/events`, query)
+		if err != nil {
+			log.Printf("docker_sd: %v", err)
+			<-clock.After(5 * time.Second)
+			continue
+		}
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			var event map[string]interface{}
+			if err := decoder.Decode(&event); err != nil {
+				break
+			}
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+		resp.Body.Close()
+	}
+}
+
+func (discovery *dockerDiscovery) reconcile() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	filters, _ := json.Marshal(map[string][]string{
+		`label`:  {discovery.labelPrefix + `.scrape=true`},
+		`status`: {`running`},
+	})
+	query := url.Values{}
+	query.Set(`filters`, string(filters))
+	resp, err := discovery.get(ctx, `/containers/json`, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return err
+	}
+
+	var discovered []discoveredTarget
+	for _, container := range containers {
+		if target, ok := discovery.target(container); ok {
+			discovered = append(discovered, target)
+		}
+	}
+	discovery.router.update(`docker_sd`, discovery.pathTemplate, discovered)
+	return nil
+}
+
+func (discovery *dockerDiscovery) target(container dockerContainer) (discoveredTarget, bool) {
+	name := container.ID
+	if len(container.Names) > 0 {
+		name = strings.TrimPrefix(container.Names[0], `/`)
+	}
+	port, err := strconv.Atoi(container.Labels[discovery.labelPrefix+`.port`])
+	if err != nil {
+		log.Printf("docker_sd: container %s has no valid %s.port label", name, discovery.labelPrefix)
+		return discoveredTarget{}, false
+	}
+	path := container.Labels[discovery.labelPrefix+`.path`]
+	if path == `` {
+		path = basePath
+	}
+
+	// Use the first network the container is attached to, by name
+	networks := make([]string, 0, len(container.NetworkSettings.Networks))
+	for network := range container.NetworkSettings.Networks {
+		networks = append(networks, network)
+	}
+	sort.Strings(networks)
+	var address string
+	for _, network := range networks {
+		if address = container.NetworkSettings.Networks[network].IPAddress; address != `` {
+			break
+		}
+	}
+	if address == `` {
+		log.Printf("docker_sd: container %s has no IP address", name)
+		return discoveredTarget{}, false
+	}
+
+	return discoveredTarget{
+		url: `http://` + net.JoinHostPort(address, strconv.Itoa(port)) + path,
+		meta: map[string]string{
+			`name`:  name,
+			`id`:    container.ID,
+			`image`: container.Image,
+			`port`:  strconv.Itoa(port),
+		},
+		labels: map[string]string{
+			`container`: name,
+			`image`:     container.Image,
+		},
+	}, true
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// A Docker daemon on a Unix socket listing containers that can be changed,
+// and sending an event for every change
+type fakeDocker struct {
+	mu         sync.Mutex
+	containers []dockerContainer
+	filters    string
+	events     chan struct{}
+}
+
+func newFakeDocker(t *testing.T) (*fakeDocker, string) {
+	docker := &fakeDocker{events: make(chan struct{}, 10)}
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/containers/json`, func(w http.ResponseWriter, r *http.Request) {
+		docker.mu.Lock()
+		defer docker.mu.Unlock()
+		docker.filters = r.URL.Query().Get(`filters`)
+		json.NewEncoder(w).Encode(docker.containers)
+	})
+	done := make(chan struct{})
+	mux.HandleFunc(`/events`, func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-docker.events:
+				w.Write([]byte(`{"Type":"container","Action":"start"}` + "\n"))
+				w.(http.Flusher).Flush()
+			case <-done:
+				return
+			}
+		}
+	})
+	socket := filepath.Join(t.TempDir(), `docker.sock`)
+	listener, err := net.Listen(`unix`, socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	t.Cleanup(func() {
+		close(done)
+		server.Close()
+	})
+	return docker, socket
+}
+
+func (docker *fakeDocker) run(containers ...dockerContainer) {
+	docker.mu.Lock()
+	docker.containers = containers
+	docker.mu.Unlock()
+	docker.events <- struct{}{}
+}
+
+func labelledContainer(name, address, port string) dockerContainer {
+	container := dockerContainer{ID: `id-` + name, Names: []string{`/` + name}, Image: `prom/node-exporter`}
+	container.Labels = map[string]string{`prometheus.scrape`: `true`, `prometheus.port`: port}
+	container.NetworkSettings.Networks = map[string]struct {
+		IPAddress string `json:"IPAddress"`
+	}{`bridge`: {IPAddress: address}}
+	return container
+}
+
+func newTestDockerDiscovery(socket string) (*dockerDiscovery, *discoveryRouter) {
+	router := newDiscoveryRouter(time.Hour)
+	discovery := newDockerDiscovery(socket, router)
+	discovery.labelPrefix = `prometheus`
+	discovery.pathTemplate = template.Must(template.New(`path`).Parse(`/{{.name}}/metrics`))
+	return discovery, router
+}
+
+func TestDockerDiscoveryFollowsContainerEvents(t *testing.T) {
+	useCommandLineSettings(t)
+	docker, socket := newFakeDocker(t)
+	docker.containers = []dockerContainer{labelledContainer(`node`, `172.17.0.2`, `9100`)}
+	discovery, router := newTestDockerDiscovery(socket)
+	go discovery.run()
+	waitForRoutes(t, router, `/node/metrics=http://172.17.0.2:9100/metrics`)
+	docker.mu.Lock()
+	filters := docker.filters
+	docker.mu.Unlock()
+	if !strings.Contains(filters, `prometheus.scrape=true`) || !strings.Contains(filters, `running`) {
+		t.Errorf(`listed containers with filters %s`, filters)
+	}
+
+	// Without the event the next update would be a minute away
+	docker.run(labelledContainer(`node`, `172.17.0.2`, `9100`), labelledContainer(`redis`, `172.17.0.3`, `9121`))
+	waitForRoutes(t, router, `/node/metrics=http://172.17.0.2:9100/metrics`, `/redis/metrics=http://172.17.0.3:9121/metrics`)
+
+	docker.run(labelledContainer(`redis`, `172.17.0.3`, `9121`))
+	waitForRoutes(t, router, `/redis/metrics=http://172.17.0.3:9121/metrics`)
+}
+
+func TestDockerContainersNeedAPortAndAnAddress(t *testing.T) {
+	discovery := &dockerDiscovery{labelPrefix: `prometheus`}
+	if _, ok := discovery.target(labelledContainer(`node`, `172.17.0.2`, `metrics`)); ok {
+		t.Error(`a container without a numeric port label was scraped`)
+	}
+	if _, ok := discovery.target(labelledContainer(`node`, ``, `9100`)); ok {
+		t.Error(`a container without an IP address was scraped`)
+	}
+
+	container := labelledContainer(`node`, ``, `9100`)
+	container.Labels[`prometheus.path`] = `/federate`
+	container.NetworkSettings.Networks[`backend`] = struct {
+		IPAddress string `json:"IPAddress"`
+	}{IPAddress: `10.5.0.2`}
+	target, ok := discovery.target(container)
+	if !ok || target.url != `http://10.5.0.2:9100/federate` {
+		t.Errorf(`target %v %v, expected the address on the backend network and the path label`, target.url, ok)
+	}
+	if target.labels[`container`] != `node` || target.labels[`image`] != `prom/node-exporter` {
+		t.Errorf(`labels %v`, target.labels)
+	}
+}
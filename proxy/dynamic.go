@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Path on every listener scraping the upstream given in ?target=, when enabled
+const dynamicPath = `/proxy`
+
+// Comma separated, repeatable command line flag holding the CIDR ranges and
+// hostname patterns (like *.internal.example) dynamic targets may point at
+type targetAllowlist struct {
+	networks cidrList
+	patterns []string
+}
+
+func (allowlist *targetAllowlist) String() string {
+	elements := append(strings.Split(allowlist.networks.String(), `,`), allowlist.patterns...)
+	return strings.Trim(strings.Join(elements, `,`), `,`)
+}
+
+func (allowlist *targetAllowlist) Set(value string) error {
+	for _, element := range strings.Split(value, `,`) {
+		element = strings.ToLower(strings.TrimSpace(element))
+		if element == `` {
+			continue
+		}
+		if allowlist.networks.Set(element) == nil {
+			continue
+		}
+		if _, err := path.Match(element, ``); err != nil {
+			return fmt.Errorf(`%s is neither a CIDR range nor a hostname pattern`, element)
+		}
+		allowlist.patterns = append(allowlist.patterns, element)
+	}
+	return nil
+}
+
+func (allowlist *targetAllowlist) allows(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return allowlist.networks.contains(ip)
+	}
+	for _, pattern := range allowlist.patterns {
+		if matched, _ := path.Match(pattern, host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Targets scraped on request, blackbox exporter style. The state of the
+// most recently used ones is kept, the least recently used is dropped
+// when there are too many.
+type dynamicTargets struct {
+	allowlist *targetAllowlist
+	max       int
+	mu        sync.Mutex
+	byTarget  map[string]*list.Element
+	recent    *list.List // Most recently used first, holding *ScrapeTarget
+}
+
+func newDynamicTargets(allowlist *targetAllowlist, max int) *dynamicTargets {
+	return &dynamicTargets{allowlist: allowlist, max: max, byTarget: make(map[string]*list.Element), recent: list.New()}
+}
+
+// Turn the target parameter into host:port with a lower case host, so the
+// same upstream written differently shares its state
+func normalizeTarget(target string) (string, string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return ``, ``, err
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, `.`))
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	if host == `` || port == `` {
+		return ``, ``, fmt.Errorf(`target %q needs a host and a port`, target)
+	}
+	return net.JoinHostPort(host, port), host, nil
+}
+
+// The state for a target, created when it isn't known (anymore)
+func (dynamic *dynamicTargets) get(target string) *ScrapeTarget {
+	dynamic.mu.Lock()
+	defer dynamic.mu.Unlock()
+	if element, ok := dynamic.byTarget[target]; ok {
+		dynamic.recent.MoveToFront(element)
+		return element.Value.(*ScrapeTarget)
+	}
+
+	scrapeTarget := newScrapeTarget(`dynamic:`+target, []string{`http://` + target + basePath}, commandLine)
+	dynamic.byTarget[target] = dynamic.recent.PushFront(scrapeTarget)
+	for dynamic.recent.Len() > dynamic.max {
+		oldest := dynamic.recent.Back()
+		dynamic.recent.Remove(oldest)
+		evicted := oldest.Value.(*ScrapeTarget)
+		delete(dynamic.byTarget, strings.TrimPrefix(evicted.name, `dynamic:`))
+		evicted.close()
+	}
+	return scrapeTarget
+}
+
+func (dynamic *dynamicTargets) handler(w http.ResponseWriter, r *http.Request) {
+	target, host, err := normalizeTarget(r.URL.Query().Get(`target`))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !dynamic.allowlist.allows(host) {
+		http.Error(w, `target `+target+` is not allowed`, http.StatusForbidden)
+		return
+	}
+	scrapeTarget := dynamic.get(target)
+	scrapeTarget.handler(w, r)
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestDynamicTargets(t *testing.T, allowed string, max int) *dynamicTargets {
+	allowlist := &targetAllowlist{}
+	if err := allowlist.Set(allowed); err != nil {
+		t.Fatal(err)
+	}
+	dynamic := newDynamicTargets(allowlist, max)
+	t.Cleanup(func() {
+		for element := dynamic.recent.Front(); element != nil; element = element.Next() {
+			element.Value.(*ScrapeTarget).close()
+		}
+	})
+	return dynamic
+}
+
+func scrapeDynamic(dynamic *dynamicTargets, target string) (int, string) {
+	recorder := httptest.NewRecorder()
+	dynamic.handler(recorder, httptest.NewRequest(http.MethodGet, dynamicPath+`?target=`+target, nil))
+	return recorder.Code, recorder.Body.String()
+}
+
+func TestDynamicTargetsMustBeAllowed(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.StartStale = false
+	_, upstream := newFakeExporter(t, "node_load1 0.5\n")
+	address := strings.TrimPrefix(upstream, `http://`)
+	dynamic := newTestDynamicTargets(t, `127.0.0.0/8,*.internal.example`, 10)
+
+	if code, body := scrapeDynamic(dynamic, address); code != http.StatusOK || !strings.Contains(body, `node_load1 0.5`) {
+		t.Errorf(`an allowed target answered %d %s`, code, body)
+	}
+	for target, expected := range map[string]int{
+		`10.0.0.5:9100`:                http.StatusForbidden,
+		`metadata.google.internal:80`:  http.StatusForbidden,
+		`node.internal.example.:99999`: http.StatusBadGateway,
+		`10.0.0.5`:                     http.StatusBadRequest,
+		`:9100`:                        http.StatusBadRequest,
+	} {
+		if code, _ := scrapeDynamic(dynamic, target); code != expected {
+			t.Errorf(`target %s answered %d, expected %d`, target, code, expected)
+		}
+	}
+}
+
+func TestDynamicTargetsKeepTheirState(t *testing.T) {
+	useCommandLineSettings(t)
+	dynamic := newTestDynamicTargets(t, `10.0.0.0/8,*.internal.example`, 10)
+	first := dynamic.get(mustNormalizeTarget(t, `Node.Internal.Example.:9100`))
+	if again := dynamic.get(mustNormalizeTarget(t, `node.internal.example:9100`)); again != first {
+		t.Error(`the same target written differently got another state`)
+	}
+	if other := dynamic.get(mustNormalizeTarget(t, `node.internal.example:9101`)); other == first {
+		t.Error(`another port shared the state`)
+	}
+}
+
+func TestLeastRecentlyUsedDynamicTargetsAreDropped(t *testing.T) {
+	useCommandLineSettings(t)
+	dynamic := newTestDynamicTargets(t, `10.0.0.0/8`, 2)
+	a := dynamic.get(`10.0.0.1:9100`)
+	dynamic.get(`10.0.0.2:9100`)
+	dynamic.get(`10.0.0.1:9100`)
+	dynamic.get(`10.0.0.3:9100`)
+
+	if dynamic.recent.Len() != 2 {
+		t.Fatalf(`kept %d targets, expected 2`, dynamic.recent.Len())
+	}
+	if _, ok := dynamic.byTarget[`10.0.0.2:9100`]; ok {
+		t.Error(`the least recently used target was kept`)
+	}
+	if dynamic.get(`10.0.0.1:9100`) != a {
+		t.Error(`a recently used target lost its state`)
+	}
+}
+
+func mustNormalizeTarget(t *testing.T, target string) string {
+	t.Helper()
+	normalized, _, err := normalizeTarget(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return normalized
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+var scrapeErrors = selfMetrics.newCounterVec(`frugalpromproxy_scrape_errors_total`, `Scrapes that failed, by reason: unreachable, status, body_too_large, not_exposition, parse, sample_limit, no_fetch_slot, timeout or other. Failed background scrapes are counted once, not for every request answered with their error.`, `target`, `reason`)
+
+var (
+	// ErrUpstreamUnreachable is wrapped by the errors of upstreams that
+	// couldn't be connected to, or broke off their answer
+	ErrUpstreamUnreachable = errors.New(`upstream unreachable`)
+	// ErrBodyTooLarge is returned for upstream bodies above -max-body-bytes
+	ErrBodyTooLarge = errors.New(`upstream body too large`)
+	// ErrNoFetchSlot is returned when a scrape gave up waiting for a free
+	// upstream fetch slot
+	ErrNoFetchSlot = errors.New(`gave up waiting for a free upstream fetch slot`)
+	// ErrScrapeTimedOut is returned when the scraper's timeout ran out
+	ErrScrapeTimedOut = errors.New(`upstream fetch timed out`)
+	// ErrNotScrapedYet is returned for a target scraped in the background
+	// until its first scrape finished
+	ErrNotScrapedYet = errors.New(`no background scrape has finished yet`)
+)
+
+// ErrUpstreamStatus is returned when the upstream answered with a status
+// other than 200
+type ErrUpstreamStatus struct {
+	Code int
+	URL  string // Of the upstream that answered
+}
+
+func (err *ErrUpstreamStatus) Error() string {
+	return fmt.Sprintf(`upstream %s returned %d %s`, err.URL, err.Code, http.StatusText(err.Code))
+}
+
+// ErrNotExposition is returned when the upstream answered with a content
+// type and a body that don't look like metrics, like an HTML page
+type ErrNotExposition struct {
+	ContentType string
+	Samples     int // Series parsed from the body
+}
+
+func (err *ErrNotExposition) Error() string {
+	return fmt.Sprintf(`upstream returned %s, %d samples parsed`, err.ContentType, err.Samples)
+}
+
+// ErrParse is returned by a fail-closed target when too many lines of the
+// upstream body couldn't be parsed
+type ErrParse struct {
+	Line      int // Number of the first line that couldn't be parsed
+	Unparsed  int
+	Lines     int
+	Threshold float64
+}
+
+func (err *ErrParse) Error() string {
+	return fmt.Sprintf(`%d of %d upstream lines could not be parsed, more than the allowed fraction of %g, the first on line %d`, err.Unparsed, err.Lines, err.Threshold, err.Line)
+}
+
+// Upper limit for an upstream body, 0 means none
+var maxBodyBytes int64
+
+// Read the body of an upstream, up to maxBodyBytes
+func readBody(body io.Reader, upstream string) ([]byte, error) {
+	if maxBodyBytes > 0 {
+		body = io.LimitReader(body, maxBodyBytes+1)
+	}
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf(`%w: reading %s: %v`, ErrUpstreamUnreachable, upstream, err)
+	}
+	if maxBodyBytes > 0 && int64(len(content)) > maxBodyBytes {
+		return nil, fmt.Errorf(`%w: %s sent more than %d bytes`, ErrBodyTooLarge, upstream, maxBodyBytes)
+	}
+	return content, nil
+}
+
+// The HTTP status to answer a failed scrape with, and the reason label of
+// its self-metric. Every scrape error is mapped here.
+func errorStatus(err error) (int, string) {
+	var status *ErrUpstreamStatus
+	var notExposition *ErrNotExposition
+	var parse *ErrParse
+	var samples *ErrSampleLimit
+	switch {
+	case errors.Is(err, ErrNoFetchSlot):
+		return http.StatusServiceUnavailable, `no_fetch_slot`
+	case errors.Is(err, ErrNotScrapedYet):
+		return http.StatusServiceUnavailable, `not_scraped_yet`
+	case errors.Is(err, ErrScrapeTimedOut):
+		return http.StatusGatewayTimeout, `timeout`
+	case errors.Is(err, ErrUpstreamUnreachable):
+		return http.StatusBadGateway, `unreachable`
+	case errors.As(err, &status):
+		return http.StatusBadGateway, `status`
+	case errors.Is(err, ErrBodyTooLarge):
+		return http.StatusBadGateway, `body_too_large`
+	case errors.As(err, &notExposition):
+		return http.StatusBadGateway, `not_exposition`
+	case errors.As(err, &parse):
+		return http.StatusBadGateway, `parse`
+	case errors.As(err, &samples):
+		return http.StatusBadGateway, `sample_limit`
+	}
+	return http.StatusInternalServerError, `other`
+}
+
+// Count a failed scrape, returning the status to answer it with
+func (scrapeTarget *ScrapeTarget) countError(err error) int {
+	code, reason := errorStatus(err)
+	if !isBackgroundScrapeError(err) {
+		scrapeErrors.inc(scrapeTarget.name, reason)
+	}
+	return code
+}
+
+// Count a failed scrape and answer it
+func (scrapeTarget *ScrapeTarget) scrapeFailed(w http.ResponseWriter, err error) {
+	code := scrapeTarget.countError(err)
+	if !isBackgroundScrapeError(err) {
+		log.Printf("%s: scrape failed: %v", scrapeTarget.name, err)
+	}
+	http.Error(w, err.Error(), code)
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEveryScrapeErrorHasAStatusAndAReason(t *testing.T) {
+	for _, test := range []struct {
+		err    error
+		code   int
+		reason string
+	}{
+		{fmt.Errorf(`node: %w`, ErrNoFetchSlot), http.StatusServiceUnavailable, `no_fetch_slot`},
+		{&backgroundScrapeError{err: fmt.Errorf(`node: %w`, ErrNotScrapedYet)}, http.StatusServiceUnavailable, `not_scraped_yet`},
+		{fmt.Errorf(`node: %w after 10s`, ErrScrapeTimedOut), http.StatusGatewayTimeout, `timeout`},
+		{fmt.Errorf(`%w: connection refused`, ErrUpstreamUnreachable), http.StatusBadGateway, `unreachable`},
+		{fmt.Errorf(`node: %w`, &ErrUpstreamStatus{Code: http.StatusNotFound}), http.StatusBadGateway, `status`},
+		{fmt.Errorf(`%w: more than 10 bytes`, ErrBodyTooLarge), http.StatusBadGateway, `body_too_large`},
+		{&ErrNotExposition{ContentType: `text/html`}, http.StatusBadGateway, `not_exposition`},
+		{fmt.Errorf(`node: %w`, &ErrParse{Line: 3, Unparsed: 5, Lines: 10}), http.StatusBadGateway, `parse`},
+		{&ErrSampleLimit{Samples: 20, Limit: 10}, http.StatusBadGateway, `sample_limit`},
+		{errors.New(`something else`), http.StatusInternalServerError, `other`},
+	} {
+		if code, reason := errorStatus(test.err); code != test.code || reason != test.reason {
+			t.Errorf(`%v: %d %s, expected %d %s`, test.err, code, reason, test.code, test.reason)
+		}
+	}
+}
+
+func TestScrapeErrorsCanBeTold(t *testing.T) {
+	useCommandLineSettings(t)
+	exporter, upstream := newFakeExporter(t, "up 1\n")
+	scrapeTarget := newScrapeTarget(`node`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+
+	exporter.fail(http.StatusNotFound)
+	_, err := scrapeTarget.Scrape(context.Background())
+	var status *ErrUpstreamStatus
+	if !errors.As(err, &status) || status.Code != http.StatusNotFound || status.URL != upstream {
+		t.Errorf(`an upstream answering 404 failed the scrape with %v`, err)
+	}
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	unreachable := newScrapeTarget(`gone`, []string{closed.URL}, commandLine)
+	t.Cleanup(unreachable.close)
+	if _, err := unreachable.Scrape(context.Background()); !errors.Is(err, ErrUpstreamUnreachable) {
+		t.Errorf(`an upstream that isn't listening failed the scrape with %v`, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := unreachable.Scrape(ctx); !errors.Is(err, ErrScrapeTimedOut) && !errors.Is(err, ErrNoFetchSlot) {
+		t.Errorf(`a scrape given up on failed with %v`, err)
+	}
+}
+
+func TestBodiesAboveTheLimitAreRefused(t *testing.T) {
+	previous := maxBodyBytes
+	maxBodyBytes = 10
+	t.Cleanup(func() { maxBodyBytes = previous })
+
+	if body, err := readBody(strings.NewReader(`0123456789`), `http://localhost:9100/metrics`); err != nil || string(body) != `0123456789` {
+		t.Errorf(`a body at the limit read %q, %v`, body, err)
+	}
+	if _, err := readBody(strings.NewReader(`0123456789a`), `http://localhost:9100/metrics`); !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf(`a body above the limit read with %v`, err)
+	}
+}
+
+func TestFailedScrapesAreAnsweredAndCountedByReason(t *testing.T) {
+	useCommandLineSettings(t)
+	exporter, upstream := newFakeExporter(t, "up 1\n")
+	scrapeTarget := newScrapeTarget(`node`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+
+	exporter.fail(http.StatusInternalServerError)
+	failed := selfMetricValue(scrapeErrors.selfMetric, `node`, `status`)
+	response := httptest.NewRecorder()
+	scrapeTarget.handler(response, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+	if response.Code != http.StatusBadGateway {
+		t.Errorf(`answered %d`, response.Code)
+	}
+	if selfMetricValue(scrapeErrors.selfMetric, `node`, `status`) != failed+1 {
+		t.Error(`the failed scrape wasn't counted`)
+	}
+
+	// A background scrape counted its error once already
+	notYet := selfMetricValue(scrapeErrors.selfMetric, `node`, `not_scraped_yet`)
+	if code := scrapeTarget.countError(&backgroundScrapeError{err: ErrNotScrapedYet}); code != http.StatusServiceUnavailable {
+		t.Errorf(`answered %d`, code)
+	}
+	if selfMetricValue(scrapeErrors.selfMetric, `node`, `not_scraped_yet`) != notYet {
+		t.Error(`the error of a background scrape was counted again`)
+	}
+}
+
+// An upstream restarting fails the scrapes while it is down, naming it, and
+// the next scrape after it is back succeeds
+func TestAnUpstreamGoingDownFailsOnlyItsScrapes(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.StartStale = false
+	listener, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	exporter := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "up 1\n")
+	})}
+	go exporter.Serve(listener)
+	scrapeTarget := newScrapeTarget(`node`, []string{`http://` + address + `/metrics`}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+	_, other := newFakeExporter(t, "node_load1 0.5\n")
+	otherTarget := newScrapeTarget(`other`, []string{other}, commandLine)
+	t.Cleanup(otherTarget.close)
+
+	if code, served := servedSeries(scrapeTarget); code != http.StatusOK || served != `up 1` {
+		t.Fatalf(`before the upstream went down %d %s`, code, served)
+	}
+	exporter.Close()
+	response := httptest.NewRecorder()
+	scrapeTarget.handler(response, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+	if response.Code != http.StatusBadGateway || !strings.Contains(response.Body.String(), address) {
+		t.Errorf(`with the upstream down answered %d %s`, response.Code, response.Body)
+	}
+	if code, _ := servedSeries(otherTarget); code != http.StatusOK {
+		t.Errorf(`another target answered %d`, code)
+	}
+
+	if listener, err = net.Listen(`tcp`, address); err != nil {
+		t.Skipf(`the upstream can't listen on %s again: %v`, address, err)
+	}
+	restarted := &http.Server{Handler: exporter.Handler}
+	go restarted.Serve(listener)
+	t.Cleanup(func() { restarted.Close() })
+	if code, served := servedSeries(scrapeTarget); code != http.StatusOK || served != `up 1` {
+		t.Errorf(`after the upstream came back %d %s`, code, served)
+	}
+}
+
+func TestUpstreamAnswersThatFailAreAnsweredWith502(t *testing.T) {
+	useCommandLineSettings(t)
+	for _, upstream := range []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{`status`, func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, `restarting`, http.StatusServiceUnavailable)
+		}},
+		{`cut off`, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(`Content-Length`, `1000`)
+			io.WriteString(w, "up 1\n")
+			w.(http.Flusher).Flush()
+			connection, _, _ := w.(http.Hijacker).Hijack()
+			connection.Close()
+		}},
+	} {
+		server := httptest.NewServer(upstream.handler)
+		scrapeTarget := newScrapeTarget(`node`, []string{server.URL}, commandLine)
+		response := httptest.NewRecorder()
+		scrapeTarget.handler(response, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+		if response.Code != http.StatusBadGateway || !strings.Contains(response.Body.String(), server.Listener.Addr().String()) {
+			t.Errorf(`an upstream answer %s was answered %d %s`, upstream.name, response.Code, response.Body)
+		}
+		scrapeTarget.close()
+		server.Close()
+	}
+}
@@ -0,0 +1,51 @@
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	"github.com/pdxiv/frugalpromproxy/proxy"
+)
+
+// Serve the filtered metrics of an exporter from the mux of an existing
+// program, under a path of its own
+func ExampleProxy_Handler() {
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "# HELP node_load1 1m load average.\n# TYPE node_load1 gauge\nnode_load1 0.5\n")
+	}))
+	defer exporter.Close()
+
+	p, err := proxy.New(proxy.Config{StartLive: true},
+		proxy.WithTarget(proxy.Target{Name: `node`, Upstreams: []string{exporter.URL + `/metrics`}}),
+		proxy.WithStaleThreshold(120),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx)
+
+	mux := http.NewServeMux()
+	mux.Handle(`/node/metrics`, p.Handler(`node`))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + `/node/metrics`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	fmt.Println(resp.Status)
+	io.Copy(os.Stdout, resp.Body)
+	// Output:
+	// 200 OK
+	// # HELP node_load1 1m load average.
+	// # TYPE node_load1 gauge
+	// node_load1 0.5
+}
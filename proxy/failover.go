@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How many probes in a row an upstream before the active one has to answer
+// before the target switches back to it
+const failbackThreshold = 3
+
+// While failed over, the upstreams before the active one are probed out of
+// band at most this often, with a HEAD request of their own timeout
+const (
+	failbackProbeInterval = 10 * time.Second
+	failbackProbeTimeout  = 2 * time.Second
+)
+
+// Which of a target's upstreams is scraped. The first upstream is the
+// primary, the others are only used while the ones before them fail.
+type upstreamSelector struct {
+	mu        sync.Mutex
+	urls      []string
+	active    int
+	successes []int // Consecutive successful probes of every upstream
+	probing   bool
+	lastProbe time.Time
+}
+
+func newUpstreamSelector(urls []string) *upstreamSelector {
+	return &upstreamSelector{urls: urls, successes: make([]int, len(urls))}
+}
+
+func (selector *upstreamSelector) activeURL() string {
+	selector.mu.Lock()
+	defer selector.mu.Unlock()
+	return selector.urls[selector.active]
+}
+
+// Fetch from the active upstream. When it fails the others are tried in
+// the order of the list, and the first one answering becomes the active
+// one. Scrapes never wait for the upstreams before the active one, those
+// are probed in the background.
+func (scrapeTarget *ScrapeTarget) fetch(ctx context.Context, request upstreamRequest) (*http.Response, error) {
+	selector := scrapeTarget.upstreams
+	selector.mu.Lock()
+	active := selector.active
+	selector.mu.Unlock()
+	if active > 0 {
+		scrapeTarget.probePreferredUpstreams()
+	}
+
+	order := []int{active}
+	for i := range selector.urls {
+		if i != active {
+			order = append(order, i)
+		}
+	}
+	var lastErr error
+	for _, i := range order {
+		resp, err := scrapeTarget.get(ctx, selector.urls[i], request)
+		if err != nil {
+			log.Printf("%s: upstream %s failed: %v", scrapeTarget.name, selector.urls[i], err)
+			lastErr = err
+			continue
+		}
+		if i != active {
+			scrapeTarget.switchUpstream(i)
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// Probe the upstreams before the active one, unless they were probed less
+// than failbackProbeInterval ago, and switch back to the first of them that
+// has answered failbackThreshold probes in a row
+func (scrapeTarget *ScrapeTarget) probePreferredUpstreams() {
+	selector := scrapeTarget.upstreams
+	selector.mu.Lock()
+	if selector.probing || (!selector.lastProbe.IsZero() && scrapeTarget.since(selector.lastProbe) < failbackProbeInterval) {
+		selector.mu.Unlock()
+		return
+	}
+	selector.probing, selector.lastProbe = true, scrapeTarget.now()
+	active := selector.active
+	selector.mu.Unlock()
+
+	go func() {
+		recovered := -1
+		for i := 0; i < active; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), failbackProbeTimeout)
+			err := scrapeTarget.probe(ctx, selector.urls[i])
+			cancel()
+			selector.mu.Lock()
+			if err != nil {
+				selector.successes[i] = 0
+			} else {
+				selector.successes[i]++
+			}
+			if recovered < 0 && selector.successes[i] >= failbackThreshold {
+				recovered = i
+			}
+			selector.mu.Unlock()
+		}
+		selector.mu.Lock()
+		selector.probing = false
+		// A scrape may have failed over further meanwhile, which is fine,
+		// but not back to one before the recovered upstream
+		switchBack := recovered >= 0 && recovered < selector.active
+		selector.mu.Unlock()
+		if switchBack {
+			scrapeTarget.switchUpstream(recovered)
+		}
+	}()
+}
+
+func (scrapeTarget *ScrapeTarget) get(ctx context.Context, upstream string, request upstreamRequest) (*http.Response, error) {
+	if request.path != `` {
+		var err error
+		if upstream, err = withPath(upstream, request.path); err != nil {
+			return nil, err
+		}
+	}
+	if len(request.query) > 0 {
+		upstream += `?` + request.query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstream, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(`Accept`, upstreamAccept)
+	scrapeTarget.currentCredentials().apply(req)
+	for name, values := range request.header {
+		req.Header[name] = values
+	}
+	scrapeTarget.setHost(req)
+	resp, err := scrapeTarget.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf(`%w: %v`, ErrUpstreamUnreachable, err)
+	}
+	scrapeTarget.protocolMutex.Lock()
+	scrapeTarget.protocol = resp.Proto
+	scrapeTarget.protocolMutex.Unlock()
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &ErrUpstreamStatus{Code: resp.StatusCode, URL: upstream}
+	}
+	return resp, nil
+}
+
+func (scrapeTarget *ScrapeTarget) switchUpstream(index int) {
+	selector := scrapeTarget.upstreams
+	selector.mu.Lock()
+	previous := selector.active
+	selector.active = index
+	for i := range selector.successes {
+		selector.successes[i] = 0
+	}
+	selector.mu.Unlock()
+
+	log.Printf("%s: switching upstream from %s to %s", scrapeTarget.name, selector.urls[previous], selector.urls[index])
+	scrapeTarget.reportActiveUpstream()
+}
+
+func (scrapeTarget *ScrapeTarget) reportActiveUpstream() {
+	selector := scrapeTarget.upstreams
+	selector.mu.Lock()
+	defer selector.mu.Unlock()
+	for i, url := range selector.urls {
+		value := 0.0
+		if i == selector.active {
+			value = 1
+		}
+		activeUpstream.set(value, scrapeTarget.name, url)
+	}
+}
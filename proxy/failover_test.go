@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// An upstream counting scrapes and probes apart, answering 503 while down
+type failingUpstream struct {
+	url          string
+	down         int32
+	gets, probes int32
+}
+
+func newFailingUpstream(t *testing.T) *failingUpstream {
+	upstream := &failingUpstream{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			atomic.AddInt32(&upstream.probes, 1)
+		} else {
+			atomic.AddInt32(&upstream.gets, 1)
+		}
+		if atomic.LoadInt32(&upstream.down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "up 1\n")
+	}))
+	t.Cleanup(server.Close)
+	upstream.url = server.URL + `/metrics`
+	return upstream
+}
+
+func (upstream *failingUpstream) setDown(down bool) {
+	value := int32(0)
+	if down {
+		value = 1
+	}
+	atomic.StoreInt32(&upstream.down, value)
+}
+
+func newFailoverProxy(t *testing.T, clock *fakeClock, upstreams ...*failingUpstream) *ScrapeTarget {
+	t.Helper()
+	var urls []string
+	for _, upstream := range upstreams {
+		urls = append(urls, upstream.url)
+	}
+	p, err := New(Config{Clock: clock, Targets: []Target{{Name: `node`, Upstreams: urls}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.targets[`node`].close() })
+	return p.targets[`node`]
+}
+
+func scrapeOnce(t *testing.T, scrapeTarget *ScrapeTarget) {
+	t.Helper()
+	resp, err := scrapeTarget.fetch(context.Background(), upstreamRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+// Wait for the background probe to finish, and return the active upstream
+func activeAfterProbing(t *testing.T, scrapeTarget *ScrapeTarget) int {
+	t.Helper()
+	selector := scrapeTarget.upstreams
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		selector.mu.Lock()
+		probing, active := selector.probing, selector.active
+		selector.mu.Unlock()
+		if !probing {
+			return active
+		}
+	}
+	t.Fatal(`the probe didn't finish`)
+	return 0
+}
+
+func TestFailedOverScrapesProbeThePrimaryOutOfBand(t *testing.T) {
+	clock := newFakeClock()
+	primary, backup := newFailingUpstream(t), newFailingUpstream(t)
+	scrapeTarget := newFailoverProxy(t, clock, primary, backup)
+
+	primary.setDown(true)
+	scrapeOnce(t, scrapeTarget)
+	if active := activeAfterProbing(t, scrapeTarget); active != 1 {
+		t.Fatalf(`upstream %d active after the primary failed`, active)
+	}
+
+	primary.setDown(false)
+	for i := 0; i < 5; i++ {
+		scrapeOnce(t, scrapeTarget)
+		activeAfterProbing(t, scrapeTarget)
+	}
+	if gets, probes := atomic.LoadInt32(&primary.gets), atomic.LoadInt32(&primary.probes); gets != 1 || probes != 1 {
+		t.Errorf(`five scrapes within the probe interval sent %d scrapes and %d probes to the primary, expected 1 and 1`, gets, probes)
+	}
+
+	for probe := 2; probe <= failbackThreshold; probe++ {
+		clock.Advance(failbackProbeInterval)
+		scrapeOnce(t, scrapeTarget)
+		active := activeAfterProbing(t, scrapeTarget)
+		if probe < failbackThreshold && active != 1 {
+			t.Fatalf(`switched back after %d probes`, probe)
+		}
+		if probe == failbackThreshold && active != 0 {
+			t.Fatalf(`still on upstream %d after %d probes`, active, probe)
+		}
+	}
+	scrapeOnce(t, scrapeTarget)
+	if gets := atomic.LoadInt32(&primary.gets); gets != 2 {
+		t.Errorf(`the primary got %d scrapes after switching back, expected 2`, gets)
+	}
+}
+
+func TestFailoverTriesTheUpstreamsInOrder(t *testing.T) {
+	clock := newFakeClock()
+	first, second, third := newFailingUpstream(t), newFailingUpstream(t), newFailingUpstream(t)
+	scrapeTarget := newFailoverProxy(t, clock, first, second, third)
+
+	first.setDown(true)
+	second.setDown(true)
+	scrapeOnce(t, scrapeTarget)
+	if active := activeAfterProbing(t, scrapeTarget); active != 2 {
+		t.Fatalf(`upstream %d active after the first two failed`, active)
+	}
+
+	// The one in between comes back, and is used as soon as the active one
+	// fails, before the primary's probes say anything
+	second.setDown(false)
+	third.setDown(true)
+	scrapeOnce(t, scrapeTarget)
+	if active := activeAfterProbing(t, scrapeTarget); active != 1 {
+		t.Fatalf(`upstream %d active after the third failed`, active)
+	}
+
+	// And the upstreams before the active one are all probed
+	third.setDown(false)
+	first.setDown(false)
+	for probe := 1; probe <= failbackThreshold; probe++ {
+		clock.Advance(failbackProbeInterval)
+		scrapeOnce(t, scrapeTarget)
+		activeAfterProbing(t, scrapeTarget)
+	}
+	if active := activeAfterProbing(t, scrapeTarget); active != 0 {
+		t.Errorf(`upstream %d active after the primary answered its probes`, active)
+	}
+}
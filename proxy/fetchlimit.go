@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+)
+
+// Global cap on how many upstream fetches (and the parsing that follows) run
+// at the same time. Waiting requests are served round-robin per target, so
+// one busy target can't starve the others.
+type fetchLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	active  int
+	waiting map[string][]chan struct{} // Waiting requests per target
+	order   []string                   // Targets with waiting requests, next in line first
+}
+
+func newFetchLimiter(limit int) *fetchLimiter {
+	return &fetchLimiter{limit: limit, waiting: make(map[string][]chan struct{})}
+}
+
+// Block until a fetch slot is free or the context is done
+func (limiter *fetchLimiter) acquire(ctx context.Context, target string) error {
+	limiter.mu.Lock()
+	if limiter.limit <= 0 || (limiter.active < limiter.limit && len(limiter.order) == 0) {
+		limiter.active++
+		limiter.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{}, 1)
+	if len(limiter.waiting[target]) == 0 {
+		limiter.order = append(limiter.order, target)
+	}
+	limiter.waiting[target] = append(limiter.waiting[target], ready)
+	limiter.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		limiter.mu.Lock()
+		removed := limiter.remove(target, ready)
+		limiter.mu.Unlock()
+		if !removed {
+			// The slot was handed over while we were giving up, pass it on
+			limiter.release()
+		}
+		return ctx.Err()
+	}
+}
+
+func (limiter *fetchLimiter) release() {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	if len(limiter.order) == 0 {
+		limiter.active--
+		return
+	}
+	target := limiter.order[0]
+	limiter.order = limiter.order[1:]
+	queue := limiter.waiting[target]
+	next := queue[0]
+	if len(queue) > 1 {
+		limiter.waiting[target] = queue[1:]
+		limiter.order = append(limiter.order, target)
+	} else {
+		delete(limiter.waiting, target)
+	}
+	// The slot goes straight to the next waiter, active stays the same
+	next <- struct{}{}
+}
+
+// Must be called with the lock held
+func (limiter *fetchLimiter) remove(target string, ready chan struct{}) bool {
+	queue := limiter.waiting[target]
+	for i, waiter := range queue {
+		if waiter != ready {
+			continue
+		}
+		queue = append(queue[:i], queue[i+1:]...)
+		if len(queue) > 0 {
+			limiter.waiting[target] = queue
+			return true
+		}
+		delete(limiter.waiting, target)
+		for j, name := range limiter.order {
+			if name == target {
+				limiter.order = append(limiter.order[:j], limiter.order[j+1:]...)
+				break
+			}
+		}
+		return true
+	}
+	return false
+}
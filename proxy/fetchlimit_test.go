@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Start acquiring a slot for target, returning a channel that gets the result
+func acquireAsync(limiter *fetchLimiter, ctx context.Context, target string) chan error {
+	acquired := make(chan error, 1)
+	go func() { acquired <- limiter.acquire(ctx, target) }()
+	return acquired
+}
+
+// Wait until n requests are queued for slots
+func waitForQueued(t *testing.T, limiter *fetchLimiter, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		limiter.mu.Lock()
+		var queued int
+		for _, queue := range limiter.waiting {
+			queued += len(queue)
+		}
+		limiter.mu.Unlock()
+		if queued == n {
+			return
+		}
+	}
+	t.Fatalf(`%d requests never queued`, n)
+}
+
+func TestFetchLimiterServesTargetsRoundRobin(t *testing.T) {
+	limiter := newFetchLimiter(1)
+	if err := limiter.acquire(context.Background(), `busy`); err != nil {
+		t.Fatal(err)
+	}
+	// The busy target queues three fetches before the quiet one queues its own
+	var order []string
+	done := make(chan string, 4)
+	for _, target := range []string{`busy`, `busy`, `busy`, `quiet`} {
+		acquired := acquireAsync(limiter, context.Background(), target)
+		waitForQueued(t, limiter, len(order)+1)
+		order = append(order, target)
+		go func(target string) {
+			<-acquired
+			done <- target
+		}(target)
+	}
+
+	var served []string
+	for range order {
+		limiter.release()
+		served = append(served, <-done)
+	}
+	if served[1] != `quiet` {
+		t.Errorf(`slots went to %v, the quiet target should have been second`, served)
+	}
+	limiter.release()
+	if limiter.active != 0 {
+		t.Errorf(`%d slots still active after all were released`, limiter.active)
+	}
+}
+
+func TestFetchLimiterGivesUpWithTheContext(t *testing.T) {
+	limiter := newFetchLimiter(1)
+	if err := limiter.acquire(context.Background(), `node`); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	acquired := acquireAsync(limiter, ctx, `node`)
+	waitForQueued(t, limiter, 1)
+	cancel()
+	if err := <-acquired; err != context.Canceled {
+		t.Fatalf(`a canceled wait returned %v`, err)
+	}
+	waitForQueued(t, limiter, 0)
+
+	// The slot isn't lost to the request that gave up
+	limiter.release()
+	if err := limiter.acquire(context.Background(), `node`); err != nil {
+		t.Fatal(err)
+	}
+	if limiter.active != 1 {
+		t.Errorf(`%d slots active, expected 1`, limiter.active)
+	}
+}
+
+func TestFetchLimiterWithoutALimit(t *testing.T) {
+	limiter := newFetchLimiter(0)
+	for i := 0; i < 100; i++ {
+		if err := limiter.acquire(context.Background(), `node`); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
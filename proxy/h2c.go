@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// Talk HTTP/2 without TLS (h2c) to the upstreams
+var upstreamH2C bool
+
+// How long checking whether an upstream speaks h2c waits for its answer
+const h2cPrefaceTimeout = 2 * time.Second
+
+// Speaks h2c to the upstream. When the upstream turns out not to, it falls
+// back to HTTP/1.1 for good.
+type h2cTransport struct {
+	name string
+	h2   *http2.Transport
+	h1   *http.Transport
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
+
+	mu       sync.Mutex
+	fallback bool
+}
+
+// Build an http client speaking h2c, dialing through the resolver
+func (resolver *upstreamResolver) h2cClient(name string) *http.Client {
+	h1 := http.DefaultTransport.(*http.Transport).Clone()
+	h1.DialContext = resolver.dialContext
+	h1.TLSClientConfig = upstreamTLSConfig()
+	transport := &h2cTransport{
+		name: name,
+		h2: &http2.Transport{
+			AllowHTTP: true,
+			// Plain TCP, despite the name
+			DialTLS: func(network, address string, config *tls.Config) (net.Conn, error) {
+				return resolver.dialContext(context.Background(), network, address)
+			},
+		},
+		h1:   h1,
+		dial: resolver.dialContext,
+	}
+	resolver.transport = transport
+	return &http.Client{Transport: transport}
+}
+
+func (transport *h2cTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport.mu.Lock()
+	fallback := transport.fallback
+	transport.mu.Unlock()
+	if fallback || req.URL.Scheme != `http` {
+		return transport.h1.RoundTrip(req)
+	}
+
+	resp, h2Err := transport.h2.RoundTrip(req)
+	if h2Err == nil || !transport.prefaceFailed(req, h2Err) {
+		return resp, h2Err
+	}
+	// The request never got to the upstream, so it is safe to send again
+	log.Printf("%s: upstream doesn't speak h2c (%v), using HTTP/1.1", transport.name, h2Err)
+	transport.mu.Lock()
+	transport.fallback = true
+	transport.mu.Unlock()
+	return transport.h1.RoundTrip(req)
+}
+
+// Whether a failed request failed because the upstream doesn't speak
+// HTTP/2, rather than because it is down, slow or failing. The errors of an
+// HTTP/1.1 server hanging up on the preface look like those of a crash, so
+// ask the upstream.
+func (transport *h2cTransport) prefaceFailed(req *http.Request, err error) bool {
+	var opErr *net.OpError
+	if req.Context().Err() != nil || (errors.As(err, &opErr) && opErr.Op == `dial`) {
+		return false
+	}
+	address := req.URL.Host
+	if req.URL.Port() == `` {
+		address = net.JoinHostPort(req.URL.Hostname(), `80`)
+	}
+	return !transport.speaksH2C(req.Context(), address)
+}
+
+// Whether the upstream answers the HTTP/2 connection preface with the
+// SETTINGS frame every HTTP/2 server starts with. One that can't be reached
+// can't be told apart and counts as speaking it.
+func (transport *h2cTransport) speaksH2C(ctx context.Context, address string) bool {
+	ctx, cancel := context.WithTimeout(ctx, h2cPrefaceTimeout)
+	defer cancel()
+	conn, err := transport.dial(ctx, `tcp`, address)
+	if err != nil {
+		return true
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+		return false
+	}
+	framer := http2.NewFramer(conn, conn)
+	if err := framer.WriteSettings(); err != nil {
+		return false
+	}
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		return false
+	}
+	_, ok := frame.(*http2.SettingsFrame)
+	return ok
+}
+
+func (transport *h2cTransport) CloseIdleConnections() {
+	transport.h2.CloseIdleConnections()
+	transport.h1.CloseIdleConnections()
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func newTestH2CTransport() *h2cTransport {
+	var dialer net.Dialer
+	return &h2cTransport{
+		name: `node`,
+		h2: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, address string, config *tls.Config) (net.Conn, error) {
+				return dialer.Dial(network, address)
+			},
+		},
+		h1:   &http.Transport{},
+		dial: dialer.DialContext,
+	}
+}
+
+// An upstream counting its scrapes, aborting them when fail is set. An
+// HTTP/1.1 server hands the h2c preface to the handler as a PRI request.
+func countingUpstream(t *testing.T, speaksH2C bool, fail bool) (*int32, string) {
+	var requests int32
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			return
+		}
+		atomic.AddInt32(&requests, 1)
+		if fail {
+			panic(http.ErrAbortHandler)
+		}
+		w.Write([]byte("up 1\n"))
+	})
+	if speaksH2C {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return &requests, server.URL
+}
+
+func roundTrip(transport *h2cTransport, url string) (*http.Response, error) {
+	req, _ := http.NewRequest(http.MethodGet, url+`/metrics`, nil)
+	resp, err := transport.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return resp, err
+}
+
+func TestH2CFallsBackForHTTP1Upstreams(t *testing.T) {
+	requests, url := countingUpstream(t, false, false)
+	transport := newTestH2CTransport()
+	if resp, err := roundTrip(transport, url); err != nil || resp.ProtoMajor != 1 {
+		t.Fatalf(`an HTTP/1.1 upstream: %v %v`, resp, err)
+	}
+	if !transport.fallback || atomic.LoadInt32(requests) != 1 {
+		t.Errorf(`fallback %v after %d requests`, transport.fallback, atomic.LoadInt32(requests))
+	}
+}
+
+func TestH2CKeepsHTTP2WhenTheUpstreamFails(t *testing.T) {
+	requests, url := countingUpstream(t, true, true)
+	transport := newTestH2CTransport()
+	if _, err := roundTrip(transport, url); err == nil {
+		t.Fatal(`a failing request succeeded`)
+	}
+	if transport.fallback || atomic.LoadInt32(requests) != 1 {
+		t.Errorf(`a failing h2c upstream got %d requests and fallback %v, expected 1 and false`, atomic.LoadInt32(requests), transport.fallback)
+	}
+
+	requests, url = countingUpstream(t, true, false)
+	if resp, err := roundTrip(transport, url); err != nil || resp.ProtoMajor != 2 {
+		t.Errorf(`an h2c upstream: %v %v`, resp, err)
+	}
+}
+
+func TestH2CDoesntFallBackForUnreachableUpstreams(t *testing.T) {
+	listener, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	transport := newTestH2CTransport()
+	if _, err := roundTrip(transport, `http://`+address); err == nil {
+		t.Fatal(`a request to a closed port succeeded`)
+	}
+	if transport.fallback {
+		t.Error(`an unreachable upstream made the transport fall back`)
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Answer HEAD requests with a HEAD request to the upstream instead of
+// just the headers
+var headProbe bool
+
+// Answer a HEAD request without scraping, so health checks and probing
+// tools don't fetch the upstream or advance the staleness counters
+func (scrapeTarget *ScrapeTarget) head(w http.ResponseWriter, r *http.Request) {
+	if headProbe {
+		if err := scrapeTarget.probeActive(r.Context()); err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+	}
+	// Only a background scrape leaves a result to measure
+	if scrapeTarget.schedule != nil {
+		families, err := scrapeTarget.latestFamilies()
+		if err != nil {
+			code, _ := errorStatus(err)
+			w.WriteHeader(code)
+			return
+		}
+		// The length of the format a GET would be answered in
+		measured := &measuringWriter{header: w.Header()}
+		writeFamilies(measured, r, families, scrapeTarget.now())
+		w.Header().Set(`Content-Length`, strconv.Itoa(measured.bytes))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	setContentType(w, r)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (merged *mergedTarget) head(w http.ResponseWriter, r *http.Request) {
+	if headProbe {
+		for _, source := range merged.sources {
+			if err := source.probeActive(r.Context()); err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+		}
+	}
+	setContentType(w, r)
+	w.WriteHeader(http.StatusOK)
+}
+
+// Counts what would be written, setting the headers of the real response
+type measuringWriter struct {
+	header http.Header
+	bytes  int
+}
+
+func (w *measuringWriter) Header() http.Header { return w.header }
+func (w *measuringWriter) WriteHeader(int)     {}
+
+func (w *measuringWriter) Write(b []byte) (int, error) {
+	w.bytes += len(b)
+	return len(b), nil
+}
+
+func setContentType(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case wantsOpenMetrics(r):
+		w.Header().Set(`Content-Type`, openMetricsContentType)
+	case wantsJSON(r):
+		w.Header().Set(`Content-Type`, `application/json`)
+	default:
+		w.Header().Set(`Content-Type`, textContentType)
+	}
+}
+
+// Send a HEAD request to the active upstream
+func (scrapeTarget *ScrapeTarget) probeActive(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return scrapeTarget.probe(ctx, scrapeTarget.upstreams.activeURL())
+}
+
+// Send a HEAD request to an upstream, to see whether it answers without
+// fetching its metrics
+func (scrapeTarget *ScrapeTarget) probe(ctx context.Context, upstream string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, upstream, nil)
+	if err != nil {
+		return err
+	}
+	scrapeTarget.currentCredentials().apply(req)
+	scrapeTarget.setHost(req)
+	resp, err := scrapeTarget.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf(`upstream returned %s`, resp.Status)
+	}
+	return nil
+}
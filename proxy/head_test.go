@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHeadContentLengthIsTheOneOfTheNegotiatedFormat(t *testing.T) {
+	clock := newFakeClock()
+	_, upstream := newFakeExporter(t, "# HELP up Whether the target is up.\n# TYPE up gauge\nup{job=\"node\"} 1\n# TYPE requests counter\nrequests_total 7\n")
+	p := newFakeClockProxy(t, clock, Config{ScrapeInterval: time.Minute, StartLive: true}, upstream)
+	nextBackgroundScrape(t, clock)
+
+	for _, format := range []string{`text`, `openmetrics`, `json`} {
+		answer := func(method string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			p.Handler(`node`).ServeHTTP(recorder, httptest.NewRequest(method, `/metrics?format=`+format, nil))
+			return recorder
+		}
+		head, get := answer(http.MethodHead), answer(http.MethodGet)
+		if head.Code != http.StatusOK || get.Code != http.StatusOK {
+			t.Fatalf(`%s: HEAD answered %d, GET %d`, format, head.Code, get.Code)
+		}
+		if length := head.Header().Get(`Content-Length`); length != strconv.Itoa(get.Body.Len()) {
+			t.Errorf(`%s: HEAD has Content-Length %s, the GET body is %d bytes`, format, length, get.Body.Len())
+		}
+		if head.Header().Get(`Content-Type`) != get.Header().Get(`Content-Type`) {
+			t.Errorf(`%s: HEAD has Content-Type %q, GET %q`, format, head.Header().Get(`Content-Type`), get.Header().Get(`Content-Type`))
+		}
+		if head.Body.Len() != 0 {
+			t.Errorf(`%s: HEAD answered with a body`, format)
+		}
+	}
+}
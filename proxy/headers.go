@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Headers of the scrape request copied onto the upstream request
+var forwardHeaders paramNames
+
+// Authorization is only forwarded when explicitly allowed, as it passes the
+// scraper's credentials on to every upstream
+var forwardAuthorization bool
+
+// Headers that only concern one connection, never forwarded
+var hopByHopHeaders = []string{
+	`Connection`,
+	`Keep-Alive`,
+	`Proxy-Authenticate`,
+	`Proxy-Authorization`,
+	`Proxy-Connection`,
+	`Te`,
+	`Trailer`,
+	`Transfer-Encoding`,
+	`Upgrade`,
+}
+
+func checkForwardHeaders() error {
+	for _, name := range forwardHeaders {
+		if http.CanonicalHeaderKey(name) == `Authorization` && !forwardAuthorization {
+			return errors.New(`forwarding the Authorization header needs -forward-authorization`)
+		}
+	}
+	return nil
+}
+
+func isHopByHop(name string, r *http.Request) bool {
+	for _, header := range hopByHopHeaders {
+		if name == header {
+			return true
+		}
+	}
+	// Connection lists further headers meant for this hop only
+	for _, value := range r.Header[`Connection`] {
+		for _, header := range strings.Split(value, `,`) {
+			if http.CanonicalHeaderKey(strings.TrimSpace(header)) == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The listed headers of the scrape request, nil for background scrapes
+func forwardedHeaders(r *http.Request) http.Header {
+	if r == nil || len(forwardHeaders) == 0 {
+		return nil
+	}
+	header := http.Header{}
+	for _, name := range forwardHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if values, ok := r.Header[name]; ok && !isHopByHop(name, r) {
+			header[name] = values
+		}
+	}
+	return header
+}
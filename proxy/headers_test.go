@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func useForwardHeaders(t *testing.T, names string) {
+	previous := forwardHeaders
+	forwardHeaders = paramNames{}
+	if err := forwardHeaders.Set(names); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { forwardHeaders = previous })
+}
+
+func TestOnlyListedHeadersAreForwarded(t *testing.T) {
+	useCommandLineSettings(t)
+	useForwardHeaders(t, `x-team,Upgrade,X-Hop`)
+	exporter, upstream := newRecordingExporter(t)
+	scrapeTarget := newParamsTarget(t, upstream, nil)
+
+	r := httptest.NewRequest(http.MethodGet, `/metrics`, nil)
+	r.Header.Set(`X-Team`, `storage`)
+	r.Header.Set(`X-Other`, `secret`)
+	r.Header.Set(`Upgrade`, `h2c`)
+	r.Header.Set(`Connection`, `X-Hop`)
+	r.Header.Set(`X-Hop`, `only this connection`)
+	scrapeTarget.handler(httptest.NewRecorder(), r)
+
+	received := exporter.lastRequest().Header
+	if received.Get(`X-Team`) != `storage` {
+		t.Errorf(`a listed header wasn't forwarded: %v`, received)
+	}
+	for _, name := range []string{`X-Other`, `Upgrade`, `X-Hop`} {
+		if received.Get(name) != `` {
+			t.Errorf(`%s was forwarded`, name)
+		}
+	}
+}
+
+func TestBackgroundScrapesForwardNoHeaders(t *testing.T) {
+	useForwardHeaders(t, `X-Team`)
+	if header := forwardedHeaders(nil); header != nil {
+		t.Errorf(`a background scrape forwarded %v`, header)
+	}
+}
+
+func TestForwardingAuthorizationNeedsAnOptIn(t *testing.T) {
+	defer func(allowed bool) { forwardAuthorization = allowed }(forwardAuthorization)
+	useForwardHeaders(t, `X-Team,authorization`)
+	forwardAuthorization = false
+	if err := checkForwardHeaders(); err == nil {
+		t.Error(`Authorization was forwarded without -forward-authorization`)
+	}
+	forwardAuthorization = true
+	if err := checkForwardHeaders(); err != nil {
+		t.Error(err)
+	}
+}
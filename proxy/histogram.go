@@ -0,0 +1,54 @@
+package proxy
+
+// Suffixes of the series making up a histogram or a summary, besides the
+// summary's own quantile series, in the order they are served
+var childSuffixes = map[MetricType][]string{
+	histogram: {`_bucket`, `_sum`, `_count`},
+	summary:   {`_sum`, `_count`},
+}
+
+// A series of a family: one of its own, or a child series of a histogram or
+// summary like <name>_bucket
+type familySeries struct {
+	name      string
+	labels    string
+	value     float64
+	timestamp int64
+}
+
+// The parser returns the series of histograms and summaries as families of
+// their own, named like the series. Move them into their family, so the
+// family is decided on and served as a whole. A series family with a TYPE
+// of its own stays what it is.
+func groupChildren(data map[string]MetricData) {
+	for name, content := range data {
+		for _, suffix := range childSuffixes[content.commentType] {
+			child, ok := data[name+suffix]
+			if !ok || child.commentType != untyped || len(child.children) > 0 {
+				continue
+			}
+			if content.children == nil {
+				content.children = make(map[string]map[string]LabelSet)
+			}
+			content.children[name+suffix] = child.label
+			delete(data, name+suffix)
+		}
+		data[name] = content
+	}
+}
+
+// The series of a family, its own first and then the child series in the
+// order of childSuffixes
+func (content MetricData) series(name string) []familySeries {
+	series := make([]familySeries, 0, len(content.label))
+	for _, label := range orderedLabels(content.label) {
+		series = append(series, familySeries{name: name, labels: label, value: content.label[label].value, timestamp: content.label[label].timestamp})
+	}
+	for _, suffix := range childSuffixes[content.commentType] {
+		children := content.children[name+suffix]
+		for _, label := range orderedLabels(children) {
+			series = append(series, familySeries{name: name + suffix, labels: label, value: children[label].value, timestamp: children[label].timestamp})
+		}
+	}
+	return series
+}
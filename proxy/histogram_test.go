@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const histogramExposition = `# HELP http_request_duration_seconds Request latency.
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{handler="/api",le="0.05"} 24054
+http_request_duration_seconds_bucket{handler="/api",le="0.1"} 33444
+http_request_duration_seconds_bucket{handler="/api",le="0.5"} 129389
+http_request_duration_seconds_bucket{handler="/api",le="1"} 133988
+http_request_duration_seconds_bucket{handler="/api",le="+Inf"} 144320
+http_request_duration_seconds_sum{handler="/api"} 53423
+http_request_duration_seconds_count{handler="/api"} 144320
+# HELP rpc_duration_seconds RPC latency.
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 4773
+rpc_duration_seconds{quantile="0.9"} 9001
+rpc_duration_seconds{quantile="0.99"} 76656
+rpc_duration_seconds_sum 1.7560473e+07
+rpc_duration_seconds_count 2693
+# TYPE node_load1 gauge
+node_load1 0.52
+`
+
+func TestHistogramsAndSummariesPassThroughWhole(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.StartStale = false
+	_, upstream := newFakeExporter(t, histogramExposition)
+	scrapeTarget := newScrapeTarget(`app`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+
+	response := httptest.NewRecorder()
+	scrapeTarget.handler(response, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+	body := response.Body.String()
+	if got, expected := strings.Join(seriesLines(body), "\n"), strings.Join(seriesLines(histogramExposition), "\n"); got != expected {
+		t.Errorf("passed on\n%s\nexpected\n%s", got, expected)
+	}
+	for _, comment := range []string{`# TYPE http_request_duration_seconds histogram`, `# HELP http_request_duration_seconds Request latency.`, `# TYPE rpc_duration_seconds summary`} {
+		if strings.Count(body, comment+"\n") != 1 {
+			t.Errorf("%q isn't in\n%s\nonce", comment, body)
+		}
+	}
+	if strings.Contains(body, `# TYPE http_request_duration_seconds_bucket`) || strings.Contains(body, `# TYPE rpc_duration_seconds_sum`) {
+		t.Errorf("comments for the series of a family\n%s", body)
+	}
+	// The series follow the comments of their family
+	if !strings.Contains(body, "# TYPE http_request_duration_seconds histogram\nhttp_request_duration_seconds_bucket") {
+		t.Errorf("the buckets aren't under their family\n%s", body)
+	}
+}
+
+func TestHistogramsAreSuppressedAndRevivedWhole(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.StartStale = false
+	commandLine.staleness.Threshold = 1
+	exporter, upstream := newFakeExporter(t, histogramExposition)
+	scrapeTarget := newScrapeTarget(`app`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+
+	for i := 0; i < 2; i++ {
+		servedSeries(scrapeTarget)
+	}
+	if _, served := servedSeries(scrapeTarget); strings.Contains(served, `http_request_duration_seconds`) || strings.Contains(served, `rpc_duration_seconds`) {
+		t.Fatalf("unchanged families weren't suppressed\n%s", served)
+	}
+
+	// One of the series changing brings back all of its family
+	exporter.serve(strings.Replace(histogramExposition, `http_request_duration_seconds_count{handler="/api"} 144320`, `http_request_duration_seconds_count{handler="/api"} 144321`, 1))
+	_, served := servedSeries(scrapeTarget)
+	var histogram []string
+	for _, line := range strings.Split(served, "\n") {
+		if strings.HasPrefix(line, `http_request_duration_seconds`) {
+			histogram = append(histogram, line)
+		}
+	}
+	if len(histogram) != 7 || !strings.Contains(served, `http_request_duration_seconds_bucket{handler="/api",le="+Inf"} 144320`) {
+		t.Errorf("after the count changed\n%s", served)
+	}
+	if strings.Contains(served, `rpc_duration_seconds`) {
+		t.Errorf("the unchanged summary came back with the histogram\n%s", served)
+	}
+}
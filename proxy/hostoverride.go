@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Host header and server name overrides of single targets, from the
+// command line
+var targetHostHeaders, targetServerNames = targetStrings{}, targetStrings{}
+
+// Comma separated target=value pairs
+type targetStrings map[string]string
+
+func (values targetStrings) String() string {
+	var pairs []string
+	for name, value := range values {
+		pairs = append(pairs, name+`=`+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, `,`)
+}
+
+func (values targetStrings) Set(value string) error {
+	pairs, err := parseNameValuePairs(value)
+	if err != nil {
+		return err
+	}
+	for name, value := range pairs {
+		values[name] = value
+	}
+	return nil
+}
+
+// The target of an upstream of the command line arguments, with the
+// overrides of the flags, to validate and apply them
+func (upstream upstreamSpec) commandLineTarget() Target {
+	name := upstream.name()
+	return Target{Name: name, Upstreams: upstream.urls(), HostHeader: targetHostHeaders[name], ServerName: targetServerNames[name]}
+}
+
+// A DNS name, like TLS sends for SNI
+var serverNamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+
+// Check the Host header and SNI overrides of a target
+func validateHostOverride(target Target) error {
+	if target.HostHeader != `` {
+		parsed, err := url.Parse(`//` + target.HostHeader)
+		if err != nil || parsed.Host != target.HostHeader || parsed.User != nil || parsed.Hostname() == `` {
+			return fmt.Errorf(`target %s: host header %q isn't a host with an optional port`, target.Name, target.HostHeader)
+		}
+	}
+	if target.ServerName != `` {
+		if !serverNamePattern.MatchString(target.ServerName) || net.ParseIP(target.ServerName) != nil {
+			return fmt.Errorf(`target %s: server name %q isn't a DNS name without a port`, target.Name, target.ServerName)
+		}
+		for _, upstream := range target.Upstreams {
+			if !strings.HasPrefix(upstream, `https://`) {
+				return fmt.Errorf(`target %s: a server name needs https upstreams, %s isn't one`, target.Name, upstream)
+			}
+		}
+	}
+	return nil
+}
+
+// Present serverName in the TLS handshake with the upstream and check its
+// certificate against it, instead of the host of the upstream URL
+func (scrapeTarget *ScrapeTarget) useServerName(serverName string) {
+	scrapeTarget.serverName = serverName
+	config := upstreamTLSConfig()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config.ServerName = serverName
+	switch transport := scrapeTarget.client.Transport.(type) {
+	case *http.Transport:
+		transport.TLSClientConfig = config
+	case *h2cTransport:
+		// https goes over HTTP/1.1 or negotiated HTTP/2, never h2c
+		transport.h1.TLSClientConfig = config
+	}
+}
+
+// Send the Host header override, if the target has one
+func (scrapeTarget *ScrapeTarget) setHost(req *http.Request) {
+	if scrapeTarget.hostHeader != `` {
+		req.Host = scrapeTarget.hostHeader
+	}
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Requests a listener serves at the same time, 0 means unlimited
+var maxListenerRequests int
+
+var (
+	requestsInFlight = selfMetrics.newGaugeVec(`frugalpromproxy_requests_in_flight`, `Requests the listener is serving right now.`, `target`)
+	rejectedRequests = selfMetrics.newCounterVec(`frugalpromproxy_requests_rejected_total`, `Requests rejected because the listener was serving -max-listener-requests already.`, `target`)
+)
+
+// Caps the requests a listener serves at the same time, so slow upstreams
+// and an eager scraper can't pile up goroutines in the proxy. Unlike the
+// upstream fetch limit, requests above the cap don't wait: they get a 503
+// right away.
+type requestLimit struct {
+	name  string
+	limit int
+
+	mu       sync.Mutex
+	inFlight int
+}
+
+func newRequestLimit(name string, limit int) *requestLimit {
+	return &requestLimit{name: name, limit: limit}
+}
+
+// The health check and the proxy's own metrics and status are never
+// limited, so a busy proxy doesn't look dead and can still be looked into
+func unlimitedPath(path string) bool {
+	return path == healthyPath || path == selfMetricsPath || path == targetsPath || strings.HasPrefix(path, targetsPath+`/`)
+}
+
+func (limit *requestLimit) wrap(next http.Handler) http.Handler {
+	if limit.limit <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unlimitedPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !limit.acquire() {
+			rejectedRequests.inc(limit.name)
+			w.Header().Set(`Retry-After`, `1`)
+			http.Error(w, `too many requests in flight on `+limit.name, http.StatusServiceUnavailable)
+			return
+		}
+		defer limit.release()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (limit *requestLimit) acquire() bool {
+	limit.mu.Lock()
+	defer limit.mu.Unlock()
+	if limit.inFlight >= limit.limit {
+		return false
+	}
+	limit.inFlight++
+	requestsInFlight.set(float64(limit.inFlight), limit.name)
+	return true
+}
+
+func (limit *requestLimit) release() {
+	limit.mu.Lock()
+	defer limit.mu.Unlock()
+	limit.inFlight--
+	requestsInFlight.set(float64(limit.inFlight), limit.name)
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestsAboveTheLimitAreRejected(t *testing.T) {
+	serving, release := make(chan struct{}), make(chan struct{})
+	limited := newRequestLimit(`:19100`, 1).wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == basePath {
+			serving <- struct{}{}
+			<-release
+		}
+	}))
+	serve := func(path string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		limited.ServeHTTP(response, httptest.NewRequest(http.MethodGet, path, nil))
+		return response
+	}
+	rejected := selfMetricValue(rejectedRequests.selfMetric, `:19100`)
+
+	first := make(chan int)
+	go func() { first <- serve(basePath).Code }()
+	<-serving
+	if inFlight := selfMetricValue(requestsInFlight.selfMetric, `:19100`); inFlight != 1 {
+		t.Errorf(`%g requests in flight`, inFlight)
+	}
+	if second := serve(basePath); second.Code != http.StatusServiceUnavailable || second.Header().Get(`Retry-After`) != `1` {
+		t.Errorf(`a second request was answered %d with Retry-After %q`, second.Code, second.Header().Get(`Retry-After`))
+	}
+	if selfMetricValue(rejectedRequests.selfMetric, `:19100`) != rejected+1 {
+		t.Error(`the rejected request wasn't counted`)
+	}
+	for _, path := range []string{healthyPath, selfMetricsPath, targetsPath, targetsPath + `/node/series`} {
+		if code := serve(path).Code; code != http.StatusOK {
+			t.Errorf(`%s was answered %d while the listener was busy`, path, code)
+		}
+	}
+
+	close(release)
+	if code := <-first; code != http.StatusOK {
+		t.Errorf(`the first request was answered %d`, code)
+	}
+	if selfMetricValue(requestsInFlight.selfMetric, `:19100`) != 0 {
+		t.Error(`the finished request is still in flight`)
+	}
+	go func() { <-serving }()
+	if code := serve(basePath).Code; code != http.StatusOK {
+		t.Errorf(`a request after the first finished was answered %d`, code)
+	}
+}
+
+func TestListenersWithoutALimitServeEveryRequest(t *testing.T) {
+	serving, release := make(chan struct{}), make(chan struct{})
+	unlimited := newRequestLimit(`:19100`, 0).wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serving <- struct{}{}
+		<-release
+	}))
+	answered := make(chan int)
+	for i := 0; i < 3; i++ {
+		go func() {
+			response := httptest.NewRecorder()
+			unlimited.ServeHTTP(response, httptest.NewRequest(http.MethodGet, basePath, nil))
+			answered <- response.Code
+		}()
+	}
+	// All three are served at the same time
+	for i := 0; i < 3; i++ {
+		<-serving
+	}
+	close(release)
+	for i := 0; i < 3; i++ {
+		if code := <-answered; code != http.StatusOK {
+			t.Errorf(`answered %d`, code)
+		}
+	}
+}
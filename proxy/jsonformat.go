@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The filtered families as JSON, for tools that would rather not parse the
+// exposition format. A debugging and integration aid, not a replacement
+// for the exposition format.
+type jsonFamily struct {
+	Name   string       `json:"name"`
+	Type   string       `json:"type"`
+	Help   string       `json:"help"`
+	Series []jsonSeries `json:"series"`
+}
+
+type jsonSeries struct {
+	Labels      map[string]string `json:"labels"`
+	Value       interface{}       `json:"value"`        // A number, or "NaN", "+Inf" or "-Inf"
+	TimestampMs int64             `json:"timestamp_ms"` // From the upstream, or else when the proxy served it
+}
+
+// Whether the scraper asked for JSON, with ?format=json or the Accept header
+func wantsJSON(r *http.Request) bool {
+	if format := r.URL.Query().Get(`format`); format != `` {
+		return format == `json`
+	}
+	return strings.Contains(r.Header.Get(`Accept`), `application/json`)
+}
+
+func toJSONFamily(family outputFamily, timestamp int64) jsonFamily {
+	converted := jsonFamily{Name: family.name, Type: typeText[family.metricType], Help: family.help, Series: []jsonSeries{}}
+	for _, line := range family.lines {
+		sample, ok := parseSample(line)
+		if !ok {
+			continue
+		}
+		series := jsonSeries{Labels: make(map[string]string, len(sample.labels)-1), Value: jsonValue(sample.value), TimestampMs: timestamp}
+		if sample.timestamp != 0 {
+			series.TimestampMs = sample.timestamp
+		}
+		for _, label := range sample.labels[1:] {
+			series.Labels[label[0]] = label[1]
+		}
+		// The series of a histogram or summary, like <name>_bucket
+		if name := sample.labels[0][1]; name != family.name {
+			series.Labels[`__name__`] = name
+		}
+		converted.Series = append(converted.Series, series)
+	}
+	return converted
+}
+
+// A value as a JSON number, or as "NaN", "+Inf" or "-Inf" which JSON has no
+// numbers for
+func jsonValue(value float64) interface{} {
+	switch {
+	case math.IsNaN(value):
+		return `NaN`
+	case math.IsInf(value, 1):
+		return `+Inf`
+	case math.IsInf(value, -1):
+		return `-Inf`
+	}
+	return value
+}
+
+// Write the families in the format the scraper asked for. JSON is written
+// family by family, so large outputs aren't built in memory twice.
+func writeFamilies(w http.ResponseWriter, r *http.Request, families []outputFamily, now time.Time) {
+	switch {
+	case wantsOpenMetrics(r):
+		w.Header().Set(`Content-Type`, openMetricsContentType)
+		writeOpenMetrics(w, families)
+		return
+	case !wantsJSON(r):
+		w.Header().Set(`Content-Type`, textContentType)
+		writeText(w, families)
+		return
+	}
+	w.Header().Set(`Content-Type`, `application/json`)
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+	encoder := json.NewEncoder(w)
+	fmt.Fprint(w, `[`)
+	for i, family := range families {
+		if i > 0 {
+			fmt.Fprint(w, `,`)
+		}
+		encoder.Encode(toJSONFamily(family, timestamp))
+	}
+	fmt.Fprintln(w, `]`)
+}
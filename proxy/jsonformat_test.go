@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var jsonTestFamilies = []outputFamily{
+	{name: `http_requests_total`, help: `Requests.`, metricType: counter, lines: []string{
+		"http_requests_total{code=\"200\",path=\"/a\\\"b\"} 7 1622548800000\n",
+		"http_requests_total{code=\"500\"} NaN 1622548800000\n",
+	}},
+	{name: `latency_seconds`, metricType: histogram, lines: []string{
+		"latency_seconds_bucket{le=\"+Inf\"} 3 1622548800000\n",
+		"latency_seconds_sum 1.5 1622548800000\n",
+	}},
+}
+
+// The JSON of jsonTestFamilies
+const jsonGolden = `[{"name":"http_requests_total","type":"counter","help":"Requests.","series":[` +
+	`{"labels":{"code":"200","path":"/a\"b"},"value":7,"timestamp_ms":1622548800000},` +
+	`{"labels":{"code":"500"},"value":"NaN","timestamp_ms":1622548800000}]}` + "\n" +
+	`,{"name":"latency_seconds","type":"histogram","help":"","series":[` +
+	`{"labels":{"__name__":"latency_seconds_bucket","le":"+Inf"},"value":3,"timestamp_ms":1622548800000},` +
+	`{"labels":{"__name__":"latency_seconds_sum"},"value":1.5,"timestamp_ms":1622548800000}]}` + "\n" +
+	`]` + "\n"
+
+func renderFor(r *http.Request, families []outputFamily) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	writeFamilies(recorder, r, families, newFakeClock().Now())
+	return recorder
+}
+
+func TestJSONOutputMatchesTheGolden(t *testing.T) {
+	recorder := renderFor(httptest.NewRequest(http.MethodGet, `/metrics?format=json`, nil), jsonTestFamilies)
+	if recorder.Header().Get(`Content-Type`) != `application/json` {
+		t.Errorf(`content type %s`, recorder.Header().Get(`Content-Type`))
+	}
+	if got := recorder.Body.String(); got != jsonGolden {
+		t.Errorf("JSON output\n%s\nexpected\n%s", got, jsonGolden)
+	}
+	var decoded []jsonFamily
+	if err := json.Unmarshal(recorder.Body.Bytes(), &decoded); err != nil {
+		t.Errorf(`the output isn't valid JSON: %v`, err)
+	}
+}
+
+func TestJSONOutputHoldsTheSeriesOfTheText(t *testing.T) {
+	text := renderFor(httptest.NewRequest(http.MethodGet, `/metrics`, nil), jsonTestFamilies).Body.String()
+	r := httptest.NewRequest(http.MethodGet, `/metrics`, nil)
+	r.Header.Set(`Accept`, `application/json`)
+	var decoded []jsonFamily
+	if err := json.Unmarshal(renderFor(r, jsonTestFamilies).Body.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	var fromJSON []string
+	for _, family := range decoded {
+		for _, series := range family.Series {
+			name := family.Name
+			if series.Labels[`__name__`] != `` {
+				name = series.Labels[`__name__`]
+				delete(series.Labels, `__name__`)
+			}
+			line := seriesLine(name, renderStaticLabels(series.Labels), 0, series.TimestampMs)
+			value, _ := json.Marshal(series.Value)
+			fromJSON = append(fromJSON, strings.Replace(line, ` 0 `, ` `+strings.Trim(string(value), `"`)+` `, 1))
+		}
+	}
+	if got, expected := strings.Join(seriesLines(strings.Join(fromJSON, ``)), "\n"), strings.Join(seriesLines(text), "\n"); got != expected {
+		t.Errorf("series of the JSON\n%s\nseries of the text\n%s", got, expected)
+	}
+}
+
+func TestFormatParameterWinsOverTheAcceptHeader(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, `/metrics?format=text`, nil)
+	r.Header.Set(`Accept`, `application/json`)
+	if wantsJSON(r) {
+		t.Error(`?format=text answered JSON`)
+	}
+}
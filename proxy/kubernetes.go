@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Finds exporter pods through the Kubernetes API with a shared informer,
+// which lists the pods once and then watches them, relisting with backoff
+// whenever the watch breaks. Only list and watch on pods are needed.
+type kubernetesDiscovery struct {
+	client       kubernetes.Interface
+	namespace    string // Empty means all namespaces
+	selector     string
+	node         string // Empty means all nodes
+	portName     string
+	pathTemplate *template.Template
+	router       *discoveryRouter
+
+	pods corelisters.PodLister
+}
+
+// Set up discovery with the service account the proxy runs as
+func newInClusterKubernetesDiscovery(router *discoveryRouter) (*kubernetesDiscovery, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &kubernetesDiscovery{client: client, router: router}, nil
+}
+
+// Watch the pods until stop is closed, a nil stop runs for as long as the
+// process does. When the API server can't be reached the current targets
+// are kept.
+func (discovery *kubernetesDiscovery) run(stop <-chan struct{}) {
+	factory := informers.NewSharedInformerFactoryWithOptions(discovery.client, 0,
+		informers.WithNamespace(discovery.namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = discovery.selector
+			if discovery.node != `` {
+				options.FieldSelector = `spec.nodeName=` + discovery.node
+			}
+		}),
+	)
+	pods := factory.Core().V1().Pods()
+	informer := pods.Informer()
+	discovery.pods = pods.Lister()
+	informer.SetWatchErrorHandler(func(_ *cache.Reflector, err error) {
+		log.Printf("kubernetes_sd: %v", err)
+	})
+	// Until the first list is in, one sync after it does
+	changed := func() {
+		if informer.HasSynced() {
+			discovery.sync()
+		}
+	}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { changed() },
+		UpdateFunc: func(interface{}, interface{}) { changed() },
+		DeleteFunc: func(interface{}) { changed() },
+	})
+
+	factory.Start(stop)
+	if !cache.WaitForCacheSync(stop, informer.HasSynced) {
+		return
+	}
+	discovery.sync()
+	<-stop
+}
+
+// Hand the running pods exposing the metrics port to the router
+func (discovery *kubernetesDiscovery) sync() {
+	pods, err := discovery.pods.List(labels.Everything())
+	if err != nil {
+		log.Printf("kubernetes_sd: %v", err)
+		return
+	}
+	var discovered []discoveredTarget
+	for _, pod := range pods {
+		if pod.Status.Phase != corev1.PodRunning || pod.Status.PodIP == `` {
+			continue
+		}
+		port := discovery.metricsPort(pod)
+		if port == 0 {
+			continue
+		}
+
+		static := make(map[string]string, len(pod.Labels)+2)
+		for name, value := range pod.Labels {
+			static[name] = value
+		}
+		static[`namespace`] = pod.Namespace
+		static[`pod`] = pod.Name
+
+		discovered = append(discovered, discoveredTarget{
+			url: `http://` + net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(port)) + basePath,
+			meta: map[string]string{
+				`namespace`: pod.Namespace,
+				`pod`:       pod.Name,
+				`node`:      pod.Spec.NodeName,
+				`port`:      strconv.Itoa(port),
+			},
+			labels: static,
+		})
+	}
+	discovery.router.update(`kubernetes_sd`, discovery.pathTemplate, discovered)
+}
+
+// The container port with the configured name, or the configured number
+func (discovery *kubernetesDiscovery) metricsPort(pod *corev1.Pod) int {
+	if number, err := strconv.Atoi(discovery.portName); err == nil {
+		return number
+	}
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			if port.Name == discovery.portName {
+				return int(port.ContainerPort)
+			}
+		}
+	}
+	return 0
+}
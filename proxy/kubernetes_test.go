@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func exporterPod(name, ip string, phase corev1.PodPhase) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: `monitoring`, UID: types.UID(`uid-` + name), Labels: map[string]string{`app`: `node-exporter`}},
+		Spec: corev1.PodSpec{
+			NodeName:   `node-a`,
+			Containers: []corev1.Container{{Ports: []corev1.ContainerPort{{Name: `metrics`, ContainerPort: 9100}}}},
+		},
+		Status: corev1.PodStatus{Phase: phase, PodIP: ip},
+	}
+}
+
+// Wait for the router to serve exactly the paths
+func waitForRoutes(t *testing.T, router *discoveryRouter, paths ...string) {
+	t.Helper()
+	expected := strings.Join(paths, ` `)
+	var got string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		router.mu.RLock()
+		var served []string
+		for path, route := range router.routes {
+			served = append(served, path+`=`+route.url)
+		}
+		router.mu.RUnlock()
+		sort.Strings(served)
+		if got = strings.Join(served, ` `); got == expected {
+			return
+		}
+	}
+	t.Fatalf(`routes %q, expected %q`, got, expected)
+}
+
+func TestKubernetesDiscoveryFollowsPodChurn(t *testing.T) {
+	useCommandLineSettings(t)
+	client := fake.NewSimpleClientset(
+		exporterPod(`exporter-1`, `10.1.0.1`, corev1.PodRunning),
+		exporterPod(`exporter-2`, ``, corev1.PodPending),
+	)
+	router := newDiscoveryRouter(time.Hour)
+	discovery := &kubernetesDiscovery{
+		client:       client,
+		namespace:    `monitoring`,
+		selector:     `app=node-exporter`,
+		portName:     `metrics`,
+		pathTemplate: template.Must(template.New(`path`).Parse(`/{{.namespace}}/{{.pod}}/metrics`)),
+		router:       router,
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go discovery.run(stop)
+	waitForRoutes(t, router, `/monitoring/exporter-1/metrics=http://10.1.0.1:9100/metrics`)
+
+	pods := client.CoreV1().Pods(`monitoring`)
+	if _, err := pods.Update(context.Background(), exporterPod(`exporter-2`, `10.1.0.2`, corev1.PodRunning), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForRoutes(t, router, `/monitoring/exporter-1/metrics=http://10.1.0.1:9100/metrics`, `/monitoring/exporter-2/metrics=http://10.1.0.2:9100/metrics`)
+
+	if err := pods.Delete(context.Background(), `exporter-1`, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForRoutes(t, router, `/monitoring/exporter-2/metrics=http://10.1.0.2:9100/metrics`)
+	router.mu.RLock()
+	_, kept := router.retired[`http://10.1.0.1:9100/metrics`]
+	router.mu.RUnlock()
+	if !kept {
+		t.Error(`a deleted pod's target wasn't kept for the grace period`)
+	}
+
+	if _, err := pods.Create(context.Background(), exporterPod(`exporter-3`, `10.1.0.4`, corev1.PodRunning), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForRoutes(t, router, `/monitoring/exporter-2/metrics=http://10.1.0.2:9100/metrics`, `/monitoring/exporter-3/metrics=http://10.1.0.4:9100/metrics`)
+}
+
+func TestKubernetesDiscoveryUsesThePortNameOrNumber(t *testing.T) {
+	pod := exporterPod(`exporter`, `10.1.0.1`, corev1.PodRunning)
+	for portName, expected := range map[string]int{`metrics`: 9100, `8080`: 8080, `http`: 0} {
+		discovery := &kubernetesDiscovery{portName: portName}
+		if port := discovery.metricsPort(pod); port != expected {
+			t.Errorf(`port %s found %d, expected %d`, portName, port, expected)
+		}
+	}
+}
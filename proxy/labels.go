@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"sort"
+	"strings"
+)
+
+// Render static labels once, so they can be appended to every series.
+// Names are made valid label names and sorted for a stable output.
+func renderStaticLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	sanitized := make(map[string]string, len(labels))
+	for name, value := range labels {
+		name = sanitizeLabelName(name)
+		sanitized[name] = value
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + escapeLabelValue(sanitized[name]) + `"`
+	}
+	return strings.Join(pairs, `,`)
+}
+
+func (scrapeTarget *ScrapeTarget) setStaticLabels(labels map[string]string) {
+	rendered := renderStaticLabels(labels)
+	scrapeTarget.staticLabelsMutex.Lock()
+	scrapeTarget.staticLabels = rendered
+	scrapeTarget.staticLabelsMutex.Unlock()
+}
+
+func (scrapeTarget *ScrapeTarget) currentStaticLabels() string {
+	scrapeTarget.staticLabelsMutex.Lock()
+	defer scrapeTarget.staticLabelsMutex.Unlock()
+	return scrapeTarget.staticLabels
+}
+
+// Replace everything not allowed in a label name with underscores
+func sanitizeLabelName(name string) string {
+	sanitized := []byte(name)
+	for i, c := range sanitized {
+		valid := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')
+		if !valid {
+			sanitized[i] = '_'
+		}
+	}
+	return string(sanitized)
+}
+
+// Add static labels to the labels of a series. The series' own labels win
+// when both have the same name.
+func withStaticLabels(label, static string) string {
+	if static == `` {
+		return label
+	}
+	if label == `` {
+		return static
+	}
+	var added []string
+	for _, pair := range splitLabels(static) {
+		name := pair[:strings.Index(pair, `=`)]
+		if !hasLabel(label, name) {
+			added = append(added, pair)
+		}
+	}
+	if len(added) == 0 {
+		return label
+	}
+	return label + `,` + strings.Join(added, `,`)
+}
+
+// Split the contents of a label block into name="value" pairs, taking care
+// of commas inside quoted values
+func splitLabels(label string) []string {
+	var pairs []string
+	start := 0
+	quoted := false
+	for i := 0; i < len(label); i++ {
+		switch label[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				pairs = append(pairs, strings.TrimSpace(label[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if rest := strings.TrimSpace(label[start:]); rest != `` {
+		pairs = append(pairs, rest)
+	}
+	return pairs
+}
+
+func hasLabel(label, name string) bool {
+	for _, pair := range splitLabels(label) {
+		if strings.TrimSpace(pair[:strings.Index(pair+`=`, `=`)]) == name {
+			return true
+		}
+	}
+	return false
+}
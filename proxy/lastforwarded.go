@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Under targetsPath, the series of a target and when they were passed on
+const seriesSuffix = `/series`
+
+var oldestForwardedAge = selfMetrics.newGaugeVec(`frugalpromproxy_oldest_forwarded_age_seconds`, `Age of the oldest last forwarded time among the series of the last scrape of the target that were ever passed on.`, `target`)
+
+type seriesStatus struct {
+	Name          string      `json:"name"`
+	Labels        string      `json:"labels"`
+	Value         interface{} `json:"value"` // A number, or "NaN", "+Inf" or "-Inf"
+	Unchanged     int64       `json:"unchanged"`
+	LastForwarded *time.Time  `json:"last_forwarded"` // null when it never was
+	Rule          string      `json:"rule"`           // The staleness rule deciding about it
+}
+
+// GET /api/v1/targets/<name>/series: the series tracked by the unchanged
+// policies of a target, when each was last passed on and the rule deciding
+// about it. ?name= restricts the list to one metric name.
+func seriesHandler(w http.ResponseWriter, r *http.Request, scrapeTarget *ScrapeTarget) {
+	name := r.URL.Query().Get(`name`)
+	statuses := make([]seriesStatus, 0)
+	scrapeTarget.configMutex.Lock()
+	policies := scrapeTarget.staleness
+	scrapeTarget.configMutex.Unlock()
+	scrapeTarget.eachUnchangedSeries(func(series SeriesKey, state SeriesState) {
+		if name != `` && series.Name != name {
+			return
+		}
+		status := seriesStatus{Name: series.Name, Labels: series.Labels, Value: jsonValue(float64(state.Value)), Unchanged: state.Unchanged, Rule: policies.Rule(series.Name)}
+		if state.LastForwarded > 0 {
+			lastForwarded := time.Unix(0, state.LastForwarded*int64(time.Millisecond)).UTC()
+			status.LastForwarded = &lastForwarded
+		}
+		statuses = append(statuses, status)
+	})
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Name != statuses[j].Name {
+			return statuses[i].Name < statuses[j].Name
+		}
+		return statuses[i].Labels < statuses[j].Labels
+	})
+	w.Header().Set(`Content-Type`, `application/json`)
+	json.NewEncoder(w).Encode(statuses)
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func nodeSeries(t *testing.T, scrapeTarget *ScrapeTarget, query string) []seriesStatus {
+	t.Helper()
+	response := httptest.NewRecorder()
+	seriesHandler(response, httptest.NewRequest(http.MethodGet, targetsPath+`/node`+seriesSuffix+query, nil), scrapeTarget)
+	var statuses []seriesStatus
+	if err := json.Unmarshal(response.Body.Bytes(), &statuses); err != nil {
+		t.Fatalf(`answered %d %s`, response.Code, response.Body)
+	}
+	return statuses
+}
+
+func TestLastForwardedIsOnlyUpdatedWhenPassedOn(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	exporter, upstream := newFakeExporter(t, "node_load1 0.5\nnode_time_seconds 0\n")
+	p := newFakeClockProxy(t, clock, Config{StaleThreshold: 1, StartLive: true}, upstream)
+
+	for i := 0; i < 4; i++ {
+		exporter.serve("node_load1 0.5\nnode_time_seconds " + strconv.Itoa(i) + "\n")
+		if i > 0 {
+			clock.Advance(time.Minute)
+		}
+		scrapeNode(t, p)
+	}
+	// node_load1 was passed on in the first two scrapes only
+	statuses := nodeSeries(t, p.targets[`node`], `?name=node_load1`)
+	if len(statuses) != 1 || statuses[0].LastForwarded == nil || !statuses[0].LastForwarded.Equal(start.Add(time.Minute)) || statuses[0].Unchanged != 3 {
+		t.Fatalf(`node_load1 %+v`, statuses)
+	}
+	if statuses := nodeSeries(t, p.targets[`node`], ``); len(statuses) != 2 || statuses[1].Name != `node_time_seconds` || !statuses[1].LastForwarded.Equal(start.Add(3*time.Minute)) {
+		t.Errorf(`all series %+v`, statuses)
+	}
+	if age := selfMetricValue(oldestForwardedAge.selfMetric, `node`); age != 120 {
+		t.Errorf(`the oldest series was last passed on %gs ago, expected 120s`, age)
+	}
+
+	exporter.serve("node_load1 0.6\nnode_time_seconds 4\n")
+	clock.Advance(time.Minute)
+	scrapeNode(t, p)
+	if statuses := nodeSeries(t, p.targets[`node`], `?name=node_load1`); !statuses[0].LastForwarded.Equal(start.Add(4 * time.Minute)) {
+		t.Errorf(`after changing node_load1 %+v`, statuses)
+	}
+	if age := selfMetricValue(oldestForwardedAge.selfMetric, `node`); age != 0 {
+		t.Errorf(`with every series passed on the oldest is %gs old`, age)
+	}
+}
+
+func TestSeriesNeverPassedOnHaveNoLastForwarded(t *testing.T) {
+	_, upstream := newFakeExporter(t, "node_load1 0.5\n")
+	p := newFakeClockProxy(t, newFakeClock(), Config{}, upstream)
+	scrapeNode(t, p)
+	if statuses := nodeSeries(t, p.targets[`node`], ``); len(statuses) != 1 || statuses[0].LastForwarded != nil || statuses[0].Rule == `` {
+		t.Errorf(`a series starting stale %+v`, statuses)
+	}
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Listen arguments starting with this are Unix domain sockets
+const unixSocketPrefix = `unix://`
+
+// Permissions of the Unix domain sockets the proxy listens on
+var listenSocketMode socketMode = 0660
+
+// Where a listener binds: a TCP port on all interfaces like 9100, on one
+// address like 127.0.0.1:9100 or [::1]:9100, or a Unix domain socket like
+// unix:///run/frugalpromproxy/node.sock
+type listenAddress struct {
+	host   string // Empty for all interfaces
+	port   int
+	socket string // Path of the Unix domain socket, instead of host and port
+}
+
+func parseListenAddress(argument string) (listenAddress, error) {
+	if strings.HasPrefix(argument, unixSocketPrefix) {
+		socket := strings.TrimPrefix(argument, unixSocketPrefix)
+		if socket == `` {
+			return listenAddress{}, fmt.Errorf(`%s has no socket path`, argument)
+		}
+		return listenAddress{socket: socket}, nil
+	}
+	if port, err := strconv.Atoi(argument); err == nil {
+		return listenAddress{port: port}, nil
+	}
+	host, port, err := net.SplitHostPort(argument)
+	if err != nil {
+		return listenAddress{}, err
+	}
+	address := listenAddress{host: host}
+	if address.port, err = strconv.Atoi(port); err != nil {
+		return listenAddress{}, fmt.Errorf(`%s has no port number`, argument)
+	}
+	return address, nil
+}
+
+// As given on the command line, a bare port for all interfaces
+func (address listenAddress) String() string {
+	switch {
+	case address.socket != ``:
+		return unixSocketPrefix + address.socket
+	case address.host == ``:
+		return strconv.Itoa(address.port)
+	}
+	return net.JoinHostPort(address.host, strconv.Itoa(address.port))
+}
+
+// Name of the listener in logs and metrics, like :9100
+func (address listenAddress) name() string {
+	if address.socket != `` {
+		return address.String()
+	}
+	return net.JoinHostPort(address.host, strconv.Itoa(address.port))
+}
+
+func (address listenAddress) validPort() bool {
+	return address.socket != `` || address.port >= 1 && address.port <= 65535
+}
+
+// Bind the address. A socket file left behind by a crash is removed first,
+// as long as nothing answers on it anymore, and the socket gets
+// listenSocketMode. It is removed again when the listener is closed.
+func (address listenAddress) listen() (net.Listener, error) {
+	if address.socket == `` {
+		return net.Listen(`tcp`, address.name())
+	}
+	if err := removeStaleSocket(address.socket); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen(`unix`, address.socket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(address.socket, os.FileMode(listenSocketMode)); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func removeStaleSocket(socket string) error {
+	info, err := os.Lstat(socket)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf(`%s exists and isn't a socket`, socket)
+	}
+	if connection, err := net.DialTimeout(`unix`, socket, time.Second); err == nil {
+		connection.Close()
+		return fmt.Errorf(`%s is in use by another process`, socket)
+	}
+	return os.Remove(socket)
+}
+
+// The TCP ports of the addresses, for registering them
+func listenPortsOf(addresses []listenAddress) []int {
+	var ports []int
+	for _, address := range addresses {
+		if address.socket == `` {
+			ports = append(ports, address.port)
+		}
+	}
+	return ports
+}
+
+// Permissions given in octal, like 0660
+type socketMode os.FileMode
+
+func (mode *socketMode) String() string {
+	return fmt.Sprintf(`%#o`, uint32(*mode))
+}
+
+func (mode *socketMode) Set(value string) error {
+	parsed, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || parsed > 0777 {
+		return fmt.Errorf(`%s isn't an octal file mode like 0660`, value)
+	}
+	*mode = socketMode(parsed)
+	return nil
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListenAddressesAreParsed(t *testing.T) {
+	for _, test := range []struct {
+		argument     string
+		expected     listenAddress
+		name, string string
+	}{
+		{`19100`, listenAddress{port: 19100}, `:19100`, `19100`},
+		{`127.0.0.1:19100`, listenAddress{host: `127.0.0.1`, port: 19100}, `127.0.0.1:19100`, `127.0.0.1:19100`},
+		{`[::1]:19100`, listenAddress{host: `::1`, port: 19100}, `[::1]:19100`, `[::1]:19100`},
+		{`unix:///run/frugalpromproxy/node.sock`, listenAddress{socket: `/run/frugalpromproxy/node.sock`}, `unix:///run/frugalpromproxy/node.sock`, `unix:///run/frugalpromproxy/node.sock`},
+	} {
+		address, err := parseListenAddress(test.argument)
+		if err != nil || address != test.expected || address.name() != test.name || address.String() != test.string {
+			t.Errorf(`%s: %+v named %s, %v`, test.argument, address, address.name(), err)
+		}
+	}
+	for _, argument := range []string{`unix://`, `localhost`, `127.0.0.1:http`, `::1:19100`} {
+		if address, err := parseListenAddress(argument); err == nil {
+			t.Errorf(`%s parsed as %+v`, argument, address)
+		}
+	}
+}
+
+func TestSocketModesAreOctal(t *testing.T) {
+	var mode socketMode
+	if err := mode.Set(`0600`); err != nil || mode != 0600 || mode.String() != `0600` {
+		t.Errorf(`0600 is %s, %v`, mode.String(), err)
+	}
+	for _, value := range []string{`660`, `0660`} {
+		if err := mode.Set(value); err != nil || mode != 0660 {
+			t.Errorf(`%s is %s, %v`, value, mode.String(), err)
+		}
+	}
+	for _, value := range []string{`0888`, `rw-rw----`, `01000`} {
+		if err := mode.Set(value); err == nil {
+			t.Errorf(`%s was taken`, value)
+		}
+	}
+}
+
+// A client sending every request to the socket
+func socketClient(socket string) *http.Client {
+	return &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, `unix`, socket)
+	}}}
+}
+
+func TestScrapesAreServedOnUnixSockets(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.StartStale = false
+	defer func(mode socketMode) { listenSocketMode = mode }(listenSocketMode)
+	listenSocketMode = 0600
+	socket := filepath.Join(t.TempDir(), `node.sock`)
+	_, upstream := newFakeExporter(t, "node_load1 0.5\n")
+	sources, err := parseUpstreamArgument(upstream + `/metrics`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Left behind by a crash
+	stale, err := net.Listen(`unix`, socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	address := listenAddress{socket: socket}
+	listener, err := address.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf(`the socket has the mode %v, %v`, info.Mode().Perm(), err)
+	}
+	routes := []route{{path: basePath, sources: sources}}
+	mux := http.NewServeMux()
+	targets := routes[0].newTargets()
+	for _, scrapeTarget := range targets {
+		t.Cleanup(scrapeTarget.close)
+	}
+	routes[0].register(mux, address, targets)
+	server := &http.Server{Handler: mux}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(listener) }()
+
+	client := socketClient(socket)
+	if code, body := get(t, client, `http://node`+basePath); code != http.StatusOK || strings.Join(seriesLines(body), "\n") != `node_load1 0.5` {
+		t.Errorf(`the socket answered %d %q`, code, body)
+	}
+	// Taken by a running proxy
+	if _, err := address.listen(); err == nil || !strings.Contains(err.Error(), `in use`) {
+		t.Errorf(`listened on a socket in use: %v`, err)
+	}
+
+	// The socket is gone after a graceful shutdown
+	client.CloseIdleConnections()
+	server.Shutdown(context.Background())
+	if err := <-served; err != http.ErrServerClosed {
+		t.Error(err)
+	}
+	if _, err := os.Lstat(socket); !os.IsNotExist(err) {
+		t.Errorf(`the socket is left after the shutdown: %v`, err)
+	}
+}
+
+func TestFilesAreNotTakenForStaleSockets(t *testing.T) {
+	file := filepath.Join(t.TempDir(), `node.sock`)
+	if err := ioutil.WriteFile(file, []byte(`data`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (listenAddress{socket: file}).listen(); err == nil || !strings.Contains(err.Error(), `isn't a socket`) {
+		t.Errorf(`listened over a file: %v`, err)
+	}
+	if content, _ := ioutil.ReadFile(file); string(content) != `data` {
+		t.Error(`the file was replaced`)
+	}
+}
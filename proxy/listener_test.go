@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Serve a listener for the upstream in this process like listener does,
+// returning its URL and its server
+func startListener(t *testing.T, upstream string) (string, *http.Server) {
+	t.Helper()
+	sources, err := parseUpstreamArgument(upstream + `/metrics`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bound, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listenAddress{host: `127.0.0.1`, port: bound.Addr().(*net.TCPAddr).Port}
+	routes := []route{{path: basePath, sources: sources}}
+	mux := http.NewServeMux()
+	for _, route := range routes {
+		targets := route.newTargets()
+		for _, scrapeTarget := range targets {
+			t.Cleanup(scrapeTarget.close)
+		}
+		route.register(mux, address, targets)
+	}
+	mux.HandleFunc(`/`, routeNotFound(routes))
+	handleCommonEndpoints(address.name(), mux)
+	server := newListenerServer(address.name(), address, mux)
+	served := make(chan error, 1)
+	go func() { served <- serveOn(bound, server) }()
+	t.Cleanup(func() {
+		shutdownListener(context.Background(), server)
+		if err := <-served; err != nil {
+			t.Errorf(`listener %s: %v`, address.name(), err)
+		}
+	})
+	return `http://` + address.name(), server
+}
+
+// Two port pairs run as two independent proxies
+func TestListenersServeTheirOwnUpstream(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.StartStale = false
+	_, node := newFakeExporter(t, "node_load1 0.5\n")
+	_, app := newFakeExporter(t, "app_requests_total 7\n")
+	nodeListener, _ := startListener(t, node)
+	appListener, _ := startListener(t, app)
+
+	for i := 0; i < 2; i++ {
+		if code, body := get(t, http.DefaultClient, nodeListener+basePath); code != http.StatusOK || strings.Join(seriesLines(body), "\n") != `node_load1 0.5` {
+			t.Errorf(`the node listener answered %d %q`, code, body)
+		}
+		if code, body := get(t, http.DefaultClient, appListener+basePath); code != http.StatusOK || strings.Join(seriesLines(body), "\n") != `app_requests_total 7` {
+			t.Errorf(`the app listener answered %d %q`, code, body)
+		}
+	}
+	if code, _ := get(t, http.DefaultClient, nodeListener+healthyPath); code != http.StatusOK {
+		t.Errorf(`the node listener answered %d on %s`, code, healthyPath)
+	}
+}
+
+func TestShutdownLetsRequestsInFlightFinish(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.StartStale = false
+	exporter, upstream := newSlowExporter(t)
+	listenerURL, server := startListener(t, upstream)
+
+	answered := make(chan string, 1)
+	go func() {
+		_, body := get(t, http.DefaultClient, listenerURL+basePath)
+		answered <- body
+	}()
+	exporter.waitForFetches(t, 1)
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- shutdownListener(context.Background(), server) }()
+	select {
+	case err := <-shutdown:
+		t.Fatalf(`shut down with a request in flight: %v`, err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(exporter.release)
+	if body := <-answered; !strings.HasSuffix(body, "\nup 1\n") {
+		t.Errorf(`the request in flight was answered %q`, body)
+	}
+	if err := <-shutdown; err != nil {
+		t.Error(err)
+	}
+}
+
+// Shut down every listener like on SIGTERM, opening them again for the
+// tests after
+func shutdownAllListeners(t *testing.T, grace time.Duration) chan error {
+	t.Cleanup(func() {
+		listeners.mu.Lock()
+		listeners.closed = false
+		listeners.mu.Unlock()
+	})
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		shutdown <- shutdownListeners(ctx)
+	}()
+	return shutdown
+}
+
+func TestShutdownDrainsEveryListener(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.StartStale = false
+	exporter, upstream := newSlowExporter(t)
+	slowURL, _ := startListener(t, upstream)
+	_, node := newFakeExporter(t, "node_load1 0.5\n")
+	nodeURL, _ := startListener(t, node)
+
+	answered := make(chan string, 1)
+	go func() {
+		_, body := get(t, http.DefaultClient, slowURL+basePath)
+		answered <- body
+	}()
+	exporter.waitForFetches(t, 1)
+	shutdown := shutdownAllListeners(t, 5*time.Second)
+	// The idle listener stops taking requests while the slow one drains
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if code, _ := get(t, client, nodeURL+basePath); code == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(`the idle listener kept answering after the shutdown`)
+		}
+	}
+	close(exporter.release)
+	if body := <-answered; !strings.HasSuffix(body, "\nup 1\n") {
+		t.Errorf(`the request in flight was answered %q`, body)
+	}
+	if err := <-shutdown; err != nil {
+		t.Error(err)
+	}
+
+	// A listener starting late doesn't serve anymore
+	bound, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := serveOn(bound, &http.Server{}); err != nil {
+		t.Errorf(`a listener starting after the shutdown returned %v`, err)
+	}
+}
+
+func TestRequestsOutlastingTheGracePeriodAreCutOff(t *testing.T) {
+	useCommandLineSettings(t)
+	exporter, upstream := newSlowExporter(t)
+	slowURL, _ := startListener(t, upstream)
+
+	answered := make(chan int, 1)
+	go func() {
+		code, _ := get(t, http.DefaultClient, slowURL+basePath)
+		answered <- code
+	}()
+	exporter.waitForFetches(t, 1)
+	if err := <-shutdownAllListeners(t, 50*time.Millisecond); err != context.DeadlineExceeded {
+		t.Errorf(`shut down with %v`, err)
+	}
+	if code := <-answered; code != 0 {
+		t.Errorf(`a request cut off was answered %d`, code)
+	}
+}
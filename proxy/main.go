@@ -0,0 +1,1164 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/pdxiv/frugalpromproxy/parser"
+	"github.com/pdxiv/frugalpromproxy/staleness"
+)
+
+// Per-listener rate limiting of incoming scrapes
+var rateLimit float64
+var rateBurst int
+
+// Source addresses that may connect to the listeners, and the proxies whose
+// X-Forwarded-For header is believed
+var allowedCIDRs, trustedProxies cidrList
+
+// Set when the listeners serve TLS
+var tlsConfig *tls.Config
+
+// How upstream host names are resolved
+var dnsRefreshInterval time.Duration
+var dnsAddressFamily string
+
+// Targets are scraped in the background instead of on every request when set
+var scrapeInterval, scrapeJitter time.Duration
+
+// Upper limit for upstream fetches, and the margin left to the scraper's own timeout
+var scrapeTimeout, scrapeTimeoutOffset time.Duration
+
+// Like Prometheus' default scrape_timeout, so a hung upstream can't keep
+// requests waiting forever
+const defaultScrapeTimeout = 10 * time.Second
+
+// What to do when too much of the upstream output can't be parsed
+var parseErrorThreshold float64
+var parseErrorPolicy string
+
+// What to do with families exported by more than one merged upstream
+var mergeCollisionPolicy string
+
+// Scrapes of ?target= on every listener, nil when disabled
+var dynamic *dynamicTargets
+
+// Pushes every background scrape, nil when disabled
+var remoteWrite *remoteWriter
+
+// Listener serving the targets found by service discovery
+var discoveryPort int
+var discoveryGrace time.Duration
+
+// Shared by the targets of the command line, limits concurrent upstream
+// fetches
+var upstreamFetches *fetchLimiter
+
+const basePath = `/metrics`
+const defaultStaleThreshold = staleness.DefaultThreshold
+
+var staleThreshold int64 = defaultStaleThreshold // This decides how many times a value can be unchanged before it is blocked from sending, 0 or less never blocks
+var startStale = true
+
+// Take a new upstream timestamp with the same value for a change
+var timestampIsChange bool
+
+type MetricType int32
+
+const (
+	histogram MetricType = iota
+	summary
+	untyped
+	counter
+	gauge
+)
+
+var typeText = [...]string{
+	`histogram`,
+	`summary`,
+	`untyped`,
+	`counter`,
+	`gauge`,
+}
+
+type ScrapeTarget struct {
+	name      string
+	settings  *proxySettings // Shared with the other targets of its Proxy, or of the command line
+	upstreams *upstreamSelector
+	client    *http.Client
+	resolver  *upstreamResolver
+	schedule  *scrapeSchedule // nil unless scraped in the background
+	params    url.Values      // Static query parameters for the upstream
+	paths     []string        // All paths scraped on the upstream, when there are several
+
+	hostHeader string // Sent instead of the upstream's host, if set
+	serverName string // Sent for SNI and verified instead of the upstream's host, if set
+
+	// Held while a scrape decides on staleness and saves the state, so
+	// overlapping scrapes take turns
+	stateMutex sync.Mutex
+	lastForget time.Time // When the vanished series were last looked for
+
+	created time.Time // Start of its cumulative series, like the OTLP sums
+
+	lastScrapeAt    time.Time
+	averageInterval time.Duration // Between scrapes, rolling
+	delayWarned     bool          // The implied suppression delay was logged as too long
+
+	lastWall      time.Time     // Of the previous scrape, for noticing clock jumps
+	lastMonotonic time.Duration // Of the clock at the previous scrape
+
+	sharedMutex sync.Mutex
+	shared      map[string]*sharedScrape // Running scrape requests by upstream request
+
+	configMutex           sync.Mutex // Replaced together on a reload
+	staleness             *staleness.Policies
+	transformers          []Transformer      // Applied to every scrape before staleness is decided
+	names                 nameFilter         // Metric names dropped right after parsing
+	credentials           credentials        // Sent to the upstream
+	defaults              staleness.Defaults // Of the unchanged policies
+	pruneState            bool               // The next scrape forgets the series it doesn't have
+	sampleLimit           int                // Samples a scrape may have after the transformers, 0 means no limit
+	sampleLimitFailClosed bool               // Fail the scrape instead of leaving out families
+
+	timeout       time.Duration // Upper limit for an upstream fetch, 0 means none
+	timeoutOffset time.Duration // Subtracted from the scraper's timeout
+
+	parseErrorThreshold  float64 // Fraction of unparseable lines tolerated, 0 disables the check
+	parseErrorFailClosed bool    // Fail the scrape instead of serving what could be parsed
+
+	staticLabelsMutex sync.Mutex
+	staticLabels      string // Rendered labels added to every series, if any
+
+	latestMutex sync.Mutex
+	latest      []outputFamily // Result of the last successful background scrape
+	latestErr   error          // Of the last background scrape, nil once one succeeded
+
+	journal *deltaJournal // Changes of the last scrapes for ?since=, nil if disabled
+
+	suppressedMutex sync.Mutex
+	suppressed      []outputFamily // Series withheld from the last scrape
+
+	rawMutex sync.Mutex
+	raw      []outputFamily // Everything parsed in the last scrape, unfiltered
+	rawAt    time.Time
+
+	cachedMutex sync.Mutex
+	cached      *cachedOutput // Of the last successful scrape on request, for -serve-stale-on-error
+
+	protocolMutex sync.Mutex
+	protocol      string // Of the last upstream response, like HTTP/2.0
+
+	stop     chan struct{}  // Closed when the target is no longer served
+	scraping sync.WaitGroup // The background scrape loop, waited for when closing
+}
+
+type MetricData struct {
+	commentType MetricType
+	commentHelp string
+	label       map[string]LabelSet
+	children    map[string]map[string]LabelSet // Series of a histogram or summary by name, like <name>_bucket
+	position    int                            // Of the family in the upstream body, it is served in that order
+}
+
+// A series of a family, its staleness is kept by the policies
+type LabelSet struct {
+	value     float64
+	timestamp int64 // Milliseconds, 0 when the upstream gave none
+	position  int   // Of the series in its family in the upstream body
+}
+
+func (scrapeTarget *ScrapeTarget) handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodHead {
+		scrapeTarget.head(w, r)
+		return
+	}
+	if _, ok := r.URL.Query()[`since`]; ok && scrapeTarget.journal != nil {
+		scrapeTarget.deltaHandler(w, r)
+		return
+	}
+	families, err := scrapeTarget.families(r)
+	if err != nil {
+		if !scrapeTarget.answerCached(w, r, err) {
+			scrapeTarget.scrapeFailed(w, err)
+		}
+		return
+	}
+	counted := &countingWriter{ResponseWriter: w}
+	writeFamilies(counted, r, families, scrapeTarget.now())
+	servedBytes.add(float64(counted.bytes), []string{scrapeTarget.name})
+}
+
+// The families to serve for a request, either from a fresh scrape or from
+// the latest background scrape
+func (scrapeTarget *ScrapeTarget) families(r *http.Request) ([]outputFamily, error) {
+	ctx := r.Context()
+	if timeout := scrapeTarget.scrapeTimeout(r); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return scrapeTarget.currentFamilies(ctx, scrapeTarget.servedRequest(r))
+}
+
+// Fetch the upstream, update the staleness state and return what should be
+// passed on
+func (scrapeTarget *ScrapeTarget) scrape(ctx context.Context, request upstreamRequest) (*ScrapeResult, error) {
+	if len(scrapeTarget.paths) > 1 {
+		return scrapeTarget.scrapePaths(ctx, request)
+	}
+	start := scrapeTarget.now()
+	resp, err := scrapeTarget.fetch(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf(`%s: %w`, scrapeTarget.name, err)
+	}
+	defer resp.Body.Close()
+	body, err := readBody(resp.Body, resp.Request.URL.String())
+	if err != nil {
+		return nil, fmt.Errorf(`%s: %w`, scrapeTarget.name, err)
+	}
+
+	if upstreamRecorder != nil {
+		upstreamRecorder.record(scrapeTarget.name, resp, body)
+	}
+
+	upstream := UpstreamInfo{URL: resp.Request.URL.String(), Status: resp.StatusCode, Protocol: resp.Proto, Duration: scrapeTarget.since(start), Bytes: len(body)}
+	stringBody := string(body)
+	if pushed != nil && pushed.target == scrapeTarget.name {
+		stringBody += "\n" + pushed.exposition()
+	}
+	result, err := scrapeTarget.process(stringBody, resp.Header.Get(`Content-Type`))
+	if err != nil {
+		return nil, err
+	}
+	result.Upstream = upstream
+	return result, nil
+}
+
+// Run an upstream body through the parser and the staleness filter. An
+// empty content type skips the content check.
+func (scrapeTarget *ScrapeTarget) process(stringBody, contentType string) (*ScrapeResult, error) {
+	var rejected []ParseError
+	data, lines := parseExposition(stringBody, func(number int, line string) {
+		rejected = append(rejected, ParseError{Line: number, Text: line})
+	})
+	if err := checkContent(contentType, data, len(rejected)); err != nil {
+		return nil, fmt.Errorf(`%s: %w`, scrapeTarget.name, err)
+	}
+	return scrapeTarget.processParsed(data, rejected, lines)
+}
+
+// Run parsed upstream data through the staleness filter, returning the
+// families to serve
+func (scrapeTarget *ScrapeTarget) processParsed(data map[string]MetricData, rejected []ParseError, lines int) (*ScrapeResult, error) {
+	parseWarning, err := scrapeTarget.checkParseErrors(rejected, lines)
+	if err != nil {
+		return nil, fmt.Errorf(`%s: %w`, scrapeTarget.name, err)
+	}
+
+	result := &ScrapeResult{Warnings: rejected}
+	var families, suppressed []outputFamily
+	staticLabels := withStaticLabels(scrapeTarget.currentStaticLabels(), tenantLabels())
+	scrapeTarget.stateMutex.Lock()
+	defer scrapeTarget.stateMutex.Unlock()
+	scrapeTarget.configMutex.Lock()
+	policies, chain, prune := scrapeTarget.staleness, scrapeTarget.transformers, scrapeTarget.pruneState
+	scrapeTarget.configMutex.Unlock()
+	var seen map[SeriesKey]bool // Series of this scrape, when it prunes the state
+	if prune {
+		seen = make(map[SeriesKey]bool)
+	}
+	scrapeTarget.filterNames(data)
+	if len(chain) > 0 {
+		data = scrapeTarget.transform(data, chain)
+	}
+	if data, err = scrapeTarget.checkSampleLimit(data); err != nil {
+		return nil, fmt.Errorf(`%s: %w`, scrapeTarget.name, err)
+	}
+
+	now := scrapeTarget.now()
+	jumped := scrapeTarget.detectClockJump(policies, now)
+	scrapeTarget.observeCadence(now, jumped)
+	decisions := make(ruleCounts)
+	for _, name := range orderedNames(data) {
+		content := data[name]
+		family := outputFamily{name: name, help: content.commentHelp, metricType: content.commentType}
+		withheld := outputFamily{name: name, help: suppressedHelp + content.commentHelp, metricType: content.commentType}
+		// The series of a histogram or summary are only passed on together,
+		// as long as one of them is
+		grouped := len(content.children) > 0
+		var groupForwarded bool
+		var groupLines []string
+		var groupKeys []SeriesKey
+		var groupSeries []familySeries
+		for _, series := range content.series(name) {
+			key := SeriesKey{Name: series.name, Labels: series.labels}
+			decision := policies.Observe(key, Sample{Value: series.value, Timestamp: series.timestamp, Type: typeText[content.commentType]}, now)
+			if prune {
+				seen[key] = true
+			}
+			line := seriesLine(series.name, withStaticLabels(series.labels, staticLabels), series.value, series.timestamp)
+			switch {
+			case grouped:
+				groupForwarded = groupForwarded || decision == Forward
+				groupLines = append(groupLines, line)
+				groupKeys = append(groupKeys, key)
+				groupSeries = append(groupSeries, series)
+			case decision == Forward:
+				result.Forwarded++
+				family.lines = append(family.lines, line)
+				policies.Forwarded(key, now)
+			default:
+				result.Suppressed++
+				rule := policies.Rule(series.name)
+				decisions[rule]++
+				if serveSuppressed {
+					withheld.lines = append(withheld.lines, withheldLine(series, withStaticLabels(series.labels, staticLabels), rule))
+				}
+			}
+		}
+		switch {
+		case groupForwarded:
+			result.Forwarded += len(groupLines)
+			family.lines = groupLines
+			for _, key := range groupKeys {
+				policies.Forwarded(key, now)
+			}
+		case grouped:
+			// Withheld together, but every series by its own rule
+			result.Suppressed += len(groupLines)
+			for i, key := range groupKeys {
+				rule := policies.Rule(key.Name)
+				decisions[rule]++
+				if serveSuppressed {
+					withheld.lines = append(withheld.lines, withheldLine(groupSeries[i], withStaticLabels(key.Labels, staticLabels), rule))
+				}
+			}
+		}
+
+		if len(family.lines) > 0 {
+			families = append(families, family)
+		}
+		if len(withheld.lines) > 0 {
+			suppressed = append(suppressed, withheld)
+		}
+	}
+	decisions.report(scrapeTarget.name)
+	seriesForwarded.set(float64(result.Forwarded), scrapeTarget.name)
+	seriesSuppressed.set(float64(result.Suppressed), scrapeTarget.name)
+	if oldest := policies.Flush(); !oldest.IsZero() {
+		oldestForwardedAge.set(now.Sub(oldest).Seconds(), scrapeTarget.name)
+	}
+	if file := stateFileFor(scrapeTarget.name); file != nil {
+		file.scraped()
+	}
+	if !jumped {
+		scrapeTarget.forgetVanished(policies, now)
+	}
+	if prune {
+		if removed := policies.Prune(seen); removed > 0 {
+			log.Printf("%s: forgot the state of %d series the new transformers or name filters leave out", scrapeTarget.name, removed)
+		}
+		scrapeTarget.configMutex.Lock()
+		scrapeTarget.pruneState = false
+		scrapeTarget.configMutex.Unlock()
+	}
+	if serveSuppressed {
+		scrapeTarget.setSuppressed(suppressed)
+	}
+	if serveRaw {
+		scrapeTarget.setRaw(rawFamilies(data, staticLabels))
+	}
+	if emitTargetInfo {
+		families = append(families, scrapeTarget.targetInfo(data, staticLabels))
+	}
+	if parseWarning != nil {
+		families = append(families, *parseWarning)
+	}
+	result.families = families
+	return result, nil
+}
+
+// Parse an exposition into data, calling rejected for every line that
+// couldn't be parsed. Also returns the number of lines that aren't blank.
+func parseExposition(stringBody string, rejected func(number int, line string)) (map[string]MetricData, int) {
+	families, parseErrors, lines := parser.ParseCounting(strings.NewReader(stringBody))
+	for _, parseError := range parseErrors {
+		rejected(parseError.Line, parseError.Text)
+	}
+
+	data := make(map[string]MetricData, len(families))
+	for position, family := range families {
+		content := MetricData{commentType: metricType(family.Type), commentHelp: family.Help, position: position}
+		if len(family.Series) > 0 {
+			content.label = make(map[string]LabelSet, len(family.Series))
+		}
+		for i, series := range family.Series {
+			// A repeated series keeps its first place and its last value
+			if previous, ok := content.label[series.Labels]; ok {
+				i = previous.position
+			}
+			content.label[series.Labels] = LabelSet{value: series.Value, timestamp: series.Timestamp, position: i}
+		}
+		data[family.Name] = content
+	}
+	groupChildren(data)
+	return data, lines
+}
+
+// Main runs the frugalpromproxy command line: the proxy itself, or one of
+// its subcommands
+func Main() {
+	// Subcommands, besides running the proxy
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case `replay`:
+			replayCommand(os.Args[2:])
+			return
+		case `diff`:
+			diffCommand(os.Args[2:])
+			return
+		case `parse`:
+			parseCommand(os.Args[2:])
+			return
+		case `mockexporter`:
+			mockExporterCommand(os.Args[2:])
+			return
+		}
+	}
+
+	flag.Float64Var(&rateLimit, `rate-limit`, 0, `Maximum sustained scrapes per second accepted by each listener (0 means unlimited)`)
+	flag.IntVar(&rateBurst, `rate-burst`, 5, `Number of scrapes a listener accepts in a burst above the rate limit`)
+	flag.IntVar(&maxListenerRequests, `max-listener-requests`, 100, `Maximum number of requests each listener serves at the same time, more are answered with 503 (0 means unlimited)`)
+	flag.Var(&listenSocketMode, `listen-socket-mode`, `Permissions of the Unix sockets listened on, in octal`)
+	flag.Var(&allowedCIDRs, `allow-cidr`, `Comma separated CIDR ranges allowed to connect to the listeners, may be repeated (default allows everyone)`)
+	flag.Var(&listenerCIDRs, `listener-allow-cidr`, `Listen address and the comma separated CIDR ranges allowed to connect to it instead of -allow-cidr, like 19100=10.0.0.0/8, may be repeated`)
+	flag.Var(&trustedProxies, `trusted-proxies`, `Comma separated CIDR ranges of proxies whose X-Forwarded-For header is trusted, may be repeated`)
+	var tlsSettings listenerTLS
+	flag.StringVar(&tlsSettings.certFile, `tls-cert-file`, ``, `Certificate for serving the listeners over TLS`)
+	flag.StringVar(&tlsSettings.keyFile, `tls-key-file`, ``, `Private key for serving the listeners over TLS`)
+	flag.StringVar(&tlsSettings.clientAuth, `tls-client-auth-type`, ``, `Client certificate policy: NoClientCert, RequestClientCert, RequireAnyClientCert, VerifyClientCertIfGiven or RequireAndVerifyClientCert`)
+	flag.StringVar(&tlsSettings.clientCAFile, `tls-client-ca-file`, ``, `CA certificates used to verify client certificates`)
+	flag.StringVar(&tlsSettings.clientNames, `tls-client-allowed-names`, ``, `Comma separated SANs or CNs accepted in client certificates (default accepts any verified certificate)`)
+	flag.Var(&listenerClientNames, `listener-tls-client-allowed-names`, `Listen address and the comma separated SANs or CNs accepted by it instead of -tls-client-allowed-names, like 19100=prometheus.example, may be repeated`)
+	flag.DurationVar(&dnsRefreshInterval, `dns-refresh-interval`, 30*time.Second, `How long resolved upstream addresses are reused before looking them up again`)
+	flag.StringVar(&dnsAddressFamily, `dns-address-family`, `ip`, `Address family used for upstream connections: ip (any), ip4 or ip6`)
+	flag.DurationVar(&scrapeInterval, `scrape-interval`, 0, `Scrape the upstreams in the background at this interval and serve the latest result (default scrapes on every request)`)
+	flag.DurationVar(&scrapeJitter, `scrape-jitter`, 500*time.Millisecond, `Maximum random delay added to every background scrape`)
+	flag.DurationVar(&scrapeTimeout, `scrape-timeout`, defaultScrapeTimeout, `Maximum time for an upstream fetch, answered with 504 when it runs out (0 means no limit besides the scraper's own timeout)`)
+	flag.DurationVar(&scrapeTimeoutOffset, `scrape-timeout-offset`, 500*time.Millisecond, `Subtracted from the scraper's X-Prometheus-Scrape-Timeout-Seconds to leave time for the response`)
+	flag.Float64Var(&parseErrorThreshold, `parse-error-threshold`, 0, `Fraction of upstream lines that may fail to parse before -parse-error-policy applies (0 disables the check)`)
+	flag.IntVar(&contentCheckMinSamples, `content-check-min-samples`, 10, `Fail scrapes whose upstream Content-Type isn't an exposition format when the body has fewer samples than this (0 disables this part of the check)`)
+	flag.Float64Var(&contentCheckMinRatio, `content-check-min-ratio`, 0.5, `Fail scrapes whose upstream Content-Type isn't an exposition format when less than this fraction of the lines that aren't comments are samples (0 disables this part of the check)`)
+	flag.StringVar(&parseErrorPolicy, `parse-error-policy`, `open`, `Above the parse error threshold either fail the scrape (closed) or serve what parsed with a warning gauge (open)`)
+	flag.IntVar(&sampleLimit, `sample-limit`, 0, `Samples a scrape may have after the transformers before -sample-limit-policy applies (0 means no limit)`)
+	flag.StringVar(&sampleLimitPolicy, `sample-limit-policy`, `closed`, `Above the sample limit either fail the scrape (closed) or serve the first families by name that fit (open)`)
+	flag.IntVar(&deltaJournalSize, `delta-journal-size`, 0, `Scrapes of each target kept for ?since= requests that only want the series changed since their cursor (0 disables them)`)
+	flag.DurationVar(&deltaJournalTTL, `delta-journal-ttl`, time.Hour, `Drop scrapes older than this from the ?since= journal (0 keeps them until the journal is full)`)
+	flag.BoolVar(&allowDuplicateUpstreams, `allow-duplicate-upstreams`, false, `Scrape an upstream for several listen ports or paths without a warning`)
+	flag.StringVar(&mergeCollisionPolicy, `merge-collision`, ``, `What to do with families exported by more than one merged upstream: error, prefix (with the upstream name) or merge (default error, merge with -merge-label)`)
+	flag.StringVar(&mergeLabel, `merge-label`, ``, `Label added to every series of merged upstreams, holding the upstream name, like upstream for node=9100+postgres=9187`)
+	dynamicEnabled := flag.Bool(`dynamic-targets`, false, `Scrape the upstream in the target query parameter under /proxy on every listener`)
+	var dynamicAllowlist targetAllowlist
+	flag.Var(&dynamicAllowlist, `dynamic-targets-allow`, `Comma separated CIDR ranges and hostname patterns (like *.internal.example) dynamic targets may point at, may be repeated`)
+	dynamicMax := flag.Int(`dynamic-targets-max`, 100, `Number of dynamic targets whose state is kept, the least recently scraped is forgotten first`)
+	flag.Var(&passthroughParams, `passthrough-params`, `Comma separated query parameters of the scrape request passed on to the upstream, like match[] for federation, may be repeated`)
+	flag.Var(&forwardHeaders, `forward-headers`, `Comma separated headers of the scrape request copied onto the upstream request, may be repeated`)
+	flag.BoolVar(&forwardAuthorization, `forward-authorization`, false, `Allow -forward-headers to include Authorization, passing the scraper's credentials on to the upstream`)
+	remoteWriteURL := flag.String(`remote-write-url`, ``, `Push the series of every background scrape to this Prometheus remote_write endpoint (needs -scrape-interval)`)
+	remoteWriteUsername := flag.String(`remote-write-username`, ``, `Username for basic authentication against the remote_write endpoint`)
+	remoteWritePasswordFile := flag.String(`remote-write-password-file`, ``, `File holding the password for basic authentication against the remote_write endpoint`)
+	remoteWriteTokenFile := flag.String(`remote-write-bearer-token-file`, ``, `File holding a bearer token for the remote_write endpoint`)
+	remoteWriteJob := flag.String(`remote-write-job`, `frugalpromproxy`, `job label of the pushed series, the instance label is the target name`)
+	remoteWriteQueue := flag.Int(`remote-write-max-queue`, 100, `Number of scrapes kept while the remote_write endpoint can't be reached, the oldest is dropped first`)
+	pushgatewayURL := flag.String(`pushgateway-url`, ``, `Periodically push the filtered metrics of every target to this Pushgateway (needs -scrape-interval)`)
+	pushgatewayJob := flag.String(`pushgateway-job`, `frugalpromproxy`, `job the targets are pushed under`)
+	pushgatewayInstanceLabel := flag.String(`pushgateway-instance-label`, `instance`, `Grouping label holding the target name`)
+	pushgatewayGrouping := flag.String(`pushgateway-grouping`, ``, `Further grouping labels for the pushes, as comma separated name=value pairs`)
+	pushgatewayMethod := flag.String(`pushgateway-method`, `PUT`, `PUT replaces everything pushed for a group before, POST only replaces the pushed metric families`)
+	pushgatewayInterval := flag.Duration(`pushgateway-interval`, 15*time.Second, `How often the targets are pushed`)
+	otlpEndpoint := flag.String(`otlp-endpoint`, ``, `Periodically export the filtered metrics of every target to this OTLP/HTTP endpoint, e.g. http://collector:4318/v1/metrics (needs -scrape-interval)`)
+	otlpHeaders := flag.String(`otlp-headers`, ``, `Headers for the OTLP export as comma separated name=value pairs, e.g. for authentication`)
+	otlpInterval := flag.Duration(`otlp-interval`, 15*time.Second, `How often the targets are exported over OTLP`)
+	textfileDirectory := flag.String(`textfile-directory`, ``, `Periodically write the filtered metrics of every target to <target>.prom files in this directory, for node_exporter's textfile collector (needs -scrape-interval)`)
+	textfileInterval := flag.Duration(`textfile-interval`, 15*time.Second, `How often the textfiles are written`)
+	textfileMaxAge := flag.Duration(`textfile-max-age`, 5*time.Minute, `Remove a target's textfile when it couldn't be written for this long`)
+	pushTarget := flag.String(`push-target`, ``, `Accept pushed expositions under /push/<group> on every listener, and serve them with this target, e.g. localhost:9100`)
+	pushTTL := flag.Duration(`push-ttl`, 5*time.Minute, `How long pushed series are served when the group isn't pushed again, unless the push sets ?ttl=`)
+	pushMaxBytes := flag.Int64(`push-max-bytes`, 1<<20, `Largest accepted push`)
+	pushTokenFile := flag.String(`push-bearer-token-file`, ``, `File holding a bearer token required for pushing`)
+	flag.StringVar(&tenant, `tenant`, ``, `Tenant sent in the tenant header of remote_write, OTLP and Pushgateway pushes`)
+	flag.StringVar(&tenantHeader, `tenant-header`, `X-Scope-OrgID`, `Header carrying the tenant`)
+	flag.BoolVar(&requireTenant, `require-tenant`, false, `Reject scrapes without the tenant header, or with another tenant than -tenant`)
+	flag.StringVar(&tenantLabel, `tenant-label`, ``, `Add the tenant to every series as a label with this name`)
+	recordDirectory := flag.String(`record-directory`, ``, `Save every raw upstream response with a JSON sidecar under <directory>/<target>/, to reproduce problems later`)
+	recordMaxFiles := flag.Int(`record-max-files`, 1000, `Recorded responses kept per target, the oldest are removed first (0 means no limit)`)
+	recordMaxBytes := flag.Int64(`record-max-bytes`, 100<<20, `Total size of the recorded responses kept per target (0 means no limit)`)
+	recordQueue := flag.Int(`record-queue`, 100, `Responses waiting to be written before further ones are dropped`)
+	flag.BoolVar(&serveSuppressed, `serve-suppressed`, false, `Serve the series withheld from the last scrape under <path>/suppressed, for auditing`)
+	flag.BoolVar(&emitTargetInfo, `target-info`, false, `Add a target_info series with the target name and its static labels to every target, never suppressed`)
+	flag.BoolVar(&targetInfoBuild, `target-info-build-info`, false, `Also copy the labels of the upstream's *_build_info series into target_info`)
+	flag.BoolVar(&headProbe, `head-probe`, false, `Answer HEAD requests according to a HEAD request to the upstream (default answers without contacting the upstream)`)
+	corsOrigins := flag.String(`cors-allowed-origins`, ``, `Comma separated origins allowed to use the admin and debug endpoints from a browser, * for any (default no CORS)`)
+	corsMethods := flag.String(`cors-allowed-methods`, `GET, HEAD`, `Methods allowed in CORS requests`)
+	corsHeaders := flag.String(`cors-allowed-headers`, ``, `Headers allowed in CORS requests`)
+	corsMaxAge := flag.Duration(`cors-max-age`, 10*time.Minute, `How long browsers may cache a CORS preflight answer`)
+	corsCredentials := flag.Bool(`cors-allow-credentials`, false, `Allow CORS requests with credentials, not possible with -cors-allowed-origins *`)
+	flag.BoolVar(&upstreamInsecureSkipVerify, `upstream-insecure-skip-verify`, false, `Accept any certificate from https upstreams, for self-signed exporters`)
+	upstreamUsername := flag.String(`upstream-username`, ``, `Username for basic authentication against the upstreams`)
+	upstreamPasswordFile := flag.String(`upstream-password-file`, ``, `File holding the password for basic authentication against the upstreams ($`+upstreamPasswordEnv+` takes precedence)`)
+	upstreamTokenFile := flag.String(`upstream-bearer-token-file`, ``, `File holding a bearer token for the upstreams ($`+upstreamBearerTokenEnv+` takes precedence)`)
+	listenUsername := flag.String(`listen-username`, ``, `Require basic authentication with this username on the listeners`)
+	listenPasswordFile := flag.String(`listen-password-file`, ``, `File holding the password required with -listen-username ($`+listenPasswordEnv+` takes precedence)`)
+	listenTokenFile := flag.String(`listen-bearer-token-file`, ``, `File holding a bearer token required on the listeners ($`+listenBearerTokenEnv+` takes precedence)`)
+	flag.BoolVar(&upstreamH2C, `upstream-h2c`, false, `Talk HTTP/2 without TLS (h2c) to the upstreams, falling back to HTTP/1.1 for upstreams that don't support it`)
+	flag.DurationVar(&shutdownGracePeriod, `shutdown-grace-period`, 10*time.Second, `How long the requests in flight may take to finish on SIGINT or SIGTERM before they are cut off (0 waits as long as they take)`)
+	flag.BoolVar(&serveRaw, `serve-raw`, false, `Serve the parsed upstream metrics without suppression under <path>/raw, for spot checks`)
+	flag.BoolVar(&serveStaleOnError, `serve-stale-on-error`, false, `Answer a scrape the upstream failed with the output of the last successful one, as long as it is younger than -max-cache-age`)
+	flag.DurationVar(&maxCacheAge, `max-cache-age`, 5*time.Minute, `How old an output -serve-stale-on-error may replay, after that failed scrapes are answered with an error again (0 replays any age)`)
+	once := flag.Bool(`once`, false, `Scrape the single upstream argument once, print the filtered metrics to stdout and exit, 0 on success and 1 when the scrape failed`)
+	flag.Int64Var(&staleThreshold, `stale-threshold`, defaultStaleThreshold, `Scrapes a value may stay the same before it is suppressed, 0 or less never suppresses`)
+	flag.BoolVar(&startStale, `start-stale`, true, `Start out with every series suppressed until its value changes, instead of passed on`)
+	flag.BoolVar(&timestampIsChange, `timestamp-is-change`, false, `Count a series whose upstream timestamp moved as changed, even when its value stayed the same`)
+	flag.DurationVar(&forgetSeriesAfter, `forget-series-after`, time.Hour, `Forget the state of series missing from the upstream for this long (0 keeps it while the target is served)`)
+	flag.DurationVar(&clockJumpThreshold, `clock-jump-threshold`, 30*time.Second, `Handle the wall clock moving this much more or less than the time that passed between two scrapes as a clock jump (0 never looks for jumps)`)
+	flag.DurationVar(&suppressionDelayWarning, `suppression-delay-warning`, time.Hour, `Warn when the stale threshold at the observed scrape interval suppresses values only after being unchanged this long (0 never warns)`)
+	flag.Var(&targetStaleThresholds, `target-stale-threshold`, `Comma separated target=scrapes pairs overriding -stale-threshold, like localhost:9100=60`)
+	flag.Var(&targetStartStale, `target-start-stale`, `Comma separated target=bool pairs overriding -start-stale, like localhost:9100=false`)
+	flag.BoolVar(&neverSuppressCounters, `never-suppress-counters`, false, `Pass counters on even when their value stayed the same, so rate() never sees a gap`)
+	flag.Var(&targetNeverSuppressCounters, `target-never-suppress-counters`, `Comma separated target=bool pairs overriding -never-suppress-counters, like localhost:9100=true`)
+	flag.Var(&targetHostHeaders, `target-host-header`, `Comma separated target=host pairs, sending the host as the Host header to the upstream of the target, like 10.0.0.5:8080=node.example`)
+	flag.Var(&targetServerNames, `target-server-name`, `Comma separated target=name pairs, sending the name for SNI and checking the upstream certificate against it, like 10.0.0.5:8443=node.example`)
+	flag.Int64Var(&counterWarmUp, `counter-warm-up`, 0, `Scrapes a suppressed counter that changed again is passed on for beyond -stale-threshold`)
+	flag.StringVar(&configFile, `config`, ``, `YAML file with the targets to serve and their settings, instead of upstream and listen arguments, read again on SIGHUP`)
+	flag.Var(&stalenessPolicyRules, `staleness-policy`, `Staleness policy for the metric names matching a pattern, like node_cpu_*=unchanged:threshold=20 or up=never, may be repeated (default unchanged for all)`)
+	flag.Var(&globalNames.keep, `keep`, `Only serve the metrics whose name matches this anchored RE2 pattern, and next to -drop never drop them, may be repeated`)
+	flag.Var(&globalNames.drop, `drop`, `Drop the metrics whose name matches this anchored RE2 pattern right after parsing, unless they match -keep, may be repeated`)
+	flag.Var(&transformers, `transform`, `Stage of the transform chain every scrape goes through before staleness is decided, in the order given: keep=<regex>, drop=<regex>, rename=<regex>:<replacement>, label=<name>=<value> or round=<decimals>, may be repeated`)
+	stateBoltFile := flag.String(`state-bolt-file`, ``, `Keep the series state of the targets in this bbolt file instead of in memory, so it survives restarts and large targets need less memory`)
+	stateBoltTargets := flag.String(`state-bolt-targets`, `*`, `Comma separated patterns of the target names kept in -state-bolt-file, like localhost:9100`)
+	flag.StringVar(&stateDir, `state-dir`, ``, `Save the series state of every target not in -state-bolt-file to a file of its own in this directory, and read it back on startup`)
+	flag.IntVar(&stateSaveEvery, `state-save-every`, 10, `Scrapes between saves of the state files of -state-dir, which are also saved on shutdown`)
+	flag.Int64Var(&maxBodyBytes, `max-body-bytes`, 0, `Fail scrapes whose upstream body is larger than this many bytes (0 means no limit)`)
+	flag.BoolVar(&debugMode, `debug`, false, `List the available routes when a path without a route is requested`)
+	flag.IntVar(&discoveryPort, `sd-listen-port`, 0, `Port serving the targets found by service discovery`)
+	flag.DurationVar(&discoveryGrace, `sd-grace-period`, 5*time.Minute, `How long the state of a target that went away is kept in case it comes back`)
+	kubernetesSD := flag.Bool(`kubernetes-sd`, false, `Discover exporter pods through the Kubernetes API`)
+	kubernetesNamespace := flag.String(`kubernetes-sd-namespace`, ``, `Only discover pods in this namespace (default all namespaces)`)
+	kubernetesSelector := flag.String(`kubernetes-sd-selector`, ``, `Label selector for the exporter pods`)
+	kubernetesNode := flag.String(`kubernetes-sd-node`, os.Getenv(`NODE_NAME`), `Only discover pods on this node (default $NODE_NAME)`)
+	kubernetesPort := flag.String(`kubernetes-sd-port`, `metrics`, `Name or number of the container port exposing the metrics`)
+	kubernetesPath := flag.String(`kubernetes-sd-path-template`, `/{{.namespace}}/{{.pod}}/metrics`, `Listen path of a discovered pod, can use .namespace, .pod, .node and .port`)
+	consulAddress := flag.String(`consul-address`, `localhost:8500`, `Address of the Consul agent`)
+	consulToken := flag.String(`consul-token`, os.Getenv(`CONSUL_HTTP_TOKEN`), `ACL token for Consul (default $CONSUL_HTTP_TOKEN)`)
+	consulDatacenter := flag.String(`consul-datacenter`, ``, `Consul datacenter to use (default the agent's own)`)
+	consulSD := flag.Bool(`consul-sd`, false, `Discover exporters registered in the Consul catalog`)
+	consulServices := flag.String(`consul-sd-services`, ``, `Comma separated services to discover (default all services with -consul-sd-tag)`)
+	consulTag := flag.String(`consul-sd-tag`, ``, `Only discover service instances with this tag`)
+	consulPath := flag.String(`consul-sd-path-template`, `/{{.service}}/{{.node}}/metrics`, `Listen path of a discovered service instance, can use .service, .id, .node, .datacenter, .address and .port`)
+	dnsSDNames := flag.String(`dns-sd-names`, ``, `Comma separated DNS SRV names to discover exporters from`)
+	dnsSDRefresh := flag.Duration(`dns-sd-refresh-interval`, 30*time.Second, `How often the DNS SRV names are looked up`)
+	dnsSDPath := flag.String(`dns-sd-path-template`, `/{{.host}}/{{.port}}/metrics`, `Listen path of a discovered SRV target, can use .name, .host and .port`)
+	dockerSD := flag.Bool(`docker-sd`, false, `Discover containers labelled for scraping through the Docker API`)
+	dockerSocket := flag.String(`docker-sd-socket`, `/var/run/docker.sock`, `Unix socket of the Docker API`)
+	dockerLabelPrefix := flag.String(`docker-sd-label-prefix`, `prometheus`, `Containers are scraped when they have the label <prefix>.scrape=true, on the port in <prefix>.port and the optional path in <prefix>.path`)
+	dockerPath := flag.String(`docker-sd-path-template`, `/{{.name}}/metrics`, `Listen path of a discovered container, can use .name, .id, .image and .port`)
+	consulRegister := flag.Bool(`consul-register`, false, `Register every listener as a service in Consul, and deregister on shutdown`)
+	consulRegisterName := flag.String(`consul-register-name`, `frugalpromproxy`, `Service name the listeners are registered with`)
+	consulRegisterTags := flag.String(`consul-register-tags`, ``, `Comma separated tags for the registered services`)
+	consulRegisterAddress := flag.String(`consul-register-address`, ``, `Address Consul and Prometheus reach the proxy on (default the address of the Consul agent)`)
+	maxConcurrentScrapes := flag.Int(`max-concurrent-scrapes`, 8, `Maximum number of upstream fetches running at the same time across all listeners (0 means unlimited)`)
+	flag.Parse()
+
+	upstreamFetches = newFetchLimiter(*maxConcurrentScrapes)
+
+	if dnsAddressFamily != `ip` && dnsAddressFamily != `ip4` && dnsAddressFamily != `ip6` {
+		fmt.Println(`unknown address family ` + dnsAddressFamily)
+		os.Exit(2)
+	}
+
+	if mergeCollisionPolicy == `` {
+		mergeCollisionPolicy = `error`
+		if mergeLabel != `` {
+			mergeCollisionPolicy = `merge`
+		}
+	}
+	if mergeCollisionPolicy != `error` && mergeCollisionPolicy != `prefix` && mergeCollisionPolicy != `merge` {
+		fmt.Println(`unknown merge collision policy ` + mergeCollisionPolicy)
+		os.Exit(2)
+	}
+
+	if err := checkForwardHeaders(); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	var err error
+	if upstreamCredentials, err = loadCredentials(*upstreamUsername, *upstreamPasswordFile, upstreamPasswordEnv, *upstreamTokenFile, upstreamBearerTokenEnv); err != nil {
+		fmt.Println(`upstream credentials:`, err)
+		os.Exit(2)
+	}
+	if listenCredentials, err = loadCredentials(*listenUsername, *listenPasswordFile, listenPasswordEnv, *listenTokenFile, listenBearerTokenEnv); err != nil {
+		fmt.Println(`listen credentials:`, err)
+		os.Exit(2)
+	}
+	if listenCredentials.username != `` && listenCredentials.password == `` {
+		fmt.Println(`-listen-username needs -listen-password-file or $` + listenPasswordEnv)
+		os.Exit(2)
+	}
+
+	if *stateBoltFile != `` {
+		var err error
+		if boltState.store, err = staleness.OpenBoltStore(*stateBoltFile); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		boltState.targets = strings.Split(*stateBoltTargets, `,`)
+	}
+	if stateDir != `` {
+		if stateSaveEvery < 1 {
+			fmt.Println(`-state-save-every must be at least 1`)
+			os.Exit(2)
+		}
+		if err := os.MkdirAll(stateDir, 0755); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+	}
+
+	commandLine = commandLineSettings()
+
+	if *once {
+		if flag.NArg() != 1 {
+			fmt.Println(`-once needs exactly one upstream argument`)
+			os.Exit(2)
+		}
+		status := runOnce(flag.Arg(0))
+		saveStateFiles()
+		if boltState.store != nil {
+			boltState.store.Close()
+		}
+		os.Exit(status)
+	}
+
+	if *remoteWriteURL != `` {
+		if scrapeInterval <= 0 {
+			fmt.Println(`-remote-write-url needs -scrape-interval`)
+			os.Exit(2)
+		}
+		remoteWrite = newRemoteWriter(*remoteWriteURL, *remoteWriteQueue)
+		remoteWrite.job = *remoteWriteJob
+		remoteWrite.username = *remoteWriteUsername
+		if *remoteWritePasswordFile != `` {
+			password, err := ioutil.ReadFile(*remoteWritePasswordFile)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(2)
+			}
+			remoteWrite.password = strings.TrimSpace(string(password))
+		}
+		if *remoteWriteTokenFile != `` {
+			token, err := ioutil.ReadFile(*remoteWriteTokenFile)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(2)
+			}
+			remoteWrite.bearerToken = strings.TrimSpace(string(token))
+		}
+		go remoteWrite.run()
+	}
+
+	if *pushgatewayURL != `` {
+		if scrapeInterval <= 0 {
+			fmt.Println(`-pushgateway-url needs -scrape-interval`)
+			os.Exit(2)
+		}
+		pusher := &pushgatewayPusher{
+			url:           *pushgatewayURL,
+			job:           *pushgatewayJob,
+			instanceLabel: *pushgatewayInstanceLabel,
+			method:        strings.ToUpper(*pushgatewayMethod),
+			interval:      *pushgatewayInterval,
+			client:        &http.Client{},
+		}
+		if pusher.method != http.MethodPut && pusher.method != http.MethodPost {
+			fmt.Println(`unknown Pushgateway method ` + *pushgatewayMethod)
+			os.Exit(2)
+		}
+		var err error
+		if pusher.grouping, err = parseNameValuePairs(*pushgatewayGrouping); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		go pusher.run()
+	}
+
+	if *otlpEndpoint != `` {
+		if scrapeInterval <= 0 {
+			fmt.Println(`-otlp-endpoint needs -scrape-interval`)
+			os.Exit(2)
+		}
+		exporter := &otlpExporter{endpoint: *otlpEndpoint, interval: *otlpInterval, client: &http.Client{}}
+		var err error
+		if exporter.headers, err = parseNameValuePairs(*otlpHeaders); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		go exporter.run()
+	}
+
+	if *textfileDirectory != `` {
+		if scrapeInterval <= 0 {
+			fmt.Println(`-textfile-directory needs -scrape-interval`)
+			os.Exit(2)
+		}
+		writer := &textfileWriter{directory: *textfileDirectory, interval: *textfileInterval, maxAge: *textfileMaxAge}
+		go writer.run()
+	}
+
+	if *pushTarget != `` {
+		pushed = newPushStore(*pushTarget, *pushTTL, *pushMaxBytes, commandLine.clock)
+		if *pushTokenFile != `` {
+			token, err := ioutil.ReadFile(*pushTokenFile)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(2)
+			}
+			pushed.token = strings.TrimSpace(string(token))
+		}
+	}
+
+	if *recordDirectory != `` {
+		upstreamRecorder = newRecorder(*recordDirectory, *recordMaxFiles, *recordMaxBytes, *recordQueue)
+	}
+
+	if *corsOrigins != `` {
+		var err error
+		if cors, err = newCORSPolicy(*corsOrigins, *corsMethods, *corsHeaders, *corsMaxAge, *corsCredentials); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+	}
+
+	if *dynamicEnabled {
+		if len(dynamicAllowlist.networks) == 0 && len(dynamicAllowlist.patterns) == 0 {
+			fmt.Println(`-dynamic-targets needs -dynamic-targets-allow`)
+			os.Exit(2)
+		}
+		dynamic = newDynamicTargets(&dynamicAllowlist, *dynamicMax)
+	}
+
+	if parseErrorPolicy != `open` && parseErrorPolicy != `closed` {
+		fmt.Println(`unknown parse error policy ` + parseErrorPolicy)
+		os.Exit(2)
+	}
+	if sampleLimitPolicy != `open` && sampleLimitPolicy != `closed` {
+		fmt.Println(`unknown sample limit policy ` + sampleLimitPolicy)
+		os.Exit(2)
+	}
+
+	if tlsSettings.enabled() {
+		var err error
+		if tlsConfig, err = tlsSettings.config(); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+	} else if len(listenerClientNames) > 0 {
+		fmt.Println(`-listener-tls-client-allowed-names needs -tls-cert-file and -tls-key-file`)
+		os.Exit(2)
+	}
+
+	// Arguments come in pairs of where to fetch data from, and where to listen.
+	// The first can be a comma separated list of ports or URLs: a primary
+	// upstream followed by the ones to fail over to, optionally with query parameters
+	// after a ?. Several paths on the upstream can be scraped together, like
+	// 9100/metrics;/metrics/app. Several upstreams joined with + are merged
+	// into one output.
+	// The second can have a path, so several pairs can share one listen port
+	// under different paths, and an address to bind, or be a Unix socket.
+	var listenAddresses []listenAddress
+	routeTables := make(map[listenAddress][]route)
+	commandlineArguments := flag.Args()
+	var loaded *loadedConfig
+	if configFile != `` {
+		if len(commandlineArguments) > 0 {
+			fmt.Println(`-config can't be combined with upstream and listen arguments`)
+			os.Exit(2)
+		}
+		var err error
+		if loaded, err = loadConfigFile(configFile); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		listenAddresses, routeTables = loaded.listenAddresses, loaded.routeTables
+	}
+	for len(commandlineArguments) >= 2 {
+		upstreams, err := parseUpstreamArgument(commandlineArguments[0])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		address, path, err := parseListenArgument(commandlineArguments[1])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		commandlineArguments = commandlineArguments[2:]
+		for _, upstream := range upstreams {
+			if err := validateHostOverride(upstream.commandLineTarget()); err != nil {
+				fmt.Println(err)
+				os.Exit(2)
+			}
+		}
+
+		if _, ok := routeTables[address]; !ok {
+			listenAddresses = append(listenAddresses, address)
+		}
+		routeTables[address] = append(routeTables[address], route{path: path, sources: upstreams})
+	}
+	if err := validateRoutes(listenAddresses, routeTables, discoveryPort, allowDuplicateUpstreams); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	// Listen addresses a reload of the config file adds can be flagged ahead
+	if loaded == nil {
+		if err := validateListenerOverrides(listenAddresses); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+	}
+	printRoutes(os.Stdout, listenAddresses, routeTables)
+	if loaded != nil {
+		served, err := serveConfigFile(configFile, loaded)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		go served.reloadOnHangup()
+	} else {
+		for _, address := range listenAddresses {
+			go listener(routeTables[address], address)
+		}
+	}
+
+	if discoveryPort > 0 {
+		router := newDiscoveryRouter(discoveryGrace)
+		if *kubernetesSD {
+			discovery, err := newInClusterKubernetesDiscovery(router)
+			if err == nil {
+				discovery.pathTemplate, err = template.New(`path`).Parse(*kubernetesPath)
+			}
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(2)
+			}
+			discovery.namespace = *kubernetesNamespace
+			discovery.selector = *kubernetesSelector
+			discovery.node = *kubernetesNode
+			discovery.portName = *kubernetesPort
+			go discovery.run(nil)
+		}
+
+		if *consulSD {
+			discovery := &consulDiscovery{
+				consul: newConsulClient(*consulAddress, *consulToken, *consulDatacenter),
+				tag:    *consulTag,
+				router: router,
+			}
+			if *consulServices != `` {
+				discovery.services = strings.Split(*consulServices, `,`)
+			}
+			var err error
+			if discovery.pathTemplate, err = template.New(`path`).Parse(*consulPath); err != nil {
+				fmt.Println(err)
+				os.Exit(2)
+			}
+			go discovery.run()
+		}
+
+		if *dnsSDNames != `` {
+			discovery := &dnsDiscovery{
+				names:     strings.Split(*dnsSDNames, `,`),
+				refresh:   *dnsSDRefresh,
+				lookupSRV: net.DefaultResolver.LookupSRV,
+				router:    router,
+			}
+			var err error
+			if discovery.pathTemplate, err = template.New(`path`).Parse(*dnsSDPath); err != nil {
+				fmt.Println(err)
+				os.Exit(2)
+			}
+			go discovery.run()
+		}
+
+		if *dockerSD {
+			discovery := newDockerDiscovery(*dockerSocket, router)
+			discovery.labelPrefix = *dockerLabelPrefix
+			var err error
+			if discovery.pathTemplate, err = template.New(`path`).Parse(*dockerPath); err != nil {
+				fmt.Println(err)
+				os.Exit(2)
+			}
+			go discovery.run()
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc(`/`, rateLimitOf(`discovery`).wrap(router.ServeHTTP))
+		listenAddresses = append(listenAddresses, listenAddress{port: discoveryPort})
+		go serve(`discovery`, listenAddress{port: discoveryPort}, mux)
+	}
+
+	var registration *consulRegistration
+	if *consulRegister {
+		registration = &consulRegistration{
+			consul:  newConsulClient(*consulAddress, *consulToken, *consulDatacenter),
+			name:    *consulRegisterName,
+			address: *consulRegisterAddress,
+			ports:   listenPortsOf(listenAddresses),
+		}
+		if *consulRegisterTags != `` {
+			registration.tags = strings.Split(*consulRegisterTags, `,`)
+		}
+		registration.start()
+	}
+
+	fmt.Printf("Press Ctrl+C to end\n")
+	waitForSignal()
+	log.Printf("shutting down, letting the requests in flight finish")
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if shutdownGracePeriod > 0 {
+		ctx, cancel = context.WithTimeout(ctx, shutdownGracePeriod)
+	}
+	if err := shutdownListeners(ctx); err != nil {
+		log.Printf("requests still in flight after %v were cut off: %v", shutdownGracePeriod, err)
+	}
+	cancel()
+	saveStateFiles()
+	if registration != nil {
+		registration.deregister()
+	}
+	fmt.Printf("\n")
+}
+
+func listener(routes []route, address listenAddress) {
+	mux := http.NewServeMux()
+	for _, route := range routes {
+		route.register(mux, address, route.newTargets())
+	}
+	mux.HandleFunc(`/`, routeNotFound(routes))
+	serve(address.name(), address, mux)
+}
+
+// Create a target with the settings of its Proxy or the command line, and
+// start scraping it if it is scraped in the background
+func newScrapeTarget(name string, urls []string, settings *proxySettings) *ScrapeTarget {
+	scrapeTarget := unstartedScrapeTarget(name, urls, settings)
+	scrapeTarget.start()
+	return scrapeTarget
+}
+
+// A target that can still be set up further before it is started
+func unstartedScrapeTarget(name string, urls []string, settings *proxySettings) *ScrapeTarget {
+	scrapeTarget := &ScrapeTarget{name: name, settings: settings, upstreams: newUpstreamSelector(urls), stop: make(chan struct{})}
+	scrapeTarget.created = scrapeTarget.now()
+	scrapeTarget.defaults, scrapeTarget.names = settings.stalenessDefaults(name), settings.names
+	scrapeTarget.credentials = settings.credentials
+	scrapeTarget.staleness = newStalenessPolicies(name, settings.stalenessRules, scrapeTarget.defaults)
+	scrapeTarget.transformers = settings.transformers
+	scrapeTarget.timeout = settings.scrapeTimeout
+	scrapeTarget.timeoutOffset = settings.scrapeTimeoutOffset
+	scrapeTarget.parseErrorThreshold = settings.parseErrorThreshold
+	scrapeTarget.parseErrorFailClosed = settings.parseErrorFailClosed
+	scrapeTarget.sampleLimit = settings.sampleLimit
+	scrapeTarget.sampleLimitFailClosed = settings.sampleLimitFailClosed
+	if settings.deltaJournalSize > 0 {
+		scrapeTarget.journal = newDeltaJournal(settings.deltaJournalSize, settings.deltaJournalTTL)
+	}
+	scrapeTarget.resolver = newUpstreamResolver(settings.dnsRefreshInterval, settings.dnsAddressFamily, settings.clock)
+	if settings.upstreamH2C {
+		scrapeTarget.client = scrapeTarget.resolver.h2cClient(name)
+	} else {
+		scrapeTarget.client = scrapeTarget.resolver.client()
+	}
+	if settings.scrapeInterval > 0 {
+		scrapeTarget.schedule = newScrapeSchedule(scrapeTarget.name, settings.scrapeInterval, settings.scrapeJitter)
+		scrapeTarget.latestErr = &backgroundScrapeError{err: fmt.Errorf(`%s: %w`, name, ErrNotScrapedYet)}
+	}
+	return scrapeTarget
+}
+
+// Serve the target in the status API, and scrape it if it is scraped in the
+// background
+func (scrapeTarget *ScrapeTarget) start() {
+	scrapeTarget.settings.targets.register(scrapeTarget)
+	scrapeTarget.reportActiveUpstream()
+	if scrapeTarget.schedule != nil {
+		scrapeTarget.scraping.Add(1)
+		go scrapeTarget.scrapeLoop()
+	}
+}
+
+// Stop scraping a target that is no longer served
+func (scrapeTarget *ScrapeTarget) close() {
+	close(scrapeTarget.stop)
+	// A background scrape still running would update the closed state
+	scrapeTarget.scraping.Wait()
+	scrapeTarget.settings.targets.unregister(scrapeTarget)
+	scrapeTarget.stateMutex.Lock()
+	defer scrapeTarget.stateMutex.Unlock()
+	scrapeTarget.configMutex.Lock()
+	scrapeTarget.staleness.Close()
+	scrapeTarget.configMutex.Unlock()
+}
+
+// How long the requests in flight may take to finish when the proxy is
+// stopped, 0 means as long as they take
+var shutdownGracePeriod time.Duration
+
+// The servers of all listeners, each with a mux of its own
+var listeners struct {
+	mu      sync.Mutex
+	servers []*http.Server
+	closed  bool // Shutting down, listeners starting late don't serve anymore
+}
+
+// Stop all listeners at once, letting the requests in flight finish until
+// ctx is done, and wait until they have. Requests still running then are cut
+// off.
+func shutdownListeners(ctx context.Context) error {
+	listeners.mu.Lock()
+	servers := listeners.servers
+	listeners.servers = nil
+	listeners.closed = true
+	listeners.mu.Unlock()
+
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			err := server.Shutdown(ctx)
+			if err != nil {
+				server.Close()
+			}
+			errs <- err
+		}(server)
+	}
+	var first error
+	for range servers {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Stop one listener, like one a reload of the -config file removed,
+// letting its requests in flight finish until ctx is done
+func shutdownListener(ctx context.Context, server *http.Server) error {
+	listeners.mu.Lock()
+	for i, running := range listeners.servers {
+		if running == server {
+			listeners.servers = append(listeners.servers[:i], listeners.servers[i+1:]...)
+			break
+		}
+	}
+	listeners.mu.Unlock()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		server.Close()
+	}
+	return err
+}
+
+// Serve a listener's endpoints, adding the ones every listener has
+func serve(name string, address listenAddress, mux *http.ServeMux) {
+	handleCommonEndpoints(name, mux)
+	bound, err := address.listen()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := serveOn(bound, newListenerServer(name, address, mux)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// The endpoints every listener has besides its routes
+func handleCommonEndpoints(listener string, mux *http.ServeMux) {
+	mux.HandleFunc(selfMetricsPath, adminEndpoint(selfMetrics.handler))
+	mux.HandleFunc(targetsPath, adminEndpoint(targetsHandler))
+	mux.HandleFunc(targetsPath+`/`, adminEndpoint(targetHandler))
+	mux.HandleFunc(healthyPath, adminEndpoint(healthyHandler))
+	if dynamic != nil {
+		mux.HandleFunc(dynamicPath, rateLimitOf(listener).wrap(dynamic.handler))
+	}
+	if pushed != nil {
+		mux.HandleFunc(pushPath, pushed.handler)
+	}
+}
+
+// The server of a listener, checking the access policy, credentials and
+// request limit before the handler
+func newListenerServer(name string, address listenAddress, handler http.Handler) *http.Server {
+	// Clients of a Unix socket have no address, the file permissions say who
+	// may connect
+	policy := &accessPolicy{name: name, trustedProxies: trustedProxies, clock: clock}
+	if address.socket == `` {
+		policy.allowed = listenerAllowedCIDRs(address)
+	}
+	return &http.Server{
+		Addr:      address.name(),
+		Handler:   policy.wrap(requireCredentials(name, newRequestLimit(name, maxListenerRequests).wrap(tenantChecked(handler)))),
+		TLSConfig: listenerTLSConfig(address),
+		ErrorLog:  newHandshakeErrorLog(name),
+	}
+}
+
+// Serve on a bound listener until the server is shut down
+func serveOn(bound net.Listener, server *http.Server) error {
+	listeners.mu.Lock()
+	if listeners.closed {
+		listeners.mu.Unlock()
+		bound.Close()
+		return nil
+	}
+	listeners.servers = append(listeners.servers, server)
+	listeners.mu.Unlock()
+	// Serve closes the listener when the server shuts down, which removes a
+	// Unix socket file
+	var err error
+	if tlsConfig != nil {
+		err = server.ServeTLS(bound, ``, ``)
+	} else {
+		err = server.Serve(bound)
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Wait for Ctrl+C or SIGTERM, which is what systemd and Kubernetes send. A
+// second signal exits at once, without waiting for the requests in flight.
+func waitForSignal() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	go func() {
+		<-signals
+		log.Printf("second signal, exiting without waiting for the requests in flight")
+		os.Exit(1)
+	}()
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pdxiv/frugalpromproxy/parser"
+)
+
+// Name of the gauge telling which of the merged upstreams could be scraped
+const upstreamUpName = `frugalpromproxy_upstream_up`
+
+// Label added to every series of merged upstreams, holding the upstream
+// name, empty for none
+var mergeLabel string
+
+// Several upstreams served together on one listener. Every upstream keeps
+// its own staleness state, and their filtered outputs are concatenated.
+type mergedTarget struct {
+	name            string
+	sources         []*ScrapeTarget
+	labels          []string // Names of the sources, given like node=9100 or else the target names
+	collisionPolicy string   // What to do with families found in more than one upstream: error, prefix or merge
+}
+
+func (merged *mergedTarget) handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodHead {
+		merged.head(w, r)
+		return
+	}
+	// Scraped at the same time, so the slowest upstream sets the duration
+	perSource := make([][]outputFamily, len(merged.sources))
+	errs := make([]error, len(merged.sources))
+	var scrapes sync.WaitGroup
+	for i, source := range merged.sources {
+		scrapes.Add(1)
+		go func(i int, source *ScrapeTarget) {
+			defer scrapes.Done()
+			perSource[i], errs[i] = source.families(r)
+		}(i, source)
+	}
+	scrapes.Wait()
+
+	up := outputFamily{name: upstreamUpName, help: `Whether the upstream could be scraped.`, metricType: gauge}
+	for i, source := range merged.sources {
+		value := 1
+		if errs[i] != nil {
+			source.countError(errs[i])
+			log.Printf("%s: %v", merged.name, errs[i])
+			value = 0
+		}
+		if mergeLabel != `` {
+			perSource[i] = withUpstreamLabel(perSource[i], sanitizeLabelName(mergeLabel)+`="`+escapeLabelValue(merged.labels[i])+`"`)
+		}
+		up.lines = append(up.lines, fmt.Sprintln(upstreamUpName+`{upstream="`+escapeLabelValue(merged.labels[i])+`"}`, value))
+	}
+
+	families, err := merged.combine(perSource)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	counted := &countingWriter{ResponseWriter: w}
+	writeFamilies(counted, r, append(families, up), merged.sources[0].now())
+	servedBytes.add(float64(counted.bytes), []string{merged.name})
+}
+
+// Concatenate the families of all upstreams, applying the collision policy
+// to the families exported by more than one of them
+func (merged *mergedTarget) combine(perSource [][]outputFamily) ([]outputFamily, error) {
+	sources := make(map[string]int)
+	for _, families := range perSource {
+		for _, family := range families {
+			sources[family.name]++
+		}
+	}
+	var collisions []string
+	for name, count := range sources {
+		// Every upstream has its own target_info series, they go together
+		if count > 1 && name != targetInfoName {
+			collisions = append(collisions, name)
+		}
+	}
+	if len(collisions) > 0 && merged.collisionPolicy == `error` {
+		sort.Strings(collisions)
+		return nil, fmt.Errorf(`%s: families exported by more than one upstream: %s`, merged.name, strings.Join(collisions, `, `))
+	}
+
+	var combined []outputFamily
+	position := make(map[string]int) // Where a merged family ended up in combined
+	for i, families := range perSource {
+		prefix := sanitizeLabelName(merged.labels[i]) + `_`
+		for _, family := range families {
+			if sources[family.name] < 2 {
+				combined = append(combined, family)
+				continue
+			}
+			policy := merged.collisionPolicy
+			if family.name == targetInfoName {
+				policy = `merge`
+			}
+			switch policy {
+			case `prefix`:
+				renamed := outputFamily{name: prefix + family.name, help: family.help, metricType: family.metricType}
+				for _, line := range family.lines {
+					renamed.lines = append(renamed.lines, prefix+line)
+				}
+				combined = append(combined, renamed)
+			case `merge`:
+				// HELP and TYPE come from the first upstream with the family
+				if at, ok := position[family.name]; ok {
+					combined[at].lines = append(combined[at].lines, family.lines...)
+					continue
+				}
+				position[family.name] = len(combined)
+				family.lines = append([]string(nil), family.lines...)
+				combined = append(combined, family)
+			}
+		}
+	}
+	return combined, nil
+}
+
+// The families with the label naming their upstream added to every series.
+// A series' own label of that name wins, like with static labels.
+func withUpstreamLabel(families []outputFamily, label string) []outputFamily {
+	labelled := make([]outputFamily, len(families))
+	for i, family := range families {
+		labelled[i] = family
+		labelled[i].lines = make([]string, len(family.lines))
+		for j, line := range family.lines {
+			name, series, ok := parser.ParseSeriesLine(strings.TrimSuffix(line, "\n"))
+			if ok {
+				line = seriesLine(name, withStaticLabels(series.Labels, label), series.Value, series.Timestamp)
+			}
+			labelled[i].lines[j] = line
+		}
+	}
+	return labelled
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Merged upstreams named node, app and other, whose series start out live
+func newMergedTarget(t *testing.T, policy string, upstreams ...string) *mergedTarget {
+	commandLine.staleness.StartStale = false
+	merged := &mergedTarget{name: `edge`, collisionPolicy: policy}
+	for i, upstream := range upstreams {
+		source := newScrapeTarget(upstream, []string{upstream}, commandLine)
+		t.Cleanup(source.close)
+		merged.sources = append(merged.sources, source)
+		merged.labels = append(merged.labels, []string{`node`, `app`, `other`}[i])
+	}
+	return merged
+}
+
+func serveMerged(merged *mergedTarget) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	merged.handler(recorder, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+	return recorder
+}
+
+func TestMergedFamiliesFollowTheCollisionPolicy(t *testing.T) {
+	useCommandLineSettings(t)
+	_, node := newFakeExporter(t, "# TYPE requests_total counter\nrequests_total 1\nnode_load1 0.5\n")
+	_, app := newFakeExporter(t, "# TYPE requests_total counter\nrequests_total{path=\"/\"} 2\n")
+
+	recorder := serveMerged(newMergedTarget(t, `error`, node, app))
+	if recorder.Code != http.StatusBadGateway || !strings.Contains(recorder.Body.String(), `requests_total`) {
+		t.Errorf(`the error policy answered %d %s`, recorder.Code, recorder.Body)
+	}
+
+	body := serveMerged(newMergedTarget(t, `prefix`, node, app)).Body.String()
+	for _, expected := range []string{"node_requests_total 1\n", "app_requests_total{path=\"/\"} 2\n", "# TYPE app_requests_total counter\n", "node_load1 0.5\n"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf(`the prefix policy served no %q in %s`, expected, body)
+		}
+	}
+
+	body = serveMerged(newMergedTarget(t, `merge`, node, app)).Body.String()
+	if strings.Count(body, `# TYPE requests_total counter`) != 1 || !strings.Contains(body, "requests_total 1\nrequests_total{path=\"/\"} 2\n") {
+		t.Errorf(`the merge policy served %s`, body)
+	}
+}
+
+func TestMergedUpstreamsFailOnTheirOwn(t *testing.T) {
+	useCommandLineSettings(t)
+	_, node := newFakeExporter(t, "node_load1 0.5\n")
+	app, appURL := newFakeExporter(t, "app_requests_total 7\n")
+	app.fail(http.StatusInternalServerError)
+
+	recorder := serveMerged(newMergedTarget(t, `error`, node, appURL))
+	body := recorder.Body.String()
+	if recorder.Code != http.StatusOK || !strings.Contains(body, "node_load1 0.5\n") {
+		t.Fatalf(`a failing upstream took the others down: %d %s`, recorder.Code, body)
+	}
+	if !strings.Contains(body, upstreamUpName+`{upstream="node"} 1`) || !strings.Contains(body, upstreamUpName+`{upstream="app"} 0`) {
+		t.Errorf(`up gauges in %s`, body)
+	}
+}
+
+func TestMergedUpstreamsKeepTheirOwnStaleness(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.Threshold = 1
+	node, nodeURL := newFakeExporter(t, "node_load1 0.5\n")
+	_, appURL := newFakeExporter(t, "app_requests 7\n")
+	merged := newMergedTarget(t, `error`, nodeURL, appURL)
+	for i := 0; i < 3; i++ {
+		serveMerged(merged)
+	}
+
+	node.serve("node_load1 0.7\n")
+	body := serveMerged(merged).Body.String()
+	if !strings.Contains(body, "node_load1 0.7\n") || strings.Contains(body, `app_requests`) {
+		t.Errorf(`a change of one upstream showed up as %s`, body)
+	}
+}
+
+func TestUpstreamLabelsDontReplaceTheSeriesOwn(t *testing.T) {
+	families := []outputFamily{{name: `up`, lines: []string{"up 1\n", "up{upstream=\"own\"} 1\n"}}}
+	labelled := withUpstreamLabel(families, `upstream="node"`)
+	if got := strings.Join(labelled[0].lines, ``); got != "up{upstream=\"node\"} 1\nup{upstream=\"own\"} 1\n" {
+		t.Errorf(`labelled lines %q`, got)
+	}
+	if families[0].lines[0] != "up 1\n" {
+		t.Error(`the families given were changed`)
+	}
+}
+
+func TestMergedUpstreamsCanBeNamed(t *testing.T) {
+	upstreams, err := parseUpstreamArgument(`node=9100+postgres=9187?collect[]=a%2Bb+8080`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upstreams) != 3 || upstreams[0].label != `node` || upstreams[1].label != `postgres` || upstreams[1].params.Get(`collect[]`) != `a+b` || upstreams[2].label != `` {
+		t.Errorf(`upstreams %+v`, upstreams)
+	}
+	if _, err := parseUpstreamArgument(`node=9100+node=9187`); err == nil {
+		t.Error(`an upstream name given twice was taken`)
+	}
+}
+
+func TestMergedSeriesAreLabelledWithTheirUpstream(t *testing.T) {
+	useCommandLineSettings(t)
+	defer func(label string) { mergeLabel = label }(mergeLabel)
+	mergeLabel = `upstream`
+	_, node := newFakeExporter(t, "# HELP requests_total Requests.\n# TYPE requests_total counter\nrequests_total 1\nnode_load1 0.5\n")
+	_, app := newFakeExporter(t, "# HELP requests_total Requests.\n# TYPE requests_total counter\nrequests_total{upstream=\"own\"} 2\n")
+
+	body := serveMerged(newMergedTarget(t, `merge`, node, app)).Body.String()
+	expected := `node_load1{upstream="node"} 0.5
+requests_total{upstream="node"} 1
+requests_total{upstream="own"} 2`
+	var lines []string
+	for _, line := range seriesLines(body) {
+		if !strings.HasPrefix(line, upstreamUpName) {
+			lines = append(lines, line)
+		}
+	}
+	if strings.Join(lines, "\n") != expected {
+		t.Errorf("served\n%s", body)
+	}
+	if strings.Count(body, `# HELP requests_total `) != 1 || strings.Count(body, `# TYPE requests_total `) != 1 {
+		t.Errorf("HELP and TYPE aren't served once\n%s", body)
+	}
+}
+
+func TestMergedUpstreamsAreScrapedAtTheSameTime(t *testing.T) {
+	useCommandLineSettings(t)
+	defer func(label string) { mergeLabel = label }(mergeLabel)
+	mergeLabel = `upstream`
+	node, nodeURL := newSlowExporter(t)
+	app, appURL := newSlowExporter(t)
+	merged := newMergedTarget(t, `merge`, nodeURL, appURL)
+
+	answered := make(chan *httptest.ResponseRecorder, 1)
+	go func() { answered <- serveMerged(merged) }()
+	// Both are fetched before either answers
+	node.waitForFetches(t, 1)
+	app.waitForFetches(t, 1)
+	close(node.release)
+	close(app.release)
+	if recorder := <-answered; recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "up{upstream=\"node\"} 1\nup{upstream=\"app\"} 1\n") {
+		t.Errorf("answered %d\n%s", recorder.Code, recorder.Body)
+	}
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Shape of the exposition a mock exporter serves
+type mockProfile struct {
+	prefix         string
+	labelNames     [2]string
+	families       int
+	series         int     // Per family
+	changeFraction float64 // Of the values, changed on every scrape
+}
+
+var mockProfiles = map[string]mockProfile{
+	// Lots of small families, a good part of them busy
+	`node`: {prefix: `node_mock_`, labelNames: [2]string{`device`, `mode`}, families: 50, series: 10, changeFraction: .2},
+	// Few families with many series, hardly any of them changing
+	`ksm`: {prefix: `kube_mock_`, labelNames: [2]string{`namespace`, `pod`}, families: 20, series: 200, changeFraction: .02},
+}
+
+// Serves a synthetic exposition, for demos and for testing the proxy
+// without a real exporter
+type mockExporter struct {
+	profile    mockProfile
+	histograms bool
+	summaries  bool
+
+	mu     sync.Mutex
+	random *rand.Rand
+	values [][]float64 // Per family and series
+	scrape int
+}
+
+// Run the mockexporter subcommand
+func mockExporterCommand(arguments []string) {
+	flags := flag.NewFlagSet(`mockexporter`, flag.ExitOnError)
+	listen := flags.String(`listen`, `:9100`, `Address to serve the mock metrics on`)
+	profileName := flags.String(`profile`, `node`, `Shape of the metrics: node (many small, busy families) or ksm (few large, mostly static families)`)
+	families := flags.Int(`families`, 0, `Number of families (default from the profile)`)
+	series := flags.Int(`series`, 0, `Number of series per family (default from the profile)`)
+	changeFraction := flags.Float64(`change-fraction`, -1, `Fraction of the values changed on every scrape (default from the profile)`)
+	histograms := flags.Bool(`histograms`, false, `Add a histogram family`)
+	summaries := flags.Bool(`summaries`, false, `Add a summary family`)
+	seed := flags.Int64(`seed`, 1, `Seed for the generated values, the same seed gives the same sequence of scrapes`)
+	flags.Parse(arguments)
+
+	profile, ok := mockProfiles[*profileName]
+	if !ok {
+		fmt.Println(`unknown profile ` + *profileName)
+		os.Exit(2)
+	}
+	if *families > 0 {
+		profile.families = *families
+	}
+	if *series > 0 {
+		profile.series = *series
+	}
+	if *changeFraction >= 0 {
+		profile.changeFraction = *changeFraction
+	}
+
+	exporter := newMockExporter(profile, *seed)
+	exporter.histograms = *histograms
+	exporter.summaries = *summaries
+	log.Printf("serving %d mock families of %d series on %s", profile.families, profile.series, *listen)
+	log.Fatal(http.ListenAndServe(*listen, exporter))
+}
+
+func newMockExporter(profile mockProfile, seed int64) *mockExporter {
+	exporter := &mockExporter{profile: profile, random: rand.New(rand.NewSource(seed))}
+	exporter.values = make([][]float64, profile.families)
+	for family := range exporter.values {
+		exporter.values[family] = make([]float64, profile.series)
+		for series := range exporter.values[family] {
+			exporter.values[family][series] = float64(exporter.random.Intn(1000))
+		}
+	}
+	return exporter
+}
+
+// Even families are counters, odd ones gauges
+func (exporter *mockExporter) familyName(family int) (string, string) {
+	if family%2 == 0 {
+		return fmt.Sprintf(`%sevents_%d_total`, exporter.profile.prefix, family), `counter`
+	}
+	return fmt.Sprintf(`%slevel_%d`, exporter.profile.prefix, family), `gauge`
+}
+
+// Change the configured fraction of the values, counters only go up
+func (exporter *mockExporter) advance() {
+	for family := range exporter.values {
+		_, metricType := exporter.familyName(family)
+		for series := range exporter.values[family] {
+			if exporter.random.Float64() >= exporter.profile.changeFraction {
+				continue
+			}
+			if metricType == `counter` {
+				exporter.values[family][series] += float64(1 + exporter.random.Intn(100))
+			} else {
+				exporter.values[family][series] = float64(exporter.random.Intn(1000))
+			}
+		}
+	}
+}
+
+func (exporter *mockExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	exporter.mu.Lock()
+	if exporter.scrape > 0 {
+		exporter.advance()
+	}
+	exporter.scrape++
+
+	var builder strings.Builder
+	labels := exporter.profile.labelNames
+	for family, values := range exporter.values {
+		name, metricType := exporter.familyName(family)
+		fmt.Fprintf(&builder, "# HELP %s Mock %s %d.\n# TYPE %s %s\n", name, metricType, family, name, metricType)
+		for series, value := range values {
+			fmt.Fprintf(&builder, "%s{%s=\"%s%d\",%s=\"%s%d\"} %v\n", name, labels[0], labels[0], series/10, labels[1], labels[1], series%10, value)
+		}
+	}
+	if exporter.histograms {
+		exporter.writeHistogram(&builder)
+	}
+	if exporter.summaries {
+		exporter.writeSummary(&builder)
+	}
+	exporter.mu.Unlock()
+
+	w.Header().Set(`Content-Type`, `text/plain; version=0.0.4`)
+	fmt.Fprint(w, builder.String())
+}
+
+func (exporter *mockExporter) writeHistogram(builder *strings.Builder) {
+	name := exporter.profile.prefix + `request_duration_seconds`
+	fmt.Fprintf(builder, "# HELP %s Mock histogram.\n# TYPE %s histogram\n", name, name)
+	count := exporter.scrape * 10
+	cumulative := 0
+	for _, bound := range []string{`0.1`, `0.5`, `1`, `5`} {
+		cumulative += count / 5
+		fmt.Fprintf(builder, "%s_bucket{le=\"%s\"} %d\n", name, bound, cumulative)
+	}
+	fmt.Fprintf(builder, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %v\n%s_count %d\n", name, count, name, float64(count)*0.4, name, count)
+}
+
+func (exporter *mockExporter) writeSummary(builder *strings.Builder) {
+	name := exporter.profile.prefix + `response_size_bytes`
+	fmt.Fprintf(builder, "# HELP %s Mock summary.\n# TYPE %s summary\n", name, name)
+	value := 0
+	for _, quantile := range []string{`0.5`, `0.9`, `0.99`} {
+		value += 200 + exporter.random.Intn(500)
+		fmt.Fprintf(builder, "%s{quantile=\"%s\"} %d\n", name, quantile, value)
+	}
+	fmt.Fprintf(builder, "%s_sum %d\n%s_count %d\n", name, exporter.scrape*700, name, exporter.scrape)
+}
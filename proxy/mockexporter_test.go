@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pdxiv/frugalpromproxy/parser"
+)
+
+func scrapeMock(t *testing.T, exporter *mockExporter) []parser.Family {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	exporter.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+	families, errs := parser.Parse(strings.NewReader(recorder.Body.String()))
+	if len(errs) > 0 {
+		t.Fatalf(`the mock exposition didn't parse: %v`, errs)
+	}
+	return families
+}
+
+func TestMockExpositionsParse(t *testing.T) {
+	exporter := newMockExporter(mockProfiles[`ksm`], 1)
+	exporter.histograms, exporter.summaries = true, true
+	families := scrapeMock(t, exporter)
+	var series int
+	types := make(map[string]int)
+	for _, family := range families {
+		series += len(family.Series)
+		types[family.Type]++
+	}
+	// Histogram and summary series are families of their own for the parser
+	if series != 20*200+7+5 {
+		t.Errorf(`%d series, expected the profile's 4000 and 12 of the histogram and summary`, series)
+	}
+	if types[`counter`] != 10 || types[`gauge`] != 10 || types[`histogram`] != 1 || types[`summary`] != 1 {
+		t.Errorf(`family types %v`, types)
+	}
+}
+
+func TestMockValuesChangeByTheFraction(t *testing.T) {
+	for _, fraction := range []float64{0, .1, .5, 1} {
+		profile := mockProfiles[`node`]
+		profile.families, profile.series, profile.changeFraction = 20, 100, fraction
+		exporter := newMockExporter(profile, 7)
+		before := scrapeMock(t, exporter)
+		after := scrapeMock(t, exporter)
+
+		var changed int
+		for i, family := range before {
+			for j, series := range family.Series {
+				if after[i].Series[j].Value != series.Value {
+					changed++
+					if family.Type == `counter` && after[i].Series[j].Value < series.Value {
+						t.Errorf(`counter %s went down`, family.Name)
+					}
+				}
+			}
+		}
+		// Gauges may draw the value they had, so allow some slack
+		if got := float64(changed) / 2000; got > fraction || got < fraction-.05 {
+			t.Errorf(`a change fraction of %v changed %v of the values`, fraction, got)
+		}
+	}
+}
+
+func TestMockSeedsGiveTheSameScrapes(t *testing.T) {
+	render := func(seed int64) string {
+		exporter := newMockExporter(mockProfiles[`node`], seed)
+		var bodies []string
+		for i := 0; i < 3; i++ {
+			recorder := httptest.NewRecorder()
+			exporter.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+			bodies = append(bodies, recorder.Body.String())
+		}
+		return strings.Join(bodies, ``)
+	}
+	if render(3) != render(3) {
+		t.Error(`the same seed gave different scrapes`)
+	}
+	if render(3) == render(4) {
+		t.Error(`different seeds gave the same scrapes`)
+	}
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Repeatable command line flag holding patterns on the metric name. They
+// are anchored at both ends like the keep and drop transforms, so go_.*
+// matches go_goroutines but not my_go_goroutines.
+type namePatterns []namePattern
+
+type namePattern struct {
+	source string // As given on the command line
+	regexp *regexp.Regexp
+}
+
+func (patterns *namePatterns) String() string {
+	sources := make([]string, len(*patterns))
+	for i, pattern := range *patterns {
+		sources[i] = pattern.source
+	}
+	return strings.Join(sources, ` `)
+}
+
+func (patterns *namePatterns) Set(value string) error {
+	compiled, err := regexp.Compile(`^(?:` + value + `)$`)
+	if err != nil {
+		return err
+	}
+	*patterns = append(*patterns, namePattern{source: value, regexp: compiled})
+	return nil
+}
+
+// The first pattern matching a metric name
+func (patterns namePatterns) matching(name string) (string, bool) {
+	for _, pattern := range patterns {
+		if pattern.regexp.MatchString(name) {
+			return pattern.source, true
+		}
+	}
+	return ``, false
+}
+
+// The -keep and -drop patterns of a target
+type nameFilter struct {
+	keep, drop namePatterns
+}
+
+// Of the command line, for every target without patterns of its own
+var globalNames nameFilter
+
+// The rule dropping a metric name, empty when it is kept. A name matching a
+// -keep pattern is always kept. Otherwise it is dropped when it matches a
+// -drop pattern, or when there are -keep patterns but no -drop patterns, so
+// -keep alone is an allowlist and next to -drop a list of exceptions.
+func (filter nameFilter) dropping(name string) string {
+	if _, kept := filter.keep.matching(name); kept {
+		return ``
+	}
+	if source, dropped := filter.drop.matching(name); dropped {
+		return `drop:` + source
+	}
+	if len(filter.keep) > 0 && len(filter.drop) == 0 {
+		return `keep`
+	}
+	return ``
+}
+
+// Remove the families dropped by -keep and -drop right after parsing, with
+// their histogram and summary series, so the transform chain and the
+// staleness state never see them
+func (scrapeTarget *ScrapeTarget) filterNames(data map[string]MetricData) {
+	scrapeTarget.configMutex.Lock()
+	filter := scrapeTarget.names
+	scrapeTarget.configMutex.Unlock()
+	if len(filter.keep) == 0 && len(filter.drop) == 0 {
+		return
+	}
+	decisions := make(ruleCounts)
+	for name, content := range data {
+		if rule := filter.dropping(name); rule != `` {
+			decisions[rule] += content.samples()
+			delete(data, name)
+		}
+	}
+	decisions.report(scrapeTarget.name)
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func namesOf(t *testing.T, keep, drop []string) nameFilter {
+	t.Helper()
+	var filter nameFilter
+	for _, pattern := range keep {
+		if err := filter.keep.Set(pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, pattern := range drop {
+		if err := filter.drop.Set(pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filter
+}
+
+func TestKeepTakesPrecedenceOverDrop(t *testing.T) {
+	for _, test := range []struct {
+		keep, drop []string
+		name       string
+		expected   string
+	}{
+		{nil, []string{`go_.*`, `process_.*`}, `go_goroutines`, `drop:go_.*`},
+		{nil, []string{`go_.*`, `process_.*`}, `process_cpu_seconds_total`, `drop:process_.*`},
+		{nil, []string{`go_.*`}, `node_load1`, ``},
+		// Patterns are anchored at both ends
+		{nil, []string{`go_.*`}, `my_go_goroutines`, ``},
+		{nil, []string{`go`}, `go_goroutines`, ``},
+		// Kept although dropped too
+		{[]string{`go_goroutines`}, []string{`go_.*`}, `go_goroutines`, ``},
+		{[]string{`go_goroutines`}, []string{`go_.*`}, `go_threads`, `drop:go_.*`},
+		{[]string{`go_goroutines`}, []string{`go_.*`}, `node_load1`, ``},
+		// -keep alone is an allowlist
+		{[]string{`node_.*`}, nil, `node_load1`, ``},
+		{[]string{`node_.*`}, nil, `up`, `keep`},
+		{nil, nil, `up`, ``},
+	} {
+		if rule := namesOf(t, test.keep, test.drop).dropping(test.name); rule != test.expected {
+			t.Errorf(`keep %v drop %v: %s is dropped by %q, expected %q`, test.keep, test.drop, test.name, rule, test.expected)
+		}
+	}
+}
+
+func TestBadNamePatternsAreRejected(t *testing.T) {
+	var patterns namePatterns
+	if err := patterns.Set(`go_(`); err == nil || len(patterns) != 0 {
+		t.Errorf(`took go_( with %v`, err)
+	}
+}
+
+func TestDroppedMetricsAreGoneRightAfterParsing(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.StartStale = false
+	commandLine.names = namesOf(t, []string{`go_goroutines`}, []string{`go_.*`, `latency`})
+	_, upstream := newFakeExporter(t, `# HELP go_goroutines Goroutines.
+# TYPE go_goroutines gauge
+go_goroutines 7
+# HELP go_threads Threads.
+# TYPE go_threads gauge
+go_threads 9
+# TYPE latency histogram
+latency_bucket{le="+Inf"} 3
+latency_sum 1.5
+latency_count 3
+# HELP node_load1 Load.
+# TYPE node_load1 gauge
+node_load1 0.5
+`)
+	scrapeTarget := newScrapeTarget(`node`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+	dropped := selfMetricValue(ruleDecisions.selfMetric, `node`, `drop:go_.*`)
+
+	response := httptest.NewRecorder()
+	scrapeTarget.handler(response, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+	expected := `# HELP go_goroutines Goroutines.
+# TYPE go_goroutines gauge
+go_goroutines 7
+# HELP node_load1 Load.
+# TYPE node_load1 gauge
+node_load1 0.5
+`
+	if response.Body.String() != expected {
+		t.Errorf("served\n%s\nexpected\n%s", response.Body, expected)
+	}
+	// Nothing of them is kept between scrapes
+	var tracked []string
+	for _, status := range nodeSeries(t, scrapeTarget, ``) {
+		tracked = append(tracked, status.Name)
+	}
+	if strings.Join(tracked, ` `) != `go_goroutines node_load1` {
+		t.Errorf(`the state has %v`, tracked)
+	}
+	if counted := selfMetricValue(ruleDecisions.selfMetric, `node`, `drop:go_.*`) - dropped; counted != 1 {
+		t.Errorf(`drop:go_.* dropped %g series`, counted)
+	}
+}
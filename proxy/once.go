@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// How long -once waits for the upstream, unless -scrape-timeout is shorter
+const onceTimeout = time.Minute
+
+// Scrape the upstream given like the first half of a port pair once, print
+// the filtered exposition to stdout and return the exit status. Unless the
+// state is kept in a bbolt file, there is no earlier scrape to compare with
+// and the staleness state starts like it does for a new target.
+func runOnce(argument string) int {
+	upstreams, err := parseUpstreamArgument(argument)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if len(upstreams) != 1 {
+		fmt.Fprintln(os.Stderr, `-once scrapes a single upstream, not merged ones`)
+		return 2
+	}
+
+	// Scraped right here, not in the background
+	settings := *commandLine
+	settings.scrapeInterval = 0
+	scrapeTarget := newScrapeTarget(upstreams[0].name(), upstreams[0].urls(), &settings)
+	scrapeTarget.params = upstreams[0].params
+	if len(upstreams[0].paths) > 1 {
+		scrapeTarget.paths = upstreams[0].paths
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), onceTimeout)
+	defer cancel()
+	result, err := scrapeTarget.Scrape(ctx)
+	if err != nil {
+		log.Printf("%s: %v", scrapeTarget.name, err)
+		return 1
+	}
+	if err := result.WriteText(os.Stdout); err != nil {
+		log.Printf("%s: %v", scrapeTarget.name, err)
+		return 1
+	}
+	return 0
+}
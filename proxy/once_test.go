@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Run -once with stdout going to a file, returning the exit status and what
+// was printed
+func runOnceCapturing(t *testing.T, argument string) (int, string) {
+	t.Helper()
+	stdout, err := os.Create(filepath.Join(t.TempDir(), `stdout`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	previous := os.Stdout
+	os.Stdout = stdout
+	status := runOnce(argument)
+	os.Stdout = previous
+
+	printed, err := ioutil.ReadFile(stdout.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, string(printed)
+}
+
+func TestOncePrintsTheFilteredExposition(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.StartStale = false
+	_, upstream := newFakeExporter(t, "# HELP node_load1 1m load average.\n# TYPE node_load1 gauge\nnode_load1 0.52\n")
+	status, printed := runOnceCapturing(t, upstream+`/metrics`)
+	if status != 0 {
+		t.Errorf(`exit status %d`, status)
+	}
+	if expected := "# HELP node_load1 1m load average.\n# TYPE node_load1 gauge\nnode_load1 0.52\n"; printed != expected {
+		t.Errorf("printed\n%s\nexpected\n%s", printed, expected)
+	}
+}
+
+func TestOnceLeavesOutSeriesStartingStale(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.StartStale = true
+	_, upstream := newFakeExporter(t, "node_load1 0.52\n")
+	status, printed := runOnceCapturing(t, upstream+`/metrics`)
+	if status != 0 || len(seriesLines(printed)) != 0 {
+		t.Errorf(`exit status %d, printed %q`, status, printed)
+	}
+}
+
+func TestOnceFailsWhenTheUpstreamDoes(t *testing.T) {
+	useCommandLineSettings(t)
+	exporter, upstream := newFakeExporter(t, "node_load1 0.52\n")
+	exporter.fail(http.StatusInternalServerError)
+	status, printed := runOnceCapturing(t, upstream+`/metrics`)
+	if status != 1 || printed != `` {
+		t.Errorf(`exit status %d, printed %q`, status, printed)
+	}
+}
+
+func TestOnceNeedsASingleUpstream(t *testing.T) {
+	useCommandLineSettings(t)
+	for _, argument := range []string{`9100+9200`, `not a port`} {
+		if status, printed := runOnceCapturing(t, argument); status != 2 || printed != `` {
+			t.Errorf(`%s: exit status %d, printed %q`, argument, status, printed)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pdxiv/frugalpromproxy/parser"
+)
+
+const (
+	textContentType        = `text/plain; version=0.0.4; charset=utf-8`
+	openMetricsContentType = `application/openmetrics-text; version=1.0.0; charset=utf-8`
+	// Sent to the upstreams, which answer the text format the parser reads
+	// rather than protobuf or OpenMetrics
+	upstreamAccept = `text/plain;version=0.0.4;q=1,*/*;q=0.1`
+)
+
+// Whether the scraper asked for OpenMetrics, with ?format=openmetrics or an
+// Accept header preferring it over the text format. Prometheus asks like
+//
+//	application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1
+//
+// The text format wins a tie, and is what */* gets.
+func wantsOpenMetrics(r *http.Request) bool {
+	if format := r.URL.Query().Get(`format`); format != `` {
+		return format == `openmetrics`
+	}
+	var openMetrics, text float64
+	for _, accepted := range strings.Split(r.Header.Get(`Accept`), `,`) {
+		parameters := strings.Split(accepted, `;`)
+		quality, version := 1.0, ``
+		for _, parameter := range parameters[1:] {
+			equals := strings.IndexByte(parameter, '=')
+			if equals < 0 {
+				continue
+			}
+			value := strings.Trim(strings.TrimSpace(parameter[equals+1:]), `"`)
+			switch strings.ToLower(strings.TrimSpace(parameter[:equals])) {
+			case `q`:
+				if q, err := strconv.ParseFloat(value, 64); err == nil {
+					quality = q
+				}
+			case `version`:
+				version = value
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(parameters[0])) {
+		case `application/openmetrics-text`:
+			if version == `` || version == `1.0.0` || version == `0.0.1` {
+				openMetrics = math.Max(openMetrics, quality)
+			}
+		case `text/plain`, `text/*`, `*/*`:
+			text = math.Max(text, quality)
+		}
+	}
+	return openMetrics > text
+}
+
+// Write the families in the OpenMetrics text format, ending with # EOF
+func writeOpenMetrics(w io.Writer, families []outputFamily) error {
+	buffered := bufio.NewWriterSize(w, 64*1024)
+	for _, family := range families {
+		family.renderOpenMetrics(buffered)
+	}
+	buffered.WriteString("# EOF\n")
+	return buffered.Flush()
+}
+
+// HELP is escaped like in the text format, plus double quotes
+var openMetricsHelpEscaper = strings.NewReplacer(`"`, `\"`)
+
+// The family in the OpenMetrics text format. A counter is named without
+// _total and its series with it, untyped is unknown, timestamps are in
+// seconds and an empty HELP is left out.
+func (family outputFamily) renderOpenMetrics(w io.StringWriter) {
+	name, metricType := family.name, typeText[family.metricType]
+	switch family.metricType {
+	case counter:
+		name = strings.TrimSuffix(family.name, `_total`)
+	case untyped:
+		metricType = `unknown`
+	}
+	if family.help != `` {
+		w.WriteString(`# HELP ` + name + ` ` + openMetricsHelpEscaper.Replace(family.help) + "\n")
+	}
+	w.WriteString(`# TYPE ` + name + ` ` + metricType + "\n")
+	for _, line := range family.lines {
+		seriesName, series, ok := parser.ParseSeriesLine(strings.TrimSuffix(line, "\n"))
+		if !ok {
+			continue
+		}
+		if family.metricType == counter && seriesName == family.name {
+			seriesName = name + `_total`
+		}
+		w.WriteString(openMetricsLine(seriesName, series))
+	}
+}
+
+func openMetricsLine(name string, series Series) string {
+	line := make([]byte, 0, len(name)+len(series.Labels)+40)
+	line = append(line, name...)
+	if series.Labels != `` {
+		line = append(line, '{')
+		line = append(line, series.Labels...)
+		line = append(line, '}')
+	}
+	line = append(line, ' ')
+	line = strconv.AppendFloat(line, series.Value, 'g', -1, 64)
+	if series.Timestamp != 0 {
+		line = append(line, ' ')
+		line = strconv.AppendFloat(line, float64(series.Timestamp)/1000, 'f', -1, 64)
+	}
+	return string(append(line, '\n'))
+}
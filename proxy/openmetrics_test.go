@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestScrapersGetOpenMetricsWhenTheyPreferIt(t *testing.T) {
+	for _, test := range []struct {
+		query, accept string
+		expected      bool
+	}{
+		{``, `application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1`, true},
+		{``, `application/openmetrics-text`, true},
+		{``, `application/openmetrics-text; version="0.0.1"`, true},
+		{``, `text/plain;version=0.0.4;q=0.5,application/openmetrics-text;q=0.6`, true},
+		{``, ``, false},
+		{``, `*/*`, false},
+		{``, `text/plain;version=0.0.4`, false},
+		// A tie goes to the text format
+		{``, `application/openmetrics-text,text/plain`, false},
+		{``, `application/openmetrics-text;q=0.5,*/*;q=0.5`, false},
+		// A version the proxy doesn't write
+		{``, `application/openmetrics-text;version=2.0.0`, false},
+		{``, `application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited`, false},
+		{`?format=openmetrics`, ``, true},
+		{`?format=text`, `application/openmetrics-text`, false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, `/metrics`+test.query, nil)
+		r.Header.Set(`Accept`, test.accept)
+		if wants := wantsOpenMetrics(r); wants != test.expected {
+			t.Errorf(`%s with Accept %q wants OpenMetrics: %t`, test.query, test.accept, wants)
+		}
+	}
+}
+
+func TestFamiliesAreWrittenInOpenMetrics(t *testing.T) {
+	families := []outputFamily{
+		{name: `http_requests_total`, help: `The total number of "HTTP" requests.`, metricType: counter, lines: []string{
+			"http_requests_total{code=\"200\",method=\"post\"} 1027 1395066363000\n",
+			"http_requests_total{code=\"400\",method=\"post\"} 3 1395066363000\n",
+		}},
+		{name: `latency_seconds`, metricType: histogram, lines: []string{
+			"latency_seconds_bucket{le=\"0.5\"} 129389\n",
+			"latency_seconds_bucket{le=\"+Inf\"} 144320\n",
+			"latency_seconds_sum 53423\n",
+			"latency_seconds_count 144320\n",
+		}},
+		{name: `metric_without_timestamp_and_labels`, metricType: untyped, lines: []string{"metric_without_timestamp_and_labels 12.47\n"}},
+		{name: `temperature`, metricType: gauge, lines: []string{"temperature -Inf 1395066363500\n"}},
+	}
+	var written bytes.Buffer
+	if err := writeOpenMetrics(&written, families); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP http_requests The total number of \"HTTP\" requests.
+# TYPE http_requests counter
+http_requests_total{code="200",method="post"} 1027 1395066363
+http_requests_total{code="400",method="post"} 3 1395066363
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.5"} 129389
+latency_seconds_bucket{le="+Inf"} 144320
+latency_seconds_sum 53423
+latency_seconds_count 144320
+# TYPE metric_without_timestamp_and_labels unknown
+metric_without_timestamp_and_labels 12.47
+# TYPE temperature gauge
+temperature -Inf 1395066363.5
+# EOF
+`
+	if written.String() != expected {
+		t.Errorf("written\n%s\nexpected\n%s", written.String(), expected)
+	}
+}
+
+func TestScrapesAreAnsweredInTheNegotiatedFormat(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.StartStale = false
+	var accepted atomic.Value
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accepted.Store(r.Header.Get(`Accept`))
+		w.Write([]byte("# TYPE app_requests_total counter\napp_requests_total 7\n"))
+	}))
+	t.Cleanup(exporter.Close)
+	scrapeTarget := newScrapeTarget(`app`, []string{exporter.URL}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+	scrape := func(accept string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, `/metrics`, nil)
+		r.Header.Set(`Accept`, accept)
+		scrapeTarget.handler(response, r)
+		return response
+	}
+
+	text := scrape(`text/plain`)
+	if text.Header().Get(`Content-Type`) != textContentType || strings.Contains(text.Body.String(), `# EOF`) || !strings.HasSuffix(text.Body.String(), "\napp_requests_total 7\n") {
+		t.Errorf("answered %s\n%s", text.Header().Get(`Content-Type`), text.Body)
+	}
+	openMetrics := scrape(`application/openmetrics-text;version=1.0.0`)
+	if openMetrics.Header().Get(`Content-Type`) != openMetricsContentType || openMetrics.Body.String() != "# TYPE app_requests counter\napp_requests_total 7\n# EOF\n" {
+		t.Errorf("answered %s\n%s", openMetrics.Header().Get(`Content-Type`), openMetrics.Body)
+	}
+	// Either way the upstream is asked for the text format
+	if accepted.Load() != upstreamAccept {
+		t.Errorf(`the upstream was sent Accept %q`, accepted.Load())
+	}
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOptionsApplyAfterTheConfig(t *testing.T) {
+	cfg := Config{StaleThreshold: 10, ScrapeInterval: time.Minute, Targets: []Target{{Name: `node`, Upstreams: []string{`http://localhost:9100/metrics`}}}}
+	for _, option := range []Option{
+		WithStaleThreshold(120),
+		WithTarget(Target{Name: `app`, Upstreams: []string{`http://localhost:8080/metrics`}}),
+		WithScrapeTimeout(3 * time.Second),
+		WithStalenessPolicy(`up=never`),
+		WithStalenessPolicy(`node_cpu_*=unchanged:threshold=20`),
+		WithMaxConcurrentScrapes(2),
+	} {
+		option(&cfg)
+	}
+	if cfg.StaleThreshold != 120 || cfg.ScrapeInterval != time.Minute || cfg.ScrapeTimeout != 3*time.Second || cfg.MaxConcurrentScrapes != 2 {
+		t.Errorf(`config %+v`, cfg)
+	}
+	if len(cfg.Targets) != 2 || cfg.Targets[1].Name != `app` {
+		t.Errorf(`targets %+v`, cfg.Targets)
+	}
+	if strings.Join(cfg.StalenessPolicies, ` `) != `up=never node_cpu_*=unchanged:threshold=20` {
+		t.Errorf(`policies %v`, cfg.StalenessPolicies)
+	}
+}
+
+func TestZeroSettingsGetTheFlagDefaults(t *testing.T) {
+	settings := Config{}.settings()
+	if settings.staleness.Threshold != defaultStaleThreshold || !settings.staleness.StartStale || !settings.staleness.SuppressCounters {
+		t.Errorf(`staleness defaults %+v`, settings.staleness)
+	}
+	if settings.scrapeTimeout != defaultScrapeTimeout || settings.forgetSeriesAfter != time.Hour || settings.clockJumpThreshold != 30*time.Second || settings.scrapeJitter != 0 {
+		t.Errorf(`settings %+v`, settings)
+	}
+	if settings.fetches.limit != 8 {
+		t.Errorf(`fetch limit %d`, settings.fetches.limit)
+	}
+
+	settings = Config{StaleThreshold: -1, StartLive: true, ScrapeInterval: time.Minute, ScrapeTimeout: -1, MaxConcurrentScrapes: -1}.settings()
+	if settings.staleness.Threshold != -1 || settings.staleness.StartStale || settings.scrapeJitter == 0 || settings.scrapeTimeout != -1 || settings.fetches.limit != -1 {
+		t.Errorf(`settings %+v`, settings)
+	}
+}
+
+// A config file and the same targets built in code make the same targets
+func TestConfigFileAndOptionsBuildTheSameTargets(t *testing.T) {
+	useCommandLineSettings(t)
+	path := filepath.Join(t.TempDir(), `targets.yaml`)
+	writeConfigFile(t, path, `targets:
+  - upstream: http://127.0.0.1:9100/metrics
+    listen: 19100
+    stale_threshold: 60
+    start_stale: false
+    host_header: node.example
+  - upstream: http://127.0.0.1:8080/metrics
+    listen: 19101
+    stale_threshold: 0
+`)
+	loaded, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var built Config
+	for _, option := range []Option{
+		WithTarget(Target{Name: `127.0.0.1:9100`, Upstreams: []string{`http://127.0.0.1:9100/metrics`}, StaleThreshold: 60, StartLive: true, HostHeader: `node.example`}),
+		WithTarget(Target{Name: `127.0.0.1:8080`, Upstreams: []string{`http://127.0.0.1:8080/metrics`}, StaleThreshold: -1}),
+	} {
+		option(&built)
+	}
+
+	settings := Config{}.settings()
+	fromFile, err := newProxy(loaded.config, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inCode, err := newProxy(built, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, proxy := range []*Proxy{fromFile, inCode} {
+			for _, scrapeTarget := range proxy.targets {
+				scrapeTarget.close()
+			}
+		}
+	})
+	if !reflect.DeepEqual(fromFile.Targets(), inCode.Targets()) {
+		t.Fatalf(`targets %v and %v`, fromFile.Targets(), inCode.Targets())
+	}
+	for _, name := range inCode.Targets() {
+		file, _ := fromFile.target(name)
+		code, _ := inCode.target(name)
+		if file.defaults != code.defaults || file.hostHeader != code.hostHeader || file.upstreams.activeURL() != code.upstreams.activeURL() {
+			t.Errorf("%s from the file: %+v, host %q\nin code: %+v, host %q", name, file.defaults, file.hostHeader, code.defaults, code.hostHeader)
+		}
+	}
+}
+
+// The file loader ends in Config.Validate, so both report the same problems
+func TestConfigFileAndOptionsAreValidatedAlike(t *testing.T) {
+	useCommandLineSettings(t)
+	path := filepath.Join(t.TempDir(), `targets.yaml`)
+	writeConfigFile(t, path, `targets:
+  - upstream: http://127.0.0.1:9100/metrics
+    listen: 19100
+    server_name: node.example
+`)
+	_, fileErr := loadConfigFile(path)
+	codeErr := Config{Targets: []Target{{Name: `127.0.0.1:9100`, Upstreams: []string{`http://127.0.0.1:9100/metrics`}, ServerName: `node.example`}}}.Validate()
+	if fileErr == nil || codeErr == nil || !strings.HasSuffix(fileErr.Error(), codeErr.Error()) {
+		t.Errorf("the file failed with\n%v\nthe config in code with\n%v", fileErr, codeErr)
+	}
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import "sort"
+
+// A name or label set with the position it was exposed at, sorted without
+// looking it up in its map for every comparison
+type positioned struct {
+	key      string
+	position int
+}
+
+func sortPositioned(keys []positioned) []string {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].position != keys[j].position {
+			return keys[i].position < keys[j].position
+		}
+		return keys[i].key < keys[j].key
+	})
+	sorted := make([]string, len(keys))
+	for i, key := range keys {
+		sorted[i] = key.key
+	}
+	return sorted
+}
+
+// The names of the families in the order the upstream exposed them.
+// Families without a position of their own, like ones a transformer added,
+// are ordered by name among those with the same position.
+func orderedNames(data map[string]MetricData) []string {
+	names := make([]positioned, 0, len(data))
+	for name, content := range data {
+		names = append(names, positioned{name, content.position})
+	}
+	return sortPositioned(names)
+}
+
+// The label sets of a family's series in the order the upstream exposed them
+func orderedLabels(series map[string]LabelSet) []string {
+	labels := make([]positioned, 0, len(series))
+	for label, set := range series {
+		labels = append(labels, positioned{label, set.position})
+	}
+	return sortPositioned(labels)
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// The upstream output as the proxy writes it, families and series in no
+// sorted order
+const orderedExposition = `# HELP zz_requests_total Requests.
+# TYPE zz_requests_total counter
+zz_requests_total{code="500",method="post"} 2
+zz_requests_total{code="200",method="get"} 1027
+zz_requests_total{code="404",method="get"} 3
+# HELP node_load1 1m load average.
+# TYPE node_load1 gauge
+node_load1 0.52
+# HELP http_request_duration_seconds Request latency.
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{le="0.5"} 129389
+http_request_duration_seconds_bucket{le="0.05"} 24054
+http_request_duration_seconds_bucket{le="+Inf"} 144320
+http_request_duration_seconds_sum 53423
+http_request_duration_seconds_count 144320
+# HELP aa_temperature_celsius Temperature.
+# TYPE aa_temperature_celsius gauge
+aa_temperature_celsius{sensor="b"} 41
+aa_temperature_celsius{sensor="a"} 39
+`
+
+func TestOutputKeepsTheUpstreamOrder(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.StartStale = false
+	commandLine.staleness.SuppressCounters = false
+	_, upstream := newFakeExporter(t, orderedExposition)
+	scrapeTarget := newScrapeTarget(`node`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+	for i := 0; i < 5; i++ {
+		response := httptest.NewRecorder()
+		scrapeTarget.handler(response, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+		if response.Body.String() != orderedExposition {
+			t.Fatalf("scrape %d served\n%s\nexpected the upstream output\n%s", i+1, response.Body, orderedExposition)
+		}
+	}
+}
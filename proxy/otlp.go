@@ -0,0 +1,392 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var otlpExports = selfMetrics.newCounterVec(`frugalpromproxy_otlp_exports_total`, `Exports of a target over OTLP, by outcome: success or failed.`, `target`, `outcome`)
+
+// Periodically exports the filtered families of every target over OTLP/HTTP
+// with the JSON encoding. Counters become monotonic cumulative sums, gauges
+// and untyped metrics become gauges. Histograms become cumulative histograms
+// with the finite le bounds as explicit bounds and the +Inf bucket as the
+// overflow bucket, summaries become summaries with their quantiles. The
+// cumulative points start when the target was created. A target's static
+// labels (like the ones from service discovery) become resource attributes.
+type otlpExporter struct {
+	endpoint string // e.g. http://collector:4318/v1/metrics
+	headers  map[string]string
+	interval time.Duration
+	client   *http.Client
+}
+
+// The OTLP JSON encoding, as far as it is used here
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpScopeMetrics struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Gauge       *otlpGauge     `json:"gauge,omitempty"`
+	Sum         *otlpSum       `json:"sum,omitempty"`
+	Histogram   *otlpHistogram `json:"histogram,omitempty"`
+	Summary     *otlpSummary   `json:"summary,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"` // 2 is cumulative
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"` // Of the cumulative sums
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsDouble          interface{}     `json:"asDouble"` // A number, or a string for NaN and infinities
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+// Counts are 64 bit integers, which the JSON encoding writes as strings
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	Count             string          `json:"count"`
+	Sum               interface{}     `json:"sum,omitempty"`
+	BucketCounts      []string        `json:"bucketCounts"` // Not cumulative, one more than the bounds
+	ExplicitBounds    []float64       `json:"explicitBounds"`
+}
+
+type otlpSummary struct {
+	DataPoints []otlpSummaryDataPoint `json:"dataPoints"`
+}
+
+type otlpSummaryDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	Count             string          `json:"count"`
+	Sum               interface{}     `json:"sum"`
+	QuantileValues    []otlpQuantile  `json:"quantileValues"`
+}
+
+type otlpQuantile struct {
+	Quantile float64     `json:"quantile"`
+	Value    interface{} `json:"value"`
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func newOTLPAttribute(key, value string) otlpAttribute {
+	attribute := otlpAttribute{Key: key}
+	attribute.Value.StringValue = value
+	return attribute
+}
+
+// JSON has no NaN or infinities, the OTLP JSON encoding spells them out
+func otlpDouble(value float64) interface{} {
+	switch {
+	case math.IsNaN(value):
+		return `NaN`
+	case math.IsInf(value, 1):
+		return `Infinity`
+	case math.IsInf(value, -1):
+		return `-Infinity`
+	}
+	return value
+}
+
+// A count for the JSON encoding. Prometheus keeps counts as floats, they are
+// rounded, and what isn't a finite count of at least 0 becomes 0.
+func otlpCount(value float64) string {
+	if !(value > 0) || math.IsInf(value, 1) {
+		return `0`
+	}
+	return strconv.FormatUint(uint64(math.Round(value)), 10)
+}
+
+func (exporter *otlpExporter) run() {
+	ticker := clock.NewTicker(exporter.interval)
+	defer ticker.Stop()
+	for range ticker.C() {
+		for _, scrapeTarget := range targets.all() {
+			if err := exporter.export(scrapeTarget); err != nil {
+				log.Printf("%s: OTLP export failed: %v", scrapeTarget.name, err)
+				otlpExports.inc(scrapeTarget.name, `failed`)
+			} else {
+				otlpExports.inc(scrapeTarget.name, `success`)
+			}
+		}
+	}
+}
+
+// Convert the families of one target into one resource. The cumulative
+// points start at start.
+func otlpResource(target, staticLabels string, families []outputFamily, start, now time.Time) otlpResourceMetrics {
+	var resource otlpResourceMetrics
+	resource.Resource.Attributes = []otlpAttribute{
+		newOTLPAttribute(`service.name`, `frugalpromproxy`),
+		newOTLPAttribute(`service.instance.id`, target),
+	}
+	static := make(map[string]string)
+	if staticLabels != `` {
+		sample, _ := parseSample(`x{` + staticLabels + `} 0`)
+		for _, label := range sample.labels[1:] {
+			resource.Resource.Attributes = append(resource.Resource.Attributes, newOTLPAttribute(label[0], label[1]))
+			static[label[0]] = label[1]
+		}
+	}
+
+	conversion := otlpConversion{start: strconv.FormatInt(start.UnixNano(), 10), now: strconv.FormatInt(now.UnixNano(), 10), static: static}
+	scope := otlpScopeMetrics{}
+	scope.Scope.Name = `frugalpromproxy`
+	for _, family := range families {
+		metric := otlpMetric{Name: family.name, Description: family.help}
+		switch family.metricType {
+		case histogram:
+			metric.Histogram = &otlpHistogram{DataPoints: conversion.histogramPoints(family), AggregationTemporality: 2}
+		case summary:
+			metric.Summary = &otlpSummary{DataPoints: conversion.summaryPoints(family)}
+		case counter:
+			metric.Sum = &otlpSum{DataPoints: conversion.points(family, true), AggregationTemporality: 2, IsMonotonic: true}
+		default:
+			metric.Gauge = &otlpGauge{DataPoints: conversion.points(family, false)}
+		}
+		scope.Metrics = append(scope.Metrics, metric)
+	}
+	resource.ScopeMetrics = []otlpScopeMetrics{scope}
+	return resource
+}
+
+// What the points of a resource share: the start of the cumulative points,
+// the export time for the series without a timestamp, and the static labels
+// already in the resource attributes
+type otlpConversion struct {
+	start, now string
+	static     map[string]string
+}
+
+// The time of a sample, the upstream's timestamp if it gave one
+func (conversion otlpConversion) of(sample remoteWriteSample) string {
+	if sample.timestamp != 0 {
+		return strconv.FormatInt(sample.timestamp*int64(time.Millisecond), 10)
+	}
+	return conversion.now
+}
+
+// The labels of a sample as attributes, leaving out the static labels and
+// the le or quantile label of a bucket or quantile
+func (conversion otlpConversion) attributes(sample remoteWriteSample, skip string) []otlpAttribute {
+	var attributes []otlpAttribute
+	for _, label := range sample.labels[1:] {
+		if value, ok := conversion.static[label[0]]; label[0] == skip || ok && value == label[1] {
+			continue
+		}
+		attributes = append(attributes, newOTLPAttribute(label[0], label[1]))
+	}
+	return attributes
+}
+
+func (conversion otlpConversion) points(family outputFamily, cumulative bool) []otlpDataPoint {
+	var points []otlpDataPoint
+	for _, line := range family.lines {
+		sample, ok := parseSample(line)
+		if !ok {
+			continue
+		}
+		point := otlpDataPoint{Attributes: conversion.attributes(sample, ``), TimeUnixNano: conversion.of(sample), AsDouble: otlpDouble(sample.value)}
+		if cumulative {
+			point.StartTimeUnixNano = conversion.start
+		}
+		points = append(points, point)
+	}
+	return points
+}
+
+// The series of a histogram or summary with the same labels, besides le or
+// quantile
+type otlpGroup struct {
+	attributes []otlpAttribute
+	time       string
+	bounds     []float64 // Of the buckets or quantiles, by the le or quantile label
+	values     []float64
+	sum, count float64
+	hasCount   bool
+}
+
+// Collect the series of a histogram or summary family by their labels, in
+// the order they first come in
+func (conversion otlpConversion) groups(family outputFamily, bound string) []*otlpGroup {
+	var groups []*otlpGroup
+	byKey := make(map[string]*otlpGroup)
+	for _, line := range family.lines {
+		sample, ok := parseSample(line)
+		if !ok {
+			continue
+		}
+		attributes := conversion.attributes(sample, bound)
+		key := attributesKey(attributes)
+		group, ok := byKey[key]
+		if !ok {
+			group = &otlpGroup{attributes: attributes, time: conversion.of(sample)}
+			byKey[key] = group
+			groups = append(groups, group)
+		}
+		switch sample.labels[0][1] {
+		case family.name + `_sum`:
+			group.sum = sample.value
+		case family.name + `_count`:
+			group.count, group.hasCount = sample.value, true
+		default:
+			for _, label := range sample.labels[1:] {
+				if label[0] != bound {
+					continue
+				}
+				if value, err := strconv.ParseFloat(label[1], 64); err == nil {
+					group.bounds = append(group.bounds, value)
+					group.values = append(group.values, sample.value)
+				}
+			}
+		}
+	}
+	for _, group := range groups {
+		sort.Sort(boundsOrder{group})
+	}
+	return groups
+}
+
+func attributesKey(attributes []otlpAttribute) string {
+	var key strings.Builder
+	for _, attribute := range attributes {
+		key.WriteString(attribute.Key + "\xff" + attribute.Value.StringValue + "\xff")
+	}
+	return key.String()
+}
+
+type boundsOrder struct{ *otlpGroup }
+
+func (order boundsOrder) Len() int           { return len(order.bounds) }
+func (order boundsOrder) Less(i, j int) bool { return order.bounds[i] < order.bounds[j] }
+func (order boundsOrder) Swap(i, j int) {
+	order.bounds[i], order.bounds[j] = order.bounds[j], order.bounds[i]
+	order.values[i], order.values[j] = order.values[j], order.values[i]
+}
+
+// The cumulative le buckets become counts per bucket. The finite bounds are
+// the explicit bounds, and what is above the last of them is counted in the
+// overflow bucket: the +Inf bucket, or _count when there is none.
+func (conversion otlpConversion) histogramPoints(family outputFamily) []otlpHistogramDataPoint {
+	var points []otlpHistogramDataPoint
+	for _, group := range conversion.groups(family, `le`) {
+		point := otlpHistogramDataPoint{Attributes: group.attributes, StartTimeUnixNano: conversion.start, TimeUnixNano: group.time, Sum: otlpDouble(group.sum), ExplicitBounds: []float64{}}
+		var below, overflow float64
+		hasOverflow := false
+		for i, bound := range group.bounds {
+			if math.IsInf(bound, 1) {
+				overflow, hasOverflow = group.values[i], true
+				break
+			}
+			point.ExplicitBounds = append(point.ExplicitBounds, bound)
+			point.BucketCounts = append(point.BucketCounts, otlpCount(group.values[i]-below))
+			below = group.values[i]
+		}
+		total := below
+		switch {
+		case hasOverflow:
+			total = overflow
+		case group.hasCount:
+			total = group.count
+		}
+		point.BucketCounts = append(point.BucketCounts, otlpCount(total-below))
+		point.Count = otlpCount(total)
+		points = append(points, point)
+	}
+	return points
+}
+
+func (conversion otlpConversion) summaryPoints(family outputFamily) []otlpSummaryDataPoint {
+	var points []otlpSummaryDataPoint
+	for _, group := range conversion.groups(family, `quantile`) {
+		point := otlpSummaryDataPoint{Attributes: group.attributes, StartTimeUnixNano: conversion.start, TimeUnixNano: group.time, Count: otlpCount(group.count), Sum: otlpDouble(group.sum), QuantileValues: []otlpQuantile{}}
+		for i, quantile := range group.bounds {
+			point.QuantileValues = append(point.QuantileValues, otlpQuantile{Quantile: quantile, Value: otlpDouble(group.values[i])})
+		}
+		points = append(points, point)
+	}
+	return points
+}
+
+func (exporter *otlpExporter) export(scrapeTarget *ScrapeTarget) error {
+	ctx, cancel := context.WithTimeout(context.Background(), exporter.interval)
+	defer cancel()
+	families, err := pushFamilies(scrapeTarget)
+	if err != nil {
+		return err
+	}
+	resource := otlpResource(scrapeTarget.name, scrapeTarget.currentStaticLabels(), families, scrapeTarget.created, scrapeTarget.now())
+	body, err := json.Marshal(otlpRequest{ResourceMetrics: []otlpResourceMetrics{resource}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, exporter.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(`Content-Type`, `application/json`)
+	setTenantHeader(req)
+	for name, value := range exporter.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := exporter.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf(`collector returned %s: %s`, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
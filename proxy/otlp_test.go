@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A collector decoding the OTLP requests it gets
+type fakeCollector struct {
+	mu       sync.Mutex
+	requests []otlpRequest
+	headers  []http.Header
+}
+
+func newFakeCollector(t *testing.T) (*fakeCollector, string) {
+	collector := &fakeCollector{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		collector.mu.Lock()
+		collector.requests = append(collector.requests, request)
+		collector.headers = append(collector.headers, r.Header)
+		collector.mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+	return collector, server.URL + `/v1/metrics`
+}
+
+func (collector *fakeCollector) metrics(t *testing.T) map[string]otlpMetric {
+	t.Helper()
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	if len(collector.requests) != 1 {
+		t.Fatalf(`collector got %d requests, expected 1`, len(collector.requests))
+	}
+	metrics := make(map[string]otlpMetric)
+	for _, metric := range collector.requests[0].ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		metrics[metric.Name] = metric
+	}
+	return metrics
+}
+
+func attributes(list []otlpAttribute) string {
+	pairs := make([]string, len(list))
+	for i, attribute := range list {
+		pairs[i] = attribute.Key + `=` + attribute.Value.StringValue
+	}
+	return strings.Join(pairs, `,`)
+}
+
+func TestFamiliesAreExportedAsOTLPPoints(t *testing.T) {
+	useCommandLineSettings(t)
+	collector, endpoint := newFakeCollector(t)
+	scrapeTarget := newPushedTarget(t, `localhost:9100`, `# HELP http_requests_total Requests.
+# TYPE http_requests_total counter
+http_requests_total{code="200",site="oslo"} 7 1622548800000
+# TYPE temperature gauge
+temperature +Inf
+untyped_value NaN
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="+Inf"} 1
+latency_seconds_sum 0.5
+latency_seconds_count 1
+`)
+	scrapeTarget.setStaticLabels(map[string]string{`site`: `oslo`})
+	exporter := &otlpExporter{endpoint: endpoint, headers: map[string]string{`X-Api-Key`: `secret`}, interval: time.Minute, client: http.DefaultClient}
+	if err := exporter.export(scrapeTarget); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := collector.metrics(t)
+	if latency := metrics[`latency_seconds`]; len(metrics) != 4 || latency.Histogram == nil || latency.Histogram.DataPoints[0].Count != `1` {
+		t.Errorf(`exported %d metrics, the histogram as %+v`, len(metrics), latency)
+	}
+	requests := metrics[`http_requests_total`]
+	if requests.Sum == nil || !requests.Sum.IsMonotonic || requests.Sum.AggregationTemporality != 2 || requests.Description != `Requests.` {
+		t.Fatalf(`the counter became %+v`, requests)
+	}
+	point := requests.Sum.DataPoints[0]
+	if point.AsDouble != 7.0 || point.TimeUnixNano != `1622548800000000000` || point.StartTimeUnixNano != strconv.FormatInt(scrapeTarget.created.UnixNano(), 10) || attributes(point.Attributes) != `code=200` {
+		t.Errorf(`the counter's point %+v`, point)
+	}
+	if temperature := metrics[`temperature`]; temperature.Gauge == nil || temperature.Gauge.DataPoints[0].AsDouble != `Infinity` {
+		t.Errorf(`the gauge became %+v`, temperature)
+	}
+	if untyped := metrics[`untyped_value`]; untyped.Gauge == nil || untyped.Gauge.DataPoints[0].AsDouble != `NaN` {
+		t.Errorf(`the untyped metric became %+v`, untyped)
+	}
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	if got := attributes(collector.requests[0].ResourceMetrics[0].Resource.Attributes); got != `service.name=frugalpromproxy,service.instance.id=localhost:9100,site=oslo` {
+		t.Errorf(`resource attributes %s`, got)
+	}
+	if collector.headers[0].Get(`X-Api-Key`) != `secret` {
+		t.Error(`the configured headers weren't sent`)
+	}
+}
+
+// The JSON of the metrics exported for the families, started an hour before
+// the export
+func otlpJSON(t *testing.T, families ...outputFamily) string {
+	t.Helper()
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	resource := otlpResource(`node`, `site="oslo"`, families, now.Add(-time.Hour), now)
+	var metrics []string
+	for _, metric := range resource.ScopeMetrics[0].Metrics {
+		encoded, err := json.Marshal(metric)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metrics = append(metrics, string(encoded))
+	}
+	return strings.Join(metrics, "\n")
+}
+
+func TestHistogramsAreExportedWithExplicitBounds(t *testing.T) {
+	exported := otlpJSON(t, outputFamily{name: `latency_seconds`, help: `Latency.`, metricType: histogram, lines: []string{
+		"latency_seconds_bucket{le=\"0.5\",path=\"/\",site=\"oslo\"} 5\n",
+		"latency_seconds_bucket{le=\"0.1\",path=\"/\",site=\"oslo\"} 2\n",
+		"latency_seconds_bucket{le=\"+Inf\",path=\"/\",site=\"oslo\"} 6\n",
+		"latency_seconds_sum{path=\"/\",site=\"oslo\"} 1.5\n",
+		"latency_seconds_count{path=\"/\",site=\"oslo\"} 6\n",
+		// Without a +Inf bucket _count is the total
+		"latency_seconds_bucket{le=\"0.1\",path=\"/api\"} 1 1622548830000\n",
+		"latency_seconds_sum{path=\"/api\"} +Inf 1622548830000\n",
+		"latency_seconds_count{path=\"/api\"} 4 1622548830000\n",
+	}})
+	expected := `{"name":"latency_seconds","description":"Latency.","histogram":{"dataPoints":[` +
+		`{"attributes":[{"key":"path","value":{"stringValue":"/"}}],"startTimeUnixNano":"1622545200000000000","timeUnixNano":"1622548800000000000","count":"6","sum":1.5,"bucketCounts":["2","3","1"],"explicitBounds":[0.1,0.5]},` +
+		`{"attributes":[{"key":"path","value":{"stringValue":"/api"}}],"startTimeUnixNano":"1622545200000000000","timeUnixNano":"1622548830000000000","count":"4","sum":"Infinity","bucketCounts":["1","3"],"explicitBounds":[0.1]}` +
+		`],"aggregationTemporality":2}}`
+	if exported != expected {
+		t.Errorf("exported\n%s\nexpected\n%s", exported, expected)
+	}
+
+	// Only the overflow bucket
+	exported = otlpJSON(t, outputFamily{name: `empty_seconds`, metricType: histogram, lines: []string{
+		"empty_seconds_bucket{le=\"+Inf\"} 0\n",
+		"empty_seconds_sum 0\n",
+		"empty_seconds_count 0\n",
+	}})
+	if !strings.Contains(exported, `"count":"0","sum":0,"bucketCounts":["0"],"explicitBounds":[]`) {
+		t.Errorf(`a histogram without finite buckets became %s`, exported)
+	}
+}
+
+func TestSummariesAreExportedWithTheirQuantiles(t *testing.T) {
+	exported := otlpJSON(t, outputFamily{name: `rpc_seconds`, metricType: summary, lines: []string{
+		"rpc_seconds{quantile=\"0.99\"} NaN\n",
+		"rpc_seconds{quantile=\"0.5\"} 0.02\n",
+		"rpc_seconds_sum 3.5\n",
+		"rpc_seconds_count 100\n",
+	}})
+	expected := `{"name":"rpc_seconds","summary":{"dataPoints":[{"startTimeUnixNano":"1622545200000000000","timeUnixNano":"1622548800000000000","count":"100","sum":3.5,` +
+		`"quantileValues":[{"quantile":0.5,"value":0.02},{"quantile":0.99,"value":"NaN"}]}]}}`
+	if exported != expected {
+		t.Errorf("exported\n%s\nexpected\n%s", exported, expected)
+	}
+}
+
+func TestSuppressedSeriesAreNotExported(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.Threshold = 1
+	collector, endpoint := newFakeCollector(t)
+	scrapeTarget, _, clock := newBackgroundTarget(t, `localhost:9100`, "up 1\n")
+	exporter := &otlpExporter{endpoint: endpoint, interval: time.Minute, client: http.DefaultClient}
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			nextBackgroundScrape(t, clock)
+		}
+		if err := exporter.export(scrapeTarget); err != nil {
+			t.Fatal(err)
+		}
+	}
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	if metrics := collector.requests[0].ResourceMetrics[0].ScopeMetrics[0].Metrics; len(metrics) != 1 {
+		t.Errorf(`the first export had %+v`, metrics)
+	}
+	for _, metric := range collector.requests[2].ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		if metric.Gauge != nil && len(metric.Gauge.DataPoints) > 0 {
+			t.Errorf(`the third export of an unchanged series had %+v`, metric)
+		}
+	}
+}
+
+func TestNonFiniteValuesAreSpelledOut(t *testing.T) {
+	for value, expected := range map[float64]interface{}{math.Inf(1): `Infinity`, math.Inf(-1): `-Infinity`, 1.5: 1.5} {
+		if got := otlpDouble(value); got != expected {
+			t.Errorf(`%v encoded as %v`, value, got)
+		}
+	}
+	if otlpDouble(math.NaN()) != `NaN` {
+		t.Error(`NaN isn't encoded as a string`)
+	}
+}
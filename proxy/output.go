@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	"github.com/pdxiv/frugalpromproxy/parser"
+)
+
+// A metric family as it is passed on: HELP and TYPE, and the series lines
+type outputFamily struct {
+	name       string
+	help       string
+	metricType MetricType
+	lines      []string // Complete series lines starting with the name, newline included
+}
+
+func (family outputFamily) render(w io.StringWriter) {
+	w.WriteString(`# HELP ` + family.name + ` ` + family.help + "\n")
+	w.WriteString(`# TYPE ` + family.name + ` ` + typeText[family.metricType] + "\n")
+	for _, line := range family.lines {
+		w.WriteString(line)
+	}
+}
+
+// Bytes of the families in the text exposition format
+func renderedSize(families []outputFamily) int {
+	var size int
+	for _, family := range families {
+		size += 2*len(family.name) + len(family.help) + len(typeText[family.metricType]) + len("# HELP  \n# TYPE  \n")
+		for _, line := range family.lines {
+			size += len(line)
+		}
+	}
+	return size
+}
+
+func renderFamilies(families []outputFamily) string {
+	var builder strings.Builder
+	builder.Grow(renderedSize(families))
+	for _, family := range families {
+		family.render(&builder)
+	}
+	return builder.String()
+}
+
+// Write the families in the text exposition format as they are rendered,
+// without building the whole output in memory first
+func writeText(w io.Writer, families []outputFamily) error {
+	buffered := bufio.NewWriterSize(w, 64*1024)
+	for _, family := range families {
+		family.render(buffered)
+	}
+	return buffered.Flush()
+}
+
+// The families with the timestamps left out of their series lines, for
+// node_exporter's textfile collector and the Pushgateway, which reject
+// series with timestamps
+func withoutTimestamps(families []outputFamily) []outputFamily {
+	stripped := make([]outputFamily, len(families))
+	for i, family := range families {
+		stripped[i] = family
+		stripped[i].lines = make([]string, len(family.lines))
+		for j, line := range family.lines {
+			name, series, ok := parser.ParseSeriesLine(strings.TrimSuffix(line, "\n"))
+			if ok && series.Timestamp != 0 {
+				line = seriesLine(name, series.Labels, series.Value, 0)
+			}
+			stripped[i].lines[j] = line
+		}
+	}
+	return stripped
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSeriesLinesAreFormattedLikeTheExposition(t *testing.T) {
+	for _, test := range []struct {
+		labels    string
+		value     float64
+		timestamp int64
+		expected  string
+	}{
+		{``, 0.52, 0, "node_load1 0.52\n"},
+		{`cpu="0"`, 1e21, 0, "node_load1{cpu=\"0\"} 1e+21\n"},
+		{``, 144320, 1622548800000, "node_load1 144320 1622548800000\n"},
+		{``, math.NaN(), 0, "node_load1 NaN\n"},
+		{``, math.Inf(1), 0, "node_load1 +Inf\n"},
+		{``, math.Inf(-1), 0, "node_load1 -Inf\n"},
+	} {
+		if line := seriesLine(`node_load1`, test.labels, test.value, test.timestamp); line != test.expected {
+			t.Errorf(`%q, expected %q`, line, test.expected)
+		}
+	}
+}
+
+func TestWrittenAndRenderedOutputAreTheSame(t *testing.T) {
+	families := []outputFamily{
+		{name: `node_load1`, help: `1m load average.`, metricType: gauge, lines: []string{"node_load1 0.52\n"}},
+		{name: `up`, metricType: untyped, lines: []string{"up 1\n"}},
+	}
+	var written bytes.Buffer
+	if err := writeText(&written, families); err != nil {
+		t.Fatal(err)
+	}
+	rendered := renderFamilies(families)
+	expected := "# HELP node_load1 1m load average.\n# TYPE node_load1 gauge\nnode_load1 0.52\n# HELP up \n# TYPE up untyped\nup 1\n"
+	if written.String() != expected || rendered != expected || renderedSize(families) != len(expected) {
+		t.Errorf("written\n%s\nrendered\n%s\nsize %d", written.String(), rendered, renderedSize(families))
+	}
+}
+
+// A node_exporter of a large host: 100k series in 1000 families
+func largeExposition() string {
+	var exposition strings.Builder
+	for family := 0; family < 1000; family++ {
+		name := `node_disk_io_time_seconds_` + strconv.Itoa(family)
+		exposition.WriteString("# HELP " + name + " Disk I/O time.\n# TYPE " + name + " counter\n")
+		for series := 0; series < 100; series++ {
+			exposition.WriteString(name + `{device="sd` + strconv.Itoa(series) + `",instance="host-1"} ` + strconv.FormatFloat(float64(family*series)+0.25, 'g', -1, 64) + "\n")
+		}
+	}
+	return exposition.String()
+}
+
+func BenchmarkParseExposition(b *testing.B) {
+	exposition := largeExposition()
+	b.SetBytes(int64(len(exposition)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		parseExposition(exposition, func(int, string) {})
+	}
+}
+
+// Parsing, deciding and writing a scrape of 100k series that all pass
+func BenchmarkProcessAndWrite(b *testing.B) {
+	exposition := largeExposition()
+	settings := commandLineSettings()
+	settings.fetches = newFetchLimiter(0)
+	settings.staleness.Threshold = -1
+	settings.staleness.StartStale = false
+	scrapeTarget := newScrapeTarget(`node`, []string{`http://localhost:9100/metrics`}, settings)
+	defer scrapeTarget.close()
+	b.SetBytes(int64(len(exposition)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		result, err := scrapeTarget.process(exposition, ``)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := result.WriteText(ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestEscapedLabelValuesAreServedAsTheyCame(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.StartStale = false
+	const exposition = `errors_total{message="unexpected \"}\" in input"} 3
+msdos_file_access_time_seconds{error="Cannot find file:\n\"FILE.TXT\"",path="C:\\DIR\\FILE.TXT"} 1.458255915e+09
+query_total{a="x=1,y=2",b="{}"} 1
+`
+	_, upstream := newFakeExporter(t, exposition)
+	scrapeTarget := newScrapeTarget(`node`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+	if _, served := servedSeries(scrapeTarget); served != strings.Join(seriesLines(exposition), "\n") {
+		t.Errorf("served\n%s", served)
+	}
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Comma separated, repeatable command line flag holding query parameter names
+type paramNames []string
+
+func (names *paramNames) String() string {
+	return strings.Join(*names, `,`)
+}
+
+func (names *paramNames) Set(value string) error {
+	for _, element := range strings.Split(value, `,`) {
+		if element = strings.TrimSpace(element); element != `` {
+			*names = append(*names, element)
+		}
+	}
+	return nil
+}
+
+// Query parameters of the scrape request passed on to the upstreams
+var passthroughParams paramNames
+
+// What a scrape request passes on to the upstream request
+type upstreamRequest struct {
+	query  url.Values
+	header http.Header
+	path   string // Replaces the path of the upstream URL, if set
+}
+
+// Upstream requests with the same key fetch the same
+func (request upstreamRequest) key() string {
+	var key strings.Builder
+	key.WriteString(request.path)
+	key.WriteString("\x00")
+	key.WriteString(request.query.Encode())
+	names := make([]string, 0, len(request.header))
+	for name := range request.header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range request.header[name] {
+			key.WriteString("\x00" + name + ": " + value)
+		}
+	}
+	return key.String()
+}
+
+// Build the upstream request for a scrape request, or for a background
+// scrape when r is nil
+func (scrapeTarget *ScrapeTarget) upstreamRequest(r *http.Request) upstreamRequest {
+	return upstreamRequest{query: scrapeTarget.upstreamQuery(r), header: forwardedHeaders(r)}
+}
+
+// The upstream request a scrape request is answered from: its own, or the
+// one of the background scrapes
+func (scrapeTarget *ScrapeTarget) servedRequest(r *http.Request) upstreamRequest {
+	if scrapeTarget.schedule != nil {
+		return scrapeTarget.upstreamRequest(nil)
+	}
+	return scrapeTarget.upstreamRequest(r)
+}
+
+// The query for the upstream: the target's static parameters, plus the
+// allowed ones from the scrape request. Without a request (background
+// scrapes) only the static ones.
+func (scrapeTarget *ScrapeTarget) upstreamQuery(r *http.Request) url.Values {
+	query := url.Values{}
+	for name, values := range scrapeTarget.params {
+		query[name] = append(query[name], values...)
+	}
+	if r != nil {
+		incoming := r.URL.Query()
+		for _, name := range passthroughParams {
+			if values, ok := incoming[name]; ok {
+				query[name] = append(query[name], values...)
+			}
+		}
+	}
+	return query
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// An exporter remembering the last request it got
+type recordingExporter struct {
+	mu   sync.Mutex
+	last *http.Request
+}
+
+func newRecordingExporter(t *testing.T) (*recordingExporter, string) {
+	exporter := &recordingExporter{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exporter.mu.Lock()
+		exporter.last = r
+		exporter.mu.Unlock()
+		io.WriteString(w, "up 1\n")
+	}))
+	t.Cleanup(server.Close)
+	return exporter, server.URL
+}
+
+func (exporter *recordingExporter) lastRequest() *http.Request {
+	exporter.mu.Lock()
+	defer exporter.mu.Unlock()
+	return exporter.last
+}
+
+func newParamsTarget(t *testing.T, upstream string, params url.Values) *ScrapeTarget {
+	scrapeTarget := unstartedScrapeTarget(`federate`, []string{upstream + `/federate`}, commandLine)
+	scrapeTarget.params = params
+	scrapeTarget.start()
+	t.Cleanup(scrapeTarget.close)
+	return scrapeTarget
+}
+
+func scrapeWithQuery(scrapeTarget *ScrapeTarget, query string) int {
+	recorder := httptest.NewRecorder()
+	scrapeTarget.handler(recorder, httptest.NewRequest(http.MethodGet, `/metrics?`+query, nil))
+	return recorder.Code
+}
+
+func TestStaticParamsAreSentEncoded(t *testing.T) {
+	useCommandLineSettings(t)
+	exporter, upstream := newRecordingExporter(t)
+	params := url.Values{`match[]`: {`{job="node",instance=~"10\\..+"}`, `up`}}
+	scrapeTarget := newParamsTarget(t, upstream, params)
+	if code := scrapeWithQuery(scrapeTarget, `match[]=other`); code != http.StatusOK {
+		t.Fatalf(`answered %d`, code)
+	}
+	received := exporter.lastRequest().URL
+	if received.Path != `/federate` || received.RawQuery != params.Encode() {
+		t.Errorf(`upstream got %s, expected the query %s`, received, params.Encode())
+	}
+	if got := received.Query()[`match[]`]; len(got) != 2 || got[0] != `{job="node",instance=~"10\\..+"}` {
+		t.Errorf(`upstream decoded %q`, got)
+	}
+}
+
+func TestPassthroughParamsAreAddedToTheStaticOnes(t *testing.T) {
+	useCommandLineSettings(t)
+	defer func(names paramNames) { passthroughParams = names }(passthroughParams)
+	passthroughParams = paramNames{}
+	if err := passthroughParams.Set(`module, match[]`); err != nil {
+		t.Fatal(err)
+	}
+	exporter, upstream := newRecordingExporter(t)
+	scrapeTarget := newParamsTarget(t, upstream, url.Values{`match[]`: {`up`}})
+	scrapeWithQuery(scrapeTarget, `match[]=node_load1&module=a+b%26c&secret=x`)
+	query := exporter.lastRequest().URL.Query()
+	if got := query[`match[]`]; len(got) != 2 || got[0] != `up` || got[1] != `node_load1` {
+		t.Errorf(`match[] %q, expected the static one and then the passed through one`, got)
+	}
+	if query.Get(`module`) != `a b&c` || query.Get(`secret`) != `` {
+		t.Errorf(`upstream query %v`, query)
+	}
+
+	if scrapeTarget.upstreamRequest(nil).query.Get(`module`) != `` {
+		t.Error(`a background scrape passed parameters through`)
+	}
+	first := scrapeTarget.upstreamRequest(httptest.NewRequest(http.MethodGet, `/metrics?module=a`, nil))
+	second := scrapeTarget.upstreamRequest(httptest.NewRequest(http.MethodGet, `/metrics?module=b`, nil))
+	if first.key() == second.key() {
+		t.Error(`requests with different parameters share a cache key`)
+	}
+}
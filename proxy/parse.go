@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// What the parser made of one family
+type parsedFamily struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Help    string `json:"help"`
+	Series  int    `json:"series"`
+	Example string `json:"example,omitempty"`
+}
+
+type rejectedLine struct {
+	Number int    `json:"line"`
+	Text   string `json:"text"`
+}
+
+type parseSummary struct {
+	Families []parsedFamily `json:"families"`
+	Rejected []rejectedLine `json:"rejected"`
+}
+
+// Run the parse subcommand: show what the proxy's parser sees in an
+// exposition, from a file or a URL
+func parseCommand(arguments []string) {
+	flags := flag.NewFlagSet(`parse`, flag.ExitOnError)
+	format := flags.String(`format`, `table`, `Output format: table or json`)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), `Usage: frugalpromproxy parse [-format json] <file or URL>`)
+		flags.PrintDefaults()
+	}
+	flags.Parse(arguments)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	source := flags.Arg(0)
+	var body string
+	var err error
+	if strings.HasPrefix(source, `http://`) || strings.HasPrefix(source, `https://`) {
+		body, err = fetchBody(source)
+	} else {
+		var content []byte
+		content, err = ioutil.ReadFile(source)
+		body = string(content)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	summary := summarizeExposition(body)
+	if *format == `json` {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent(``, `  `)
+		encoder.Encode(summary)
+		return
+	}
+	summary.printTable()
+}
+
+func summarizeExposition(body string) parseSummary {
+	summary := parseSummary{Families: []parsedFamily{}, Rejected: []rejectedLine{}}
+	data, _ := parseExposition(body, func(number int, line string) {
+		summary.Rejected = append(summary.Rejected, rejectedLine{Number: number, Text: line})
+	})
+
+	for name, content := range data {
+		series := content.series(name)
+		family := parsedFamily{Name: name, Type: typeText[content.commentType], Help: content.commentHelp, Series: len(series)}
+		sort.Slice(series, func(i, j int) bool {
+			if series[i].name != series[j].name {
+				return series[i].name < series[j].name
+			}
+			return series[i].labels < series[j].labels
+		})
+		if len(series) > 0 {
+			family.Example = series[0].name
+			if series[0].labels != `` {
+				family.Example += `{` + series[0].labels + `}`
+			}
+			family.Example += fmt.Sprint(` `, series[0].value)
+		}
+		summary.Families = append(summary.Families, family)
+	}
+	sort.Slice(summary.Families, func(i, j int) bool { return summary.Families[i].Name < summary.Families[j].Name })
+	return summary
+}
+
+func (summary parseSummary) printTable() {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "FAMILY\tTYPE\tSERIES\tEXAMPLE\tHELP")
+	for _, family := range summary.Families {
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%s\t%s\n", family.Name, family.Type, family.Series, family.Example, family.Help)
+	}
+	writer.Flush()
+
+	if len(summary.Rejected) > 0 {
+		fmt.Printf("\n%d lines rejected:\n", len(summary.Rejected))
+		for _, line := range summary.Rejected {
+			fmt.Printf("%d: %s\n", line.Number, line.Text)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const nodeExposition = `# HELP node_load1 1m load average.
+# TYPE node_load1 gauge
+node_load1 0.52
+# HELP node_cpu_seconds_total Seconds the CPUs spent in each mode.
+# TYPE node_cpu_seconds_total counter
+node_cpu_seconds_total{cpu="1",mode="idle"} 1250.5
+node_cpu_seconds_total{cpu="0",mode="user"} 30.25
+node_cpu_seconds_total{cpu="0",mode="idle"} 1234.75
+`
+
+func TestParseSummaryDescribesTheFamilies(t *testing.T) {
+	summary := summarizeExposition(nodeExposition)
+	encoded, err := json.Marshal(summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"families":[` +
+		`{"name":"node_cpu_seconds_total","type":"counter","help":"Seconds the CPUs spent in each mode.","series":3,"example":"node_cpu_seconds_total{cpu=\"0\",mode=\"idle\"} 1234.75"},` +
+		`{"name":"node_load1","type":"gauge","help":"1m load average.","series":1,"example":"node_load1 0.52"}` +
+		`],"rejected":[]}`
+	if string(encoded) != expected {
+		t.Errorf("summary %s\nexpected %s", encoded, expected)
+	}
+}
+
+func TestParseSummaryListsRejectedLines(t *testing.T) {
+	summary := summarizeExposition("up 1\nup{job=\"node\" 1\n\n# a comment\nnot a series line\nok 2\n")
+	if len(summary.Families) != 2 {
+		t.Errorf(`families %+v`, summary.Families)
+	}
+	if len(summary.Rejected) != 2 || summary.Rejected[0] != (rejectedLine{Number: 2, Text: `up{job="node" 1`}) || summary.Rejected[1].Number != 5 {
+		t.Errorf(`rejected %+v`, summary.Rejected)
+	}
+}
+
+func TestParseReadsURLs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, nodeExposition)
+	}))
+	defer server.Close()
+	body, err := fetchBody(server.URL + `/metrics`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary := summarizeExposition(body); len(summary.Families) != 2 || summary.Families[0].Series != 3 {
+		t.Errorf(`summary of the fetched exposition %+v`, summary)
+	}
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"mime"
+)
+
+// Name of the gauge added to the output when a fail-open target has too many
+// lines that couldn't be parsed
+const unparsedWarningName = `frugalpromproxy_unparsed_lines_ratio`
+
+// Decide what to do about the lines of a scrape that couldn't be parsed.
+// Returns a warning family to add to the output, or an error if the scrape
+// should fail.
+func (scrapeTarget *ScrapeTarget) checkParseErrors(rejected []ParseError, lines int) (*outputFamily, error) {
+	if scrapeTarget.parseErrorThreshold <= 0 || lines == 0 {
+		return nil, nil
+	}
+	ratio := float64(len(rejected)) / float64(lines)
+	if ratio <= scrapeTarget.parseErrorThreshold {
+		return nil, nil
+	}
+
+	spike := &ErrParse{Line: rejected[0].Line, Unparsed: len(rejected), Lines: lines, Threshold: scrapeTarget.parseErrorThreshold}
+	if scrapeTarget.parseErrorFailClosed {
+		return nil, spike
+	}
+	log.Printf("%s: %v", scrapeTarget.name, spike)
+	return &outputFamily{
+		name:       unparsedWarningName,
+		help:       `WARNING: part of the upstream output could not be parsed and is missing from this response.`,
+		metricType: gauge,
+		lines:      []string{fmt.Sprintln(unparsedWarningName, ratio)},
+	}, nil
+}
+
+// Thresholds below which a body with a content type other than an exposition
+// format is taken for something else, like an HTML page on the wrong port
+var (
+	contentCheckMinSamples = 10
+	contentCheckMinRatio   = 0.5
+)
+
+// Content types of expositions, including the ones of exporters that don't
+// set one properly
+var expositionContentTypes = map[string]bool{
+	`text/plain`:                   true,
+	`application/openmetrics-text`: true,
+	`application/octet-stream`:     true,
+}
+
+// Fail a scrape whose upstream sent something other than metrics: the
+// content type isn't an exposition format, and few samples were parsed, or
+// few of the lines that aren't comments were samples
+func checkContent(contentType string, data map[string]MetricData, unparsed int) error {
+	if contentType == `` {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err == nil && expositionContentTypes[mediaType] {
+		return nil
+	}
+	var samples int
+	for name, content := range data {
+		samples += len(content.series(name))
+	}
+	tooFew := samples < contentCheckMinSamples
+	if samples+unparsed > 0 && float64(samples)/float64(samples+unparsed) < contentCheckMinRatio {
+		tooFew = true
+	}
+	if !tooFew {
+		return nil
+	}
+	return &ErrNotExposition{ContentType: contentType, Samples: samples}
+}
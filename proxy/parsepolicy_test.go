@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Two of the four lines that aren't comments can't be parsed
+const halfBrokenExposition = "# TYPE up gauge\nup 1\nload 0.5\nup{ 1\nbroken line here\n"
+
+func TestParseErrorSpikesFailClosedTargets(t *testing.T) {
+	_, upstream := newFakeExporter(t, "up 1\n")
+	scrapeTarget := newFakeClockProxy(t, newFakeClock(), Config{StartLive: true}, upstream).targets[`node`]
+	scrapeTarget.parseErrorThreshold, scrapeTarget.parseErrorFailClosed = 0.25, true
+
+	_, err := scrapeTarget.process(halfBrokenExposition, ``)
+	var parse *ErrParse
+	if !errors.As(err, &parse) || parse.Unparsed != 2 || parse.Line != 4 {
+		t.Fatalf(`scraping a half broken exposition returned %v`, err)
+	}
+	if code, _ := errorStatus(err); code != http.StatusBadGateway {
+		t.Errorf(`a parse error spike is answered %d`, code)
+	}
+
+	scrapeTarget.parseErrorThreshold = 0.6
+	if _, err := scrapeTarget.process(halfBrokenExposition, ``); err != nil {
+		t.Errorf(`parse errors below the threshold failed the scrape: %v`, err)
+	}
+}
+
+func TestParseErrorSpikesAddAWarningToFailOpenTargets(t *testing.T) {
+	_, upstream := newFakeExporter(t, "up 1\n")
+	scrapeTarget := newFakeClockProxy(t, newFakeClock(), Config{StartLive: true}, upstream).targets[`node`]
+	scrapeTarget.parseErrorThreshold = 0.25
+
+	result, err := scrapeTarget.process(halfBrokenExposition, ``)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !forwarded(result, unparsedWarningName) || !forwarded(result, `up`) {
+		t.Errorf(`a fail-open target served %+v`, result.families)
+	}
+}
+
+func useContentCheck(t *testing.T, minSamples int, minRatio float64) {
+	previousSamples, previousRatio := contentCheckMinSamples, contentCheckMinRatio
+	contentCheckMinSamples, contentCheckMinRatio = minSamples, minRatio
+	t.Cleanup(func() { contentCheckMinSamples, contentCheckMinRatio = previousSamples, previousRatio })
+}
+
+const (
+	adminPage    = "<!DOCTYPE html>\n<html>\n<head><title>Admin</title></head>\n<body>up 1</body>\n</html>\n"
+	jsonAPI      = "{\n  \"status\": \"ok\",\n  \"uptime\": 3600\n}\n"
+	tinyExporter = "# TYPE app_up gauge\napp_up 1\napp_jobs_queued 3\n"
+)
+
+func TestBodiesThatArentMetricsFailTheScrape(t *testing.T) {
+	useContentCheck(t, 10, 0.5)
+	_, upstream := newFakeExporter(t, "up 1\n")
+	scrapeTarget := newFakeClockProxy(t, newFakeClock(), Config{StartLive: true}, upstream).targets[`node`]
+
+	for _, body := range []struct{ contentType, text string }{
+		{`text/html; charset=utf-8`, adminPage},
+		{`application/json`, jsonAPI},
+	} {
+		_, err := scrapeTarget.process(body.text, body.contentType)
+		var notExposition *ErrNotExposition
+		if !errors.As(err, &notExposition) || notExposition.Samples != 0 || !strings.HasSuffix(err.Error(), `upstream returned `+body.contentType+`, 0 samples parsed`) {
+			t.Errorf(`%s returned %v`, body.contentType, err)
+		}
+	}
+	for _, contentType := range []string{``, `text/plain; version=0.0.4`, `application/openmetrics-text; version=1.0.0`, `application/octet-stream`} {
+		if _, err := scrapeTarget.process(tinyExporter, contentType); err != nil {
+			t.Errorf(`a tiny exporter sending %q failed with %v`, contentType, err)
+		}
+	}
+	if _, err := scrapeTarget.process(tinyExporter, `application/json`); err == nil {
+		t.Error(`2 samples sent as application/json passed the check`)
+	}
+}
+
+func TestTinyExportersCanTurnOffTheSampleCount(t *testing.T) {
+	useContentCheck(t, 0, 0.5)
+	_, upstream := newFakeExporter(t, "up 1\n")
+	scrapeTarget := newFakeClockProxy(t, newFakeClock(), Config{StartLive: true}, upstream).targets[`node`]
+
+	result, err := scrapeTarget.process(tinyExporter, `application/json`)
+	if err != nil || !forwarded(result, `app_up`) || !forwarded(result, `app_jobs_queued`) {
+		t.Errorf(`a tiny exporter with the override returned %v`, err)
+	}
+	// Still failed by the ratio of samples
+	if _, err := scrapeTarget.process(adminPage, `text/html`); err == nil {
+		t.Error(`an HTML page passed with only the sample count turned off`)
+	}
+
+	useContentCheck(t, 0, 0)
+	if _, err := scrapeTarget.process(adminPage, `text/html`); err != nil {
+		t.Errorf(`with the check turned off an HTML page failed with %v`, err)
+	}
+}
+
+func TestAnHTMLPageIsAnsweredWith502(t *testing.T) {
+	useContentCheck(t, 10, 0.5)
+	useCommandLineSettings(t)
+	_, upstream := newFakeExporter(t, adminPage)
+	scrapeTarget := newScrapeTarget(`node`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+	response := httptest.NewRecorder()
+	scrapeTarget.handler(response, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+	if response.Code != http.StatusBadGateway || !strings.Contains(response.Body.String(), `upstream returned text/html; charset=utf-8, 0 samples parsed`) {
+		t.Errorf(`answered %d %s`, response.Code, response.Body)
+	}
+}
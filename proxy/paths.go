@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Name of the gauge telling which paths of a multi-path upstream answered
+const upstreamPathUpName = `frugalpromproxy_upstream_path_up`
+
+// Split the ports of an upstream argument from its paths, like
+// 9100/metrics;/metrics/app. Without paths the upstream is scraped on
+// basePath.
+func parseUpstreamPaths(source string) (string, []string, error) {
+	slash := strings.Index(source, `/`)
+	if slash < 0 {
+		return source, []string{basePath}, nil
+	}
+	var paths []string
+	for _, path := range strings.Split(source[slash:], `;`) {
+		if !strings.HasPrefix(path, `/`) {
+			return ``, nil, fmt.Errorf(`upstream path %q doesn't start with /`, path)
+		}
+		paths = append(paths, path)
+	}
+	return source[:slash], paths, nil
+}
+
+// The URLs of the upstream's origins on its first path, the other paths are
+// swapped in for each fetch
+func (upstream upstreamSpec) urls() []string {
+	urls := make([]string, len(upstream.origins))
+	for i, origin := range upstream.origins {
+		urls[i] = origin + upstream.paths[0]
+	}
+	return urls
+}
+
+// What one path of a multi-path scrape returned
+type pathResult struct {
+	body        string
+	contentType string
+	err         error
+}
+
+// Fetch all paths of the target at the same time and run the combined data
+// through the staleness filter. A family exported on more than one path is
+// taken from the first of them. Paths that fail are left out and reported
+// with a gauge, as long as one of them answers. Staleness state is kept by
+// series, so a series moving to another path carries on where it was.
+func (scrapeTarget *ScrapeTarget) scrapePaths(ctx context.Context, request upstreamRequest) (*ScrapeResult, error) {
+	start := scrapeTarget.now()
+	results := make([]pathResult, len(scrapeTarget.paths))
+	var wg sync.WaitGroup
+	for i, path := range scrapeTarget.paths {
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+			pathRequest := request
+			pathRequest.path = path
+			results[i].body, results[i].contentType, results[i].err = scrapeTarget.fetchPath(ctx, pathRequest)
+		}(i, path)
+	}
+	wg.Wait()
+
+	data := make(map[string]MetricData)
+	origin := make(map[string]string) // Path each family was taken from
+	var rejected []ParseError
+	var lines int
+	upstream := UpstreamInfo{URL: scrapeTarget.upstreams.activeURL(), Status: http.StatusOK, Duration: scrapeTarget.since(start)}
+	up := outputFamily{name: upstreamPathUpName, help: `Whether the upstream path could be scraped.`, metricType: gauge}
+	var lastErr error
+	for i, path := range scrapeTarget.paths {
+		var pathData map[string]MetricData
+		var pathRejected []ParseError
+		var pathLines int
+		err := results[i].err
+		if err == nil {
+			body := results[i].body
+			if i == 0 && pushed != nil && pushed.target == scrapeTarget.name {
+				body += "\n" + pushed.exposition()
+			}
+			pathData, pathLines = parseExposition(body, func(number int, line string) {
+				pathRejected = append(pathRejected, ParseError{Line: number, Text: line})
+			})
+			err = checkContent(results[i].contentType, pathData, len(pathRejected))
+		}
+		value := 1
+		if err != nil {
+			log.Printf("%s: path %s failed: %v", scrapeTarget.name, path, err)
+			lastErr = err
+			value = 0
+		}
+		up.lines = append(up.lines, fmt.Sprintln(upstreamPathUpName+`{path="`+escapeLabelValue(path)+`"}`, value))
+		if err != nil {
+			continue
+		}
+
+		rejected = append(rejected, pathRejected...)
+		upstream.Bytes += len(results[i].body)
+		// After the families of the paths before, a family has a line at least
+		offset := lines
+		lines += pathLines
+		for name, content := range pathData {
+			content.position += offset
+			if first, ok := origin[name]; ok {
+				log.Printf("%s: %s is exported on both %s and %s, keeping the one from %s", scrapeTarget.name, name, first, path, first)
+				continue
+			}
+			origin[name] = path
+			data[name] = content
+		}
+	}
+	if len(origin) == 0 && lastErr != nil {
+		return nil, fmt.Errorf(`%s: %w`, scrapeTarget.name, lastErr)
+	}
+
+	result, err := scrapeTarget.processParsed(data, rejected, lines)
+	if err != nil {
+		return nil, err
+	}
+	scrapeTarget.protocolMutex.Lock()
+	upstream.Protocol = scrapeTarget.protocol
+	scrapeTarget.protocolMutex.Unlock()
+	result.Upstream = upstream
+	result.families = append(result.families, up)
+	return result, nil
+}
+
+// Fetch one path
+func (scrapeTarget *ScrapeTarget) fetchPath(ctx context.Context, request upstreamRequest) (string, string, error) {
+	resp, err := scrapeTarget.fetch(ctx, request)
+	if err != nil {
+		return ``, ``, err
+	}
+	defer resp.Body.Close()
+	body, err := readBody(resp.Body, resp.Request.URL.String())
+	if err != nil {
+		return ``, ``, err
+	}
+	if upstreamRecorder != nil {
+		upstreamRecorder.record(scrapeTarget.name, resp, body)
+	}
+	return string(body), resp.Header.Get(`Content-Type`), nil
+}
+
+// Point an upstream URL at another path
+func withPath(upstream, path string) (string, error) {
+	parsed, err := url.Parse(upstream)
+	if err != nil {
+		return ``, err
+	}
+	parsed.Path = path
+	return parsed.String(), nil
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// An appliance splitting its metrics across three paths, of which the
+// hardware one can be made to fail
+type fakeAppliance struct {
+	mu             sync.Mutex
+	bodies         map[string]string
+	hardwareFailed bool
+}
+
+func newFakeAppliance(t *testing.T) (*fakeAppliance, string) {
+	appliance := &fakeAppliance{bodies: map[string]string{
+		`/metrics`:          "# TYPE node_load1 gauge\nnode_load1 0.52\n# TYPE shared_info gauge\nshared_info{from=\"metrics\"} 1\n",
+		`/metrics/app`:      "# TYPE app_requests_total counter\napp_requests_total 10\n# TYPE shared_info gauge\nshared_info{from=\"app\"} 1\n",
+		`/metrics/hardware`: "# TYPE hw_temp_celsius gauge\nhw_temp_celsius 41\n",
+	}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		appliance.mu.Lock()
+		defer appliance.mu.Unlock()
+		if r.URL.Path == `/metrics/hardware` && appliance.hardwareFailed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, appliance.bodies[r.URL.Path])
+	}))
+	t.Cleanup(server.Close)
+	return appliance, server.URL
+}
+
+func (appliance *fakeAppliance) set(path, body string, hardwareFailed bool) {
+	appliance.mu.Lock()
+	defer appliance.mu.Unlock()
+	if path != `` {
+		appliance.bodies[path] = body
+	}
+	appliance.hardwareFailed = hardwareFailed
+}
+
+func newPathsTarget(t *testing.T, upstream string) *ScrapeTarget {
+	upstreams, err := parseUpstreamArgument(upstream + `/metrics;/metrics/app;/metrics/hardware`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrapeTarget := unstartedScrapeTarget(`appliance`, upstreams[0].urls(), commandLine)
+	scrapeTarget.paths = upstreams[0].paths
+	scrapeTarget.start()
+	t.Cleanup(scrapeTarget.close)
+	return scrapeTarget
+}
+
+func servedSeries(scrapeTarget *ScrapeTarget) (int, string) {
+	recorder := httptest.NewRecorder()
+	scrapeTarget.handler(recorder, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+	return recorder.Code, strings.Join(seriesLines(recorder.Body.String()), "\n")
+}
+
+func TestParseUpstreamPaths(t *testing.T) {
+	ports, paths, err := parseUpstreamPaths(`9100/metrics;/metrics/app`)
+	if err != nil || ports != `9100` || strings.Join(paths, ` `) != `/metrics /metrics/app` {
+		t.Errorf(`ports %s, paths %v: %v`, ports, paths, err)
+	}
+	if _, paths, _ := parseUpstreamPaths(`9100`); len(paths) != 1 || paths[0] != basePath {
+		t.Errorf(`paths without any given %v`, paths)
+	}
+	if _, _, err := parseUpstreamPaths(`9100/metrics;metrics/app`); err == nil {
+		t.Error(`a path without a leading / was accepted`)
+	}
+}
+
+func TestPathsAreCombinedAndFailuresReported(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.StartStale = false
+	appliance, upstream := newFakeAppliance(t)
+	scrapeTarget := newPathsTarget(t, upstream)
+
+	all := strings.Join([]string{
+		`app_requests_total 10`,
+		`frugalpromproxy_upstream_path_up{path="/metrics"} 1`,
+		`frugalpromproxy_upstream_path_up{path="/metrics/app"} 1`,
+		`frugalpromproxy_upstream_path_up{path="/metrics/hardware"} 1`,
+		`hw_temp_celsius 41`,
+		`node_load1 0.52`,
+		`shared_info{from="metrics"} 1`,
+	}, "\n")
+	if code, served := servedSeries(scrapeTarget); code != http.StatusOK || served != all {
+		t.Errorf("all paths answering served %d\n%s\nexpected\n%s", code, served, all)
+	}
+
+	appliance.set(``, ``, true)
+	withoutHardware := strings.Join([]string{
+		`app_requests_total 10`,
+		`frugalpromproxy_upstream_path_up{path="/metrics"} 1`,
+		`frugalpromproxy_upstream_path_up{path="/metrics/app"} 1`,
+		`frugalpromproxy_upstream_path_up{path="/metrics/hardware"} 0`,
+		`node_load1 0.52`,
+		`shared_info{from="metrics"} 1`,
+	}, "\n")
+	if code, served := servedSeries(scrapeTarget); code != http.StatusOK || served != withoutHardware {
+		t.Errorf("with the hardware path failing served %d\n%s\nexpected\n%s", code, served, withoutHardware)
+	}
+
+	appliance.set(`/metrics/hardware`, "hw_temp_celsius 43\n", false)
+	if _, served := servedSeries(scrapeTarget); !strings.Contains(served, `hw_temp_celsius 43`) || !strings.Contains(served, `{path="/metrics/hardware"} 1`) {
+		t.Errorf("after the hardware path came back served\n%s", served)
+	}
+}
+
+func TestPathsFailTogether(t *testing.T) {
+	useCommandLineSettings(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+	scrapeTarget := newPathsTarget(t, server.URL)
+	if code, _ := servedSeries(scrapeTarget); code == http.StatusOK {
+		t.Error(`a scrape with no path answering succeeded`)
+	}
+}
+
+func TestSeriesMovingBetweenPathsKeepTheirState(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.Threshold, commandLine.staleness.StartStale = 1, false
+	appliance, upstream := newFakeAppliance(t)
+	appliance.set(`/metrics/app`, "app_requests_total 10\nmoving_gauge 1\n", false)
+	scrapeTarget := newPathsTarget(t, upstream)
+
+	servedSeries(scrapeTarget)
+	servedSeries(scrapeTarget)
+	appliance.set(`/metrics/app`, "app_requests_total 10\n", false)
+	appliance.set(`/metrics/hardware`, "hw_temp_celsius 41\nmoving_gauge 1\n", false)
+	if _, served := servedSeries(scrapeTarget); strings.Contains(served, `moving_gauge`) {
+		t.Errorf("a series moved to another path started over\n%s", served)
+	}
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Returned for the targets not scraped in the background, which have nothing
+// to push
+var errNotScrapedInTheBackground = errors.New(`pushing needs -scrape-interval`)
+
+// The families of the target's last background scrape. A push never scrapes
+// the target itself: the staleness policies would take it for a scrape, so
+// unchanged series would be suppressed after fewer scrapes than the
+// threshold.
+func pushFamilies(scrapeTarget *ScrapeTarget) ([]outputFamily, error) {
+	if scrapeTarget.schedule == nil {
+		return nil, fmt.Errorf(`%s: %w`, scrapeTarget.name, errNotScrapedInTheBackground)
+	}
+	return scrapeTarget.latestFamilies()
+}
+
+// Parse comma separated name=value pairs from the command line
+func parseNameValuePairs(pairs string) (map[string]string, error) {
+	parsed := make(map[string]string)
+	for _, pair := range strings.Split(pairs, `,`) {
+		if pair == `` {
+			continue
+		}
+		equals := strings.Index(pair, `=`)
+		if equals < 1 {
+			return nil, fmt.Errorf(`%s isn't a name=value pair`, pair)
+		}
+		parsed[pair[:equals]] = pair[equals+1:]
+	}
+	return parsed, nil
+}
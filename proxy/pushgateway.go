@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Attempts per target and interval before a push is given up
+const pushgatewayAttempts = 3
+
+var pushgatewayPushes = selfMetrics.newCounterVec(`frugalpromproxy_pushgateway_pushes_total`, `Pushes of a target to the Pushgateway, by outcome: success, retried or failed.`, `target`, `outcome`)
+
+// Periodically pushes the filtered exposition of every target to a
+// Pushgateway, grouped by job, the target name and the extra grouping labels
+type pushgatewayPusher struct {
+	url           string
+	job           string
+	instanceLabel string            // Grouping label holding the target name
+	grouping      map[string]string // Further grouping labels
+	method        string            // PUT replaces the group, POST merges into it
+	interval      time.Duration
+	client        *http.Client
+}
+
+func (pusher *pushgatewayPusher) run() {
+	ticker := clock.NewTicker(pusher.interval)
+	defer ticker.Stop()
+	for range ticker.C() {
+		for _, scrapeTarget := range targets.all() {
+			pusher.push(scrapeTarget)
+		}
+	}
+}
+
+// Pushgateway path element for a grouping label. Values that are empty or
+// contain a slash use the base64 form.
+func groupingElement(name, value string) string {
+	if value == `` || strings.Contains(value, `/`) {
+		return name + `@base64/` + base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+	return name + `/` + url.PathEscape(value)
+}
+
+func (pusher *pushgatewayPusher) groupURL(target string) string {
+	path := `/metrics/` + groupingElement(`job`, pusher.job) + `/` + groupingElement(pusher.instanceLabel, target)
+	names := make([]string, 0, len(pusher.grouping))
+	for name := range pusher.grouping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path += `/` + groupingElement(name, pusher.grouping[name])
+	}
+	return strings.TrimRight(pusher.url, `/`) + path
+}
+
+func (pusher *pushgatewayPusher) push(scrapeTarget *ScrapeTarget) {
+	ctx, cancel := context.WithTimeout(context.Background(), pusher.interval)
+	defer cancel()
+	families, err := pushFamilies(scrapeTarget)
+	if err != nil {
+		log.Printf("%s: not pushed to the Pushgateway: %v", scrapeTarget.name, err)
+		pushgatewayPushes.inc(scrapeTarget.name, `failed`)
+		return
+	}
+	body := renderFamilies(withoutTimestamps(families))
+
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err = pusher.send(ctx, scrapeTarget.name, body)
+		if err == nil {
+			pushgatewayPushes.inc(scrapeTarget.name, `success`)
+			return
+		}
+		if attempt == pushgatewayAttempts || ctx.Err() != nil {
+			break
+		}
+		pushgatewayPushes.inc(scrapeTarget.name, `retried`)
+		<-scrapeTarget.settings.clock.After(backoff)
+		backoff *= 2
+	}
+	log.Printf("%s: pushing to the Pushgateway failed: %v", scrapeTarget.name, err)
+	pushgatewayPushes.inc(scrapeTarget.name, `failed`)
+}
+
+func (pusher *pushgatewayPusher) send(ctx context.Context, target, body string) error {
+	req, err := http.NewRequestWithContext(ctx, pusher.method, pusher.groupURL(target), strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(`Content-Type`, `text/plain; version=0.0.4`)
+	setTenantHeader(req)
+	resp, err := pusher.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf(`pushgateway returned %s: %s`, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The current value of a self-metric series
+func selfMetricValue(metric *selfMetric, labelValues ...string) float64 {
+	key := metric.labelString(labelValues)
+	metric.mu.Lock()
+	defer metric.mu.Unlock()
+	return metric.values[key]
+}
+
+// A Pushgateway remembering the pushes it got, failing the first ones
+type fakePushgateway struct {
+	mu       sync.Mutex
+	failures int
+	pushes   []string // Method, path and body
+}
+
+func newFakePushgateway(t *testing.T, failures int) (*fakePushgateway, string) {
+	gateway := &fakePushgateway{failures: failures}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gateway.mu.Lock()
+		defer gateway.mu.Unlock()
+		if gateway.failures > 0 {
+			gateway.failures--
+			http.Error(w, `pushed metrics are invalid`, http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		gateway.pushes = append(gateway.pushes, r.Method+` `+r.URL.EscapedPath()+"\n"+string(body))
+	}))
+	t.Cleanup(server.Close)
+	return gateway, server.URL
+}
+
+func (gateway *fakePushgateway) received() []string {
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+	return append([]string(nil), gateway.pushes...)
+}
+
+// A target scraped in the background on a fake clock, as the push modes
+// need them, after its first scrape
+func newBackgroundTarget(t *testing.T, name, body string) (*ScrapeTarget, *fakeExporter, *fakeClock) {
+	clock := newFakeClock()
+	commandLine.clock = clock
+	commandLine.scrapeInterval, commandLine.scrapeJitter = time.Minute, 0
+	commandLine.staleness.StartStale = false
+	exporter, upstream := newFakeExporter(t, body)
+	scrapeTarget := newScrapeTarget(name, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+	nextBackgroundScrape(t, clock)
+	return scrapeTarget, exporter, clock
+}
+
+func newPushedTarget(t *testing.T, name, body string) *ScrapeTarget {
+	scrapeTarget, _, _ := newBackgroundTarget(t, name, body)
+	return scrapeTarget
+}
+
+func TestPushesAreGroupedByJobAndTarget(t *testing.T) {
+	useCommandLineSettings(t)
+	gateway, address := newFakePushgateway(t, 0)
+	pusher := &pushgatewayPusher{
+		url:           address + `/`,
+		job:           `frugalpromproxy`,
+		instanceLabel: `instance`,
+		grouping:      map[string]string{`site`: `oslo`, `rack`: `a/1`},
+		method:        http.MethodPut,
+		interval:      time.Minute,
+		client:        http.DefaultClient,
+	}
+	succeeded := selfMetricValue(pushgatewayPushes.selfMetric, `localhost:9100`, `success`)
+	pusher.push(newPushedTarget(t, `localhost:9100`, "# TYPE node_load1 gauge\nnode_load1 0.5 1622548800000\n"))
+
+	pushes := gateway.received()
+	if len(pushes) != 1 {
+		t.Fatalf(`got %d pushes`, len(pushes))
+	}
+	expected := "PUT /metrics/job/frugalpromproxy/instance/localhost:9100/rack@base64/YS8x/site/oslo\n"
+	if !strings.HasPrefix(pushes[0], expected) {
+		t.Errorf(`pushed %q, expected it to start with %q`, pushes[0], expected)
+	}
+	if !strings.Contains(pushes[0], "node_load1 0.5\n") {
+		t.Errorf(`pushed %q, expected the series without its timestamp`, pushes[0])
+	}
+	if selfMetricValue(pushgatewayPushes.selfMetric, `localhost:9100`, `success`) != succeeded+1 {
+		t.Error(`the push wasn't counted`)
+	}
+}
+
+func TestFailedPushesAreRetried(t *testing.T) {
+	useCommandLineSettings(t)
+	gateway, address := newFakePushgateway(t, 1)
+	pusher := &pushgatewayPusher{url: address, job: `proxy`, instanceLabel: `instance`, method: http.MethodPost, interval: time.Minute, client: http.DefaultClient}
+	retried, succeeded := selfMetricValue(pushgatewayPushes.selfMetric, `retried:9100`, `retried`), selfMetricValue(pushgatewayPushes.selfMetric, `retried:9100`, `success`)
+	scrapeTarget, _, clock := newBackgroundTarget(t, `retried:9100`, "up 1\n")
+	pushed := make(chan struct{})
+	go func() {
+		pusher.push(scrapeTarget)
+		close(pushed)
+	}()
+	// The background scrape and the backoff
+	clock.waitForWaiters(t, 2)
+	clock.Advance(time.Second)
+	<-pushed
+
+	if pushes := gateway.received(); len(pushes) != 1 || !strings.HasPrefix(pushes[0], `POST /metrics/job/proxy/instance/retried:9100`) {
+		t.Errorf(`pushes %q`, pushes)
+	}
+	if selfMetricValue(pushgatewayPushes.selfMetric, `retried:9100`, `retried`) != retried+1 || selfMetricValue(pushgatewayPushes.selfMetric, `retried:9100`, `success`) != succeeded+1 {
+		t.Error(`the retry wasn't counted`)
+	}
+}
+
+func TestPushesDontCountAsScrapes(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.Threshold = 2
+	gateway, address := newFakePushgateway(t, 0)
+	pusher := &pushgatewayPusher{url: address, job: `proxy`, instanceLabel: `instance`, method: http.MethodPut, interval: time.Minute, client: http.DefaultClient}
+	scrapeTarget, exporter, _ := newBackgroundTarget(t, `node`, "node_load1 0.5\n")
+
+	for i := 0; i < 5; i++ {
+		pusher.push(scrapeTarget)
+	}
+	pushes := gateway.received()
+	if len(pushes) != 5 || !strings.Contains(pushes[4], "node_load1 0.5\n") {
+		t.Errorf(`pushes %q`, pushes)
+	}
+	if scrapes := atomic.LoadInt32(&exporter.scrapes); scrapes != 1 {
+		t.Errorf(`5 pushes scraped the upstream %d more times`, scrapes-1)
+	}
+	if statuses := nodeSeries(t, scrapeTarget, ``); len(statuses) != 1 || statuses[0].Unchanged != 0 {
+		t.Errorf(`after 5 pushes tracked %+v`, statuses)
+	}
+}
+
+func TestTargetsNotScrapedInTheBackgroundAreNotPushed(t *testing.T) {
+	useCommandLineSettings(t)
+	_, upstream := newFakeExporter(t, "up 1\n")
+	scrapeTarget := newScrapeTarget(`node`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+	if _, err := pushFamilies(scrapeTarget); !errors.Is(err, errNotScrapedInTheBackground) {
+		t.Errorf(`pushing without -scrape-interval: %v`, err)
+	}
+}
+
+func TestEmptyGroupingValuesUseBase64(t *testing.T) {
+	if element := groupingElement(`instance`, ``); element != `instance@base64/` {
+		t.Errorf(`an empty value became %s`, element)
+	}
+	if element := groupingElement(`path`, `a b`); element != `path/a%20b` {
+		t.Errorf(`a value with a space became %s`, element)
+	}
+}
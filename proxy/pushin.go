@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pdxiv/frugalpromproxy/parser"
+)
+
+// Path prefix on every listener accepting pushed expositions, when enabled
+const pushPath = `/push/`
+
+// Expositions pushed by short-lived jobs, served as part of one designated
+// target. Pushed series go through the target's staleness filter like its
+// own, get a push_group label, and disappear when the group wasn't pushed
+// again within its TTL.
+type pushStore struct {
+	target   string // Name of the target the groups are served with
+	ttl      time.Duration
+	maxBytes int64
+	token    string // Bearer token required for pushing, if any
+	clock    Clock  // Of the settings of the target
+
+	mu     sync.Mutex
+	groups map[string]pushedGroup
+}
+
+type pushedGroup struct {
+	lines   []string // Exposition lines, series already labelled with the group
+	expires time.Time
+}
+
+// Pushes into the designated target, nil when disabled
+var pushed *pushStore
+
+func newPushStore(target string, ttl time.Duration, maxBytes int64, clock Clock) *pushStore {
+	return &pushStore{target: target, ttl: ttl, maxBytes: maxBytes, clock: clock, groups: make(map[string]pushedGroup)}
+}
+
+func (store *pushStore) handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set(`Allow`, `POST, PUT`)
+		http.Error(w, `push with POST or PUT`, http.StatusMethodNotAllowed)
+		return
+	}
+	if store.token != `` && subtle.ConstantTimeCompare([]byte(r.Header.Get(`Authorization`)), []byte(`Bearer `+store.token)) != 1 {
+		http.Error(w, `missing or wrong bearer token`, http.StatusUnauthorized)
+		return
+	}
+	group := strings.TrimPrefix(r.URL.Path, pushPath)
+	if group == `` || strings.Contains(group, `/`) {
+		http.Error(w, `push to `+pushPath+`<group>`, http.StatusNotFound)
+		return
+	}
+	ttl := store.ttl
+	if value := r.URL.Query().Get(`ttl`); value != `` {
+		var err error
+		if ttl, err = time.ParseDuration(value); err != nil || ttl <= 0 {
+			http.Error(w, `invalid ttl `+value, http.StatusBadRequest)
+			return
+		}
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, store.maxBytes))
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`body larger than %d bytes`, store.maxBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	lines, err := groupLines(string(body), group)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	store.mu.Lock()
+	store.groups[group] = pushedGroup{lines: lines, expires: store.clock.Now().Add(ttl)}
+	store.mu.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Check a pushed text or OpenMetrics exposition, and add the group label to
+// every series
+func groupLines(body, group string) ([]string, error) {
+	groupLabel := `push_group="` + escapeLabelValue(group) + `"`
+	var lines []string
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == `` || line == `# EOF`:
+			continue
+		case strings.HasPrefix(line, `#`):
+			lines = append(lines, line)
+			continue
+		}
+		name, series, ok := parser.ParseSeriesLine(line)
+		if !ok {
+			return nil, fmt.Errorf(`can't parse %q`, line)
+		}
+		// The group wins over a push_group label of the series itself
+		pairs := []string{groupLabel}
+		for _, pair := range splitLabels(series.Labels) {
+			if !hasLabel(pair, `push_group`) {
+				pairs = append(pairs, pair)
+			}
+		}
+		lines = append(lines, strings.TrimSuffix(seriesLine(name, strings.Join(pairs, `,`), series.Value, series.Timestamp), "\n"))
+	}
+	return lines, scanner.Err()
+}
+
+// The groups that haven't expired, as exposition text to be parsed along
+// with the target's own
+func (store *pushStore) exposition() string {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	names := make([]string, 0, len(store.groups))
+	now := store.clock.Now()
+	for name, group := range store.groups {
+		if now.After(group.expires) {
+			delete(store.groups, name)
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var builder strings.Builder
+	for _, name := range names {
+		for _, line := range store.groups[name].lines {
+			builder.WriteString(line)
+			builder.WriteString("\n")
+		}
+	}
+	return builder.String()
+}
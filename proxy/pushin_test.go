@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func usePushStore(t *testing.T, target string) *pushStore {
+	previous := pushed
+	pushed = newPushStore(target, time.Hour, 1024, newFakeClock())
+	t.Cleanup(func() { pushed = previous })
+	return pushed
+}
+
+func push(store *pushStore, path, token, body string) int {
+	recorder := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	if token != `` {
+		r.Header.Set(`Authorization`, `Bearer `+token)
+	}
+	store.handler(recorder, r)
+	return recorder.Code
+}
+
+func TestPushedSeriesAreServedWithTheTarget(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.StartStale = false
+	store := usePushStore(t, `node`)
+	_, upstream := newFakeExporter(t, "node_load1 0.5\n")
+	scrapeTarget := newScrapeTarget(`node`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+
+	if code := push(store, pushPath+`backup`, ``, "# TYPE backup_last_success_seconds gauge\nbackup_last_success_seconds{push_group=\"other\",disk=\"a\"} 1622548800\n# EOF\n"); code != http.StatusAccepted {
+		t.Fatalf(`push answered %d`, code)
+	}
+	recorder := httptest.NewRecorder()
+	scrapeTarget.handler(recorder, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+	body := recorder.Body.String()
+	if !strings.Contains(body, `node_load1 0.5`) || !strings.Contains(body, `backup_last_success_seconds{disk="a",push_group="backup"} 1.6225488e+09`) {
+		t.Errorf(`scrape served %s`, body)
+	}
+}
+
+func TestPushedGroupsExpire(t *testing.T) {
+	store := usePushStore(t, `node`)
+	push(store, pushPath+`short?ttl=1m`, ``, "short_job 1\n")
+	push(store, pushPath+`long`, ``, "long_job 1\n")
+	if exposition := store.exposition(); !strings.Contains(exposition, `short_job`) || !strings.Contains(exposition, `long_job`) {
+		t.Fatalf(`exposition before the TTL %q`, exposition)
+	}
+	store.clock.(*fakeClock).Advance(time.Minute + time.Second)
+	if exposition := store.exposition(); strings.Contains(exposition, `short_job`) || !strings.Contains(exposition, `long_job`) {
+		t.Errorf(`exposition after the TTL of one group %q`, exposition)
+	}
+}
+
+func TestPushesAreChecked(t *testing.T) {
+	store := usePushStore(t, `node`)
+	for path, expected := range map[string]int{
+		pushPath + `big`:           http.StatusRequestEntityTooLarge,
+		pushPath + `a/b`:           http.StatusNotFound,
+		pushPath + `ttl?ttl=-1s`:   http.StatusBadRequest,
+		pushPath + `ttl?ttl=never`: http.StatusBadRequest,
+	} {
+		body := "job 1\n"
+		if strings.HasSuffix(path, `big`) {
+			body = strings.Repeat("job 1\n", 200)
+		}
+		if code := push(store, path, ``, body); code != expected {
+			t.Errorf(`push to %s answered %d, expected %d`, path, code, expected)
+		}
+	}
+	if code := push(store, pushPath+`broken`, ``, "job{ 1\n"); code != http.StatusBadRequest {
+		t.Errorf(`an unparseable push answered %d`, code)
+	}
+	if exposition := store.exposition(); exposition != `` {
+		t.Errorf(`rejected pushes were kept: %q`, exposition)
+	}
+
+	store.token = `secret`
+	if code := push(store, pushPath+`job`, `wrong`, "job 1\n"); code != http.StatusUnauthorized {
+		t.Errorf(`a push with the wrong token answered %d`, code)
+	}
+	if code := push(store, pushPath+`job`, `secret`, "job 1\n"); code != http.StatusAccepted {
+		t.Errorf(`a push with the token answered %d`, code)
+	}
+}
@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Token bucket limiting how often a listener passes scrapes on to its upstream
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // Tokens added per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+// Take a token if one is available. Otherwise report how long it will take
+// until the next token is added.
+func (bucket *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+
+	if elapsed := now.Sub(bucket.last).Seconds(); elapsed > 0 {
+		bucket.tokens = math.Min(bucket.burst, bucket.tokens+elapsed*bucket.rate)
+		bucket.last = now
+	}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	missing := (1 - bucket.tokens) / bucket.rate
+	return false, time.Duration(missing * float64(time.Second))
+}
+
+// The rate limit of a listener: one token bucket for all its scrape paths,
+// and the last good answer of every path, replayed to the requests above the
+// rate
+type listenerRateLimit struct {
+	name   string
+	clock  Clock
+	bucket *tokenBucket
+
+	mu      sync.Mutex
+	answers map[string]*lastAnswer // By path
+}
+
+// An answer of 200 of a scrape path
+type lastAnswer struct {
+	key         string // Of the request, a request with another query or Accept header doesn't get it
+	contentType string
+	body        []byte
+	at          time.Time
+}
+
+// The rate limits of the listeners, by listener name, so a listener keeps
+// its bucket when the -config file is reloaded
+var listenerRateLimits = struct {
+	mu     sync.Mutex
+	byName map[string]*listenerRateLimit
+}{byName: make(map[string]*listenerRateLimit)}
+
+// The rate limit of the named listener, nil without -rate-limit
+func rateLimitOf(listener string) *listenerRateLimit {
+	if rateLimit <= 0 {
+		return nil
+	}
+	listenerRateLimits.mu.Lock()
+	defer listenerRateLimits.mu.Unlock()
+	limit, ok := listenerRateLimits.byName[listener]
+	if !ok {
+		limit = newListenerRateLimit(listener, rateLimit, rateBurst, clock)
+		listenerRateLimits.byName[listener] = limit
+	}
+	return limit
+}
+
+func newListenerRateLimit(listener string, rate float64, burst int, clock Clock) *listenerRateLimit {
+	return &listenerRateLimit{
+		name:    listener,
+		clock:   clock,
+		bucket:  newTokenBucket(rate, burst, clock.Now()),
+		answers: make(map[string]*lastAnswer),
+	}
+}
+
+// The request an answer is kept for
+func answerKey(r *http.Request) string {
+	return r.URL.RawQuery + "\n" + r.Header.Get(`Accept`)
+}
+
+// Wrap a scrape handler of the listener so it is passed at most the
+// listener's rate of requests. The ones above it are answered with the last
+// good answer of the path, like a cached answer, or else get a 429. Only the
+// scrape paths are wrapped, health and self-metrics endpoints are never
+// limited.
+func (limit *listenerRateLimit) wrap(next http.HandlerFunc) http.HandlerFunc {
+	if limit == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, wait := limit.bucket.take(limit.clock.Now())
+		if ok {
+			recorder := &recordingWriter{ResponseWriter: w}
+			next(recorder, r)
+			limit.keep(r, recorder)
+			return
+		}
+		rateLimitedRequests.inc(limit.name)
+		if limit.replay(w, r) {
+			return
+		}
+		w.Header().Set(`Retry-After`, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, `rate limit exceeded for `+limit.name, http.StatusTooManyRequests)
+	}
+}
+
+// Keep an answer of 200 that wasn't itself replayed from a cache
+func (limit *listenerRateLimit) keep(r *http.Request, recorder *recordingWriter) {
+	if recorder.status != http.StatusOK || recorder.Header().Get(cachedHeader) != `` {
+		return
+	}
+	answer := &lastAnswer{key: answerKey(r), contentType: recorder.Header().Get(`Content-Type`), body: recorder.body.Bytes(), at: limit.clock.Now()}
+	limit.mu.Lock()
+	limit.answers[r.URL.Path] = answer
+	limit.mu.Unlock()
+}
+
+// Answer with the last good answer of the path, returning false when there
+// is none for the request
+func (limit *listenerRateLimit) replay(w http.ResponseWriter, r *http.Request) bool {
+	limit.mu.Lock()
+	answer := limit.answers[r.URL.Path]
+	limit.mu.Unlock()
+	if answer == nil || answer.key != answerKey(r) {
+		return false
+	}
+	if answer.contentType != `` {
+		w.Header().Set(`Content-Type`, answer.contentType)
+	}
+	w.Header().Set(cachedHeader, `true`)
+	w.Header().Set(`Age`, strconv.Itoa(int(limit.clock.Now().Sub(answer.at).Seconds())))
+	w.Write(answer.body)
+	return true
+}
+
+// Passes an answer on and keeps a copy of it
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
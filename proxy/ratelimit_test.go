@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketAllowsABurstAboveTheRate(t *testing.T) {
+	now := newFakeClock().Now()
+	bucket := &tokenBucket{rate: 1, burst: 3, tokens: 3, last: now}
+	for i := 1; i <= 3; i++ {
+		if ok, _ := bucket.take(now); !ok {
+			t.Fatalf(`scrape %d of a burst of 3 was refused`, i)
+		}
+	}
+	if ok, wait := bucket.take(now); ok || wait != time.Second {
+		t.Errorf(`a fourth scrape: %v, wait %v, expected a refusal and a wait of 1s`, ok, wait)
+	}
+
+	// A long pause refills the bucket up to the burst, not beyond
+	later := now.Add(time.Hour)
+	for i := 1; i <= 3; i++ {
+		if ok, _ := bucket.take(later); !ok {
+			t.Fatalf(`scrape %d after a pause was refused`, i)
+		}
+	}
+	if ok, _ := bucket.take(later); ok {
+		t.Error(`a pause refilled the bucket beyond its burst`)
+	}
+}
+
+func TestTokenBucketBurstIsAtLeastOne(t *testing.T) {
+	bucket := newTokenBucket(0.1, 0, newFakeClock().Now())
+	if ok, _ := bucket.take(bucket.last); !ok {
+		t.Error(`a bucket with a burst of 0 refused the first scrape`)
+	}
+}
+
+func TestListenersWithoutARateLimitAreNotLimited(t *testing.T) {
+	handler := rateLimitOf(`:19100`).wrap(func(w http.ResponseWriter, r *http.Request) {})
+	for i := 0; i < 100; i++ {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf(`request %d answered %d`, i, recorder.Code)
+		}
+	}
+}
+
+// The routes of a listener take their tokens from the same bucket, and it
+// is the same after a reload of the -config file built the routes again
+func TestTheRateLimitIsSharedByTheRoutesOfAListener(t *testing.T) {
+	previousRate, previousBurst := rateLimit, rateBurst
+	rateLimit, rateBurst = 0.1, 1
+	t.Cleanup(func() {
+		rateLimit, rateBurst = previousRate, previousBurst
+		listenerRateLimits.mu.Lock()
+		delete(listenerRateLimits.byName, `:19400`)
+		delete(listenerRateLimits.byName, `:19401`)
+		listenerRateLimits.mu.Unlock()
+	})
+	ok := func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "up 1\n") }
+	node, app := rateLimitOf(`:19400`).wrap(ok), rateLimitOf(`:19400`).wrap(ok)
+	other := rateLimitOf(`:19401`).wrap(ok)
+
+	answer := func(handler http.HandlerFunc, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder
+	}
+	if code := answer(node, `/node/metrics`).Code; code != http.StatusOK {
+		t.Fatalf(`the first request answered %d`, code)
+	}
+	if recorder := answer(app, `/app/metrics`); recorder.Code != http.StatusTooManyRequests || recorder.Header().Get(`Retry-After`) == `` {
+		t.Errorf(`another route of the listener answered %d with Retry-After %q, expected a 429`, recorder.Code, recorder.Header().Get(`Retry-After`))
+	}
+	if code := answer(other, `/app/metrics`).Code; code != http.StatusOK {
+		t.Errorf(`another listener answered %d`, code)
+	}
+}
+
+// Above the rate, a path is answered with its last good answer instead of
+// being passed on to the upstream
+func TestRequestsAboveTheRateGetTheLastGoodAnswer(t *testing.T) {
+	clock := newFakeClock()
+	limit := newListenerRateLimit(`:19100`, 0.1, 1, clock)
+	before := selfMetricValue(rateLimitedRequests.selfMetric, `:19100`)
+	var passed int
+	handler := limit.wrap(func(w http.ResponseWriter, r *http.Request) {
+		passed++
+		w.Header().Set(`Content-Type`, `text/plain; version=0.0.4`)
+		io.WriteString(w, "up 1\n")
+	})
+	answer := func(target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+		return recorder
+	}
+
+	answer(`/metrics`)
+	clock.Advance(2 * time.Second)
+	replayed := answer(`/metrics`)
+	if replayed.Code != http.StatusOK || replayed.Body.String() != "up 1\n" || passed != 1 {
+		t.Errorf(`a request above the rate answered %d %q, passed on %d requests`, replayed.Code, replayed.Body, passed)
+	}
+	if replayed.Header().Get(cachedHeader) != `true` || replayed.Header().Get(`Age`) != `2` || replayed.Header().Get(`Content-Type`) != `text/plain; version=0.0.4` {
+		t.Errorf(`replayed with the headers %v`, replayed.Header())
+	}
+	if code := answer(`/metrics?module=other`).Code; code != http.StatusTooManyRequests {
+		t.Errorf(`a request with another query answered %d, expected a 429`, code)
+	}
+	if limited := selfMetricValue(rateLimitedRequests.selfMetric, `:19100`) - before; limited != 2 {
+		t.Errorf(`counted %g requests above the rate, expected 2`, limited)
+	}
+}
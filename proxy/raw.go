@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// How long the result of a scrape is reused for <path>/raw, so the main and
+// the raw endpoint scraped back to back share one upstream fetch
+const rawReuseWindow = 5 * time.Second
+
+// Serve the parsed upstream data without suppression next to every route
+var serveRaw bool
+
+// Every parsed series with the static labels, suppressed or not
+func rawFamilies(data map[string]MetricData, staticLabels string) []outputFamily {
+	var families []outputFamily
+	for _, name := range orderedNames(data) {
+		content := data[name]
+		family := outputFamily{name: name, help: content.commentHelp, metricType: content.commentType}
+		for _, series := range content.series(name) {
+			family.lines = append(family.lines, seriesLine(series.name, withStaticLabels(series.labels, staticLabels), series.value, series.timestamp))
+		}
+		families = append(families, family)
+	}
+	return families
+}
+
+func (scrapeTarget *ScrapeTarget) setRaw(families []outputFamily) {
+	scrapeTarget.rawMutex.Lock()
+	scrapeTarget.raw = families
+	scrapeTarget.rawAt = scrapeTarget.now()
+	scrapeTarget.rawMutex.Unlock()
+}
+
+// The unfiltered data of a recent scrape, or else of a fetch of its own,
+// which leaves the staleness state alone
+func (scrapeTarget *ScrapeTarget) rawHandler(w http.ResponseWriter, r *http.Request) {
+	scrapeTarget.rawMutex.Lock()
+	families, at := scrapeTarget.raw, scrapeTarget.rawAt
+	scrapeTarget.rawMutex.Unlock()
+	if scrapeTarget.schedule != nil || scrapeTarget.since(at) < rawReuseWindow {
+		writeFamilies(w, r, families, scrapeTarget.now())
+		return
+	}
+
+	ctx := r.Context()
+	if timeout := scrapeTarget.scrapeTimeout(r); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	data, err := scrapeTarget.rawScrape(ctx, scrapeTarget.upstreamRequest(r))
+	if err != nil {
+		scrapeTarget.scrapeFailed(w, err)
+		return
+	}
+	staticLabels := withStaticLabels(scrapeTarget.currentStaticLabels(), tenantLabels())
+	writeFamilies(w, r, rawFamilies(data, staticLabels), scrapeTarget.now())
+}
+
+// Fetch and parse the upstream like a scrape, waiting for an upstream fetch
+// slot and checking the content, but without the staleness filter
+func (scrapeTarget *ScrapeTarget) rawScrape(ctx context.Context, request upstreamRequest) (map[string]MetricData, error) {
+	fetches := scrapeTarget.settings.fetches
+	if err := fetches.acquire(ctx, scrapeTarget.name); err != nil {
+		return nil, fmt.Errorf(`%s: %w`, scrapeTarget.name, ErrNoFetchSlot)
+	}
+	defer fetches.release()
+	upstreamScrapes.inc(scrapeTarget.name)
+
+	body, contentType, err := scrapeTarget.fetchPath(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf(`%s: %w`, scrapeTarget.name, err)
+	}
+	var unparsed int
+	data, _ := parseExposition(body, func(int, string) { unparsed++ })
+	if err := checkContent(contentType, data, unparsed); err != nil {
+		return nil, fmt.Errorf(`%s: %w`, scrapeTarget.name, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func serveRawNode(p *Proxy, ctx context.Context) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	p.targets[`node`].rawHandler(recorder, httptest.NewRequest(http.MethodGet, `/metrics/raw`, nil).WithContext(ctx))
+	return recorder
+}
+
+func TestRawFetchesWaitForAFetchSlot(t *testing.T) {
+	exporter, upstream := newFakeExporter(t, "up 1\n")
+	p := newFakeClockProxy(t, newFakeClock(), Config{MaxConcurrentScrapes: 1}, upstream)
+	fetches := p.targets[`node`].settings.fetches
+	if err := fetches.acquire(context.Background(), `other`); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if answer := serveRawNode(p, ctx); answer.Code != http.StatusServiceUnavailable || atomic.LoadInt32(&exporter.scrapes) != 0 {
+		t.Errorf(`a raw fetch without a free slot answered %d after %d upstream fetches`, answer.Code, atomic.LoadInt32(&exporter.scrapes))
+	}
+
+	fetches.release()
+	if answer := serveRawNode(p, context.Background()); answer.Code != http.StatusOK || !strings.Contains(answer.Body.String(), `up 1`) {
+		t.Errorf(`a raw fetch with a free slot answered %d %s`, answer.Code, answer.Body)
+	}
+}
+
+func TestRawFetchesCheckTheContent(t *testing.T) {
+	_, upstream := newFakeExporter(t, "<html><body>Login required</body></html>\n")
+	p := newFakeClockProxy(t, newFakeClock(), Config{}, upstream)
+	if answer := serveRawNode(p, context.Background()); answer.Code == http.StatusOK {
+		t.Errorf(`a login page was served as raw metrics: %s`, answer.Body)
+	}
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var recordDropped = selfMetrics.newCounterVec(`frugalpromproxy_record_dropped_total`, `Upstream responses not recorded because the record queue was full.`, `target`)
+
+// Saves the raw upstream responses to <directory>/<target>/, so a report of
+// a dropped metric can be reproduced with the exact upstream bodies. Each
+// response is a .prom file with a .json sidecar, named by the time of the
+// scrape so they sort in order. Writing happens in the background, a full
+// queue drops recordings instead of slowing down scrapes.
+type recorder struct {
+	directory string
+	maxFiles  int   // Responses kept per target, 0 means no limit
+	maxBytes  int64 // Total size kept per target, 0 means no limit
+	queue     chan recording
+}
+
+type recording struct {
+	target string
+	body   []byte
+	meta   recordingMeta
+}
+
+// The sidecar of a recorded response
+type recordingMeta struct {
+	Target    string      `json:"target"`
+	Timestamp time.Time   `json:"timestamp"`
+	Status    int         `json:"status"`
+	Header    http.Header `json:"header"`
+}
+
+// Records every upstream response, nil when disabled
+var upstreamRecorder *recorder
+
+func newRecorder(directory string, maxFiles int, maxBytes int64, queueLength int) *recorder {
+	recorder := &recorder{directory: directory, maxFiles: maxFiles, maxBytes: maxBytes, queue: make(chan recording, queueLength)}
+	go recorder.run()
+	return recorder
+}
+
+func (recorder *recorder) record(target string, resp *http.Response, body []byte) {
+	select {
+	case recorder.queue <- recording{target: target, body: body, meta: recordingMeta{Target: target, Timestamp: clock.Now(), Status: resp.StatusCode, Header: resp.Header}}:
+	default:
+		recordDropped.inc(target)
+	}
+}
+
+func (recorder *recorder) run() {
+	for recording := range recorder.queue {
+		directory := filepath.Join(recorder.directory, strings.TrimSuffix(textfileName(recording.target), `.prom`))
+		if err := recorder.write(directory, recording); err != nil {
+			log.Printf("%s: recording the upstream response failed: %v", recording.target, err)
+			continue
+		}
+		if err := recorder.rotate(directory); err != nil {
+			log.Printf("%s: removing old recordings failed: %v", recording.target, err)
+		}
+	}
+}
+
+func (recorder *recorder) write(directory string, recording recording) error {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+	name := filepath.Join(directory, fmt.Sprintf(`%020d`, recording.meta.Timestamp.UnixNano()))
+	meta, err := json.MarshalIndent(recording.meta, ``, `  `)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomically(name+`.json`, meta); err != nil {
+		return err
+	}
+	return writeFileAtomically(name+`.prom`, recording.body)
+}
+
+// Remove the oldest recordings until the limits are kept
+func (recorder *recorder) rotate(directory string) error {
+	bodies, err := filepath.Glob(filepath.Join(directory, `*.prom`))
+	if err != nil {
+		return err
+	}
+	sort.Strings(bodies)
+	sizes := make([]int64, len(bodies))
+	var total int64
+	for i, body := range bodies {
+		if info, err := os.Stat(body); err == nil {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+
+	for i := 0; i < len(bodies); i++ {
+		remaining := len(bodies) - i
+		if (recorder.maxFiles <= 0 || remaining <= recorder.maxFiles) && (recorder.maxBytes <= 0 || total <= recorder.maxBytes) {
+			break
+		}
+		// Always keep the latest one
+		if remaining == 1 {
+			break
+		}
+		if err := os.Remove(bodies[i]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		os.Remove(strings.TrimSuffix(bodies[i], `.prom`) + `.json`)
+		total -= sizes[i]
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func useRecorder(t *testing.T, recorder *recorder) {
+	previous := upstreamRecorder
+	upstreamRecorder = recorder
+	t.Cleanup(func() { upstreamRecorder = previous })
+}
+
+// The recorded bodies in dir, oldest first
+func recordedBodies(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, `*.prom`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bodies []string
+	for _, file := range files {
+		body, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodies = append(bodies, string(body))
+	}
+	return bodies
+}
+
+func waitForRecordings(t *testing.T, dir string, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if len(recordedBodies(t, dir)) >= n {
+			return
+		}
+	}
+	t.Fatalf(`%d responses were never recorded`, n)
+}
+
+func TestUpstreamResponsesAreRecordedWithASidecar(t *testing.T) {
+	useCommandLineSettings(t)
+	dir := t.TempDir()
+	useRecorder(t, newRecorder(dir, 0, 0, 10))
+	_, upstream := newFakeExporter(t, "node_load1 0.5\n")
+	scrapeTarget := newScrapeTarget(`localhost:9100`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+	scrapeTarget.handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+
+	targetDir := filepath.Join(dir, `localhost_9100`)
+	waitForRecordings(t, targetDir, 1)
+	if bodies := recordedBodies(t, targetDir); bodies[0] != "node_load1 0.5\n" {
+		t.Errorf(`recorded %q`, bodies[0])
+	}
+	sidecars, _ := filepath.Glob(filepath.Join(targetDir, `*.json`))
+	if len(sidecars) != 1 {
+		t.Fatalf(`%d sidecars`, len(sidecars))
+	}
+	var meta recordingMeta
+	content, _ := ioutil.ReadFile(sidecars[0])
+	if err := json.Unmarshal(content, &meta); err != nil || meta.Target != `localhost:9100` || meta.Status != http.StatusOK || meta.Header.Get(`Content-Type`) == `` {
+		t.Errorf(`sidecar %s: %v`, content, err)
+	}
+}
+
+func TestRecordingsAreRotatedByCountAndSize(t *testing.T) {
+	dir := t.TempDir()
+	var written int64
+	write := func(recorder *recorder, n int, body string) {
+		for i := 0; i < n; i++ {
+			written++
+			recording := recording{target: `node`, body: []byte(body), meta: recordingMeta{Timestamp: time.Unix(written, 0)}}
+			if err := recorder.write(dir, recording); err != nil {
+				t.Fatal(err)
+			}
+			if err := recorder.rotate(dir); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	write(&recorder{maxFiles: 3}, 5, "up 1\n")
+	if bodies := recordedBodies(t, dir); len(bodies) != 3 {
+		t.Errorf(`kept %d recordings, expected 3`, len(bodies))
+	}
+	if sidecars, _ := filepath.Glob(filepath.Join(dir, `*.json`)); len(sidecars) != 3 {
+		t.Errorf(`kept %d sidecars, expected 3`, len(sidecars))
+	}
+
+	bySize := &recorder{maxBytes: 25}
+	write(bySize, 1, strings.Repeat(`x`, 10))
+	if bodies := recordedBodies(t, dir); len(bodies) != 4 || bodies[3] != strings.Repeat(`x`, 10) {
+		t.Fatalf(`kept %q`, bodies)
+	}
+	write(bySize, 1, strings.Repeat(`y`, 100))
+	if bodies := recordedBodies(t, dir); len(bodies) != 1 || bodies[0] != strings.Repeat(`y`, 100) {
+		t.Errorf(`a recording above the size limit left %q, expected only itself`, bodies)
+	}
+}
+
+func TestRecordingNeverFailsTheScrape(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.StartStale = false
+	blocked := filepath.Join(t.TempDir(), `file`)
+	writeConfigFile(t, blocked, ``)
+	// Done with the recordings before the file goes, or they would be
+	// written where it was
+	blockedRecorder := &recorder{directory: blocked, queue: make(chan recording, 10)}
+	done := make(chan struct{})
+	go func() {
+		blockedRecorder.run()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		close(blockedRecorder.queue)
+		<-done
+	})
+	useRecorder(t, blockedRecorder)
+	_, upstream := newFakeExporter(t, "up 1\n")
+	scrapeTarget := newScrapeTarget(`node`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+
+	response := httptest.NewRecorder()
+	scrapeTarget.handler(response, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `up 1`) {
+		t.Errorf(`with a recording directory that can't be written the scrape answered %d %s`, response.Code, response.Body)
+	}
+
+	// Nothing takes recordings from the queue
+	full := &recorder{queue: make(chan recording)}
+	dropped := selfMetricValue(recordDropped.selfMetric, `full`)
+	full.record(`full`, &http.Response{StatusCode: http.StatusOK}, nil)
+	if selfMetricValue(recordDropped.selfMetric, `full`) != dropped+1 {
+		t.Error(`a recording dropped on a full queue wasn't counted`)
+	}
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/pdxiv/frugalpromproxy/staleness"
+)
+
+// Apply new staleness rules and transformers to a target that stays, keeping
+// the state of its series. Series whose rule changed are decided on again by
+// the next scrape, a target scraped in the background scrapes right away
+// instead of serving what the previous rules decided until its next slot.
+// After the transformers changed, the next scrape also forgets the state of
+// the series it no longer has.
+func (scrapeTarget *ScrapeTarget) reconfigure(rules staleness.Rules, chain []Transformer) {
+	scrapeTarget.configMutex.Lock()
+	defaults := scrapeTarget.defaults
+	scrapeTarget.configMutex.Unlock()
+	policies := newStalenessPolicies(scrapeTarget.name, rules, defaults)
+	// Not in the middle of a scrape still using the previous policies
+	scrapeTarget.stateMutex.Lock()
+	defer scrapeTarget.stateMutex.Unlock()
+	scrapeTarget.configMutex.Lock()
+	previous, previousChain := scrapeTarget.staleness, scrapeTarget.transformers
+	previous.MoveState(policies)
+	scrapeTarget.staleness, scrapeTarget.transformers = policies, chain
+	rulesChanged := !previous.SameRules(policies)
+	chainChanged := !sameChain(previousChain, chain)
+	if chainChanged {
+		scrapeTarget.pruneState = true
+	}
+	scrapeTarget.configMutex.Unlock()
+	previous.Close()
+
+	if (rulesChanged || chainChanged) && scrapeTarget.schedule != nil {
+		scrapeTarget.schedule.scrapeNow()
+	}
+}
+
+// Stages are told apart by their name, which is how they were written
+func sameChain(chain, other []Transformer) bool {
+	if len(chain) != len(other) {
+		return false
+	}
+	for i := range chain {
+		if chain[i].Name() != other[i].Name() {
+			return false
+		}
+	}
+	return true
+}
+
+// Targets keep their state through a reload as long as they are scraped on
+// the same upstreams, paths and parameters, with the same Host header and
+// server name
+func (scrapeTarget *ScrapeTarget) sameSource(target Target) bool {
+	if !sameStrings(scrapeTarget.upstreams.urls, target.Upstreams) || scrapeTarget.params.Encode() != target.params.Encode() {
+		return false
+	}
+	paths := target.paths
+	if len(paths) < 2 {
+		paths = nil
+	}
+	return sameStrings(scrapeTarget.paths, paths) && scrapeTarget.hostHeader == target.HostHeader && scrapeTarget.serverName == target.ServerName
+}
+
+func sameStrings(list, other []string) bool {
+	if len(list) != len(other) {
+		return false
+	}
+	for i := range list {
+		if list[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// What a reload did with the targets, for the log
+type reloadDiff struct {
+	kept, reset, added, removed []string
+}
+
+func (diff reloadDiff) String() string {
+	list := func(names []string) string {
+		if len(names) == 0 {
+			return `none`
+		}
+		return strings.Join(names, `, `)
+	}
+	return `kept ` + list(diff.kept) + `; reset ` + list(diff.reset) + `; added ` + list(diff.added) + `; removed ` + list(diff.removed)
+}
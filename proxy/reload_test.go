@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Reload the proxy of newFakeClockProxy with the node target transformed by
+// chain
+func reloadNode(t *testing.T, p *Proxy, cfg Config, upstream string, chain ...Transformer) {
+	t.Helper()
+	cfg.Targets = []Target{{Name: `node`, Upstreams: []string{upstream}, Transformers: chain}}
+	if err := p.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewlyExemptSeriesComeBackWithoutChanging(t *testing.T) {
+	clock := newFakeClock()
+	_, upstream := newFakeExporter(t, "node_load1 0.5\nnode_boot_time_seconds 1622548800\n")
+	cfg := Config{StartLive: true, StaleThreshold: 1, Clock: clock}
+	p := newFakeClockProxy(t, clock, cfg, upstream)
+	for i := 0; i < 3; i++ {
+		scrapeNode(t, p)
+	}
+	if result := scrapeNode(t, p); result.Suppressed != 2 {
+		t.Fatalf(`suppressed %d series, expected 2`, result.Suppressed)
+	}
+
+	cfg.StalenessPolicies = []string{`node_load1=never`}
+	reloadNode(t, p, cfg, upstream)
+	result := scrapeNode(t, p)
+	if !forwarded(result, `node_load1`) || forwarded(result, `node_boot_time_seconds`) {
+		t.Errorf(`after exempting node_load1 %+v`, result.families)
+	}
+}
+
+func TestNewlyDroppedSeriesLeaveTheState(t *testing.T) {
+	clock := newFakeClock()
+	_, upstream := newFakeExporter(t, "node_load1 0.5\nnode_boot_time_seconds 1622548800\n")
+	cfg := Config{StartLive: true, StaleThreshold: 1, Clock: clock}
+	p := newFakeClockProxy(t, clock, cfg, upstream)
+	scrapeNode(t, p)
+	if statuses := nodeSeries(t, p.targets[`node`], ``); len(statuses) != 2 {
+		t.Fatalf(`tracked %+v`, statuses)
+	}
+
+	reloadNode(t, p, cfg, upstream, chainOf(t, `drop=node_boot_.*`)...)
+	if result := scrapeNode(t, p); forwarded(result, `node_boot_time_seconds`) || !forwarded(result, `node_load1`) {
+		t.Errorf(`after dropping node_boot_time_seconds %+v`, result.families)
+	}
+	if statuses := nodeSeries(t, p.targets[`node`], ``); len(statuses) != 1 || statuses[0].Name != `node_load1` {
+		t.Errorf(`tracked after the reload %+v`, statuses)
+	}
+}
+
+// A target scraped in the background doesn't wait for its next slot
+func TestChangedRulesAreScrapedRightAway(t *testing.T) {
+	clock := newFakeClock()
+	exporter, upstream := newFakeExporter(t, "node_load1 0.5\n")
+	cfg := Config{ScrapeInterval: time.Hour, Clock: clock}
+	p := newFakeClockProxy(t, clock, cfg, upstream)
+	clock.waitForWaiters(t, 1)
+
+	cfg.StalenessPolicies = []string{`node_load1=never`}
+	reloadNode(t, p, cfg, upstream)
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&exporter.scrapes) == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal(`the target wasn't scraped after its rules changed`)
+		}
+	}
+}
+
+func TestChainsAreToldApartByTheirStages(t *testing.T) {
+	chain := chainOf(t, `drop=go_.*`, `round=1`)
+	if !sameChain(chain, chainOf(t, `drop=go_.*`, `round=1`)) || sameChain(chain, chainOf(t, `round=1`, `drop=go_.*`)) || sameChain(chain, chainOf(t, `drop=go_.*`)) || !sameChain(nil, nil) {
+		t.Error(`chains compared wrong`)
+	}
+}
@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+
+	"github.com/pdxiv/frugalpromproxy/parser"
+)
+
+// Backoff between attempts to send a batch the receiver couldn't take
+const (
+	remoteWriteMinBackoff = time.Second
+	remoteWriteMaxBackoff = 30 * time.Second
+)
+
+// Pushes the series that would have been served to a Prometheus remote_write
+// endpoint, for sites Prometheus can't reach. Every background scrape becomes
+// one batch. Batches wait in a bounded queue while the receiver is down, the
+// oldest is dropped when the queue is full.
+type remoteWriter struct {
+	url         string
+	username    string
+	password    string
+	bearerToken string
+	job         string // job label of the pushed series, instance is the target name
+	maxQueue    int
+	client      *http.Client
+
+	mu      sync.Mutex
+	queue   []*remoteWriteBatch // Oldest first
+	pending chan struct{}
+}
+
+// An encoded and compressed write request
+type remoteWriteBatch struct {
+	body []byte
+}
+
+type remoteWriteSample struct {
+	labels    [][2]string // Sorted by name, including __name__
+	value     float64
+	timestamp int64 // Milliseconds, from the series line if it had one
+}
+
+var (
+	remoteWriteBatches       = selfMetrics.newCounterVec(`frugalpromproxy_remote_write_batches_total`, `Batches handled by remote write, by outcome: sent, dropped (queue full) or rejected (by the receiver).`, `outcome`)
+	remoteWriteQueuedBatches = selfMetrics.newGaugeVec(`frugalpromproxy_remote_write_queued_batches`, `Batches waiting to be sent by remote write.`)
+)
+
+func newRemoteWriter(url string, maxQueue int) *remoteWriter {
+	return &remoteWriter{
+		url:      url,
+		maxQueue: maxQueue,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		pending:  make(chan struct{}, 1),
+	}
+}
+
+// Queue the series of a background scrape
+func (writer *remoteWriter) enqueue(target string, families []outputFamily, scraped time.Time) {
+	var samples []remoteWriteSample
+	for _, family := range families {
+		for _, line := range family.lines {
+			sample, ok := parseSample(line)
+			if !ok {
+				continue
+			}
+			sample.labels = withTargetLabels(sample.labels, writer.job, target)
+			sort.Slice(sample.labels, func(i, j int) bool { return sample.labels[i][0] < sample.labels[j][0] })
+			if sample.timestamp == 0 {
+				sample.timestamp = scraped.UnixNano() / int64(time.Millisecond)
+			}
+			samples = append(samples, sample)
+		}
+	}
+	if len(samples) == 0 {
+		return
+	}
+	batch := &remoteWriteBatch{body: snappy.Encode(nil, encodeWriteRequest(samples))}
+
+	writer.mu.Lock()
+	if len(writer.queue) >= writer.maxQueue {
+		writer.queue = writer.queue[1:]
+		remoteWriteBatches.inc(`dropped`)
+	}
+	writer.queue = append(writer.queue, batch)
+	remoteWriteQueuedBatches.set(float64(len(writer.queue)))
+	writer.mu.Unlock()
+
+	select {
+	case writer.pending <- struct{}{}:
+	default:
+	}
+}
+
+// Add the job and instance labels, keeping the ones of the upstream as
+// exported_job and exported_instance the way Prometheus does
+func withTargetLabels(labels [][2]string, job, instance string) [][2]string {
+	taken := make(map[string]bool, len(labels))
+	for _, label := range labels {
+		taken[label[0]] = true
+	}
+	for i, label := range labels {
+		if label[0] != `job` && label[0] != `instance` {
+			continue
+		}
+		name := `exported_` + label[0]
+		for taken[name] {
+			name = `exported_` + name
+		}
+		taken[name] = true
+		labels[i][0] = name
+	}
+	return append(labels, [2]string{`job`, job}, [2]string{`instance`, instance})
+}
+
+// Send queued batches oldest first, backing off while the receiver fails
+func (writer *remoteWriter) run() {
+	backoff := remoteWriteMinBackoff
+	for range writer.pending {
+		for {
+			writer.mu.Lock()
+			if len(writer.queue) == 0 {
+				writer.mu.Unlock()
+				break
+			}
+			batch := writer.queue[0]
+			writer.mu.Unlock()
+
+			retry, err := writer.send(batch)
+			if err != nil && retry {
+				log.Printf("remote write: %v, retrying in %v", err, backoff)
+				<-clock.After(backoff)
+				if backoff *= 2; backoff > remoteWriteMaxBackoff {
+					backoff = remoteWriteMaxBackoff
+				}
+				continue
+			}
+			backoff = remoteWriteMinBackoff
+			if err != nil {
+				log.Printf("remote write: %v, dropping the batch", err)
+				remoteWriteBatches.inc(`rejected`)
+			} else {
+				remoteWriteBatches.inc(`sent`)
+			}
+
+			writer.mu.Lock()
+			// Unless enqueue dropped it in the meantime to make room
+			if len(writer.queue) > 0 && writer.queue[0] == batch {
+				writer.queue = writer.queue[1:]
+			}
+			remoteWriteQueuedBatches.set(float64(len(writer.queue)))
+			writer.mu.Unlock()
+		}
+	}
+}
+
+// Returns whether sending again could help when it failed
+func (writer *remoteWriter) send(batch *remoteWriteBatch) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, writer.url, bytes.NewReader(batch.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set(`Content-Encoding`, `snappy`)
+	req.Header.Set(`Content-Type`, `application/x-protobuf`)
+	req.Header.Set(`X-Prometheus-Remote-Write-Version`, `0.1.0`)
+	setTenantHeader(req)
+	if writer.bearerToken != `` {
+		req.Header.Set(`Authorization`, `Bearer `+writer.bearerToken)
+	} else if writer.username != `` {
+		req.SetBasicAuth(writer.username, writer.password)
+	}
+
+	resp, err := writer.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	err = fmt.Errorf(`receiver returned %s: %s`, resp.Status, strings.TrimSpace(string(message)))
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// Split a served series line into its labels, value and timestamp
+func parseSample(line string) (remoteWriteSample, bool) {
+	name, series, ok := parser.ParseSeriesLine(strings.TrimSuffix(line, "\n"))
+	if !ok {
+		return remoteWriteSample{}, false
+	}
+	labels, ok := parser.ParseLabels(series.Labels)
+	if !ok {
+		return remoteWriteSample{}, false
+	}
+	sample := remoteWriteSample{labels: [][2]string{{`__name__`, name}}, value: series.Value, timestamp: series.Timestamp}
+	for _, label := range labels {
+		sample.labels = append(sample.labels, [2]string{label.Name, label.Value})
+	}
+	return sample, true
+}
+
+// Encode a prometheus.WriteRequest by hand, one time series per sample:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label { string name = 1; string value = 2; }
+//	Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(samples []remoteWriteSample) []byte {
+	var request []byte
+	for _, sample := range samples {
+		var series []byte
+		for _, label := range sample.labels {
+			var encoded []byte
+			encoded = appendBytesField(encoded, 1, []byte(label[0]))
+			encoded = appendBytesField(encoded, 2, []byte(label[1]))
+			series = appendBytesField(series, 1, encoded)
+		}
+		var encoded []byte
+		encoded = appendTag(encoded, 1, 1)
+		encoded = appendFixed64(encoded, math.Float64bits(sample.value))
+		encoded = appendTag(encoded, 2, 0)
+		encoded = appendUvarint(encoded, uint64(sample.timestamp))
+		series = appendBytesField(series, 2, encoded)
+		request = appendBytesField(request, 1, series)
+	}
+	return request
+}
+
+func appendTag(buffer []byte, field, wireType int) []byte {
+	return appendUvarint(buffer, uint64(field<<3|wireType))
+}
+
+func appendBytesField(buffer []byte, field int, value []byte) []byte {
+	buffer = appendTag(buffer, field, 2)
+	buffer = appendUvarint(buffer, uint64(len(value)))
+	return append(buffer, value...)
+}
+
+func appendUvarint(buffer []byte, value uint64) []byte {
+	var encoded [binary.MaxVarintLen64]byte
+	return append(buffer, encoded[:binary.PutUvarint(encoded[:], value)]...)
+}
+
+func appendFixed64(buffer []byte, value uint64) []byte {
+	var encoded [8]byte
+	binary.LittleEndian.PutUint64(encoded[:], value)
+	return append(buffer, encoded[:]...)
+}
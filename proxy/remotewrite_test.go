@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestUpstreamJobAndInstanceAreExported(t *testing.T) {
+	for line, expected := range map[string]string{
+		"up 1\n": `[[__name__ up] [instance node] [job frugal]]`,
+		"up{job=\"node\",instance=\"a:9100\"} 1\n":   `[[__name__ up] [exported_instance a:9100] [exported_job node] [instance node] [job frugal]]`,
+		"up{job=\"node\",exported_job=\"push\"} 1\n": `[[__name__ up] [exported_exported_job node] [exported_job push] [instance node] [job frugal]]`,
+		"up{instance=\"\",zone=\"eu\"} 1\n":          `[[__name__ up] [exported_instance ] [instance node] [job frugal] [zone eu]]`,
+	} {
+		sample, ok := parseSample(line)
+		if !ok {
+			t.Fatalf(`%q didn't parse`, line)
+		}
+		labels := withTargetLabels(sample.labels, `frugal`, `node`)
+		sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+		if got := fmt.Sprint(labels); got != expected {
+			t.Errorf("%q got labels %s, expected %s", line, got, expected)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Serves recorded upstream responses in order, as a stand-in for the
+// exporter they were recorded from. Advances one response per request, or
+// on a timer when interval is set.
+type replayServer struct {
+	bodies   []string // Recorded .prom files, oldest first
+	loop     bool     // Start over after the last response, instead of answering 410
+	interval time.Duration
+
+	mu       sync.Mutex
+	position int
+	started  time.Time
+}
+
+// Run the replay subcommand
+func replayCommand(arguments []string) {
+	flags := flag.NewFlagSet(`replay`, flag.ExitOnError)
+	directory := flags.String(`dir`, `.`, `Directory with the recordings of one target, as written by -record-directory`)
+	listen := flags.String(`listen`, `:9100`, `Address to serve the recordings on`)
+	loop := flags.Bool(`loop`, false, `Start over after the last recording (default answers 410 Gone)`)
+	interval := flags.Duration(`interval`, 0, `Advance to the next recording at this interval instead of on every request`)
+	flags.Parse(arguments)
+
+	bodies, err := filepath.Glob(filepath.Join(*directory, `*.prom`))
+	if err == nil && len(bodies) == 0 {
+		err = fmt.Errorf(`no recordings in %s`, *directory)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	sort.Strings(bodies)
+
+	server := &replayServer{bodies: bodies, loop: *loop, interval: *interval, started: clock.Now()}
+	log.Printf("replaying %d recordings from %s on %s", len(bodies), *directory, *listen)
+	log.Fatal(http.ListenAndServe(*listen, server))
+}
+
+// The recording to serve now, -1 when a single pass is over
+func (server *replayServer) next() int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	position := server.position
+	if server.interval > 0 {
+		position = int(since(server.started) / server.interval)
+	} else {
+		server.position++
+	}
+	if server.loop {
+		return position % len(server.bodies)
+	}
+	if position >= len(server.bodies) {
+		return -1
+	}
+	return position
+}
+
+func (server *replayServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	position := server.next()
+	if position < 0 {
+		http.Error(w, `replay finished`, http.StatusGone)
+		return
+	}
+	body, err := ioutil.ReadFile(server.bodies[position])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Answer like the upstream did, as far as the sidecar tells
+	status := http.StatusOK
+	var meta recordingMeta
+	if sidecar, err := ioutil.ReadFile(strings.TrimSuffix(server.bodies[position], `.prom`) + `.json`); err == nil && json.Unmarshal(sidecar, &meta) == nil {
+		if meta.Status != 0 {
+			status = meta.Status
+		}
+		if contentType := meta.Header.Get(`Content-Type`); contentType != `` {
+			w.Header().Set(`Content-Type`, contentType)
+		}
+	}
+	w.Header().Set(`X-Replay-Recording`, filepath.Base(server.bodies[position]))
+	w.WriteHeader(status)
+	w.Write(body)
+}
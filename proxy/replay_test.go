@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Write the bodies as recordings, returning the paths of the .prom files
+func writeRecordings(t *testing.T, bodies ...string) []string {
+	dir := t.TempDir()
+	var paths []string
+	for i, body := range bodies {
+		name := filepath.Join(dir, fmt.Sprintf(`%020d`, i))
+		writeConfigFile(t, name+`.prom`, body)
+		paths = append(paths, name+`.prom`)
+	}
+	return paths
+}
+
+func TestReplayedScrapesAreFilteredStepByStep(t *testing.T) {
+	replay := httptest.NewServer(&replayServer{bodies: writeRecordings(t,
+		"a 1\nb 1\n",
+		"a 1\nb 2\n",
+		"a 1\nb 2\n",
+		"a 2\nb 2\n",
+	)})
+	defer replay.Close()
+	p := newFakeClockProxy(t, newFakeClock(), Config{StartLive: true, StaleThreshold: 1}, replay.URL)
+
+	for step, expected := range []struct{ a, b bool }{{true, true}, {true, true}, {false, true}, {true, false}} {
+		result := scrapeNode(t, p)
+		if forwarded(result, `a`) != expected.a || forwarded(result, `b`) != expected.b {
+			t.Errorf(`step %d forwarded a %v and b %v, expected %v and %v`, step+1, forwarded(result, `a`), forwarded(result, `b`), expected.a, expected.b)
+		}
+	}
+	if _, err := p.Scrape(context.Background(), `node`); err == nil {
+		t.Error(`a scrape after the single pass succeeded`)
+	}
+}
+
+func TestReplayAnswersLikeTheRecordedUpstream(t *testing.T) {
+	paths := writeRecordings(t, "up 1\n", "oops\n")
+	writeConfigFile(t, paths[1][:len(paths[1])-len(`.prom`)]+`.json`, `{"status": 503, "header": {"Content-Type": ["text/plain; version=0.0.4"]}}`)
+	replay := &replayServer{bodies: paths, loop: true}
+	serve := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		replay.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+		return recorder
+	}
+
+	if recorder := serve(); recorder.Code != http.StatusOK || recorder.Body.String() != "up 1\n" {
+		t.Errorf(`the first recording answered %d %q`, recorder.Code, recorder.Body)
+	}
+	if recorder := serve(); recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get(`Content-Type`) != `text/plain; version=0.0.4` {
+		t.Errorf(`the second recording answered %d with %q`, recorder.Code, recorder.Header().Get(`Content-Type`))
+	}
+	if recorder := serve(); recorder.Body.String() != "up 1\n" || recorder.Header().Get(`X-Replay-Recording`) != filepath.Base(paths[0]) {
+		t.Errorf(`looping answered %q from %s`, recorder.Body, recorder.Header().Get(`X-Replay-Recording`))
+	}
+}
+
+func TestReplayCanAdvanceOnATimer(t *testing.T) {
+	paths := writeRecordings(t, "a 1\n", "a 2\n", "a 3\n")
+	replay := &replayServer{bodies: paths, interval: time.Hour, started: time.Now().Add(-90 * time.Minute)}
+	for i := 0; i < 2; i++ {
+		if position := replay.next(); position != 1 {
+			t.Errorf(`request %d got recording %d within the second interval`, i+1, position)
+		}
+	}
+	replay.started = time.Now().Add(-5 * time.Hour)
+	if position := replay.next(); position != -1 {
+		t.Errorf(`got recording %d after the single pass`, position)
+	}
+}
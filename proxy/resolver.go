@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Resolves the upstream host name at most once per refresh interval and
+// dials the resolved addresses itself, so a changed DNS record is picked up
+// even while Go's connection pool would happily keep using the old address.
+type upstreamResolver struct {
+	clock   Clock
+	refresh time.Duration
+	network string // ip, ip4 or ip6
+	lookup  func(ctx context.Context, network, host string) ([]net.IP, error)
+	dialer  net.Dialer
+
+	mu         sync.Mutex
+	host       string
+	addrs      []net.IP
+	resolvedAt time.Time
+	current    string // Address of the last successful dial
+
+	transport interface{ CloseIdleConnections() } // Idle connections are dropped when the addresses change
+}
+
+func newUpstreamResolver(refresh time.Duration, network string, clock Clock) *upstreamResolver {
+	return &upstreamResolver{
+		clock:   clock,
+		refresh: refresh,
+		network: network,
+		lookup:  net.DefaultResolver.LookupIP,
+		dialer:  net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+	}
+}
+
+// Accept any certificate from https upstreams, for self-signed exporters
+var upstreamInsecureSkipVerify bool
+
+// The TLS settings for https upstreams, nil for Go's defaults
+func upstreamTLSConfig() *tls.Config {
+	if !upstreamInsecureSkipVerify {
+		return nil
+	}
+	return &tls.Config{InsecureSkipVerify: true}
+}
+
+// Build an http client that dials through the resolver
+func (resolver *upstreamResolver) client() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = resolver.dialContext
+	transport.TLSClientConfig = upstreamTLSConfig()
+	resolver.transport = transport
+	return &http.Client{Transport: transport}
+}
+
+func (resolver *upstreamResolver) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	resolver.mu.Lock()
+	if host == resolver.host && resolver.clock.Now().Sub(resolver.resolvedAt) < resolver.refresh {
+		addrs := resolver.addrs
+		resolver.mu.Unlock()
+		return addrs, nil
+	}
+	resolver.mu.Unlock()
+
+	addrs, err := resolver.lookup(ctx, resolver.network, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New(`no addresses found for ` + host)
+	}
+
+	resolver.mu.Lock()
+	changed := host != resolver.host || !sameAddresses(addrs, resolver.addrs)
+	hadAddresses := resolver.addrs != nil
+	resolver.host = host
+	resolver.addrs = addrs
+	resolver.resolvedAt = resolver.clock.Now()
+	resolver.mu.Unlock()
+
+	if changed && hadAddresses && resolver.transport != nil {
+		resolver.transport.CloseIdleConnections()
+	}
+	return addrs, nil
+}
+
+func (resolver *upstreamResolver) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return resolver.dialer.DialContext(ctx, network, address)
+	}
+
+	addrs, err := resolver.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range addrs {
+		var conn net.Conn
+		if conn, err = resolver.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			resolver.mu.Lock()
+			resolver.current = ip.String()
+			resolver.mu.Unlock()
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (resolver *upstreamResolver) currentAddress() string {
+	resolver.mu.Lock()
+	defer resolver.mu.Unlock()
+	return resolver.current
+}
+
+func sameAddresses(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sortedA := make([]string, len(a))
+	sortedB := make([]string, len(b))
+	for i := range a {
+		sortedA[i] = a[i].String()
+		sortedB[i] = b[i].String()
+	}
+	sort.Strings(sortedA)
+	sort.Strings(sortedB)
+	for i := range sortedA {
+		if sortedA[i] != sortedB[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A resolver whose lookups are answered from a map that can be changed
+type fakeLookup struct {
+	answers map[string][]net.IP
+	lookups int
+}
+
+func (lookup *fakeLookup) lookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	lookup.lookups++
+	return lookup.answers[host], nil
+}
+
+type closeCounter struct{ closed int }
+
+func (counter *closeCounter) CloseIdleConnections() { counter.closed++ }
+
+func TestResolverRefreshesAddressesAfterTheInterval(t *testing.T) {
+	clock := newFakeClock()
+	lookup := &fakeLookup{answers: map[string][]net.IP{`node.example`: {net.ParseIP(`10.0.0.1`)}}}
+	transport := &closeCounter{}
+	resolver := newUpstreamResolver(30*time.Second, `ip`, clock)
+	resolver.lookup = lookup.lookupIP
+	resolver.transport = transport
+
+	resolve := func() string {
+		addrs, err := resolver.resolve(context.Background(), `node.example`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addrs[0].String()
+	}
+	resolve()
+	clock.Advance(29 * time.Second)
+	lookup.answers[`node.example`] = []net.IP{net.ParseIP(`10.0.0.2`)}
+	if address := resolve(); address != `10.0.0.1` || lookup.lookups != 1 {
+		t.Errorf(`within the interval: %s after %d lookups`, address, lookup.lookups)
+	}
+	clock.Advance(time.Second)
+	if address := resolve(); address != `10.0.0.2` || lookup.lookups != 2 {
+		t.Errorf(`after the interval: %s after %d lookups`, address, lookup.lookups)
+	}
+	if transport.closed != 1 {
+		t.Errorf(`idle connections closed %d times after the address changed, expected once`, transport.closed)
+	}
+
+	clock.Advance(time.Minute)
+	resolve()
+	if transport.closed != 1 {
+		t.Error(`idle connections were closed though the addresses stayed the same`)
+	}
+}
+
+func TestResolverDialsTheNextAddressWhenOneFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, `http://`))
+
+	closed, err := net.Listen(`tcp`, `127.0.0.2:0`)
+	if err != nil {
+		t.Skip(`127.0.0.2 isn't available: `, err)
+	}
+	closed.Close()
+	lookup := &fakeLookup{answers: map[string][]net.IP{`node.example`: {net.ParseIP(`127.0.0.2`), net.ParseIP(`127.0.0.1`)}}}
+	resolver := newUpstreamResolver(time.Minute, `ip`, newFakeClock())
+	resolver.lookup = lookup.lookupIP
+	resolver.dialer.Timeout = time.Second
+
+	resp, err := resolver.client().Get(`http://node.example:` + port + `/metrics`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if address := resolver.currentAddress(); address != `127.0.0.1` {
+		t.Errorf(`connected to %s, expected 127.0.0.1`, address)
+	}
+}
+
+func TestSameAddressesIgnoresTheOrder(t *testing.T) {
+	a := []net.IP{net.ParseIP(`10.0.0.1`), net.ParseIP(`10.0.0.2`)}
+	if !sameAddresses(a, []net.IP{net.ParseIP(`10.0.0.2`), net.ParseIP(`10.0.0.1`)}) {
+		t.Error(`reordered addresses counted as changed`)
+	}
+	if sameAddresses(a, a[:1]) {
+		t.Error(`a removed address didn't count as a change`)
+	}
+}
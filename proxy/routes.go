@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Explain unknown paths with the list of routes a listener serves
+var debugMode bool
+
+// One path served by a listener, and the upstreams behind it. Each route
+// keeps its own targets, and so its own staleness state.
+type route struct {
+	path    string
+	sources []upstreamSpec // Upstreams to merge
+	targets []string       // Names of the sources in the Proxy of a -config file
+}
+
+// A primary upstream and the ones to fail over to, all queried with the
+// same parameters on the same paths
+type upstreamSpec struct {
+	origins []string // Scheme and host, like http://localhost:9100
+	paths   []string
+	params  url.Values
+	label   string // Given like node=9100, names a merged upstream instead of the target name
+}
+
+// Parse an upstream argument like 9100,9200+9090/federate?match[]=up into
+// the upstreams to merge. Parameters containing + or , have to be percent
+// encoded. Instead of a port an upstream can be a URL like
+// https://node2:9100/custom/metrics, plain ports stand for localhost.
+// Merged upstreams can be named, like node=9100+postgres=9187.
+func parseUpstreamArgument(argument string) ([]upstreamSpec, error) {
+	var upstreams []upstreamSpec
+	labels := make(map[string]bool)
+	for _, source := range strings.Split(argument, `+`) {
+		var upstream upstreamSpec
+		if equals := strings.IndexByte(source, '='); equals > 0 && isUpstreamLabel(source[:equals]) {
+			upstream.label, source = source[:equals], source[equals+1:]
+			if labels[upstream.label] {
+				return nil, fmt.Errorf(`upstream name %s is given twice`, upstream.label)
+			}
+			labels[upstream.label] = true
+		}
+		if question := strings.Index(source, `?`); question >= 0 {
+			params, err := url.ParseQuery(source[question+1:])
+			if err != nil {
+				return nil, err
+			}
+			source, upstream.params = source[:question], params
+		}
+		var err error
+		if strings.Contains(source, `://`) {
+			if upstream.origins, upstream.paths, err = parseUpstreamURLs(source); err != nil {
+				return nil, err
+			}
+			upstreams = append(upstreams, upstream)
+			continue
+		}
+		if source, upstream.paths, err = parseUpstreamPaths(source); err != nil {
+			return nil, err
+		}
+		for _, element := range strings.Split(source, `,`) {
+			port, err := strconv.Atoi(element)
+			if err != nil {
+				return nil, err
+			}
+			upstream.origins = append(upstream.origins, `http://localhost:`+strconv.Itoa(port))
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	return upstreams, nil
+}
+
+// Split comma separated upstream URLs into their origins and the paths they
+// are scraped on. Only the first URL needs the paths, the ones to fail over
+// to are scraped on the same paths.
+func parseUpstreamURLs(source string) ([]string, []string, error) {
+	var origins, paths []string
+	for i, element := range strings.Split(source, `,`) {
+		parsed, err := url.Parse(element)
+		if err != nil {
+			return nil, nil, err
+		}
+		if parsed.User != nil {
+			return nil, nil, fmt.Errorf(`upstream %s has credentials in the URL, give them with -upstream-username and -upstream-password-file instead`, parsed.Redacted())
+		}
+		if (parsed.Scheme != `http` && parsed.Scheme != `https`) || parsed.Host == `` {
+			return nil, nil, fmt.Errorf(`upstream %s isn't an http or https URL`, element)
+		}
+		origins = append(origins, parsed.Scheme+`://`+parsed.Host)
+		if i == 0 {
+			_, paths, err = parseUpstreamPaths(parsed.Host + parsed.Path)
+			if err != nil {
+				return nil, nil, err
+			}
+		} else if parsed.Path != `` && parsed.Path != strings.Join(paths, `;`) {
+			return nil, nil, fmt.Errorf(`upstream %s has another path than %s`, element, strings.Join(paths, `;`))
+		}
+	}
+	return origins, paths, nil
+}
+
+// Letters, digits, _, - and ., so a name can't be mistaken for the start of
+// a URL or a query parameter
+func isUpstreamLabel(text string) bool {
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// The target name of an upstream: the host of its primary, like
+// localhost:9100
+func (upstream upstreamSpec) name() string {
+	return upstream.origins[0][strings.Index(upstream.origins[0], `://`)+3:]
+}
+
+// The upstream as it is fetched: its primary URL and query parameters
+func (upstream upstreamSpec) key() string {
+	key := upstream.origins[0] + strings.Join(upstream.paths, `;`)
+	if len(upstream.params) > 0 {
+		key += `?` + upstream.params.Encode()
+	}
+	return key
+}
+
+// Split a listen argument like 19100, 127.0.0.1:19100/node/metrics or
+// unix:///run/frugalpromproxy/node.sock into the address and the path to
+// serve on it. A Unix domain socket always serves the base path, as its own
+// path has slashes too.
+func parseListenArgument(argument string) (listenAddress, string, error) {
+	path := basePath
+	if slash := strings.Index(argument, `/`); slash >= 0 && !strings.HasPrefix(argument, unixSocketPrefix) {
+		argument, path = argument[:slash], argument[slash:]
+	}
+	address, err := parseListenAddress(argument)
+	return address, path, err
+}
+
+// Create and start the targets of a route of the command line arguments
+func (route route) newTargets() []*ScrapeTarget {
+	var sources []*ScrapeTarget
+	for _, upstream := range route.sources {
+		target := upstream.commandLineTarget()
+		scrapeTarget := unstartedScrapeTarget(target.Name, target.Upstreams, commandLine)
+		scrapeTarget.params = upstream.params
+		if len(upstream.paths) > 1 {
+			scrapeTarget.paths = upstream.paths
+		}
+		scrapeTarget.hostHeader = target.HostHeader
+		if target.ServerName != `` {
+			scrapeTarget.useServerName(target.ServerName)
+		}
+		scrapeTarget.start()
+		sources = append(sources, scrapeTarget)
+	}
+	return sources
+}
+
+// Register the handler for a route on a listener's mux, with the targets of
+// its sources
+func (route route) register(mux *http.ServeMux, address listenAddress, sources []*ScrapeTarget) {
+	var labels []string
+	for _, upstream := range route.sources {
+		label := upstream.label
+		if label == `` {
+			label = upstream.name()
+		}
+		labels = append(labels, label)
+	}
+
+	limit := rateLimitOf(address.name())
+	if len(sources) == 1 {
+		mux.HandleFunc(route.path, limit.wrap(sources[0].handler))
+		if serveSuppressed {
+			mux.HandleFunc(route.path+`/suppressed`, adminEndpoint(sources[0].suppressedHandler))
+		}
+		if serveRaw {
+			mux.HandleFunc(route.path+`/raw`, adminEndpoint(limit.wrap(sources[0].rawHandler)))
+		}
+		return
+	}
+	merged := &mergedTarget{name: address.name() + route.path, sources: sources, labels: labels, collisionPolicy: mergeCollisionPolicy}
+	mux.HandleFunc(route.path, limit.wrap(merged.handler))
+}
+
+// 404 for paths without a route, listing the routes in debug mode
+func routeNotFound(routes []route) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !debugMode {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set(`Content-Type`, `text/plain; charset=utf-8`)
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "no route for %s, available routes:\n", r.URL.Path)
+		for _, route := range routes {
+			fmt.Fprintln(w, route.path)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import "strconv"
+
+// Label naming the rule that withheld a series under <path>/suppressed
+const ruleLabel = `frugalpromproxy_rule`
+
+// The rule that decided a series is left out, as counted in ruleDecisions.
+// Rules are applied in this order, and a series is attributed to the first
+// one that left it out:
+//
+//   - drop:<pattern>, the first -drop pattern matching the metric name, or
+//     keep for the names matching none of the -keep patterns given alone
+//   - transform:<stage>:<name>, a stage of the transform chain dropping
+//     series, like transform:1:drop=go_.*
+//   - sample_limit, families left out by an open -sample-limit
+//   - staleness:<pattern>=<policy>, the first -staleness-policy rule
+//     matching the metric name, like staleness:node_cpu_*=unchanged. Names
+//     matching none are attributed to staleness:*=unchanged.
+var ruleDecisions = selfMetrics.newCounterVec(`frugalpromproxy_rule_decisions_total`, `Series left out of a scrape, by the rule that decided it: a -keep or -drop pattern, a transform stage, sample_limit or a staleness rule.`, `target`, `rule`)
+
+const sampleLimitRule = `sample_limit`
+
+func transformRule(stage int, name string) string {
+	return `transform:` + strconv.Itoa(stage) + `:` + name
+}
+
+// Decisions of one scrape per rule, counted once the scrape is done rather
+// than for every series
+type ruleCounts map[string]int
+
+func (counts ruleCounts) report(target string) {
+	for rule, count := range counts {
+		ruleDecisions.add(float64(count), []string{target, rule})
+	}
+}
+
+// The series line served under <path>/suppressed, labelled with the rule
+// that withheld it
+func withheldLine(series familySeries, labels, rule string) string {
+	return seriesLine(series.name, withStaticLabels(labels, ruleLabel+`="`+escapeLabelValue(rule)+`"`), series.value, series.timestamp)
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Overlapping staleness rules: the first one matching a name decides
+func TestSeriesAreAttributedToTheFirstRuleLeavingThemOut(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.Threshold, commandLine.staleness.StartStale = 1, false
+	for _, rule := range []string{`node_cpu_*=unchanged`, `node_*=unchanged`} {
+		if err := commandLine.stalenessRules.Set(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commandLine.transformers = chainOf(t, `drop=go_.*`)
+	defer func(serve bool) { serveSuppressed = serve }(serveSuppressed)
+	serveSuppressed = true
+	_, upstream := newFakeExporter(t, "node_cpu_seconds_total{cpu=\"0\"} 1\nnode_load1 0.5\nup 1\ngo_goroutines 7\n")
+	scrapeTarget := newScrapeTarget(`node`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+	rules := []string{`transform:1:drop=go_.*`, `staleness:node_cpu_*=unchanged`, `staleness:node_*=unchanged`, `staleness:*=unchanged`}
+	before := make(map[string]float64)
+	for _, rule := range rules {
+		before[rule] = selfMetricValue(ruleDecisions.selfMetric, `node`, rule)
+	}
+
+	servedSeries(scrapeTarget)
+	servedSeries(scrapeTarget)
+	if _, served := servedSeries(scrapeTarget); served != `` {
+		t.Errorf("the third scrape served\n%s", served)
+	}
+	withheld := httptest.NewRecorder()
+	scrapeTarget.suppressedHandler(withheld, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+	expected := `node_cpu_seconds_total{cpu="0",frugalpromproxy_rule="staleness:node_cpu_*=unchanged"} 1
+node_load1{frugalpromproxy_rule="staleness:node_*=unchanged"} 0.5
+up{frugalpromproxy_rule="staleness:*=unchanged"} 1`
+	if listed := strings.Join(seriesLines(withheld.Body.String()), "\n"); listed != expected {
+		t.Errorf("listed as suppressed\n%s", listed)
+	}
+
+	// Dropped on every scrape by the transform, withheld once by staleness
+	for rule, expected := range map[string]float64{rules[0]: 3, rules[1]: 1, rules[2]: 1, rules[3]: 1} {
+		if counted := selfMetricValue(ruleDecisions.selfMetric, `node`, rule) - before[rule]; counted != expected {
+			t.Errorf(`%s decided about %g series, expected %g`, rule, counted, expected)
+		}
+	}
+	attributed := make(map[string]string)
+	for _, status := range nodeSeries(t, scrapeTarget, ``) {
+		attributed[status.Name] = status.Rule
+	}
+	if attributed[`node_cpu_seconds_total`] != rules[1] || attributed[`node_load1`] != rules[2] || attributed[`up`] != rules[3] || len(attributed) != 3 {
+		t.Errorf(`the series API attributes %v`, attributed)
+	}
+}
+
+func TestSeriesLeftOutByAnOpenSampleLimitAreAttributedToIt(t *testing.T) {
+	scrapeTarget := newSampleLimitTarget(t, 8, false)
+	before := selfMetricValue(ruleDecisions.selfMetric, `ksm`, sampleLimitRule)
+	servedSeries(scrapeTarget)
+	// The 4 samples of b_latency
+	if counted := selfMetricValue(ruleDecisions.selfMetric, `ksm`, sampleLimitRule) - before; counted != 4 {
+		t.Errorf(`the sample limit decided about %g series`, counted)
+	}
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Samples a scrape may have after the transformers, 0 means no limit
+var sampleLimit int
+var sampleLimitPolicy string
+
+// Families named in the log and the error of a scrape above the limit
+const sampleLimitTopFamilies = 5
+
+var (
+	scrapeSamples       = selfMetrics.newGaugeVec(`frugalpromproxy_scrape_samples`, `Samples in the last scrape of the target, after the transformers.`, `target`)
+	sampleLimitExceeded = selfMetrics.newCounterVec(`frugalpromproxy_sample_limit_exceeded_total`, `Scrapes that had more samples than the sample limit, by policy: closed or open.`, `target`, `policy`)
+)
+
+// FamilySamples is the number of samples of a family in a scrape
+type FamilySamples struct {
+	Name    string
+	Samples int
+}
+
+// ErrSampleLimit is returned by a fail-closed target when a scrape has more
+// samples than its limit
+type ErrSampleLimit struct {
+	Samples int
+	Limit   int
+	// The families with the most samples, the largest first
+	Top []FamilySamples
+}
+
+func (err *ErrSampleLimit) Error() string {
+	return fmt.Sprintf(`%d samples, more than the limit of %d, most of them in %s`, err.Samples, err.Limit, formatFamilySamples(err.Top))
+}
+
+func formatFamilySamples(families []FamilySamples) string {
+	parts := make([]string, len(families))
+	for i, family := range families {
+		parts[i] = fmt.Sprintf(`%s (%d)`, family.Name, family.Samples)
+	}
+	return strings.Join(parts, `, `)
+}
+
+// Number of samples of a family, including the series of a histogram or
+// summary
+func (content MetricData) samples() int {
+	samples := len(content.label)
+	for _, children := range content.children {
+		samples += len(children)
+	}
+	return samples
+}
+
+// Enforce the sample limit of the target on a scrape. A fail-closed target
+// fails the scrape, a fail-open one keeps whole families in the order of
+// their names, skipping the ones that don't fit anymore, so the same
+// families are left out on every scrape of the same size.
+func (scrapeTarget *ScrapeTarget) checkSampleLimit(data map[string]MetricData) (map[string]MetricData, error) {
+	scrapeTarget.configMutex.Lock()
+	limit, failClosed := scrapeTarget.sampleLimit, scrapeTarget.sampleLimitFailClosed
+	scrapeTarget.configMutex.Unlock()
+
+	counts := make([]FamilySamples, 0, len(data))
+	var total int
+	for name, content := range data {
+		samples := content.samples()
+		counts = append(counts, FamilySamples{Name: name, Samples: samples})
+		total += samples
+	}
+	scrapeSamples.set(float64(total), scrapeTarget.name)
+	if limit <= 0 || total <= limit {
+		return data, nil
+	}
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Samples != counts[j].Samples {
+			return counts[i].Samples > counts[j].Samples
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	top := counts
+	if len(top) > sampleLimitTopFamilies {
+		top = top[:sampleLimitTopFamilies]
+	}
+	exceeded := &ErrSampleLimit{Samples: total, Limit: limit, Top: append([]FamilySamples(nil), top...)}
+	if failClosed {
+		sampleLimitExceeded.inc(scrapeTarget.name, `closed`)
+		return nil, exceeded
+	}
+	sampleLimitExceeded.inc(scrapeTarget.name, `open`)
+
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Name < counts[j].Name })
+	kept := make(map[string]MetricData)
+	var samples int
+	for _, family := range counts {
+		if samples+family.Samples > limit {
+			continue
+		}
+		kept[family.Name] = data[family.Name]
+		samples += family.Samples
+	}
+	ruleDecisions.add(float64(total-samples), []string{scrapeTarget.name, sampleLimitRule})
+	log.Printf("%s: %v, serving %d families with %d samples", scrapeTarget.name, exceeded, len(kept), samples)
+	return kept, nil
+}
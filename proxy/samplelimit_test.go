@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 11 samples: 6 of a_pods, 4 of the b_latency histogram and 1 of c_up
+const sampleLimitExposition = `# TYPE a_pods gauge
+a_pods{pod="1"} 1
+a_pods{pod="2"} 1
+a_pods{pod="3"} 1
+a_pods{pod="4"} 1
+a_pods{pod="5"} 1
+a_pods{pod="6"} 1
+# TYPE b_latency histogram
+b_latency_bucket{le="1"} 2
+b_latency_bucket{le="+Inf"} 3
+b_latency_sum 1.5
+b_latency_count 3
+# TYPE c_up gauge
+c_up 1
+`
+
+func newSampleLimitTarget(t *testing.T, limit int, failClosed bool) *ScrapeTarget {
+	useCommandLineSettings(t)
+	commandLine.staleness.StartStale = false
+	_, upstream := newFakeExporter(t, sampleLimitExposition)
+	scrapeTarget := newScrapeTarget(`ksm`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+	scrapeTarget.sampleLimit, scrapeTarget.sampleLimitFailClosed = limit, failClosed
+	return scrapeTarget
+}
+
+func TestScrapesAboveTheSampleLimitFailClosed(t *testing.T) {
+	scrapeTarget := newSampleLimitTarget(t, 8, true)
+	exceeded := selfMetricValue(sampleLimitExceeded.selfMetric, `ksm`, `closed`)
+
+	_, err := scrapeTarget.Scrape(context.Background())
+	var limit *ErrSampleLimit
+	if !errors.As(err, &limit) || limit.Samples != 11 || limit.Limit != 8 {
+		t.Fatalf(`scraping 11 samples with a limit of 8 returned %v`, err)
+	}
+	top := []FamilySamples{{`a_pods`, 6}, {`b_latency`, 4}, {`c_up`, 1}}
+	if !reflect.DeepEqual(limit.Top, top) || !strings.Contains(err.Error(), `most of them in a_pods (6), b_latency (4), c_up (1)`) {
+		t.Errorf(`reported %v`, err)
+	}
+	if selfMetricValue(sampleLimitExceeded.selfMetric, `ksm`, `closed`) != exceeded+1 {
+		t.Error(`the scrape above the limit wasn't counted`)
+	}
+	if code, _ := servedSeries(scrapeTarget); code != http.StatusBadGateway {
+		t.Errorf(`answered %d`, code)
+	}
+}
+
+// Whole families are kept by name as long as they fit
+func TestScrapesAboveTheSampleLimitAreTruncatedFailOpen(t *testing.T) {
+	scrapeTarget := newSampleLimitTarget(t, 8, false)
+	exceeded := selfMetricValue(sampleLimitExceeded.selfMetric, `ksm`, `open`)
+	for i := 0; i < 2; i++ {
+		code, served := servedSeries(scrapeTarget)
+		if code != http.StatusOK || strings.Contains(served, `b_latency`) || strings.Count(served, `a_pods`) != 6 || !strings.Contains(served, `c_up 1`) {
+			t.Errorf("scrape %d answered %d\n%s", i+1, code, served)
+		}
+	}
+	if selfMetricValue(sampleLimitExceeded.selfMetric, `ksm`, `open`) != exceeded+2 {
+		t.Error(`the scrapes above the limit weren't counted`)
+	}
+}
+
+func TestScrapeSamplesAreExposedWithoutALimit(t *testing.T) {
+	scrapeTarget := newSampleLimitTarget(t, 0, true)
+	if _, err := scrapeTarget.Scrape(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if samples := selfMetricValue(scrapeSamples.selfMetric, `ksm`); samples != 11 {
+		t.Errorf(`exposed %g samples`, samples)
+	}
+}
+
+func TestTheLargestFamiliesAreReported(t *testing.T) {
+	data := make(map[string]MetricData)
+	for _, family := range []string{"g 1\n", "f 1\nf{a=\"1\"} 1\n", "e 1\n", "d 1\n", "c 1\nc{a=\"1\"} 1\nc{a=\"2\"} 1\n", "b 1\n", "a 1\n"} {
+		parsed, _ := parseExposition(family, func(int, string) {})
+		for name, content := range parsed {
+			data[name] = content
+		}
+	}
+	scrapeTarget := &ScrapeTarget{name: `ksm`, sampleLimit: 1, sampleLimitFailClosed: true}
+	_, err := scrapeTarget.checkSampleLimit(data)
+	var limit *ErrSampleLimit
+	if !errors.As(err, &limit) {
+		t.Fatal(err)
+	}
+	// The largest first, ties by name
+	top := []FamilySamples{{`c`, 3}, {`f`, 2}, {`a`, 1}, {`b`, 1}, {`d`, 1}}
+	if limit.Samples != 10 || !reflect.DeepEqual(limit.Top, top) {
+		t.Errorf(`%d samples, top %v`, limit.Samples, limit.Top)
+	}
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// When a target scraped in the background is due next. Like Prometheus,
+// every target gets a fixed offset into the interval derived from its name,
+// so targets sharing an interval don't all fire at the same moment, and each
+// tick is moved by a small random jitter on top of that.
+type scrapeSchedule struct {
+	interval time.Duration
+	offset   time.Duration
+	jitter   time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+
+	rescrape chan struct{} // Scrape now instead of at the next slot
+}
+
+func newScrapeSchedule(name string, interval, jitter time.Duration) *scrapeSchedule {
+	return &scrapeSchedule{
+		interval: interval,
+		offset:   staggerOffset(name, interval),
+		jitter:   jitter,
+		rescrape: make(chan struct{}, 1),
+	}
+}
+
+// Have the next scrape happen right away, like after a reload
+func (schedule *scrapeSchedule) scrapeNow() {
+	select {
+	case schedule.rescrape <- struct{}{}:
+	default:
+	}
+}
+
+// Deterministic offset into the interval, spreading targets evenly
+func staggerOffset(name string, interval time.Duration) time.Duration {
+	hash := fnv.New64a()
+	hash.Write([]byte(name))
+	return time.Duration(hash.Sum64() % uint64(interval))
+}
+
+// The first slot after now, based on intervals counted from the Unix epoch
+func (schedule *scrapeSchedule) nextAfter(now time.Time) time.Time {
+	next := now.Truncate(schedule.interval).Add(schedule.offset)
+	for !next.After(now) {
+		next = next.Add(schedule.interval)
+	}
+	if schedule.jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(schedule.jitter))))
+	}
+
+	schedule.mu.Lock()
+	schedule.next = next
+	schedule.mu.Unlock()
+	return next
+}
+
+func (schedule *scrapeSchedule) nextScrape() time.Time {
+	schedule.mu.Lock()
+	defer schedule.mu.Unlock()
+	return schedule.next
+}
+
+// Scrape the target on its schedule until it is closed
+func (scrapeTarget *ScrapeTarget) scrapeLoop() {
+	defer scrapeTarget.scraping.Done()
+	clock := scrapeTarget.settings.clock
+	for {
+		next := scrapeTarget.schedule.nextAfter(clock.Now())
+		timer := clock.NewTimer(next.Sub(clock.Now()))
+		select {
+		case <-timer.C():
+		case <-scrapeTarget.schedule.rescrape:
+			timer.Stop()
+			next = clock.Now()
+		case <-scrapeTarget.stop:
+			timer.Stop()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), scrapeTarget.schedule.interval)
+		result, err := scrapeTarget.Scrape(ctx)
+		cancel()
+		if err != nil {
+			scrapeTarget.countError(err)
+			log.Printf("%s: background scrape failed: %v", scrapeTarget.name, err)
+			scrapeTarget.latestMutex.Lock()
+			scrapeTarget.latestErr = &backgroundScrapeError{err: err}
+			scrapeTarget.latestMutex.Unlock()
+			continue
+		}
+
+		scrapeTarget.latestMutex.Lock()
+		scrapeTarget.latest, scrapeTarget.latestErr = result.families, nil
+		scrapeTarget.latestMutex.Unlock()
+		scrapeTarget.setCached(scrapeTarget.upstreamRequest(nil), result.families)
+		if remoteWrite != nil {
+			remoteWrite.enqueue(scrapeTarget.name, result.families, next)
+		}
+	}
+}
+
+// The result of the last background scrape. When it failed, or none has
+// finished yet, requests are answered like a failed scrape, or with the
+// output of the last successful one for -serve-stale-on-error.
+func (scrapeTarget *ScrapeTarget) latestFamilies() ([]outputFamily, error) {
+	scrapeTarget.latestMutex.Lock()
+	defer scrapeTarget.latestMutex.Unlock()
+	return scrapeTarget.latest, scrapeTarget.latestErr
+}
+
+// The error of a failed background scrape, which was counted and logged
+// when it happened and not again for the requests answered with it
+type backgroundScrapeError struct {
+	err error
+}
+
+func (err *backgroundScrapeError) Error() string { return err.err.Error() }
+func (err *backgroundScrapeError) Unwrap() error { return err.err }
+
+func isBackgroundScrapeError(err error) bool {
+	var background *backgroundScrapeError
+	return errors.As(err, &background)
+}
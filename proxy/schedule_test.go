@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run the background scrape of the next slot and wait until its result is
+// stored
+func nextBackgroundScrape(t *testing.T, clock *fakeClock) {
+	t.Helper()
+	clock.waitForWaiters(t, 1)
+	clock.Advance(time.Minute + time.Second)
+	clock.waitForWaiters(t, 1)
+}
+
+func serveNode(p *Proxy) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	p.Handler(`node`).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+	return recorder
+}
+
+func TestFailedBackgroundScrapesAreAnsweredWithTheirError(t *testing.T) {
+	defer func(serve bool) { serveStaleOnError = serve }(serveStaleOnError)
+	serveStaleOnError = false
+	clock := newFakeClock()
+	exporter, upstream := newFakeExporter(t, "up 1\n")
+	p := newFakeClockProxy(t, clock, Config{ScrapeInterval: time.Minute, StartLive: true}, upstream)
+
+	if answer := serveNode(p); answer.Code != http.StatusServiceUnavailable {
+		t.Errorf(`before the first background scrape: %d %s`, answer.Code, answer.Body)
+	}
+	exporter.fail(http.StatusInternalServerError)
+	nextBackgroundScrape(t, clock)
+	if answer := serveNode(p); answer.Code != http.StatusBadGateway || !strings.Contains(answer.Body.String(), `500`) {
+		t.Errorf(`after a failed first scrape: %d %s`, answer.Code, answer.Body)
+	}
+	exporter.serve("up 1\n")
+	nextBackgroundScrape(t, clock)
+	if answer := serveNode(p); answer.Code != http.StatusOK || !strings.Contains(answer.Body.String(), `up 1`) {
+		t.Errorf(`after a successful scrape: %d %s`, answer.Code, answer.Body)
+	}
+	exporter.fail(http.StatusInternalServerError)
+	nextBackgroundScrape(t, clock)
+	if answer := serveNode(p); answer.Code != http.StatusBadGateway {
+		t.Errorf(`a failed scrape after a successful one was answered %d %s`, answer.Code, answer.Body)
+	}
+}
+
+func TestFailedBackgroundScrapesServeStaleOutputUpToMaxCacheAge(t *testing.T) {
+	defer func(serve bool, age time.Duration) { serveStaleOnError, maxCacheAge = serve, age }(serveStaleOnError, maxCacheAge)
+	serveStaleOnError, maxCacheAge = true, 2*time.Minute
+	clock := newFakeClock()
+	exporter, upstream := newFakeExporter(t, "up 1\n")
+	p := newFakeClockProxy(t, clock, Config{ScrapeInterval: time.Minute, StartLive: true}, upstream)
+	nextBackgroundScrape(t, clock)
+
+	exporter.fail(http.StatusServiceUnavailable)
+	nextBackgroundScrape(t, clock)
+	answer := serveNode(p)
+	if answer.Code != http.StatusOK || answer.Header().Get(cachedHeader) != `true` || !strings.Contains(answer.Body.String(), `up 1`) {
+		t.Errorf(`a failed scrape within -max-cache-age: %d %q %s`, answer.Code, answer.Header().Get(cachedHeader), answer.Body)
+	}
+	nextBackgroundScrape(t, clock)
+	if answer := serveNode(p); answer.Code != http.StatusBadGateway {
+		t.Errorf(`a failed scrape past -max-cache-age was answered %d`, answer.Code)
+	}
+}
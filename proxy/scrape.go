@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pdxiv/frugalpromproxy/parser"
+)
+
+// ParseError is a line of the upstream body that couldn't be parsed
+type ParseError = parser.ParseError
+
+// UpstreamInfo describes the upstream response a scrape was made from
+type UpstreamInfo struct {
+	URL      string
+	Status   int
+	Protocol string // Like HTTP/2.0
+	Duration time.Duration
+	Bytes    int // Size of the body
+}
+
+// ScrapeResult is what one scrape of a target passes on, before it is
+// rendered
+type ScrapeResult struct {
+	Upstream   UpstreamInfo
+	Forwarded  int // Series passed on
+	Suppressed int // Series left out by the staleness policies
+	// Lines of the upstream body that were skipped
+	Warnings []ParseError
+
+	families []outputFamily
+}
+
+// Families returns the families passed on, including the ones the proxy
+// adds itself like target_info. The series of histograms and summaries
+// follow their family as families of their own, like the parser returns
+// them.
+func (result *ScrapeResult) Families() []Family {
+	families := make([]Family, 0, len(result.families))
+	for _, output := range result.families {
+		position := len(families)
+		families = append(families, Family{Name: output.name, Help: output.help, Type: typeText[output.metricType]})
+		children := make(map[string]int) // Position of a child family
+		for _, line := range output.lines {
+			name, series, ok := parser.ParseSeriesLine(strings.TrimSpace(line))
+			if !ok {
+				continue
+			}
+			if name == output.name {
+				families[position].Series = append(families[position].Series, series)
+				continue
+			}
+			at, seen := children[name]
+			if !seen {
+				at = len(families)
+				children[name] = at
+				families = append(families, Family{Name: name})
+			}
+			families[at].Series = append(families[at].Series, series)
+		}
+	}
+	return families
+}
+
+// WriteText renders the families passed on in the text exposition format
+func (result *ScrapeResult) WriteText(w io.Writer) error {
+	return writeText(w, result.families)
+}
+
+// Scrape fetches the upstream of the target now, runs it through the
+// transform chain and the staleness policies, and returns what should be
+// passed on. It waits for a free upstream fetch slot like a scrape request,
+// and gives up when ctx is done.
+func (scrapeTarget *ScrapeTarget) Scrape(ctx context.Context) (*ScrapeResult, error) {
+	if scrapeTarget.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, scrapeTarget.timeout)
+		defer cancel()
+	}
+	return scrapeTarget.limitedScrape(ctx, scrapeTarget.upstreamRequest(nil))
+}
+
+// Scrape once an upstream fetch slot is free
+func (scrapeTarget *ScrapeTarget) limitedScrape(ctx context.Context, request upstreamRequest) (*ScrapeResult, error) {
+	waitStart := scrapeTarget.now()
+	fetches := scrapeTarget.settings.fetches
+	if err := fetches.acquire(ctx, scrapeTarget.name); err != nil {
+		return nil, fmt.Errorf(`%s: %w`, scrapeTarget.name, ErrNoFetchSlot)
+	}
+	defer fetches.release()
+	fetchWaitSeconds.observe(scrapeTarget.since(waitStart).Seconds(), scrapeTarget.name)
+
+	upstreamScrapes.inc(scrapeTarget.name)
+	result, err := scrapeTarget.scrape(ctx, request)
+	if err == nil {
+		upstreamFetchSeconds.observe(result.Upstream.Duration.Seconds(), scrapeTarget.name)
+		upstreamBytes.add(float64(result.Upstream.Bytes), []string{scrapeTarget.name})
+	}
+	// Ran out of time, or the scraper gave up
+	if err != nil && ctx.Err() != nil {
+		return nil, fmt.Errorf(`%s: %w after %v`, scrapeTarget.name, ErrScrapeTimedOut, scrapeTarget.since(waitStart).Round(time.Millisecond))
+	}
+	if err == nil && scrapeTarget.journal != nil {
+		scrapeTarget.journal.record(result.families, scrapeTarget.now())
+	}
+	return result, err
+}
+
+// A scrape that requests for the same upstream request can wait for
+type sharedScrape struct {
+	done   chan struct{}
+	result *ScrapeResult
+	err    error
+
+	// Requests still waiting, the scrape is canceled once none are left
+	waiting int
+	cancel  context.CancelFunc
+}
+
+// Scrape now, unless a scrape for the same upstream request is running
+// already: then wait for its result. Overlapping scrape requests, like from
+// two Prometheus servers, make one upstream fetch, and count as one scrape
+// for the unchanged counters. The scrape runs on a context of its own, so
+// it goes on as long as one of the requests waits for it, and every request
+// gives up on its own context.
+func (scrapeTarget *ScrapeTarget) sharedScrape(ctx context.Context, request upstreamRequest) (*ScrapeResult, error) {
+	key := request.key()
+	scrapeTarget.sharedMutex.Lock()
+	running, ok := scrapeTarget.shared[key]
+	if !ok {
+		scrapeCtx, cancel := context.WithCancel(context.Background())
+		running = &sharedScrape{done: make(chan struct{}), cancel: cancel}
+		if scrapeTarget.shared == nil {
+			scrapeTarget.shared = make(map[string]*sharedScrape)
+		}
+		scrapeTarget.shared[key] = running
+		go func() {
+			result, err := scrapeTarget.limitedScrape(scrapeCtx, request)
+			scrapeTarget.sharedMutex.Lock()
+			running.result, running.err = result, err
+			if scrapeTarget.shared[key] == running {
+				delete(scrapeTarget.shared, key)
+			}
+			scrapeTarget.sharedMutex.Unlock()
+			cancel()
+			close(running.done)
+		}()
+	}
+	running.waiting++
+	scrapeTarget.sharedMutex.Unlock()
+
+	select {
+	case <-running.done:
+		return running.result, running.err
+	case <-ctx.Done():
+		scrapeTarget.sharedMutex.Lock()
+		if running.waiting--; running.waiting == 0 {
+			// Nobody wants the result any more, a request coming in now
+			// starts a new scrape
+			if scrapeTarget.shared[key] == running {
+				delete(scrapeTarget.shared, key)
+			}
+			running.cancel()
+		}
+		scrapeTarget.sharedMutex.Unlock()
+		return nil, fmt.Errorf(`%s: %w`, scrapeTarget.name, ErrScrapeTimedOut)
+	}
+}
+
+// The families of the latest background scrape, or else of a scrape now
+func (scrapeTarget *ScrapeTarget) currentFamilies(ctx context.Context, request upstreamRequest) ([]outputFamily, error) {
+	if scrapeTarget.schedule != nil {
+		return scrapeTarget.latestFamilies()
+	}
+	result, err := scrapeTarget.sharedScrape(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	scrapeTarget.setCached(request, result.families)
+	return result.families, nil
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const scrapedExposition = `# HELP node_load1 1m load average.
+# TYPE node_load1 gauge
+node_load1 0.52
+# TYPE node_memory_free_bytes gauge
+node_memory_free_bytes 1.2e+09
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{le="0.1"} 3
+http_request_duration_seconds_bucket{le="+Inf"} 4
+http_request_duration_seconds_sum 0.3
+http_request_duration_seconds_count 4
+not a series
+`
+
+func newScrapedTarget(t *testing.T) (*fakeExporter, *ScrapeTarget) {
+	useCommandLineSettings(t)
+	commandLine.staleness.StartStale = false
+	commandLine.staleness.Threshold = 1
+	exporter, upstream := newFakeExporter(t, scrapedExposition)
+	scrapeTarget := newScrapeTarget(`node`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+	return exporter, scrapeTarget
+}
+
+func TestScrapeReturnsTheUpstreamAndWarnings(t *testing.T) {
+	_, scrapeTarget := newScrapedTarget(t)
+	result, err := scrapeTarget.Scrape(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Upstream.Status != http.StatusOK || result.Upstream.URL != scrapeTarget.upstreams.activeURL() || result.Upstream.Bytes != len(scrapedExposition) || result.Upstream.Protocol != `HTTP/1.1` {
+		t.Errorf(`upstream %+v`, result.Upstream)
+	}
+	if len(result.Warnings) != 1 || result.Warnings[0].Line != 11 || result.Warnings[0].Text != `not a series` {
+		t.Errorf(`warnings %v`, result.Warnings)
+	}
+	if result.Forwarded != 6 || result.Suppressed != 0 {
+		t.Errorf(`%d forwarded, %d suppressed`, result.Forwarded, result.Suppressed)
+	}
+}
+
+func TestScrapeCountsTheSuppressedSeries(t *testing.T) {
+	exporter, scrapeTarget := newScrapedTarget(t)
+	var result *ScrapeResult
+	var err error
+	for i := 0; i < 3; i++ {
+		if result, err = scrapeTarget.Scrape(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if result.Forwarded+result.Suppressed != 6 || result.Suppressed == 0 {
+		t.Errorf(`unchanged for 3 scrapes: %d forwarded, %d suppressed`, result.Forwarded, result.Suppressed)
+	}
+	for _, family := range result.Families() {
+		if family.Name == `node_load1` {
+			t.Errorf(`the unchanged gauge was passed on: %+v`, family)
+		}
+	}
+
+	exporter.serve(strings.Replace(scrapedExposition, `node_load1 0.52`, `node_load1 0.61`, 1))
+	if result, err = scrapeTarget.Scrape(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var text bytes.Buffer
+	if err := result.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text.String(), "node_load1 0.61\n") || strings.Contains(text.String(), `node_memory_free_bytes`) {
+		t.Errorf("after the gauge changed\n%s", text.String())
+	}
+}
+
+func TestScrapeResultFamiliesSplitTheirChildren(t *testing.T) {
+	_, scrapeTarget := newScrapedTarget(t)
+	result, err := scrapeTarget.Scrape(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, family := range result.Families() {
+		names = append(names, family.Name+`:`+family.Type)
+	}
+	expected := `node_load1:gauge node_memory_free_bytes:gauge http_request_duration_seconds:histogram http_request_duration_seconds_bucket: http_request_duration_seconds_sum: http_request_duration_seconds_count:`
+	if strings.Join(names, ` `) != expected {
+		t.Errorf("families\n%s\nexpected\n%s", strings.Join(names, ` `), expected)
+	}
+	for _, family := range result.Families() {
+		if family.Name == `http_request_duration_seconds_bucket` && (len(family.Series) != 2 || family.Series[1].Labels != `le="+Inf"` || family.Series[1].Value != 4) {
+			t.Errorf(`buckets %+v`, family.Series)
+		}
+	}
+}
+
+// The handler answers with what Scrape returned, rendered
+func TestScrapeAndTheHandlerPassOnTheSame(t *testing.T) {
+	_, scrapeTarget := newScrapedTarget(t)
+	result, err := scrapeTarget.Scrape(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var text bytes.Buffer
+	result.WriteText(&text)
+
+	_, other := newScrapedTarget(t)
+	code, served := servedSeries(other)
+	if code != http.StatusOK || served != strings.Join(seriesLines(text.String()), "\n") {
+		t.Errorf("served %d\n%s\nScrape rendered\n%s", code, served, text.String())
+	}
+}
@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Path on every listener where the proxy exposes metrics about itself
+const selfMetricsPath = `/proxy-metrics`
+
+// The proxy's own instrumentation. Hand-rolled in the same exposition format
+// that is served for the targets, so no client library is needed.
+var selfMetrics = &selfRegistry{}
+
+var (
+	rateLimitedRequests = selfMetrics.newCounterVec(`frugalpromproxy_rate_limited_requests_total`, `Scrape requests above the rate limit of the listener, answered with the last good answer of the path or a 429.`, `target`)
+	deniedConnections   = selfMetrics.newCounterVec(`frugalpromproxy_denied_requests_total`, `Requests rejected because the client address is not in the allowlist.`, `target`)
+	tlsHandshakeErrors  = selfMetrics.newCounterVec(`frugalpromproxy_tls_handshake_errors_total`, `Failed TLS handshakes on the listener, including rejected client certificates.`, `target`)
+	activeUpstream      = selfMetrics.newGaugeVec(`frugalpromproxy_active_upstream`, `Whether the upstream is the one currently scraped for the target.`, `target`, `upstream`)
+	fetchWaitSeconds    = selfMetrics.newHistogramVec(`frugalpromproxy_fetch_wait_seconds`, `Time scrapes spent waiting for a free upstream fetch slot.`, []float64{.001, .005, .01, .05, .1, .25, .5, 1, 2.5, 5, 10}, `target`)
+
+	upstreamScrapes      = selfMetrics.newCounterVec(`frugalpromproxy_upstream_scrapes_total`, `Upstream fetches made for the target, including the ones that failed and are counted in frugalpromproxy_scrape_errors_total.`, `target`)
+	upstreamFetchSeconds = selfMetrics.newHistogramVec(`frugalpromproxy_upstream_fetch_seconds`, `Time the successful upstream fetches of the target took, until the body was read.`, []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}, `target`)
+	upstreamBytes        = selfMetrics.newCounterVec(`frugalpromproxy_upstream_bytes_total`, `Bytes of the bodies fetched from the upstream of the target.`, `target`)
+	servedBytes          = selfMetrics.newCounterVec(`frugalpromproxy_served_bytes_total`, `Bytes of the metrics of the target served to scrapers.`, `target`)
+	seriesForwarded      = selfMetrics.newGaugeVec(`frugalpromproxy_series_forwarded`, `Series of the last scrape of the target that were passed on.`, `target`)
+	seriesSuppressed     = selfMetrics.newGaugeVec(`frugalpromproxy_series_suppressed`, `Series of the last scrape of the target that the staleness policies left out.`, `target`)
+)
+
+type selfRegistry struct {
+	mu      sync.Mutex
+	metrics []*selfMetric
+}
+
+type selfMetric struct {
+	name       string
+	help       string
+	metricType MetricType
+	labelNames []string
+
+	buckets []float64 // Upper bounds, histograms only
+
+	mu         sync.Mutex
+	values     map[string]float64 // Keyed by the rendered label string
+	histograms map[string]*histogramValues
+}
+
+type histogramValues struct {
+	counts []uint64 // Cumulative per bucket
+	count  uint64
+	sum    float64
+}
+
+type counterVec struct{ *selfMetric }
+
+type gaugeVec struct{ *selfMetric }
+
+type histogramVec struct{ *selfMetric }
+
+func (registry *selfRegistry) register(name, help string, metricType MetricType, labelNames []string) *selfMetric {
+	metric := &selfMetric{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labelNames: labelNames,
+		values:     make(map[string]float64),
+		histograms: make(map[string]*histogramValues),
+	}
+	registry.mu.Lock()
+	registry.metrics = append(registry.metrics, metric)
+	registry.mu.Unlock()
+	return metric
+}
+
+func (registry *selfRegistry) newCounterVec(name, help string, labelNames ...string) counterVec {
+	return counterVec{registry.register(name, help, counter, labelNames)}
+}
+
+func (registry *selfRegistry) newGaugeVec(name, help string, labelNames ...string) gaugeVec {
+	return gaugeVec{registry.register(name, help, gauge, labelNames)}
+}
+
+func (registry *selfRegistry) newHistogramVec(name, help string, buckets []float64, labelNames ...string) histogramVec {
+	metric := registry.register(name, help, histogram, labelNames)
+	metric.buckets = buckets
+	return histogramVec{metric}
+}
+
+func (metric *selfMetric) labelString(labelValues []string) string {
+	if len(labelValues) != len(metric.labelNames) {
+		panic(`wrong number of label values for ` + metric.name)
+	}
+	pairs := make([]string, len(labelValues))
+	for i, value := range labelValues {
+		pairs[i] = metric.labelNames[i] + `="` + escapeLabelValue(value) + `"`
+	}
+	return strings.Join(pairs, `,`)
+}
+
+func (metric *selfMetric) add(delta float64, labelValues []string) {
+	key := metric.labelString(labelValues)
+	metric.mu.Lock()
+	metric.values[key] += delta
+	metric.mu.Unlock()
+}
+
+func (metric *selfMetric) set(value float64, labelValues []string) {
+	key := metric.labelString(labelValues)
+	metric.mu.Lock()
+	metric.values[key] = value
+	metric.mu.Unlock()
+}
+
+func (g gaugeVec) set(value float64, labelValues ...string) {
+	g.selfMetric.set(value, labelValues)
+}
+
+func (c counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues)
+}
+
+func (h histogramVec) observe(value float64, labelValues ...string) {
+	key := h.labelString(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	values, ok := h.histograms[key]
+	if !ok {
+		values = &histogramValues{counts: make([]uint64, len(h.buckets))}
+		h.histograms[key] = values
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			values.counts[i]++
+		}
+	}
+	values.count++
+	values.sum += value
+}
+
+// Series are written in label order so consecutive scrapes are stable
+func (metric *selfMetric) render(builder *strings.Builder) {
+	metric.mu.Lock()
+	defer metric.mu.Unlock()
+
+	if len(metric.values) == 0 && len(metric.histograms) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(metric.values)+len(metric.histograms))
+	for key := range metric.values {
+		keys = append(keys, key)
+	}
+	for key := range metric.histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	builder.WriteString(`# HELP ` + metric.name + ` ` + metric.help + "\n")
+	builder.WriteString(`# TYPE ` + metric.name + ` ` + typeText[metric.metricType] + "\n")
+	for _, key := range keys {
+		if metric.metricType != histogram {
+			writeSelfSample(builder, metric.name, key, metric.values[key])
+			continue
+		}
+		values := metric.histograms[key]
+		separator := ``
+		if key != `` {
+			separator = `,`
+		}
+		for i, bound := range metric.buckets {
+			writeSelfSample(builder, metric.name+`_bucket`, key+separator+`le="`+formatFloat(bound)+`"`, float64(values.counts[i]))
+		}
+		writeSelfSample(builder, metric.name+`_bucket`, key+separator+`le="+Inf"`, float64(values.count))
+		writeSelfSample(builder, metric.name+`_sum`, key, values.sum)
+		writeSelfSample(builder, metric.name+`_count`, key, float64(values.count))
+	}
+}
+
+func writeSelfSample(builder *strings.Builder, name, labels string, value float64) {
+	builder.WriteString(name)
+	if labels != `` {
+		builder.WriteString(`{` + labels + `}`)
+	}
+	builder.WriteString(` ` + formatFloat(value) + "\n")
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (registry *selfRegistry) handler(w http.ResponseWriter, r *http.Request) {
+	var builder strings.Builder
+	registry.mu.Lock()
+	for _, metric := range registry.metrics {
+		metric.render(&builder)
+	}
+	registry.mu.Unlock()
+	w.Header().Set(`Content-Type`, textContentType)
+	fmt.Fprint(w, builder.String())
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+// A ResponseWriter counting the bytes of the body written through it
+type countingWriter struct {
+	http.ResponseWriter
+	bytes int
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSelfMetricsAreRenderedInLabelOrder(t *testing.T) {
+	var registry selfRegistry
+	scrapes := registry.newCounterVec(`scrapes_total`, `Scrapes.`, `target`)
+	registry.newGaugeVec(`unused`, `Never set.`, `target`)
+	seconds := registry.newHistogramVec(`fetch_seconds`, `Fetches.`, []float64{.1, 1}, `target`)
+	scrapes.inc(`node`)
+	scrapes.add(2, []string{`app "1"`})
+	seconds.observe(.5, `node`)
+	seconds.observe(2, `node`)
+
+	response := httptest.NewRecorder()
+	registry.handler(response, httptest.NewRequest(http.MethodGet, selfMetricsPath, nil))
+	expected := `# HELP scrapes_total Scrapes.
+# TYPE scrapes_total counter
+scrapes_total{target="app \"1\""} 2
+scrapes_total{target="node"} 1
+# HELP fetch_seconds Fetches.
+# TYPE fetch_seconds histogram
+fetch_seconds_bucket{target="node",le="0.1"} 0
+fetch_seconds_bucket{target="node",le="1"} 1
+fetch_seconds_bucket{target="node",le="+Inf"} 2
+fetch_seconds_sum{target="node"} 2.5
+fetch_seconds_count{target="node"} 2
+`
+	if response.Body.String() != expected {
+		t.Errorf("rendered\n%s\nexpected\n%s", response.Body, expected)
+	}
+}
+
+// The successful fetches in the upstream fetch histogram of a target
+func fetchesTimed(target string) uint64 {
+	key := upstreamFetchSeconds.labelString([]string{target})
+	upstreamFetchSeconds.mu.Lock()
+	defer upstreamFetchSeconds.mu.Unlock()
+	if values, ok := upstreamFetchSeconds.histograms[key]; ok {
+		return values.count
+	}
+	return 0
+}
+
+func TestTargetsCountTheirFetchesBytesAndSeries(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.Threshold, commandLine.staleness.StartStale = 1, false
+	const exposition = "node_load1 0.5\nnode_boot_time_seconds 1622548800\n"
+	exporter, upstream := newFakeExporter(t, exposition)
+	scrapeTarget := newScrapeTarget(`metered`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+	scrapes, fetches := selfMetricValue(upstreamScrapes.selfMetric, `metered`), fetchesTimed(`metered`)
+	in, out := selfMetricValue(upstreamBytes.selfMetric, `metered`), selfMetricValue(servedBytes.selfMetric, `metered`)
+
+	var served int
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			exporter.serve(strings.Replace(exposition, `0.5`, `0.6`, 1))
+		}
+		response := httptest.NewRecorder()
+		scrapeTarget.handler(response, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+		served += response.Body.Len()
+	}
+	if counted := selfMetricValue(upstreamScrapes.selfMetric, `metered`) - scrapes; counted != 3 {
+		t.Errorf(`%g upstream scrapes`, counted)
+	}
+	if timed := fetchesTimed(`metered`) - fetches; timed != 3 {
+		t.Errorf(`%d fetches timed`, timed)
+	}
+	if counted := selfMetricValue(upstreamBytes.selfMetric, `metered`) - in; counted != float64(3*len(exposition)) {
+		t.Errorf(`%g bytes in, expected %d`, counted, 3*len(exposition))
+	}
+	if counted := selfMetricValue(servedBytes.selfMetric, `metered`) - out; counted != float64(served) {
+		t.Errorf(`%g bytes out, expected %d`, counted, served)
+	}
+	// node_load1 changed, the boot time has been unchanged for two scrapes
+	if forwarded, suppressed := selfMetricValue(seriesForwarded.selfMetric, `metered`), selfMetricValue(seriesSuppressed.selfMetric, `metered`); forwarded != 1 || suppressed != 1 {
+		t.Errorf(`%g series forwarded and %g suppressed`, forwarded, suppressed)
+	}
+
+	// A failed fetch is a scrape, but isn't timed
+	exporter.fail(http.StatusInternalServerError)
+	servedSeries(scrapeTarget)
+	if counted := selfMetricValue(upstreamScrapes.selfMetric, `metered`) - scrapes; counted != 4 {
+		t.Errorf(`%g upstream scrapes with a failed one`, counted)
+	}
+	if timed := fetchesTimed(`metered`) - fetches; timed != 3 {
+		t.Errorf(`%d fetches timed with a failed one`, timed)
+	}
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/pdxiv/frugalpromproxy/staleness"
+)
+
+// The settings a target is created with. The targets of the command line
+// share the ones built from its flags, and every embedded Proxy has its own,
+// built from its Config, so proxies in one process don't affect each other.
+// Only the self-metrics are shared by the whole process.
+type proxySettings struct {
+	stalenessRules staleness.Rules
+	// Of the unchanged policies, before the overrides of single targets
+	staleness staleness.Defaults
+	// Applied to every scrape before staleness is decided, unless the target
+	// has a chain of its own
+	transformers []Transformer
+
+	forgetSeriesAfter       time.Duration // 0 keeps vanished series
+	suppressionDelayWarning time.Duration // 0 never warns
+	clockJumpThreshold      time.Duration // 0 never looks for clock jumps
+
+	scrapeInterval      time.Duration // 0 scrapes on every request
+	scrapeJitter        time.Duration
+	scrapeTimeout       time.Duration // 0 means no limit
+	scrapeTimeoutOffset time.Duration
+
+	dnsRefreshInterval time.Duration
+	dnsAddressFamily   string
+	upstreamH2C        bool
+
+	parseErrorThreshold   float64 // 0 disables the check
+	parseErrorFailClosed  bool
+	sampleLimit           int // Of the targets without their own, 0 means no limit
+	sampleLimitFailClosed bool
+
+	deltaJournalSize int // 0 keeps no journal
+	deltaJournalTTL  time.Duration
+
+	fetches *fetchLimiter   // Shared with the other targets of the Proxy
+	targets *targetRegistry // Of the Proxy, the status API only serves the command line's
+	clock   Clock
+
+	// Of the targets without their own, from the command line
+	names       nameFilter
+	credentials credentials
+	// Overrides of single targets by name, from the command line
+	targetThresholds            targetThresholds
+	targetStartStale            targetBools
+	targetNeverSuppressCounters targetBools
+}
+
+// The settings of the command line, built once the flags are parsed
+var commandLine *proxySettings
+
+func commandLineSettings() *proxySettings {
+	return &proxySettings{
+		stalenessRules: stalenessPolicyRules,
+		staleness: staleness.Defaults{
+			Threshold:         staleThreshold,
+			StartStale:        startStale,
+			TimestampIsChange: timestampIsChange,
+			SuppressCounters:  !neverSuppressCounters,
+			CounterWarmUp:     counterWarmUp,
+		},
+		transformers:                transformers,
+		forgetSeriesAfter:           forgetSeriesAfter,
+		suppressionDelayWarning:     suppressionDelayWarning,
+		clockJumpThreshold:          clockJumpThreshold,
+		scrapeInterval:              scrapeInterval,
+		scrapeJitter:                scrapeJitter,
+		scrapeTimeout:               scrapeTimeout,
+		scrapeTimeoutOffset:         scrapeTimeoutOffset,
+		dnsRefreshInterval:          dnsRefreshInterval,
+		dnsAddressFamily:            dnsAddressFamily,
+		upstreamH2C:                 upstreamH2C,
+		parseErrorThreshold:         parseErrorThreshold,
+		parseErrorFailClosed:        parseErrorPolicy == `closed`,
+		sampleLimit:                 sampleLimit,
+		sampleLimitFailClosed:       sampleLimitPolicy != `open`,
+		deltaJournalSize:            deltaJournalSize,
+		deltaJournalTTL:             deltaJournalTTL,
+		fetches:                     upstreamFetches,
+		targets:                     targets,
+		clock:                       clock,
+		names:                       globalNames,
+		credentials:                 upstreamCredentials,
+		targetThresholds:            targetStaleThresholds,
+		targetStartStale:            targetStartStale,
+		targetNeverSuppressCounters: targetNeverSuppressCounters,
+	}
+}
+
+// The defaults of the unchanged policies of a target: the ones of the
+// settings, with the overrides of the target on the command line
+func (settings *proxySettings) stalenessDefaults(name string) staleness.Defaults {
+	defaults := settings.staleness
+	if override, ok := settings.targetThresholds[name]; ok {
+		defaults.Threshold = override
+	}
+	if override, ok := settings.targetStartStale[name]; ok {
+		defaults.StartStale = override
+	}
+	if override, ok := settings.targetNeverSuppressCounters[name]; ok {
+		defaults.SuppressCounters = !override
+	}
+	return defaults
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// A Proxy embedded next to the command line, with a target of the same name,
+// neither takes the options of the command line nor shows up in its status
+// API
+func TestProxiesDontShareTargetsOrOptionsWithTheCommandLine(t *testing.T) {
+	previous := targets
+	targets = &targetRegistry{}
+	t.Cleanup(func() { targets = previous })
+	useCommandLineSettings(t)
+	commandLine.staleness.StartStale = false
+	commandLine.sampleLimit, commandLine.sampleLimitFailClosed = 1, true
+	_, upstream := newFakeExporter(t, "node_load1 0.5\nnode_load5 0.4\n")
+	served := newScrapeTarget(`node`, []string{upstream}, commandLine)
+	t.Cleanup(served.close)
+
+	embedded, err := New(Config{StartLive: true, StaleThreshold: 1, Targets: []Target{{Name: `node`, Upstreams: []string{upstream}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var limit *ErrSampleLimit
+	if _, err := served.Scrape(context.Background()); !errors.As(err, &limit) {
+		t.Errorf(`the target of the command line scraped past its sample limit: %v`, err)
+	}
+	result, err := embedded.Scrape(context.Background(), `node`)
+	if err != nil || result.Forwarded != 2 {
+		t.Errorf(`the embedded target forwarded %+v, %v`, result, err)
+	}
+	if scrapeTarget := embedded.targets[`node`]; scrapeTarget.sampleLimit != 0 {
+		t.Errorf(`the embedded target took the sample limit of the command line`)
+	}
+
+	response := httptest.NewRecorder()
+	targetsHandler(response, httptest.NewRequest(http.MethodGet, targetsPath, nil))
+	var statuses []targetStatus
+	if err := json.Unmarshal(response.Body.Bytes(), &statuses); err != nil || len(statuses) != 1 {
+		t.Errorf(`the status API listed %s`, response.Body)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	embedded.Run(ctx)
+	if targets.named(`node`) != served {
+		t.Error(`stopping the embedded proxy unregistered the target of the command line`)
+	}
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// An exporter answering once release is closed, counting its fetches and
+// the ones the proxy canceled
+type slowExporter struct {
+	release          chan struct{}
+	fetches, dropped int32
+}
+
+func newSlowExporter(t *testing.T) (*slowExporter, string) {
+	exporter := &slowExporter{release: make(chan struct{})}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&exporter.fetches, 1)
+		select {
+		case <-exporter.release:
+			io.WriteString(w, "up 1\n")
+		case <-r.Context().Done():
+			atomic.AddInt32(&exporter.dropped, 1)
+		}
+	}))
+	t.Cleanup(func() {
+		server.CloseClientConnections()
+		server.Close()
+	})
+	return exporter, server.URL
+}
+
+// Wait until the exporter got n fetches
+func (exporter *slowExporter) waitForFetches(t *testing.T, n int32) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&exporter.fetches) < n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf(`the exporter got %d fetches, expected %d`, atomic.LoadInt32(&exporter.fetches), n)
+		}
+	}
+}
+
+// Wait until n requests wait for the running scrapes
+func waitForSharers(t *testing.T, scrapeTarget *ScrapeTarget, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		scrapeTarget.sharedMutex.Lock()
+		waiting := 0
+		for _, running := range scrapeTarget.shared {
+			waiting += running.waiting
+		}
+		scrapeTarget.sharedMutex.Unlock()
+		if waiting >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf(`%d requests wait for the scrape, expected %d`, waiting, n)
+		}
+	}
+}
+
+func TestSharedScrapesOutliveTheRequestThatStartedThem(t *testing.T) {
+	exporter, upstream := newSlowExporter(t)
+	scrapeTarget := newFakeClockProxy(t, newFakeClock(), Config{StartLive: true}, upstream).targets[`node`]
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, err := scrapeTarget.sharedScrape(leaderCtx, upstreamRequest{})
+		leader <- err
+	}()
+	exporter.waitForFetches(t, 1)
+	follower := make(chan *ScrapeResult, 1)
+	go func() {
+		result, err := scrapeTarget.sharedScrape(context.Background(), upstreamRequest{})
+		if err != nil {
+			t.Error(err)
+		}
+		follower <- result
+	}()
+	// Let the follower join before the leader gives up
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		scrapeTarget.sharedMutex.Lock()
+		waiting := scrapeTarget.shared[upstreamRequest{}.key()].waiting
+		scrapeTarget.sharedMutex.Unlock()
+		if waiting == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(`the follower didn't join the scrape`)
+		}
+	}
+
+	cancelLeader()
+	if err := <-leader; !errors.Is(err, ErrScrapeTimedOut) {
+		t.Errorf(`the leader gave up with %v`, err)
+	}
+	close(exporter.release)
+	if result := <-follower; result == nil || result.Forwarded != 1 {
+		t.Errorf(`the follower got %+v`, result)
+	}
+	if fetches, dropped := atomic.LoadInt32(&exporter.fetches), atomic.LoadInt32(&exporter.dropped); fetches != 1 || dropped != 0 {
+		t.Errorf(`%d fetches, %d dropped, expected one that went through`, fetches, dropped)
+	}
+}
+
+func TestSharedScrapesAreCanceledWhenNobodyWaits(t *testing.T) {
+	exporter, upstream := newSlowExporter(t)
+	scrapeTarget := newFakeClockProxy(t, newFakeClock(), Config{}, upstream).targets[`node`]
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := scrapeTarget.sharedScrape(ctx, upstreamRequest{}); !errors.Is(err, ErrScrapeTimedOut) {
+		t.Fatalf(`a scrape of a hanging exporter returned %v`, err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&exporter.dropped) < 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal(`the fetch went on after every request gave up`)
+		}
+	}
+
+	// The next request starts a scrape of its own
+	close(exporter.release)
+	if _, err := scrapeTarget.sharedScrape(context.Background(), upstreamRequest{}); err != nil {
+		t.Error(err)
+	}
+	if fetches := atomic.LoadInt32(&exporter.fetches); fetches != 2 {
+		t.Errorf(`%d fetches, expected 2`, fetches)
+	}
+}
+
+// Meant for -race: many scrape requests at once, all answered from a few
+// upstream fetches
+func TestConcurrentScrapeRequestsShareFetches(t *testing.T) {
+	exporter, upstream := newSlowExporter(t)
+	p := newFakeClockProxy(t, newFakeClock(), Config{StartLive: true}, upstream)
+
+	const requests = 50
+	var wg sync.WaitGroup
+	codes := make([]int, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = serveNode(p).Code
+		}(i)
+	}
+	exporter.waitForFetches(t, 1)
+	waitForSharers(t, p.targets[`node`], requests)
+	close(exporter.release)
+	wg.Wait()
+
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf(`request %d answered %d`, i, code)
+		}
+	}
+	if fetches := atomic.LoadInt32(&exporter.fetches); fetches >= requests {
+		t.Errorf(`%d requests made %d upstream fetches`, requests, fetches)
+	}
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pdxiv/frugalpromproxy/staleness"
+)
+
+// The types of the staleness package, under the names the proxy API has
+// always had
+type (
+	// SeriesKey identifies a series within a target
+	SeriesKey = staleness.SeriesKey
+	// Sample is the value of a series in one scrape
+	Sample = staleness.Sample
+	// Decision tells whether a series is passed on
+	Decision = staleness.Decision
+	// StalenessPolicy decides for every series of every scrape whether it
+	// is passed on, see staleness.Policy
+	StalenessPolicy = staleness.Policy
+	// StalenessPolicyFactory creates a policy for a target, from the
+	// parameters given on the command line
+	StalenessPolicyFactory = staleness.Factory
+	// SeriesState is what the unchanged policy remembers about a series
+	SeriesState = staleness.SeriesState
+	// StateStore keeps the state of the series of all targets using it
+	StateStore = staleness.StateStore
+)
+
+const (
+	Forward  = staleness.Forward  // Pass the series on
+	Suppress = staleness.Suppress // Leave the series out
+)
+
+// RegisterStalenessPolicy makes a policy selectable by name with
+// -staleness-policy. Registering a name again replaces the factory.
+func RegisterStalenessPolicy(name string, factory StalenessPolicyFactory) {
+	staleness.Register(name, factory)
+}
+
+// Rules of -staleness-policy
+var stalenessPolicyRules staleness.Rules
+
+// The policies of a target, keeping their state in -state-bolt-file or in
+// the file of -state-dir when the target has one
+func newStalenessPolicies(name string, rules staleness.Rules, defaults staleness.Defaults) *staleness.Policies {
+	var store StateStore
+	if bolt := boltStateFor(name); bolt != nil {
+		store = bolt
+	} else if file := stateFileFor(name); file != nil {
+		store = file.store
+	}
+	return staleness.New(name, rules, defaults, store)
+}
+
+// Comma separated target=scrapes pairs, overriding -stale-threshold
+type targetThresholds map[string]int64
+
+var targetStaleThresholds = targetThresholds{}
+
+func (thresholds targetThresholds) String() string {
+	var pairs []string
+	for name, threshold := range thresholds {
+		pairs = append(pairs, name+`=`+strconv.FormatInt(threshold, 10))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, `,`)
+}
+
+func (thresholds targetThresholds) Set(value string) error {
+	pairs, err := parseNameValuePairs(value)
+	if err != nil {
+		return err
+	}
+	for name, threshold := range pairs {
+		if thresholds[name], err = strconv.ParseInt(threshold, 10, 64); err != nil {
+			return fmt.Errorf(`stale threshold of %s: %w`, name, err)
+		}
+	}
+	return nil
+}
+
+// Comma separated target=bool pairs, overriding -start-stale
+type targetBools map[string]bool
+
+var targetStartStale = targetBools{}
+
+func (bools targetBools) String() string {
+	var pairs []string
+	for name, value := range bools {
+		pairs = append(pairs, name+`=`+strconv.FormatBool(value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, `,`)
+}
+
+func (bools targetBools) Set(value string) error {
+	pairs, err := parseNameValuePairs(value)
+	if err != nil {
+		return err
+	}
+	for name, boolean := range pairs {
+		if bools[name], err = strconv.ParseBool(boolean); err != nil {
+			return fmt.Errorf(`%s=%s: %w`, name, boolean, err)
+		}
+	}
+	return nil
+}
+
+// Pass counters on even when unchanged, so rate() never sees a gap.
+// -target-never-suppress-counters overrides it for single targets.
+var (
+	neverSuppressCounters       bool
+	targetNeverSuppressCounters = targetBools{}
+)
+
+// Scrapes a counter that changed after it was suppressed is passed on for
+// beyond the threshold
+var counterWarmUp int64
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Suppresses every series whose value is below zero
+type negativePolicy struct{}
+
+func (negativePolicy) Observe(series SeriesKey, sample Sample, now time.Time) Decision {
+	if sample.Value < 0 {
+		return Suppress
+	}
+	return Forward
+}
+
+func (negativePolicy) Close() {}
+
+func TestTheHandlerAppliesRegisteredPolicies(t *testing.T) {
+	RegisterStalenessPolicy(`negative`, func(params map[string]string) (StalenessPolicy, error) {
+		return negativePolicy{}, nil
+	})
+	useCommandLineSettings(t)
+	commandLine.staleness.Threshold, commandLine.staleness.StartStale = 1, false
+	for _, rule := range []string{`temperature_*=negative`, `up=never`} {
+		if err := commandLine.stalenessRules.Set(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exporter, upstream := newFakeExporter(t, "temperature_celsius{room=\"a\"} -3\ntemperature_celsius{room=\"b\"} 21\nup 1\nnode_load1 0.5\n")
+	scrapeTarget := newScrapeTarget(`sensors`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+
+	if _, served := servedSeries(scrapeTarget); served != "node_load1 0.5\ntemperature_celsius{room=\"b\"} 21\nup 1" {
+		t.Errorf("first scrape served\n%s", served)
+	}
+	exporter.serve("temperature_celsius{room=\"a\"} 2\ntemperature_celsius{room=\"b\"} 21\nup 1\nnode_load1 0.5\n")
+	servedSeries(scrapeTarget)
+	// node_load1 unchanged is suppressed, up is never
+	if _, served := servedSeries(scrapeTarget); served != "temperature_celsius{room=\"a\"} 2\ntemperature_celsius{room=\"b\"} 21\nup 1" {
+		t.Errorf("third scrape served\n%s", served)
+	}
+}
+
+// Forwarded (F) or suppressed (S) on each scrape of the target
+func forwardedPattern(t *testing.T, p *Proxy, target, series string, scrapes int) string {
+	t.Helper()
+	var pattern string
+	for i := 0; i < scrapes; i++ {
+		result, err := p.Scrape(context.Background(), target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if forwarded(result, series) {
+			pattern += `F`
+		} else {
+			pattern += `S`
+		}
+	}
+	return pattern
+}
+
+func TestTargetsHaveTheirOwnThresholdAndStart(t *testing.T) {
+	node, nodeURL := newFakeExporter(t, "node_load1 0.5\n")
+	_, debugURL := newFakeExporter(t, "app_queue 3\n")
+	idle, idleURL := newFakeExporter(t, "idle_jobs 0\n")
+	p, err := New(Config{StaleThreshold: 100, Targets: []Target{
+		{Name: `node`, Upstreams: []string{nodeURL}, StaleThreshold: 3, StartLive: true},
+		{Name: `debug`, Upstreams: []string{debugURL}, StaleThreshold: -1, StartLive: true},
+		{Name: `idle`, Upstreams: []string{idleURL}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, scrapeTarget := range p.targets {
+			scrapeTarget.close()
+		}
+	})
+
+	// Gone after exactly 3+1 unchanged scrapes, back as soon as it changes
+	if pattern := forwardedPattern(t, p, `node`, `node_load1`, 6); pattern != `FFFFSS` {
+		t.Errorf(`with a threshold of 3 node_load1 was %s`, pattern)
+	}
+	node.serve("node_load1 0.6\n")
+	if pattern := forwardedPattern(t, p, `node`, `node_load1`, 1); pattern != `F` {
+		t.Errorf(`after changing node_load1 was %s`, pattern)
+	}
+
+	if pattern := forwardedPattern(t, p, `debug`, `app_queue`, 10); pattern != `FFFFFFFFFF` {
+		t.Errorf(`without a threshold app_queue was %s`, pattern)
+	}
+
+	// Starting stale, with the threshold of the config
+	if pattern := forwardedPattern(t, p, `idle`, `idle_jobs`, 3); pattern != `SSS` {
+		t.Errorf(`starting stale idle_jobs was %s`, pattern)
+	}
+	idle.serve("idle_jobs 1\n")
+	if pattern := forwardedPattern(t, p, `idle`, `idle_jobs`, 3); pattern != `FFF` {
+		t.Errorf(`after changing idle_jobs was %s`, pattern)
+	}
+}
+
+func TestReorderedLabelsAreTheSameSeries(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.Threshold, commandLine.staleness.StartStale = 2, false
+	exporter, upstream := newFakeExporter(t, ``)
+	scrapeTarget := newScrapeTarget(`node`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+
+	var pattern string
+	for i, order := range []string{`a="1",b="2",c="3"`, `c="3",a="1",b="2"`, `b="2",c="3",a="1"`, `c="3",b="2",a="1"`} {
+		exporter.serve(`shuffled{` + order + "} 1\n")
+		switch _, served := servedSeries(scrapeTarget); served {
+		case `shuffled{a="1",b="2",c="3"} 1`:
+			pattern += `F`
+		case ``:
+			pattern += `S`
+		default:
+			t.Errorf("scrape %d served\n%s", i+1, served)
+		}
+	}
+	if pattern != `FFFS` {
+		t.Errorf(`forwarded %s`, pattern)
+	}
+	if statuses := nodeSeries(t, scrapeTarget, ``); len(statuses) != 1 || statuses[0].Unchanged != 3 {
+		t.Errorf(`tracked %+v`, statuses)
+	}
+}
+
+func TestCountersOfSomeTargetsAreNeverSuppressed(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.Threshold, commandLine.staleness.StartStale, commandLine.staleness.SuppressCounters = 1, false, true
+	commandLine.targetNeverSuppressCounters = targetBools{}
+	if err := commandLine.targetNeverSuppressCounters.Set(`app=true`); err != nil {
+		t.Fatal(err)
+	}
+	const exposition = "# TYPE requests_total counter\nrequests_total 7\n# TYPE temperature gauge\ntemperature 21\n"
+	for target, expected := range map[string]string{`node`: ``, `app`: `requests_total 7`} {
+		_, upstream := newFakeExporter(t, exposition)
+		scrapeTarget := newScrapeTarget(target, []string{upstream}, commandLine)
+		var served string
+		for i := 0; i < 3; i++ {
+			_, served = servedSeries(scrapeTarget)
+		}
+		scrapeTarget.close()
+		if served != expected {
+			t.Errorf("%s served\n%s", target, served)
+		}
+	}
+}
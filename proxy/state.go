@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"path"
+
+	"github.com/pdxiv/frugalpromproxy/staleness"
+)
+
+// The bbolt store and the targets using it, when -state-bolt-file is set
+var boltState struct {
+	store   *staleness.BoltStore
+	targets []string // path.Match patterns of target names
+}
+
+// The shared bbolt store if the target uses it, nil otherwise
+func boltStateFor(target string) StateStore {
+	if boltState.store == nil {
+		return nil
+	}
+	for _, pattern := range boltState.targets {
+		if matched, _ := path.Match(pattern, target); matched {
+			return boltState.store
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pdxiv/frugalpromproxy/staleness"
+)
+
+// Keep the series state of every target not in -state-bolt-file in memory
+// as usual, and in a file of its own in stateDir too. The file is written
+// every stateSaveEvery scrapes and on shutdown, and read when the target is
+// created, so a restart doesn't start the unchanged counters from scratch.
+var (
+	stateDir       string
+	stateSaveEvery int
+)
+
+// A state file of another version is ignored
+const stateFileVersion = 1
+
+// The first line of a state file, followed by a staleness.SnapshotRecord
+// per series
+type stateFileHeader struct {
+	Version int    `json:"version"`
+	Target  string `json:"target"`
+}
+
+// The state of a target and the file it is saved to
+type stateFile struct {
+	target string
+	path   string
+	store  *staleness.MemoryStore
+
+	mu      sync.Mutex // Held while saving, so saves don't overtake each other
+	scrapes int        // Since the last save
+}
+
+var stateFiles struct {
+	mu    sync.Mutex
+	files map[string]*stateFile
+}
+
+// The state file of a target, read when it is first asked for. Nil without
+// -state-dir and for the targets in -state-bolt-file.
+func stateFileFor(target string) *stateFile {
+	if stateDir == `` || boltStateFor(target) != nil {
+		return nil
+	}
+	stateFiles.mu.Lock()
+	defer stateFiles.mu.Unlock()
+	if file, ok := stateFiles.files[target]; ok {
+		return file
+	}
+	if stateFiles.files == nil {
+		stateFiles.files = make(map[string]*stateFile)
+	}
+	file := &stateFile{target: target, path: filepath.Join(stateDir, url.PathEscape(target)+`.state`), store: staleness.NewMemoryStore()}
+	file.load()
+	stateFiles.files[target] = file
+	return file
+}
+
+// Read the saved state. A file that is corrupt or of another version is
+// logged and ignored, the target then starts from scratch.
+func (file *stateFile) load() {
+	f, err := os.Open(file.path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("%s: ignoring the state file: %v", file.target, err)
+		return
+	}
+	defer f.Close()
+	states, err := readStateFile(f)
+	if err != nil {
+		log.Printf("%s: ignoring the state file %s: %v", file.target, file.path, err)
+		return
+	}
+	file.store.Put(file.target, states)
+	log.Printf("%s: restored the state of %d series from %s", file.target, len(states), file.path)
+}
+
+func readStateFile(r io.Reader) (map[SeriesKey]SeriesState, error) {
+	decoder := json.NewDecoder(r)
+	var header stateFileHeader
+	if err := decoder.Decode(&header); err != nil {
+		return nil, err
+	}
+	if header.Version != stateFileVersion {
+		return nil, fmt.Errorf(`version %d, expected %d`, header.Version, stateFileVersion)
+	}
+	states := make(map[SeriesKey]SeriesState)
+	for {
+		var record staleness.SnapshotRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return states, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if record.Name == `` {
+			return nil, fmt.Errorf(`series without a name after %d series`, len(states))
+		}
+		states[SeriesKey{Name: record.Name, Labels: record.Labels}] = record.SeriesState
+	}
+}
+
+// Count a scrape, saving the state every stateSaveEvery of them
+func (file *stateFile) scraped() {
+	file.mu.Lock()
+	file.scrapes++
+	due := file.scrapes >= stateSaveEvery
+	file.mu.Unlock()
+	if due {
+		file.save()
+	}
+}
+
+// Write the state to a temporary file renamed over the old one, so a crash
+// halfway leaves the last complete save behind
+func (file *stateFile) save() {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	var content bytes.Buffer
+	json.NewEncoder(&content).Encode(stateFileHeader{Version: stateFileVersion, Target: file.target})
+	if err := file.store.Snapshot(&content); err != nil {
+		log.Printf("%s: saving the state file: %v", file.target, err)
+		return
+	}
+	if err := writeFileAtomically(file.path, content.Bytes()); err != nil {
+		log.Printf("%s: saving the state file: %v", file.target, err)
+		return
+	}
+	file.scrapes = 0
+}
+
+// Save the state of every target, on shutdown
+func saveStateFiles() {
+	stateFiles.mu.Lock()
+	files := make([]*stateFile, 0, len(stateFiles.files))
+	for _, file := range stateFiles.files {
+		files = append(files, file)
+	}
+	stateFiles.mu.Unlock()
+	for _, file := range files {
+		file.save()
+	}
+}
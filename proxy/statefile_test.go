@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Keep the state of the targets in a directory of the test, saved every
+// scrapes
+func useStateDir(t *testing.T, every int) string {
+	previousDir, previousEvery := stateDir, stateSaveEvery
+	stateDir, stateSaveEvery = t.TempDir(), every
+	restart()
+	t.Cleanup(func() {
+		stateDir, stateSaveEvery = previousDir, previousEvery
+		restart()
+	})
+	return stateDir
+}
+
+// Forget the state files read, like a new process would
+func restart() {
+	stateFiles.mu.Lock()
+	stateFiles.files = nil
+	stateFiles.mu.Unlock()
+}
+
+func TestTheStateSurvivesARestart(t *testing.T) {
+	useStateDir(t, 1)
+	useCommandLineSettings(t)
+	commandLine.staleness.Threshold = 3
+	exporter, upstream := newFakeExporter(t, ``)
+	scrapeTarget := newScrapeTarget(`node`, []string{upstream}, commandLine)
+	for i := 0; i < 5; i++ {
+		exporter.serve("node_boot_time_seconds 1622548800\nnode_time_seconds " + strconv.Itoa(i) + "\n")
+		servedSeries(scrapeTarget)
+	}
+	scrapeTarget.close()
+
+	// Started stale or live, the unchanged series stays suppressed and the
+	// changing one stays live
+	for _, startStale := range []bool{true, false} {
+		restart()
+		commandLine.staleness.StartStale = startStale
+		scrapeTarget := newScrapeTarget(`node`, []string{upstream}, commandLine)
+		if _, served := servedSeries(scrapeTarget); served != `node_time_seconds 4` {
+			t.Errorf("started stale %t, served\n%s", startStale, served)
+		}
+		scrapeTarget.close()
+	}
+}
+
+func TestNaNAndInfiniteValuesSurviveARestart(t *testing.T) {
+	dir := useStateDir(t, 1)
+	useCommandLineSettings(t)
+	commandLine.staleness.Threshold = 3
+	commandLine.staleness.StartStale = false
+	_, upstream := newFakeExporter(t, "app_ratio NaN\napp_max +Inf\napp_min -Inf\n")
+	scrapeTarget := newScrapeTarget(`app`, []string{upstream}, commandLine)
+	for i := 0; i < 5; i++ {
+		servedSeries(scrapeTarget)
+	}
+	scrapeTarget.close()
+
+	f, err := os.Open(filepath.Join(dir, `app.state`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	states, err := readStateFile(f)
+	f.Close()
+	if err != nil || len(states) != 3 || !math.IsNaN(float64(states[SeriesKey{Name: `app_ratio`}].Value)) ||
+		!math.IsInf(float64(states[SeriesKey{Name: `app_max`}].Value), 1) || !math.IsInf(float64(states[SeriesKey{Name: `app_min`}].Value), -1) {
+		t.Fatalf(`read back %+v, %v`, states, err)
+	}
+
+	// The infinite series stay suppressed, NaN never equals itself
+	restart()
+	scrapeTarget = newScrapeTarget(`app`, []string{upstream}, commandLine)
+	defer scrapeTarget.close()
+	if _, served := servedSeries(scrapeTarget); served != `app_ratio NaN` {
+		t.Errorf("after the restart served\n%s", served)
+	}
+}
+
+func TestTheStateIsSavedEveryFewScrapes(t *testing.T) {
+	dir := useStateDir(t, 3)
+	useCommandLineSettings(t)
+	_, upstream := newFakeExporter(t, "node_load1 0.5\n")
+	scrapeTarget := newScrapeTarget(`localhost:9100`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+	path := filepath.Join(dir, `localhost:9100.state`)
+
+	servedSeries(scrapeTarget)
+	servedSeries(scrapeTarget)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf(`saved after two scrapes: %v`, err)
+	}
+	servedSeries(scrapeTarget)
+	content, err := ioutil.ReadFile(path)
+	if err != nil || !strings.HasPrefix(string(content), `{"version":1,"target":"localhost:9100"}`) || !strings.Contains(string(content), `node_load1`) {
+		t.Errorf("after three scrapes %v\n%s", err, content)
+	}
+	// Nothing is left of the temporary file
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf(`%d files in the state directory`, len(files))
+	}
+}
+
+func TestBrokenStateFilesAreIgnored(t *testing.T) {
+	for _, content := range []string{
+		`not json`,
+		`{"version":2,"target":"node"}` + "\n" + `{"name":"node_load1","value":0.5,"unchanged":300}` + "\n",
+		`{"version":1,"target":"node"}` + "\n" + `{"value":0.5}` + "\n",
+		`{"version":1,"target":"node"}` + "\n" + `{"name":"node_load1","val`,
+	} {
+		logged := captureLog(t)
+		dir := useStateDir(t, 1)
+		useCommandLineSettings(t)
+		commandLine.staleness.StartStale = false
+		if err := ioutil.WriteFile(filepath.Join(dir, `node.state`), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, upstream := newFakeExporter(t, "node_load1 0.5\n")
+		scrapeTarget := newScrapeTarget(`node`, []string{upstream}, commandLine)
+		if _, served := servedSeries(scrapeTarget); served != `node_load1 0.5` || !strings.Contains(logged.String(), `node: ignoring the state file`) {
+			t.Errorf("with %q served\n%s\nlogged %s", content, served, logged)
+		}
+		scrapeTarget.close()
+	}
+}
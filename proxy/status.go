@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Path on every listener listing the state of all proxied targets
+const targetsPath = `/api/v1/targets`
+
+// Path on every listener answering whether the proxy is up
+const healthyPath = `/-/healthy`
+
+// The targets of the command line, served by the status API and pushed
+var targets = &targetRegistry{}
+
+// The running targets created with one set of settings. An embedded Proxy
+// has a registry of its own, so its targets don't show up in the status API
+// of the command line and may have the same names as the ones there.
+type targetRegistry struct {
+	mu   sync.Mutex
+	list []*ScrapeTarget
+}
+
+type targetStatus struct {
+	Name       string     `json:"name"`
+	Upstream   string     `json:"upstream"` // The one currently scraped
+	Upstreams  []string   `json:"upstreams"`
+	UpstreamIP string     `json:"upstream_ip,omitempty"`
+	NextScrape *time.Time `json:"next_scrape,omitempty"`
+	Protocol   string     `json:"protocol,omitempty"` // Of the last upstream response
+	HostHeader string     `json:"host_header,omitempty"`
+	ServerName string     `json:"server_name,omitempty"`
+}
+
+func (registry *targetRegistry) register(scrapeTarget *ScrapeTarget) {
+	registry.mu.Lock()
+	registry.list = append(registry.list, scrapeTarget)
+	registry.mu.Unlock()
+}
+
+func (registry *targetRegistry) unregister(scrapeTarget *ScrapeTarget) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	for i, registered := range registry.list {
+		if registered == scrapeTarget {
+			registry.list = append(registry.list[:i], registry.list[i+1:]...)
+			return
+		}
+	}
+}
+
+// Snapshot of the registered targets
+func (registry *targetRegistry) all() []*ScrapeTarget {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	return append([]*ScrapeTarget(nil), registry.list...)
+}
+
+// The last registered target with the name, or nil
+func (registry *targetRegistry) named(name string) *ScrapeTarget {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	var found *ScrapeTarget
+	for _, registered := range registry.list {
+		if registered.name == name {
+			found = registered
+		}
+	}
+	return found
+}
+
+func (scrapeTarget *ScrapeTarget) status() targetStatus {
+	status := targetStatus{
+		Name:       scrapeTarget.name,
+		Upstream:   scrapeTarget.upstreams.activeURL(),
+		Upstreams:  scrapeTarget.upstreams.urls,
+		UpstreamIP: scrapeTarget.resolver.currentAddress(),
+		HostHeader: scrapeTarget.hostHeader,
+		ServerName: scrapeTarget.serverName,
+	}
+	scrapeTarget.protocolMutex.Lock()
+	status.Protocol = scrapeTarget.protocol
+	scrapeTarget.protocolMutex.Unlock()
+	if scrapeTarget.schedule != nil {
+		next := scrapeTarget.schedule.nextScrape()
+		status.NextScrape = &next
+	}
+	return status
+}
+
+func targetsHandler(w http.ResponseWriter, r *http.Request) {
+	registered := targets.all()
+	statuses := make([]targetStatus, len(registered))
+	for i, scrapeTarget := range registered {
+		statuses[i] = scrapeTarget.status()
+	}
+
+	w.Header().Set(`Content-Type`, `application/json`)
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// Endpoints of a single target, under targetsPath/<name>
+var targetEndpoints = map[string]func(w http.ResponseWriter, r *http.Request, scrapeTarget *ScrapeTarget){
+	thresholdsSuffix: thresholdsHandler,
+	seriesSuffix:     seriesHandler,
+}
+
+// GET /api/v1/targets/<name>/<endpoint>
+func targetHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, targetsPath+`/`)
+	slash := strings.LastIndex(rest, `/`)
+	if slash < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	name, endpoint := rest[:slash], targetEndpoints[rest[slash:]]
+	if endpoint == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	scrapeTarget := targets.named(name)
+	if scrapeTarget == nil {
+		http.Error(w, `unknown target `+name, http.StatusNotFound)
+		return
+	}
+	endpoint(w, r, scrapeTarget)
+}
+
+func healthyHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, `Healthy`)
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Put in front of the HELP of every family served under <path>/suppressed,
+// so nobody mistakes them for live series
+const suppressedHelp = `SUPPRESSED SERIES, withheld from the main endpoint and shown for auditing only. `
+
+// Serve the series withheld from the last scrape next to every route
+var serveSuppressed bool
+
+// A series line, with the timestamp unless it is 0
+func seriesLine(name, label string, value float64, timestamp int64) string {
+	// Room for the braces, the separator, the newline and most values
+	line := make([]byte, 0, len(name)+len(label)+28)
+	line = append(line, name...)
+	if label != `` {
+		line = append(line, '{')
+		line = append(line, label...)
+		line = append(line, '}')
+	}
+	line = append(line, ' ')
+	line = strconv.AppendFloat(line, value, 'g', -1, 64)
+	if timestamp != 0 {
+		line = append(line, ' ')
+		line = strconv.AppendInt(line, timestamp, 10)
+	}
+	return string(append(line, '\n'))
+}
+
+func (scrapeTarget *ScrapeTarget) setSuppressed(families []outputFamily) {
+	scrapeTarget.suppressedMutex.Lock()
+	scrapeTarget.suppressed = families
+	scrapeTarget.suppressedMutex.Unlock()
+}
+
+// The series withheld from the most recent scrape, with their stored values
+func (scrapeTarget *ScrapeTarget) suppressedHandler(w http.ResponseWriter, r *http.Request) {
+	scrapeTarget.suppressedMutex.Lock()
+	families := scrapeTarget.suppressed
+	scrapeTarget.suppressedMutex.Unlock()
+	writeFamilies(w, r, families, scrapeTarget.now())
+}
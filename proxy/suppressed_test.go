@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// The series lines of an exposition, sorted
+func seriesLines(body string) []string {
+	var lines []string
+	for _, line := range strings.Split(body, "\n") {
+		if line != `` && !strings.HasPrefix(line, `#`) {
+			lines = append(lines, line)
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func TestSuppressedSeriesAreTheComplementOfTheServedOnes(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.Threshold, commandLine.staleness.StartStale = 1, false
+	defer func(serve bool) { serveSuppressed = serve }(serveSuppressed)
+	serveSuppressed = true
+	exporter, upstream := newFakeExporter(t, "# HELP idle Idle.\n# TYPE idle gauge\nidle 1\nidle{disk=\"a\"} 2\nbusy 1\n")
+	scrapeTarget := newScrapeTarget(`node`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+	serve := func(handler http.HandlerFunc) string {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+		return recorder.Body.String()
+	}
+
+	serve(scrapeTarget.handler)
+	exporter.serve("# HELP idle Idle.\n# TYPE idle gauge\nidle 1\nidle{disk=\"a\"} 2\nbusy 2\n")
+	serve(scrapeTarget.handler)
+	exporter.serve("# HELP idle Idle.\n# TYPE idle gauge\nidle 1\nidle{disk=\"a\"} 2\nbusy 3\n")
+	served := serve(scrapeTarget.handler)
+	suppressed := serve(scrapeTarget.suppressedHandler)
+
+	if got := strings.Join(seriesLines(served), ` `); got != `busy 3` {
+		t.Errorf(`served %s`, got)
+	}
+	if got := strings.Join(seriesLines(suppressed), ` `); got != `idle{disk="a",frugalpromproxy_rule="staleness:*=unchanged"} 2 idle{frugalpromproxy_rule="staleness:*=unchanged"} 1` {
+		t.Errorf(`listed as suppressed %s`, got)
+	}
+	if !strings.Contains(suppressed, `# HELP idle `+suppressedHelp+`Idle.`) {
+		t.Errorf(`the suppressed families aren't marked: %s`, suppressed)
+	}
+}
+
+func TestSeriesLinesLeaveOutZeroTimestamps(t *testing.T) {
+	if line := seriesLine(`up`, ``, 1, 0); line != "up 1\n" {
+		t.Errorf(`line %q`, line)
+	}
+	if line := seriesLine(`up`, `job="node"`, 0.5, 1622548800000); line != "up{job=\"node\"} 0.5 1622548800000\n" {
+		t.Errorf(`line %q`, line)
+	}
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"sort"
+	"strings"
+)
+
+const targetInfoName = `target_info`
+
+// Add a target_info series to every target, and take labels from the
+// upstream's *_build_info series into it
+var (
+	emitTargetInfo  bool
+	targetInfoBuild bool
+)
+
+// A target_info{...} 1 series describing the target, for backends joining
+// on resource attributes. It is made up on every scrape, so it follows
+// changes of the labels and never goes through the staleness filter.
+func (scrapeTarget *ScrapeTarget) targetInfo(data map[string]MetricData, staticLabels string) outputFamily {
+	label := withStaticLabels(`target="`+escapeLabelValue(scrapeTarget.name)+`"`, staticLabels)
+	if targetInfoBuild {
+		label = withStaticLabels(label, buildInfoLabels(data))
+	}
+	return outputFamily{
+		name:       targetInfoName,
+		help:       `Target metadata added by frugalpromproxy.`,
+		metricType: gauge,
+		lines:      []string{seriesLine(targetInfoName, label, 1, 0)},
+	}
+}
+
+// The labels of the upstream's build info, like version and revision. With
+// more than one build info family or series the first one by name is used.
+func buildInfoLabels(data map[string]MetricData) string {
+	var names []string
+	for name := range data {
+		if strings.HasSuffix(name, `_build_info`) && len(data[name].label) > 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return ``
+	}
+	sort.Strings(names)
+	labels := make([]string, 0, len(data[names[0]].label))
+	for label := range data[names[0]].label {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels[0]
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func useTargetInfo(t *testing.T, build bool) {
+	previous, previousBuild := emitTargetInfo, targetInfoBuild
+	emitTargetInfo, targetInfoBuild = true, build
+	t.Cleanup(func() { emitTargetInfo, targetInfoBuild = previous, previousBuild })
+}
+
+func targetInfoLine(t *testing.T, scrapeTarget *ScrapeTarget) string {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	scrapeTarget.handler(recorder, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+	for _, line := range seriesLines(recorder.Body.String()) {
+		if strings.HasPrefix(line, targetInfoName+`{`) {
+			return line
+		}
+	}
+	return ``
+}
+
+func TestTargetInfoIsNeverSuppressed(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.Threshold, commandLine.staleness.StartStale = 1, true
+	useTargetInfo(t, false)
+	_, upstream := newFakeExporter(t, "up 1\n")
+	scrapeTarget := newScrapeTarget(`localhost:9100`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+
+	for i := 0; i < 4; i++ {
+		if line := targetInfoLine(t, scrapeTarget); line != `target_info{target="localhost:9100"} 1` {
+			t.Fatalf(`scrape %d served target_info as %q`, i+1, line)
+		}
+	}
+
+	scrapeTarget.setStaticLabels(map[string]string{`site`: `oslo`})
+	if line := targetInfoLine(t, scrapeTarget); line != `target_info{target="localhost:9100",site="oslo"} 1` {
+		t.Errorf(`after the static labels changed target_info was %q`, line)
+	}
+}
+
+func TestTargetInfoTakesTheBuildInfo(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.StartStale = false
+	useTargetInfo(t, true)
+	_, upstream := newFakeExporter(t, "# TYPE node_exporter_build_info gauge\nnode_exporter_build_info{branch=\"HEAD\",goversion=\"go1.16\",version=\"1.1.2\"} 1\nup 1\n")
+	scrapeTarget := newScrapeTarget(`localhost:9100`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+	if line := targetInfoLine(t, scrapeTarget); line != `target_info{target="localhost:9100",branch="HEAD",goversion="go1.16",version="1.1.2"} 1` {
+		t.Errorf(`target_info was %q`, line)
+	}
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func useTenant(t *testing.T, name string, required bool) {
+	previous, header, require, label := tenant, tenantHeader, requireTenant, tenantLabel
+	tenant, tenantHeader, requireTenant, tenantLabel = name, `X-Scope-OrgID`, required, ``
+	t.Cleanup(func() { tenant, tenantHeader, requireTenant, tenantLabel = previous, header, require, label })
+}
+
+func TestPushedRequestsCarryTheTenant(t *testing.T) {
+	useCommandLineSettings(t)
+	useTenant(t, `site-oslo`, false)
+	collector, endpoint := newFakeCollector(t)
+	exporter := &otlpExporter{endpoint: endpoint, interval: time.Minute, client: http.DefaultClient}
+	if err := exporter.export(newPushedTarget(t, `node`, "up 1\n")); err != nil {
+		t.Fatal(err)
+	}
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	if got := collector.headers[0].Get(`X-Scope-OrgID`); got != `site-oslo` {
+		t.Errorf(`pushed with tenant %q`, got)
+	}
+}
+
+func TestScrapesForAnotherTenantAreRejected(t *testing.T) {
+	useTenant(t, `site-oslo`, true)
+	handler := tenantChecked(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	answer := func(path, requested string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if requested != `` {
+			r.Header.Set(`X-Scope-OrgID`, requested)
+		}
+		handler.ServeHTTP(recorder, r)
+		return recorder
+	}
+
+	if code := answer(`/metrics`, ``).Code; code != http.StatusBadRequest {
+		t.Errorf(`a scrape without a tenant answered %d`, code)
+	}
+	if code := answer(`/metrics`, `site-bergen`).Code; code != http.StatusForbidden {
+		t.Errorf(`a scrape for another tenant answered %d`, code)
+	}
+	if recorder := answer(`/metrics`, `site-oslo`); recorder.Code != http.StatusOK || recorder.Header().Get(`X-Scope-OrgID`) != `site-oslo` {
+		t.Errorf(`a scrape for the tenant answered %d, echoing %q`, recorder.Code, recorder.Header().Get(`X-Scope-OrgID`))
+	}
+	if code := answer(healthyPath, ``).Code; code != http.StatusOK {
+		t.Errorf(`a health check without a tenant answered %d`, code)
+	}
+}
+
+func TestTenantLabelIsOptional(t *testing.T) {
+	useTenant(t, `site "oslo"`, false)
+	if labels := tenantLabels(); labels != `` {
+		t.Errorf(`without a label name the tenant became %s`, labels)
+	}
+	tenantLabel = `tenant`
+	if labels := tenantLabels(); labels != `tenant="site \"oslo\""` {
+		t.Errorf(`the tenant label became %s`, labels)
+	}
+}
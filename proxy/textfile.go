@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var textfileWrites = selfMetrics.newCounterVec(`frugalpromproxy_textfile_writes_total`, `Writes of a target's textfile, by outcome: success, failed or removed (after failing for too long).`, `target`, `outcome`)
+
+// Periodically writes the filtered output of every target to
+// <directory>/<target>.prom for node_exporter's textfile collector. Files
+// are written under a temporary name and renamed, so readers never see a
+// partial file. When a target can't be scraped for longer than maxAge its
+// file is removed, rather than serving old values as if they were current.
+type textfileWriter struct {
+	directory   string
+	interval    time.Duration
+	maxAge      time.Duration
+	lastWritten map[string]time.Time
+}
+
+func (writer *textfileWriter) run() {
+	writer.lastWritten = make(map[string]time.Time)
+	ticker := clock.NewTicker(writer.interval)
+	defer ticker.Stop()
+	for range ticker.C() {
+		for _, scrapeTarget := range targets.all() {
+			writer.write(scrapeTarget)
+		}
+	}
+}
+
+// Anything but letters, digits, dots, dashes and underscores becomes an
+// underscore, so every target name makes a plain file name
+func textfileName(target string) string {
+	name := []byte(target)
+	for i, c := range name {
+		if !(c == '.' || c == '-' || c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			name[i] = '_'
+		}
+	}
+	return string(name) + `.prom`
+}
+
+func (writer *textfileWriter) write(scrapeTarget *ScrapeTarget) {
+	path := filepath.Join(writer.directory, textfileName(scrapeTarget.name))
+	families, err := pushFamilies(scrapeTarget)
+	if err == nil {
+		err = writeFileAtomically(path, []byte(renderFamilies(withoutTimestamps(families))))
+	}
+	if err == nil {
+		writer.lastWritten[path] = scrapeTarget.now()
+		textfileWrites.inc(scrapeTarget.name, `success`)
+		return
+	}
+
+	log.Printf("%s: writing %s failed: %v", scrapeTarget.name, path, err)
+	textfileWrites.inc(scrapeTarget.name, `failed`)
+	last, ok := writer.lastWritten[path]
+	if ok && scrapeTarget.since(last) > writer.maxAge {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("%s: removing outdated %s failed: %v", scrapeTarget.name, path, err)
+			return
+		}
+		log.Printf("%s: removed %s, last written %v ago", scrapeTarget.name, path, scrapeTarget.since(last).Round(time.Second))
+		textfileWrites.inc(scrapeTarget.name, `removed`)
+		delete(writer.lastWritten, path)
+	}
+}
+
+// Write to a temporary file next to path and rename it into place. The
+// temporary name doesn't end in .prom, so the collector ignores it.
+func writeFileAtomically(path string, content []byte) error {
+	temporary, err := ioutil.TempFile(filepath.Dir(path), `.`+filepath.Base(path)+`.*.tmp`)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+	if _, err := temporary.Write(content); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Sync(); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(temporary.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporary.Name(), path)
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTextfilesAreNeverSeenHalfWritten(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, `node.prom`)
+	contents := []string{strings.Repeat("a_metric 1\n", 50000), strings.Repeat("b_metric 2\n", 60000)}
+	if err := writeFileAtomically(path, []byte(contents[0])); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			if err := writeFileAtomically(path, []byte(contents[i%2])); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+		read, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(read) != contents[0] && string(read) != contents[1] {
+			t.Fatalf(`read a file of %d bytes that was neither version`, len(read))
+		}
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Mode().Perm() != 0644 {
+		t.Errorf(`left %d files behind, the textfile with mode %v`, len(entries), entries[0].Mode())
+	}
+}
+
+func TestTextfilesAreRemovedAfterFailingForTooLong(t *testing.T) {
+	useCommandLineSettings(t)
+	scrapeTarget, exporter, clock := newBackgroundTarget(t, `localhost:9100`, "node_load1 0.5 1622548800000\n")
+	dir := t.TempDir()
+	writer := &textfileWriter{directory: dir, interval: time.Minute, maxAge: 5 * time.Minute, lastWritten: make(map[string]time.Time)}
+	path := filepath.Join(dir, `localhost_9100.prom`)
+
+	writer.write(scrapeTarget)
+	if written, err := ioutil.ReadFile(path); err != nil || !strings.Contains(string(written), "node_load1 0.5\n") {
+		t.Fatalf(`wrote %q: %v`, written, err)
+	}
+
+	exporter.fail(http.StatusInternalServerError)
+	nextBackgroundScrape(t, clock)
+	writer.write(scrapeTarget)
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf(`a file written moments ago was removed after a failure: %v`, err)
+	}
+	clock.Advance(5 * time.Minute)
+	writer.write(scrapeTarget)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf(`a file written longer than the max age ago was kept: %v`, err)
+	}
+}
+
+func TestTextfileWriteErrorsAreSurvived(t *testing.T) {
+	useCommandLineSettings(t)
+	scrapeTarget := newPushedTarget(t, `node`, "up 1\n")
+	writer := &textfileWriter{directory: filepath.Join(t.TempDir(), `missing`), interval: time.Minute, maxAge: time.Hour, lastWritten: make(map[string]time.Time)}
+	writer.write(scrapeTarget)
+	if selfMetricValue(textfileWrites.selfMetric, `node`, `failed`) == 0 {
+		t.Error(`a write into a missing directory wasn't counted as failed`)
+	}
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Under targetsPath, the distribution of the unchanged counters of a target
+const thresholdsSuffix = `/histogram`
+
+// Upper bounds of the buckets of unchanged counters
+var unchangedBuckets = []int64{0, 1, 5, 10, 30, 60, 120, 240, 480, 1000, 5000}
+
+// Thresholds the suppressed series are counted for, unless the request
+// names its own with ?threshold=
+var hypotheticalThresholds = []int64{10, 60, 240, 1000}
+
+type unchangedBucket struct {
+	LE     string `json:"le"`
+	Series int    `json:"series"` // With at most LE unchanged scrapes, like a Prometheus bucket
+}
+
+type hypotheticalThreshold struct {
+	Threshold  int64 `json:"threshold"`
+	Suppressed int   `json:"suppressed"`
+}
+
+type unchangedDistribution struct {
+	Target       string                  `json:"target"`
+	Series       int                     `json:"series"` // Tracked by an unchanged policy
+	Buckets      []unchangedBucket       `json:"buckets"`
+	SuppressedAt []hypotheticalThreshold `json:"suppressed_at"`
+}
+
+// GET /api/v1/targets/<name>/histogram: how long the series of a target have
+// been unchanged, and how many of them other thresholds would suppress
+func thresholdsHandler(w http.ResponseWriter, r *http.Request, scrapeTarget *ScrapeTarget) {
+	thresholds := hypotheticalThresholds
+	if values := r.URL.Query()[`threshold`]; len(values) > 0 {
+		thresholds = nil
+		for _, value := range values {
+			threshold, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				http.Error(w, `invalid threshold `+value, http.StatusBadRequest)
+				return
+			}
+			thresholds = append(thresholds, threshold)
+		}
+	}
+
+	counters := make([]int64, 0)
+	scrapeTarget.eachUnchangedSeries(func(series SeriesKey, state SeriesState) {
+		counters = append(counters, state.Unchanged)
+	})
+	w.Header().Set(`Content-Type`, `application/json`)
+	json.NewEncoder(w).Encode(distribute(scrapeTarget.name, counters, thresholds))
+}
+
+// Call fn for every series tracked by the target's unchanged policies
+func (scrapeTarget *ScrapeTarget) eachUnchangedSeries(fn func(SeriesKey, SeriesState)) {
+	scrapeTarget.configMutex.Lock()
+	policies := scrapeTarget.staleness
+	scrapeTarget.configMutex.Unlock()
+	policies.Each(fn)
+}
+
+func distribute(name string, counters []int64, thresholds []int64) unchangedDistribution {
+	sort.Slice(counters, func(i, j int) bool { return counters[i] < counters[j] })
+	// Number of counters not above a bound
+	atMost := func(bound int64) int {
+		return sort.Search(len(counters), func(i int) bool { return counters[i] > bound })
+	}
+
+	distribution := unchangedDistribution{Target: name, Series: len(counters)}
+	for _, bound := range unchangedBuckets {
+		distribution.Buckets = append(distribution.Buckets, unchangedBucket{LE: strconv.FormatInt(bound, 10), Series: atMost(bound)})
+	}
+	distribution.Buckets = append(distribution.Buckets, unchangedBucket{LE: `+Inf`, Series: len(counters)})
+	for _, threshold := range thresholds {
+		distribution.SuppressedAt = append(distribution.SuppressedAt, hypotheticalThreshold{Threshold: threshold, Suppressed: len(counters) - atMost(threshold)})
+	}
+	return distribution
+}
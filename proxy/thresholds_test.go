@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestUnchangedCountersAreBucketed(t *testing.T) {
+	distribution := distribute(`node`, []int64{0, 0, 1, 3, 7, 60, 61, 250, 9000}, []int64{10, 60, 240, 1000})
+	expected := []unchangedBucket{{`0`, 2}, {`1`, 3}, {`5`, 4}, {`10`, 5}, {`30`, 5}, {`60`, 6}, {`120`, 7}, {`240`, 7}, {`480`, 8}, {`1000`, 8}, {`5000`, 8}, {`+Inf`, 9}}
+	if distribution.Series != 9 || !reflect.DeepEqual(distribution.Buckets, expected) {
+		t.Errorf("buckets %v\nexpected %v", distribution.Buckets, expected)
+	}
+	suppressed := []hypotheticalThreshold{{10, 4}, {60, 3}, {240, 2}, {1000, 1}}
+	if !reflect.DeepEqual(distribution.SuppressedAt, suppressed) {
+		t.Errorf(`suppressed at %v, expected %v`, distribution.SuppressedAt, suppressed)
+	}
+
+	if empty := distribute(`node`, []int64{}, []int64{10}); empty.Buckets[len(empty.Buckets)-1].Series != 0 || empty.SuppressedAt[0].Suppressed != 0 {
+		t.Errorf(`without series %+v`, empty)
+	}
+}
+
+func TestThresholdsAreComputedFromTheLiveState(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.StartStale = false
+	commandLine.staleness.Threshold = 1000
+	exporter, upstream := newFakeExporter(t, "")
+	scrapeTarget := newScrapeTarget(`app`, []string{upstream}, commandLine)
+	t.Cleanup(scrapeTarget.close)
+	// Unchanged for 3 scrapes, changing every scrape, and new
+	for _, body := range []string{
+		"app_constant 1\napp_changing 1\n",
+		"app_constant 1\napp_changing 2\n",
+		"app_constant 1\napp_changing 3\n",
+		"app_constant 1\napp_changing 4\napp_new 1\n",
+	} {
+		exporter.serve(body)
+		servedSeries(scrapeTarget)
+	}
+
+	get := func(query string) (int, unchangedDistribution) {
+		response := httptest.NewRecorder()
+		targetHandler(response, httptest.NewRequest(http.MethodGet, targetsPath+`/app`+thresholdsSuffix+query, nil))
+		var distribution unchangedDistribution
+		json.Unmarshal(response.Body.Bytes(), &distribution)
+		return response.Code, distribution
+	}
+	code, distribution := get(`?threshold=0&threshold=2&threshold=3`)
+	if code != http.StatusOK || distribution.Target != `app` || distribution.Series != 3 {
+		t.Fatalf(`answered %d %+v`, code, distribution)
+	}
+	if buckets := distribution.Buckets; buckets[0] != (unchangedBucket{`0`, 2}) || buckets[2] != (unchangedBucket{`5`, 3}) {
+		t.Errorf(`buckets %v`, buckets)
+	}
+	suppressed := []hypotheticalThreshold{{0, 1}, {2, 1}, {3, 0}}
+	if !reflect.DeepEqual(distribution.SuppressedAt, suppressed) {
+		t.Errorf(`suppressed at %v, expected %v`, distribution.SuppressedAt, suppressed)
+	}
+
+	if _, distribution := get(``); len(distribution.SuppressedAt) != len(hypotheticalThresholds) {
+		t.Errorf(`without thresholds given %v`, distribution.SuppressedAt)
+	}
+	if code, _ := get(`?threshold=ten`); code != http.StatusBadRequest {
+		t.Errorf(`an invalid threshold answered %d`, code)
+	}
+	response := httptest.NewRecorder()
+	targetHandler(response, httptest.NewRequest(http.MethodGet, targetsPath+`/missing`+thresholdsSuffix, nil))
+	if response.Code != http.StatusNotFound {
+		t.Errorf(`an unknown target answered %d`, response.Code)
+	}
+}
@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Prometheus tells its targets how long it waits for a scrape in this header
+const scrapeTimeoutHeader = `X-Prometheus-Scrape-Timeout-Seconds`
+
+// How long the upstream fetch for this request may take, 0 means no limit.
+// The scraper's own timeout minus a safety margin is used when it is tighter
+// than the configured one.
+func (scrapeTarget *ScrapeTarget) scrapeTimeout(r *http.Request) time.Duration {
+	timeout := scrapeTarget.timeout
+	header := r.Header.Get(scrapeTimeoutHeader)
+	if header == `` {
+		return timeout
+	}
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil || seconds <= 0 || math.IsInf(seconds, 0) || math.IsNaN(seconds) {
+		return timeout
+	}
+
+	scraperTimeout := time.Duration(seconds * float64(time.Second))
+	if scraperTimeout > scrapeTarget.timeoutOffset {
+		scraperTimeout -= scrapeTarget.timeoutOffset
+	}
+	if timeout <= 0 || scraperTimeout < timeout {
+		return scraperTimeout
+	}
+	return timeout
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestScrapeTimeoutIsTheTighterOfTheHeaderAndTheSetting(t *testing.T) {
+	scrapeTarget := &ScrapeTarget{timeout: 10 * time.Second, timeoutOffset: 500 * time.Millisecond}
+	for header, expected := range map[string]time.Duration{
+		``:      10 * time.Second,
+		`5`:     4500 * time.Millisecond,
+		`30`:    10 * time.Second,
+		`0.25`:  250 * time.Millisecond, // Shorter than the margin, which is left out
+		`-1`:    10 * time.Second,
+		`NaN`:   10 * time.Second,
+		`+Inf`:  10 * time.Second,
+		`fifty`: 10 * time.Second,
+	} {
+		r := httptest.NewRequest(http.MethodGet, `/metrics`, nil)
+		if header != `` {
+			r.Header.Set(scrapeTimeoutHeader, header)
+		}
+		if timeout := scrapeTarget.scrapeTimeout(r); timeout != expected {
+			t.Errorf(`header %q: timeout %v, expected %v`, header, timeout, expected)
+		}
+	}
+
+	scrapeTarget.timeout = 0
+	r := httptest.NewRequest(http.MethodGet, `/metrics`, nil)
+	r.Header.Set(scrapeTimeoutHeader, `15`)
+	if timeout := scrapeTarget.scrapeTimeout(r); timeout != 14500*time.Millisecond {
+		t.Errorf(`without a setting the header gave %v`, timeout)
+	}
+}
+
+func TestSlowUpstreamsAreAnsweredWithAGatewayTimeout(t *testing.T) {
+	exporter, upstream := newSlowExporter(t)
+	defer close(exporter.release)
+	p := newFakeClockProxy(t, newFakeClock(), Config{}, upstream)
+
+	recorder := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, `/metrics`, nil)
+	r.Header.Set(scrapeTimeoutHeader, `0.6`)
+	p.Handler(`node`).ServeHTTP(recorder, r)
+	if recorder.Code != http.StatusGatewayTimeout || !strings.Contains(recorder.Body.String(), `node`) {
+		t.Errorf(`a scrape the upstream didn't answer in time got %d %s`, recorder.Code, recorder.Body)
+	}
+}
+
+func TestTheScrapeTimeoutCancelsTheUpstreamFetch(t *testing.T) {
+	exporter, upstream := newSlowExporter(t)
+	defer close(exporter.release)
+	p := newFakeClockProxy(t, newFakeClock(), Config{ScrapeTimeout: 100 * time.Millisecond}, upstream)
+
+	recorder := httptest.NewRecorder()
+	p.Handler(`node`).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+	if recorder.Code != http.StatusGatewayTimeout || !strings.Contains(recorder.Body.String(), `timed out`) {
+		t.Errorf(`a scrape the upstream didn't answer in time got %d %s`, recorder.Code, recorder.Body)
+	}
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&exporter.dropped) == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal(`the upstream fetch went on after the timeout`)
+		}
+	}
+}
+
+func TestUpstreamConnectionsAreKeptAlive(t *testing.T) {
+	var connections int32
+	exporter := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "up 1\n")
+	}))
+	exporter.Config.ConnState = func(connection net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	exporter.Start()
+	t.Cleanup(exporter.Close)
+	p := newFakeClockProxy(t, newFakeClock(), Config{}, exporter.URL)
+
+	for i := 0; i < 5; i++ {
+		scrapeNode(t, p)
+	}
+	if opened := atomic.LoadInt32(&connections); opened != 1 {
+		t.Errorf(`5 scrapes opened %d connections to the upstream`, opened)
+	}
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUpstreamTimestampsAreServedWithTheirSeries(t *testing.T) {
+	useCommandLineSettings(t)
+	commandLine.staleness.StartStale = false
+	for _, exposition := range []string{
+		// Without timestamps
+		"node_load1 0.5\nnode_load5 0.25\n",
+		// With timestamps
+		"node_load1 0.5 1622548800000\nnode_load5 0.25 1622548800000\n",
+		// Mixed within one family
+		"snmp_if_octets{if=\"1\"} 1024 1622548800000\nsnmp_if_octets{if=\"2\"} 2048\nsnmp_if_octets{if=\"3\"} 4096 1622548815000\n",
+	} {
+		_, upstream := newFakeExporter(t, exposition)
+		scrapeTarget := newScrapeTarget(`node`, []string{upstream}, commandLine)
+		if _, served := servedSeries(scrapeTarget); served != strings.Join(seriesLines(exposition), "\n") {
+			t.Errorf("served\n%s\nfor\n%s", served, exposition)
+		}
+		scrapeTarget.close()
+	}
+}
+
+func TestNewTimestampsOfTheSameValueAreUnchanged(t *testing.T) {
+	for _, test := range []struct {
+		timestampIsChange bool
+		expected          string
+	}{
+		{false, `FFSS`},
+		// A fresh timestamp proves the series is alive
+		{true, `FFFF`},
+	} {
+		useCommandLineSettings(t)
+		commandLine.staleness.Threshold, commandLine.staleness.StartStale = 1, false
+		commandLine.staleness.TimestampIsChange = test.timestampIsChange
+		exporter, upstream := newFakeExporter(t, ``)
+		scrapeTarget := newScrapeTarget(`node`, []string{upstream}, commandLine)
+		var pattern string
+		for i := 0; i < 4; i++ {
+			exporter.serve("pushed_jobs 3 " + strconv.FormatInt(1622548800000+int64(i)*15000, 10) + "\n")
+			if _, served := servedSeries(scrapeTarget); served != `` {
+				pattern += `F`
+			} else {
+				pattern += `S`
+			}
+		}
+		scrapeTarget.close()
+		if pattern != test.expected {
+			t.Errorf(`with timestamp_is_change %t: %s, expected %s`, test.timestampIsChange, pattern, test.expected)
+		}
+	}
+}
+
+func TestTimestampsAreLeftOutWhereTheyAreRejected(t *testing.T) {
+	families := []outputFamily{{name: `snmp_if_octets`, metricType: counter, lines: []string{
+		"snmp_if_octets{if=\"1\"} 1024 1622548800000\n",
+		"snmp_if_octets{if=\"2\"} 2048\n",
+	}}}
+	stripped := withoutTimestamps(families)
+	if lines := strings.Join(stripped[0].lines, ``); lines != "snmp_if_octets{if=\"1\"} 1024\nsnmp_if_octets{if=\"2\"} 2048\n" {
+		t.Errorf("stripped\n%s", lines)
+	}
+	if !strings.HasSuffix(families[0].lines[0], " 1622548800000\n") {
+		t.Error(`the served lines were changed`)
+	}
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// TLS settings for the listeners
+type listenerTLS struct {
+	certFile     string
+	keyFile      string
+	clientAuth   string
+	clientCAFile string
+	clientNames  string // Comma separated SANs/CNs accepted from clients
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	`NoClientCert`:               tls.NoClientCert,
+	`RequestClientCert`:          tls.RequestClientCert,
+	`RequireAnyClientCert`:       tls.RequireAnyClientCert,
+	`VerifyClientCertIfGiven`:    tls.VerifyClientCertIfGiven,
+	`RequireAndVerifyClientCert`: tls.RequireAndVerifyClientCert,
+}
+
+func (settings listenerTLS) enabled() bool {
+	return settings.certFile != `` || settings.keyFile != ``
+}
+
+func (settings listenerTLS) config() (*tls.Config, error) {
+	if settings.certFile == `` || settings.keyFile == `` {
+		return nil, errors.New(`both a certificate and a key file are needed for TLS`)
+	}
+	certificate, err := tls.LoadX509KeyPair(settings.certFile, settings.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if settings.clientAuth != `` {
+		authType, ok := clientAuthTypes[settings.clientAuth]
+		if !ok {
+			return nil, fmt.Errorf(`unknown client auth type %q`, settings.clientAuth)
+		}
+		config.ClientAuth = authType
+	}
+	if settings.clientCAFile != `` {
+		pem, err := ioutil.ReadFile(settings.clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf(`no certificates found in %s`, settings.clientCAFile)
+		}
+		config.ClientCAs = pool
+	} else if config.ClientAuth == tls.VerifyClientCertIfGiven || config.ClientAuth == tls.RequireAndVerifyClientCert {
+		return nil, fmt.Errorf(`client auth type %s needs a client CA file`, settings.clientAuth)
+	}
+
+	if settings.clientNames != `` || len(listenerClientNames) > 0 {
+		// The names are only worth something on a certificate signed by the CA
+		if config.ClientAuth != tls.VerifyClientCertIfGiven && config.ClientAuth != tls.RequireAndVerifyClientCert {
+			return nil, errors.New(`accepting client names needs client auth type VerifyClientCertIfGiven or RequireAndVerifyClientCert`)
+		}
+	}
+	if settings.clientNames != `` {
+		config.VerifyConnection = verifyClientNames(settings.clientNames)
+	}
+	return config, nil
+}
+
+// Check that a verified client certificate carries one of the comma
+// separated names, as its CN or a DNS SAN
+func verifyClientNames(names string) func(tls.ConnectionState) error {
+	allowed := make(map[string]bool)
+	for _, name := range strings.Split(names, `,`) {
+		allowed[strings.TrimSpace(name)] = true
+	}
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			// Whether a certificate is required at all is up to ClientAuth
+			return nil
+		}
+		// PeerCertificates holds whatever the client sent, only a leaf
+		// chaining up to the client CA may be matched
+		if len(state.VerifiedChains) == 0 {
+			return errors.New(`client certificate wasn't verified`)
+		}
+		leaf := state.VerifiedChains[0][0]
+		if allowed[leaf.Subject.CommonName] {
+			return nil
+		}
+		for _, name := range leaf.DNSNames {
+			if allowed[name] {
+				return nil
+			}
+		}
+		return fmt.Errorf(`client certificate %q is not in the list of accepted names`, leaf.Subject.CommonName)
+	}
+}
+
+// Client names accepted by single listeners, replacing
+// -tls-client-allowed-names for them
+var listenerClientNames = listenerStrings{}
+
+// Repeatable listen=value flag
+type listenerStrings map[string]string
+
+func (values listenerStrings) String() string {
+	var pairs []string
+	for address, value := range values {
+		pairs = append(pairs, address+`=`+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ` `)
+}
+
+func (values listenerStrings) Set(value string) error {
+	address, value, err := splitListenerValue(value)
+	if err != nil {
+		return err
+	}
+	values[address] = value
+	return nil
+}
+
+// The TLS config of a listener, with its own accepted client names when it
+// has them
+func listenerTLSConfig(address listenAddress) *tls.Config {
+	names, ok := listenerClientNames[address.String()]
+	if tlsConfig == nil || !ok {
+		return tlsConfig
+	}
+	config := tlsConfig.Clone()
+	config.VerifyConnection = verifyClientNames(names)
+	return config
+}
+
+// The http server only reports failed handshakes through its error log, so
+// count them from there
+type handshakeErrorLog struct {
+	name string
+}
+
+func (errorLog handshakeErrorLog) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte(`TLS handshake error`)) {
+		tlsHandshakeErrors.inc(errorLog.name)
+	}
+	return os.Stderr.Write(p)
+}
+
+func newHandshakeErrorLog(name string) *log.Logger {
+	return log.New(handshakeErrorLog{name: name}, ``, log.LstdFlags)
+}
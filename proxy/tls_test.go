@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A key and a certificate for name, signed by parent or else by itself
+type testCertificate struct {
+	key         *ecdsa.PrivateKey
+	certificate *x509.Certificate
+	der         []byte
+}
+
+func newTestCertificate(t *testing.T, name string, parent *testCertificate) *testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.certificate, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{key: key, certificate: certificate, der: der}
+}
+
+// Write the certificate and its key as PEM files, returning their paths
+func (cert *testCertificate) write(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(cert.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+`.crt`), filepath.Join(dir, name+`.key`)
+	writeConfigFile(t, certFile, string(pem.EncodeToMemory(&pem.Block{Type: `CERTIFICATE`, Bytes: cert.der})))
+	writeConfigFile(t, keyFile, string(pem.EncodeToMemory(&pem.Block{Type: `EC PRIVATE KEY`, Bytes: keyDER})))
+	return certFile, keyFile
+}
+
+func (cert *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{cert.der}, PrivateKey: cert.key}
+}
+
+// TLS settings with a server certificate and clients verified by ca
+func mutualTLSSettings(t *testing.T, ca *testCertificate, clientAuth, clientNames string) listenerTLS {
+	dir := t.TempDir()
+	certFile, keyFile := newTestCertificate(t, `proxy.example`, ca).write(t, dir, `server`)
+	caFile, _ := ca.write(t, dir, `ca`)
+	return listenerTLS{certFile: certFile, keyFile: keyFile, clientAuth: clientAuth, clientCAFile: caFile, clientNames: clientNames}
+}
+
+// Whether a client presenting certificate gets an answer from a server
+// using config
+func handshakeSucceeds(t *testing.T, config *tls.Config, ca *testCertificate, certificate tls.Certificate) bool {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = config
+	server.Config.ErrorLog = log.New(ioutil.Discard, ``, 0)
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      roots,
+		ServerName:   `proxy.example`,
+		Certificates: []tls.Certificate{certificate},
+	}}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+func TestClientNamesAreMatchedOnVerifiedCertificates(t *testing.T) {
+	ca := newTestCertificate(t, `ca.example`, nil)
+	config, err := mutualTLSSettings(t, ca, `RequireAndVerifyClientCert`, `prometheus.example`).config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !handshakeSucceeds(t, config, ca, newTestCertificate(t, `prometheus.example`, ca).tlsCertificate()) {
+		t.Error(`a verified certificate with an accepted name was refused`)
+	}
+	if handshakeSucceeds(t, config, ca, newTestCertificate(t, `other.example`, ca).tlsCertificate()) {
+		t.Error(`a verified certificate with another name was accepted`)
+	}
+	if handshakeSucceeds(t, config, ca, newTestCertificate(t, `prometheus.example`, nil).tlsCertificate()) {
+		t.Error(`a self-signed certificate with an accepted name was accepted`)
+	}
+}
+
+func TestClientNamesNeedAVerifiedCertificate(t *testing.T) {
+	ca := newTestCertificate(t, `ca.example`, nil)
+	forged := newTestCertificate(t, `prometheus.example`, nil)
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{forged.certificate}}
+	if err := verifyClientNames(`prometheus.example`)(state); err == nil {
+		t.Error(`the names of an unverified certificate were matched`)
+	}
+
+	for _, clientAuth := range []string{`RequestClientCert`, `RequireAnyClientCert`} {
+		if _, err := mutualTLSSettings(t, ca, clientAuth, `prometheus.example`).config(); err == nil || !strings.Contains(err.Error(), `needs client auth type`) {
+			t.Errorf(`client names with %s: %v`, clientAuth, err)
+		}
+	}
+}
+
+func TestListenersHaveTheirOwnAccessSettings(t *testing.T) {
+	defer func(allowed cidrList, cidrs listenerCIDRLists, names listenerStrings, config *tls.Config) {
+		allowedCIDRs, listenerCIDRs, listenerClientNames, tlsConfig = allowed, cidrs, names, config
+	}(allowedCIDRs, listenerCIDRs, listenerClientNames, tlsConfig)
+	allowedCIDRs, listenerCIDRs, listenerClientNames = nil, listenerCIDRLists{}, listenerStrings{}
+	if err := allowedCIDRs.Set(`192.168.0.0/16`); err != nil {
+		t.Fatal(err)
+	}
+	if err := listenerCIDRs.Set(`19101=10.0.0.0/8,172.16.0.0/12`); err != nil {
+		t.Fatal(err)
+	}
+	if err := listenerClientNames.Set(`19101=grafana.example`); err != nil {
+		t.Fatal(err)
+	}
+	ca := newTestCertificate(t, `ca.example`, nil)
+	var err error
+	if tlsConfig, err = mutualTLSSettings(t, ca, `RequireAndVerifyClientCert`, `prometheus.example`).config(); err != nil {
+		t.Fatal(err)
+	}
+
+	answer := func(server *http.Server, remoteAddr string) int {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, `/metrics`, nil)
+		r.RemoteAddr = remoteAddr
+		server.Handler.ServeHTTP(recorder, r)
+		return recorder.Code
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	shared := newListenerServer(`:19100`, listenAddress{port: 19100}, ok)
+	own := newListenerServer(`:19101`, listenAddress{port: 19101}, ok)
+	if answer(shared, `192.168.1.1:5000`) != http.StatusOK || answer(shared, `10.1.1.1:5000`) != http.StatusForbidden {
+		t.Error(`a listener without an allowlist of its own didn't use -allow-cidr`)
+	}
+	if answer(own, `10.1.1.1:5000`) != http.StatusOK || answer(own, `192.168.1.1:5000`) != http.StatusForbidden {
+		t.Error(`a listener with an allowlist of its own used -allow-cidr`)
+	}
+
+	grafana := newTestCertificate(t, `grafana.example`, ca).tlsCertificate()
+	prometheus := newTestCertificate(t, `prometheus.example`, ca).tlsCertificate()
+	if !handshakeSucceeds(t, shared.TLSConfig, ca, prometheus) || handshakeSucceeds(t, shared.TLSConfig, ca, grafana) {
+		t.Error(`a listener without client names of its own didn't use -tls-client-allowed-names`)
+	}
+	if !handshakeSucceeds(t, own.TLSConfig, ca, grafana) || handshakeSucceeds(t, own.TLSConfig, ca, prometheus) {
+		t.Error(`a listener with client names of its own used -tls-client-allowed-names`)
+	}
+
+	if err := validateListenerOverrides([]listenAddress{{port: 19100}}); err == nil || !strings.Contains(err.Error(), `no listener on 19101`) {
+		t.Errorf(`flags for a listener that doesn't exist: %v`, err)
+	}
+	if err := validateListenerOverrides([]listenAddress{{port: 19100}, {port: 19101}}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestListenerFlagsNeedAListenAddress(t *testing.T) {
+	for _, value := range []string{`10.0.0.0/8`, `=10.0.0.0/8`, `nowhere=10.0.0.0/8`, `19100=10.0.0.0/99`} {
+		if err := (listenerCIDRLists{}).Set(value); err == nil {
+			t.Errorf(`-listener-allow-cidr %s was accepted`, value)
+		}
+	}
+}
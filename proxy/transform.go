@@ -0,0 +1,248 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pdxiv/frugalpromproxy/parser"
+)
+
+var (
+	transformSeriesIn  = selfMetrics.newCounterVec(`frugalpromproxy_transform_series_in_total`, `Series passed into a stage of the transform chain.`, `target`, `stage`)
+	transformSeriesOut = selfMetrics.newCounterVec(`frugalpromproxy_transform_series_out_total`, `Series passed on by a stage of the transform chain.`, `target`, `stage`)
+)
+
+// Family is a parsed metric family as it goes through the transform chain
+type Family = parser.Family
+
+// Series is one series of a family
+type Series = parser.Series
+
+// Transformer is a stage of the transform chain. It gets the families of a
+// scrape, before staleness is decided, and returns the families to pass on
+// to the next stage. It may modify the families it gets.
+type Transformer interface {
+	Name() string
+	Transform(families []Family) []Family
+}
+
+// Repeatable command line flag building the chain every target runs, in the
+// order the flags are given
+type transformChain []Transformer
+
+var transformers transformChain
+
+func (chain *transformChain) String() string {
+	names := make([]string, len(*chain))
+	for i, stage := range *chain {
+		names[i] = stage.Name()
+	}
+	return strings.Join(names, ` `)
+}
+
+// Stages are written as kind=argument: keep=<regex> and drop=<regex> on the
+// family name, rename=<regex>:<replacement>, label=<name>=<value> and
+// round=<decimals>
+func (chain *transformChain) Set(value string) error {
+	equals := strings.Index(value, `=`)
+	if equals < 1 {
+		return fmt.Errorf(`%s isn't a kind=argument stage`, value)
+	}
+	kind, argument := value[:equals], value[equals+1:]
+	var stage Transformer
+	switch kind {
+	case `keep`, `drop`:
+		pattern, err := regexp.Compile(`^(?:` + argument + `)$`)
+		if err != nil {
+			return err
+		}
+		stage = &filterStage{name: value, pattern: pattern, keep: kind == `keep`}
+	case `rename`:
+		colon := strings.LastIndex(argument, `:`)
+		if colon < 0 {
+			return fmt.Errorf(`%s needs rename=<regex>:<replacement>`, value)
+		}
+		pattern, err := regexp.Compile(`^(?:` + argument[:colon] + `)$`)
+		if err != nil {
+			return err
+		}
+		stage = &renameStage{name: value, pattern: pattern, replacement: argument[colon+1:]}
+	case `label`:
+		pair := strings.Index(argument, `=`)
+		if pair < 1 {
+			return fmt.Errorf(`%s needs label=<name>=<value>`, value)
+		}
+		stage = &labelStage{name: value, label: sanitizeLabelName(argument[:pair]), value: argument[pair+1:]}
+	case `round`:
+		decimals, err := strconv.Atoi(argument)
+		if err != nil {
+			return err
+		}
+		stage = &roundStage{name: value, factor: math.Pow(10, float64(decimals))}
+	default:
+		return fmt.Errorf(`unknown transform %s`, kind)
+	}
+	*chain = append(*chain, stage)
+	return nil
+}
+
+// Run the parsed data through the target's chain, stopping early when a
+// stage leaves nothing. The stages get the series of histograms and
+// summaries as families of their own, like the parser returns them.
+func (scrapeTarget *ScrapeTarget) transform(data map[string]MetricData, chain []Transformer) map[string]MetricData {
+	families := make([]Family, 0, len(data))
+	for _, name := range orderedNames(data) {
+		content := data[name]
+		family := Family{Name: name, Help: content.commentHelp, Type: typeText[content.commentType]}
+		for _, label := range orderedLabels(content.label) {
+			family.Series = append(family.Series, Series{Labels: label, Value: content.label[label].value, Timestamp: content.label[label].timestamp})
+		}
+		families = append(families, family)
+		for _, suffix := range childSuffixes[content.commentType] {
+			children, ok := content.children[name+suffix]
+			if !ok {
+				continue
+			}
+			child := Family{Name: name + suffix}
+			for _, label := range orderedLabels(children) {
+				child.Series = append(child.Series, Series{Labels: label, Value: children[label].value, Timestamp: children[label].timestamp})
+			}
+			families = append(families, child)
+		}
+	}
+
+	for i, stage := range chain {
+		if len(families) == 0 {
+			break
+		}
+		name := strconv.Itoa(i+1) + `:` + stage.Name()
+		in := countSeries(families)
+		transformSeriesIn.add(float64(in), []string{scrapeTarget.name, name})
+		families = stage.Transform(families)
+		out := countSeries(families)
+		transformSeriesOut.add(float64(out), []string{scrapeTarget.name, name})
+		if out < in {
+			ruleDecisions.add(float64(in-out), []string{scrapeTarget.name, transformRule(i+1, stage.Name())})
+		}
+	}
+
+	// In the order the chain left them
+	transformed := make(map[string]MetricData, len(families))
+	for position, family := range families {
+		content, ok := transformed[family.Name]
+		if !ok {
+			content = MetricData{commentType: metricType(family.Type), commentHelp: family.Help, label: make(map[string]LabelSet), position: position}
+		}
+		for _, series := range family.Series {
+			if previous, ok := content.label[series.Labels]; ok {
+				content.label[series.Labels] = LabelSet{value: series.Value, timestamp: series.Timestamp, position: previous.position}
+				continue
+			}
+			content.label[series.Labels] = LabelSet{value: series.Value, timestamp: series.Timestamp, position: len(content.label)}
+		}
+		transformed[family.Name] = content
+	}
+	groupChildren(transformed)
+	return transformed
+}
+
+func countSeries(families []Family) int {
+	var count int
+	for _, family := range families {
+		count += len(family.Series)
+	}
+	return count
+}
+
+// The type for a TYPE comment, untyped when unknown
+func metricType(text string) MetricType {
+	for i, known := range typeText {
+		if known == text {
+			return MetricType(i)
+		}
+	}
+	return untyped
+}
+
+// Keeps or drops the families whose name matches
+type filterStage struct {
+	name    string
+	pattern *regexp.Regexp
+	keep    bool
+}
+
+func (stage *filterStage) Name() string { return stage.name }
+
+func (stage *filterStage) Transform(families []Family) []Family {
+	kept := families[:0]
+	for _, family := range families {
+		if stage.pattern.MatchString(family.Name) == stage.keep {
+			kept = append(kept, family)
+		}
+	}
+	return kept
+}
+
+// Renames the families whose name matches, families renamed to the same
+// name are merged
+type renameStage struct {
+	name        string
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+func (stage *renameStage) Name() string { return stage.name }
+
+func (stage *renameStage) Transform(families []Family) []Family {
+	for i := range families {
+		families[i].Name = stage.pattern.ReplaceAllString(families[i].Name, stage.replacement)
+	}
+	return families
+}
+
+// Sets a label on every series, replacing the upstream's value
+type labelStage struct {
+	name  string
+	label string
+	value string
+}
+
+func (stage *labelStage) Name() string { return stage.name }
+
+func (stage *labelStage) Transform(families []Family) []Family {
+	for i := range families {
+		for j, series := range families[i].Series {
+			var kept []string
+			for _, pair := range splitLabels(series.Labels) {
+				if strings.TrimSpace(pair[:strings.Index(pair+`=`, `=`)]) != stage.label {
+					kept = append(kept, pair)
+				}
+			}
+			kept = append(kept, stage.label+`="`+escapeLabelValue(stage.value)+`"`)
+			families[i].Series[j].Labels = strings.Join(kept, `,`)
+		}
+	}
+	return families
+}
+
+// Rounds every value to a number of decimals, so jitter below that doesn't
+// count as a change
+type roundStage struct {
+	name   string
+	factor float64
+}
+
+func (stage *roundStage) Name() string { return stage.name }
+
+func (stage *roundStage) Transform(families []Family) []Family {
+	for i := range families {
+		for j := range families[i].Series {
+			series := &families[i].Series[j]
+			series.Value = math.Round(series.Value*stage.factor) / stage.factor
+		}
+	}
+	return families
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const transformExposition = `# TYPE node_load1 gauge
+node_load1 0.5249
+# TYPE node_memory_free_bytes gauge
+node_memory_free_bytes{host="a"} 1024.26
+# TYPE go_goroutines gauge
+go_goroutines 12
+`
+
+func chainOf(t *testing.T, stages ...string) []Transformer {
+	t.Helper()
+	var chain transformChain
+	for _, stage := range stages {
+		if err := chain.Set(stage); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return chain
+}
+
+// Run the exposition through a chain, returning the series it leaves sorted
+func transformed(t *testing.T, target string, stages ...string) string {
+	t.Helper()
+	data, _ := parseExposition(transformExposition, func(number int, line string) {
+		t.Errorf(`line %d rejected: %s`, number, line)
+	})
+	var lines []string
+	for name, content := range (&ScrapeTarget{name: target}).transform(data, chainOf(t, stages...)) {
+		for labels, set := range content.label {
+			lines = append(lines, strings.TrimSuffix(seriesLine(name, labels, set.value, set.timestamp), "\n"))
+		}
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func TestTransformStagesDependOnTheirOrder(t *testing.T) {
+	renameFirst := transformed(t, `rename-first`, `rename=node_(.*):host_$1`, `keep=host_.*`, `round=1`)
+	if expected := "host_load1 0.5\nhost_memory_free_bytes{host=\"a\"} 1024.3"; renameFirst != expected {
+		t.Errorf("renaming first left\n%s\nexpected\n%s", renameFirst, expected)
+	}
+	if keepFirst := transformed(t, `keep-first`, `keep=host_.*`, `rename=node_(.*):host_$1`, `round=1`); keepFirst != `` {
+		t.Errorf("keeping first left\n%s", keepFirst)
+	}
+
+	labelFirst := transformed(t, `label-first`, `label=host=b`, `keep=node_.*`, `round=0`)
+	if expected := "node_load1{host=\"b\"} 1\nnode_memory_free_bytes{host=\"b\"} 1024"; labelFirst != expected {
+		t.Errorf("labeling first left\n%s\nexpected\n%s", labelFirst, expected)
+	}
+	roundFirst := transformed(t, `round-first`, `round=0`, `drop=go_.*`, `label=host=b`)
+	if labelFirst != roundFirst {
+		t.Errorf("stages that don't depend on each other gave\n%s\nand\n%s", labelFirst, roundFirst)
+	}
+}
+
+func TestTransformCountsSeriesByStage(t *testing.T) {
+	stages := []string{`drop=go_.*`, `keep=nothing`, `round=1`}
+	counted := func(stage int) (float64, float64) {
+		name := strconv.Itoa(stage+1) + `:` + stages[stage]
+		return selfMetricValue(transformSeriesIn.selfMetric, `counted`, name), selfMetricValue(transformSeriesOut.selfMetric, `counted`, name)
+	}
+	var before [3][2]float64
+	for i := range stages {
+		before[i][0], before[i][1] = counted(i)
+	}
+	droppedBefore := selfMetricValue(ruleDecisions.selfMetric, `counted`, `transform:2:keep=nothing`)
+
+	transformed(t, `counted`, stages...)
+	for i, expected := range [][2]float64{{3, 2}, {2, 0}, {0, 0}} {
+		in, out := counted(i)
+		if in-before[i][0] != expected[0] || out-before[i][1] != expected[1] {
+			t.Errorf(`stage %s: %v in and %v out, expected %v`, stages[i], in-before[i][0], out-before[i][1], expected)
+		}
+	}
+	if dropped := selfMetricValue(ruleDecisions.selfMetric, `counted`, `transform:2:keep=nothing`) - droppedBefore; dropped != 2 {
+		t.Errorf(`%v series counted as dropped by the second stage`, dropped)
+	}
+}
+
+func TestTransformStagesAreChecked(t *testing.T) {
+	for _, stage := range []string{`keep`, `keep=(`, `rename=node_.*`, `label=host`, `round=one`, `sort=name`} {
+		var chain transformChain
+		if err := chain.Set(stage); err == nil {
+			t.Errorf(`%s was accepted`, stage)
+		}
+	}
+	if chain := transformChain(chainOf(t, `keep=node_.*`, `round=2`)); chain.String() != `keep=node_.* round=2` {
+		t.Errorf(`chain %s`, chain.String())
+	}
+}
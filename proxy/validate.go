@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Scrape an upstream from several routes without a warning
+var allowDuplicateUpstreams bool
+
+// Check the routes of the command line against each other before anything
+// is served. A path routed twice on a port, and a listener that would
+// scrape itself, are errors. An upstream scraped by more than one route is
+// a warning, as it doubles its load without anyone noticing, unless
+// allowDuplicates says that's intended.
+func validateRoutes(listenAddresses []listenAddress, routeTables map[listenAddress][]route, discoveryPort int, allowDuplicates bool) error {
+	listening := make(map[int]bool) // TCP ports, on any address
+	for _, port := range listenPortsOf(listenAddresses) {
+		listening[port] = true
+	}
+	if discoveryPort > 0 && listening[discoveryPort] {
+		return fmt.Errorf(`port %d is both a listen port and the service discovery port`, discoveryPort)
+	}
+
+	routedBy := make(map[string]string) // Listen address of the first route of an upstream
+	for _, listenAt := range listenAddresses {
+		paths := make(map[string]bool)
+		for _, route := range routeTables[listenAt] {
+			address := listenAt.String() + route.path
+			if paths[route.path] {
+				return fmt.Errorf(`%s is routed twice on %s`, route.path, listenAt)
+			}
+			paths[route.path] = true
+
+			for _, upstream := range route.sources {
+				for _, origin := range upstream.origins {
+					if loopbackPort(origin) > 0 && listening[loopbackPort(origin)] {
+						return fmt.Errorf(`%s would scrape %s, which the proxy listens on itself`, address, origin)
+					}
+				}
+				key := upstream.key()
+				first, ok := routedBy[key]
+				if !ok {
+					routedBy[key] = address
+					continue
+				}
+				if !allowDuplicates {
+					log.Printf("warning: %s is scraped for both %s and %s, doubling its load (-allow-duplicate-upstreams if that's intended)", key, first, address)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// The port of an origin on this host, 0 for other hosts
+func loopbackPort(origin string) int {
+	parsed, err := url.Parse(origin)
+	if err != nil {
+		return 0
+	}
+	switch parsed.Hostname() {
+	case `localhost`, `127.0.0.1`, `::1`:
+	default:
+		return 0
+	}
+	port, _ := strconv.Atoi(parsed.Port())
+	if port == 0 && parsed.Scheme == `http` {
+		return 80
+	}
+	if port == 0 && parsed.Scheme == `https` {
+		return 443
+	}
+	return port
+}
+
+// Print the routes of every listen port and the upstreams behind them, the
+// way they were understood
+func printRoutes(w io.Writer, listenAddresses []listenAddress, routeTables map[listenAddress][]route) {
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "LISTEN\tPATH\tUPSTREAMS")
+	for _, address := range listenAddresses {
+		for _, route := range routeTables[address] {
+			var sources []string
+			for _, upstream := range route.sources {
+				source := upstream.key()
+				if upstream.label != `` {
+					source = upstream.label + `=` + source
+				}
+				if len(upstream.origins) > 1 {
+					source += ` (fails over to ` + strings.Join(upstream.origins[1:], `, `) + `)`
+				}
+				sources = append(sources, source)
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\n", address, route.path, strings.Join(sources, ` + `))
+		}
+	}
+	table.Flush()
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Route tables of listen port and path pairs to upstream arguments
+func routesOf(t *testing.T, pairs ...[3]string) ([]listenAddress, map[listenAddress][]route) {
+	t.Helper()
+	var addresses []listenAddress
+	tables := make(map[listenAddress][]route)
+	for _, pair := range pairs {
+		address, err := parseListenAddress(pair[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources, err := parseUpstreamArgument(pair[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := tables[address]; !ok {
+			addresses = append(addresses, address)
+		}
+		tables[address] = append(tables[address], route{path: pair[1], sources: sources})
+	}
+	return addresses, tables
+}
+
+func TestConflictingRoutesAreErrors(t *testing.T) {
+	for _, test := range []struct {
+		pairs    [][3]string
+		expected string
+	}{
+		{[][3]string{{`19100`, `/metrics`, `http://localhost:9100/metrics`}, {`19100`, `/metrics`, `http://localhost:9101/metrics`}}, `/metrics is routed twice on 19100`},
+		{[][3]string{{`19100`, `/metrics`, `http://localhost:19100/metrics`}}, `19100/metrics would scrape http://localhost:19100, which the proxy listens on itself`},
+		{[][3]string{{`19100`, `/metrics`, `http://localhost:9100/metrics`}, {`19101`, `/metrics`, `http://127.0.0.1:19100/metrics`}}, `which the proxy listens on itself`},
+		{[][3]string{{`19100`, `/metrics`, `http://localhost:9100/metrics`}, {`9000`, `/metrics`, `http://localhost:9101/metrics`}}, `port 9000 is both a listen port and the service discovery port`},
+	} {
+		addresses, tables := routesOf(t, test.pairs...)
+		err := validateRoutes(addresses, tables, 9000, false)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf(`%v: %v, expected %q`, test.pairs, err, test.expected)
+		}
+	}
+}
+
+func TestUpstreamsScrapedTwiceAreWarnedAbout(t *testing.T) {
+	logged := captureLog(t)
+	addresses, tables := routesOf(t,
+		[3]string{`19100`, `/metrics`, `http://localhost:9100/metrics`},
+		[3]string{`19101`, `/metrics`, `http://localhost:9100/metrics`},
+		[3]string{`19101`, `/other`, `http://localhost:9100/metrics?collect=cpu`},
+	)
+	if err := validateRoutes(addresses, tables, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logged.String(), `warning: http://localhost:9100/metrics is scraped for both 19100/metrics and 19101/metrics`) || strings.Count(logged.String(), `warning`) != 1 {
+		t.Errorf(`logged %s`, logged)
+	}
+
+	// Unless that's intended
+	logged.Reset()
+	if err := validateRoutes(addresses, tables, 0, true); err != nil || logged.Len() > 0 {
+		t.Errorf(`with duplicates allowed %v, logged %s`, err, logged)
+	}
+}
+
+func TestTheRoutesArePrintedAsUnderstood(t *testing.T) {
+	addresses, tables := routesOf(t,
+		[3]string{`19100`, `/metrics`, `http://localhost:9100/metrics`},
+		[3]string{`19100`, `/app`, `http://localhost:8080/metrics,http://localhost:8081/metrics`},
+	)
+	var printed bytes.Buffer
+	printRoutes(&printed, addresses, tables)
+	expected := `LISTEN  PATH      UPSTREAMS
+19100   /metrics  http://localhost:9100/metrics
+19100   /app      http://localhost:8080/metrics (fails over to http://localhost:8081)
+`
+	if printed.String() != expected {
+		t.Errorf("printed\n%s\nexpected\n%s", printed.String(), expected)
+	}
+}
@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/pdxiv/frugalpromproxy/staleness"
+)
+
+// Series missing from the upstream for this long are forgotten, 0 keeps
+// them for as long as the target is served
+var forgetSeriesAfter time.Duration
+
+var seriesForgotten = selfMetrics.newCounterVec(`frugalpromproxy_series_forgotten_total`, `Series whose state was dropped because they were missing from the upstream for -forget-series-after.`, `target`)
+
+// Drop the state of the series the unchanged policies haven't seen for the
+// forgetSeriesAfter of the settings. Runs every quarter of that at most, so
+// a large state isn't read on every scrape.
+func (scrapeTarget *ScrapeTarget) forgetVanished(policies *staleness.Policies, now time.Time) {
+	after := scrapeTarget.settings.forgetSeriesAfter
+	if after <= 0 || now.Sub(scrapeTarget.lastForget) < after/4 {
+		return
+	}
+	scrapeTarget.lastForget = now
+	if forgotten := policies.Forget(now, now.Add(-after)); forgotten > 0 {
+		seriesForgotten.add(float64(forgotten), []string{scrapeTarget.name})
+	}
+}
@@ -0,0 +1,151 @@
+package staleness
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// The default policy: a series is suppressed once its value hasn't changed
+// for more than threshold scrapes. A counter changing after it was
+// suppressed, like one that was reset, is passed on for counterWarmUp more
+// scrapes, so rate() has samples on both sides of the change.
+type unchangedPolicy struct {
+	threshold         int64
+	startStale        bool
+	timestampIsChange bool
+	suppressCounters  bool
+	counterWarmUp     int64
+
+	target   string
+	store    StateStore
+	ownStore bool                      // Closed along with the policy
+	pending  map[SeriesKey]SeriesState // Changes of the current scrape
+}
+
+func newUnchangedPolicy(params map[string]string) (Policy, error) {
+	policy := &unchangedPolicy{threshold: DefaultThreshold, startStale: true, suppressCounters: true, store: NewMemoryStore(), ownStore: true, pending: make(map[SeriesKey]SeriesState)}
+	for name, value := range params {
+		var err error
+		switch name {
+		case `threshold`:
+			policy.threshold, err = strconv.ParseInt(value, 10, 64)
+		case `start_stale`:
+			policy.startStale, err = strconv.ParseBool(value)
+		case `timestamp_is_change`:
+			policy.timestampIsChange, err = strconv.ParseBool(value)
+		case `suppress_counters`:
+			policy.suppressCounters, err = strconv.ParseBool(value)
+		case `counter_warm_up`:
+			policy.counterWarmUp, err = strconv.ParseInt(value, 10, 64)
+		default:
+			err = fmt.Errorf(`unknown parameter %s of the unchanged policy`, name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return policy, nil
+}
+
+// Keep the state in a store shared with other targets
+func (policy *unchangedPolicy) useStore(store StateStore) {
+	policy.store.Close()
+	policy.store, policy.ownStore = store, false
+}
+
+func (policy *unchangedPolicy) Observe(series SeriesKey, sample Sample, now time.Time) Decision {
+	state, ok, err := policy.store.Get(policy.target, series)
+	if err != nil {
+		log.Printf("%s: reading the state of %s: %v", policy.target, series.Name, err)
+	}
+	if !ok {
+		// Unchanged counter value should be initialized differently if we want
+		// to start with assuming that all value are stale, or if we want to
+		// start by assuming that all values are "live" and then gradually
+		// put them in "stale" status.
+		// * -1, assume all values are live
+		// * threshold value, assume all values are stale to begin with
+		state.Value, state.Timestamp = SampleValue(sample.Value), sample.Timestamp
+		state.Unchanged = -1
+		if policy.startStale {
+			state.Unchanged = policy.threshold
+		}
+	}
+	counter := sample.Type == `counter`
+	wasSuppressed := ok && counter && policy.suppressCounters && policy.threshold > 0 && state.Unchanged > policy.limit(state)
+	// Check if value is unchanged compared to previous value. A new
+	// timestamp alone is no change, unless it's taken as a sign of life. A
+	// counter going down was reset, which is a change like any other.
+	if float64(state.Value) != sample.Value || policy.timestampIsChange && state.Timestamp != sample.Timestamp {
+		state.Unchanged = 0
+		state.Revived = counter && (wasSuppressed || state.Revived)
+	} else {
+		state.Unchanged++
+	}
+	state.Value, state.Timestamp = SampleValue(sample.Value), sample.Timestamp
+	state.LastSeen = now.UnixNano() / int64(time.Millisecond)
+	// A threshold of 0 or less never suppresses, the state is kept anyway
+	decision := Forward
+	if policy.threshold > 0 && state.Unchanged > policy.limit(state) && (!counter || policy.suppressCounters) {
+		decision = Suppress
+		state.Revived = false
+	}
+	policy.pending[series] = state
+	return decision
+}
+
+// The scrapes a series may stay unchanged before it is suppressed
+func (policy *unchangedPolicy) limit(state SeriesState) int64 {
+	if state.Revived {
+		return policy.threshold + policy.counterWarmUp
+	}
+	return policy.threshold
+}
+
+// Note the time an observed series was passed on
+func (policy *unchangedPolicy) forwarded(series SeriesKey, now time.Time) {
+	if state, ok := policy.pending[series]; ok {
+		state.LastForwarded = now.UnixNano() / int64(time.Millisecond)
+		policy.pending[series] = state
+	}
+}
+
+// Save the changes of the scrape, returning the oldest last forwarded time
+// among its series that were ever passed on
+func (policy *unchangedPolicy) flush() int64 {
+	var oldest int64
+	for _, state := range policy.pending {
+		if state.LastForwarded > 0 && (oldest == 0 || state.LastForwarded < oldest) {
+			oldest = state.LastForwarded
+		}
+	}
+	if err := policy.store.Put(policy.target, policy.pending); err != nil {
+		log.Printf("%s: saving the series state: %v", policy.target, err)
+	}
+	policy.pending = make(map[SeriesKey]SeriesState, len(policy.pending))
+	return oldest
+}
+
+func (policy *unchangedPolicy) Close() {
+	if policy.ownStore {
+		policy.store.Close()
+	}
+}
+
+// Passes every series on, for families that must never go missing
+type neverPolicy struct{}
+
+func newNeverPolicy(params map[string]string) (Policy, error) {
+	if len(params) > 0 {
+		return nil, fmt.Errorf(`the never policy has no parameters`)
+	}
+	return neverPolicy{}, nil
+}
+
+func (neverPolicy) Observe(SeriesKey, Sample, time.Time) Decision {
+	return Forward
+}
+
+func (neverPolicy) Close() {}
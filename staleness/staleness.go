@@ -0,0 +1,506 @@
+// Package staleness decides which series of a scrape frugalpromproxy passes
+// on. Every target has a set of Policies, one for each rule matching metric
+// names, and the unchanged policy among them suppresses a series once its
+// value hasn't changed for a number of scrapes. What the unchanged policy
+// remembers about a series is kept in a StateStore, on the heap or in a
+// bbolt file.
+package staleness
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SeriesKey identifies a series within a target
+type SeriesKey struct {
+	Name   string
+	Labels string // As in the exposition, without the braces
+}
+
+// Sample is the value of a series in one scrape
+type Sample struct {
+	Value float64
+	// Milliseconds since the epoch the upstream gave with the value, 0 for
+	// none
+	Timestamp int64
+	// TYPE of the family, like counter or gauge. The series of histograms
+	// and summaries have the type of their family.
+	Type string
+}
+
+// Decision tells whether a series is passed on
+type Decision int
+
+const (
+	Forward  Decision = iota // Pass the series on
+	Suppress                 // Leave the series out
+)
+
+// Policy decides for every series of every scrape whether it is passed on.
+// Every target has its own instances, so a policy can keep state per
+// series. Observe is called for the series of one scrape at a time.
+type Policy interface {
+	Observe(series SeriesKey, sample Sample, now time.Time) Decision
+	// Close is called when the target goes away, for instance when a
+	// discovered target disappeared
+	Close()
+}
+
+// Factory creates a policy for a target, from the parameters of its rule
+type Factory func(params map[string]string) (Policy, error)
+
+var factories = struct {
+	mu        sync.Mutex
+	factories map[string]Factory
+}{factories: map[string]Factory{
+	`unchanged`: newUnchangedPolicy,
+	`never`:     newNeverPolicy,
+}}
+
+// Register makes a policy selectable by name in a Rule. Registering a name
+// again replaces the factory.
+func Register(name string, factory Factory) {
+	factories.mu.Lock()
+	factories.factories[name] = factory
+	factories.mu.Unlock()
+}
+
+// Rule is a policy for the metric names matching a pattern, like node_cpu_*
+type Rule struct {
+	pattern string
+	policy  string
+	params  map[string]string
+}
+
+// ParseRule reads a rule written like node_cpu_*=unchanged:threshold=20,
+// and checks that its policy can be created
+func ParseRule(value string) (Rule, error) {
+	equals := strings.Index(value, `=`)
+	if equals < 1 {
+		return Rule{}, fmt.Errorf(`%s isn't a pattern=policy rule`, value)
+	}
+	rule := Rule{pattern: value[:equals], policy: value[equals+1:], params: map[string]string{}}
+	if _, err := path.Match(rule.pattern, ``); err != nil {
+		return Rule{}, err
+	}
+	if colon := strings.Index(rule.policy, `:`); colon >= 0 {
+		params, err := parseParams(rule.policy[colon+1:])
+		if err != nil {
+			return Rule{}, err
+		}
+		rule.policy, rule.params = rule.policy[:colon], params
+	}
+	// Fail when the rule is read rather than for the first target
+	policy, err := rule.newPolicy()
+	if err != nil {
+		return Rule{}, err
+	}
+	policy.Close()
+	return rule, nil
+}
+
+// Comma separated name=value pairs
+func parseParams(pairs string) (map[string]string, error) {
+	parsed := make(map[string]string)
+	for _, pair := range strings.Split(pairs, `,`) {
+		if pair == `` {
+			continue
+		}
+		equals := strings.Index(pair, `=`)
+		if equals < 1 {
+			return nil, fmt.Errorf(`%s isn't a name=value pair`, pair)
+		}
+		parsed[pair[:equals]] = pair[equals+1:]
+	}
+	return parsed, nil
+}
+
+// ID names the rule in metrics and APIs, like staleness:node_cpu_*=unchanged
+func (rule Rule) ID() string {
+	return `staleness:` + rule.pattern + `=` + rule.policy
+}
+
+func (rule Rule) newPolicy() (Policy, error) {
+	factories.mu.Lock()
+	factory, ok := factories.factories[rule.policy]
+	factories.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf(`unknown staleness policy %s`, rule.policy)
+	}
+	// A copy, so the factory can't change the rule
+	params := make(map[string]string, len(rule.params))
+	for name, value := range rule.params {
+		params[name] = value
+	}
+	return factory(params)
+}
+
+func (rule Rule) equal(other Rule) bool {
+	if rule.pattern != other.pattern || rule.policy != other.policy || len(rule.params) != len(other.params) {
+		return false
+	}
+	for name, value := range rule.params {
+		if otherValue, ok := other.params[name]; !ok || otherValue != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Rules is a repeatable command line flag, like
+// node_cpu_*=unchanged:threshold=20. The first rule matching a metric name
+// applies, names matching none use the unchanged policy with its defaults.
+type Rules []Rule
+
+func (rules *Rules) String() string {
+	var elements []string
+	for _, rule := range *rules {
+		elements = append(elements, rule.pattern+`=`+rule.policy)
+	}
+	return strings.Join(elements, ` `)
+}
+
+func (rules *Rules) Set(value string) error {
+	rule, err := ParseRule(value)
+	if err != nil {
+		return err
+	}
+	*rules = append(*rules, rule)
+	return nil
+}
+
+// Defaults are the settings of the unchanged policies of a target whose
+// rule doesn't set them
+type Defaults struct {
+	Threshold         int64 // Scrapes a value may stay the same, 0 or less never suppresses
+	StartStale        bool  // New series count as unchanged for the threshold already
+	TimestampIsChange bool  // A new upstream timestamp counts as a change
+	SuppressCounters  bool  // Counters are suppressed like other series
+	CounterWarmUp     int64 // Scrapes on top of the threshold for a counter changing after it was suppressed
+}
+
+// DefaultThreshold is the threshold of an unchanged policy without one
+const DefaultThreshold = 240
+
+func (defaults Defaults) params(params map[string]string) map[string]string {
+	withDefaults := map[string]string{
+		`threshold`:           strconv.FormatInt(defaults.Threshold, 10),
+		`start_stale`:         strconv.FormatBool(defaults.StartStale),
+		`timestamp_is_change`: strconv.FormatBool(defaults.TimestampIsChange),
+		`suppress_counters`:   strconv.FormatBool(defaults.SuppressCounters),
+		`counter_warm_up`:     strconv.FormatInt(defaults.CounterWarmUp, 10),
+	}
+	for name, value := range params {
+		withDefaults[name] = value
+	}
+	return withDefaults
+}
+
+// Policies are the policies of one target, in the order of the rules.
+// Observe, Forwarded and Flush are called for one scrape at a time, the
+// other methods may be called at any time.
+type Policies struct {
+	target   string
+	rules    []Rule
+	policies []Policy
+
+	mu      sync.Mutex
+	matched map[string]int // Index of the policy for a metric name
+}
+
+// New creates the policies of a target. The rules were checked when they
+// were parsed, a factory failing now nevertheless gets the default policy
+// in its place. Unchanged policies get the defaults for the settings their
+// rule leaves out, and keep their state in store, or in a store of their
+// own when it is nil.
+func New(target string, rules Rules, defaults Defaults, store StateStore) *Policies {
+	rules = append(append(Rules(nil), rules...), Rule{pattern: `*`, policy: `unchanged`})
+	policies := &Policies{target: target, rules: rules, matched: make(map[string]int)}
+	for i, rule := range rules {
+		if rule.policy == `unchanged` {
+			rule.params = defaults.params(rule.params)
+		}
+		policy, err := rule.newPolicy()
+		if err != nil {
+			log.Printf("%s: %v, using the unchanged policy for %s", target, err, rule.pattern)
+			policy, _ = newUnchangedPolicy(defaults.params(nil))
+			policies.rules[i].policy = `unchanged`
+		}
+		policies.rules[i].params = rule.params
+		if unchanged, ok := policy.(*unchangedPolicy); ok {
+			unchanged.target = target
+			if store != nil {
+				unchanged.useStore(store)
+			}
+		}
+		policies.policies = append(policies.policies, policy)
+	}
+	return policies
+}
+
+// Policy returns the policy for a metric name, and the name it was
+// registered under
+func (policies *Policies) Policy(name string) (Policy, string) {
+	index := policies.index(name)
+	return policies.policies[index], policies.rules[index].policy
+}
+
+// Rule returns the ID of the rule applying to a metric name
+func (policies *Policies) Rule(name string) string {
+	return policies.rules[policies.index(name)].ID()
+}
+
+// The rule applying to a metric name, remembered for the next scrape
+func (policies *Policies) index(name string) int {
+	policies.mu.Lock()
+	defer policies.mu.Unlock()
+	index, ok := policies.matched[name]
+	if !ok {
+		index = policies.firstMatching(name)
+		policies.matched[name] = index
+	}
+	return index
+}
+
+// The first rule matching a metric name. The default rule at the end
+// matches every name.
+func (policies *Policies) firstMatching(name string) int {
+	var index int
+	for index = range policies.rules {
+		if matched, _ := path.Match(policies.rules[index].pattern, name); matched {
+			break
+		}
+	}
+	return index
+}
+
+// Observe decides about a series of the current scrape
+func (policies *Policies) Observe(series SeriesKey, sample Sample, now time.Time) Decision {
+	policy, _ := policies.Policy(series.Name)
+	return policy.Observe(series, sample, now)
+}
+
+// Forwarded notes that an observed series was passed on. Only the unchanged
+// policy keeps the time.
+func (policies *Policies) Forwarded(series SeriesKey, now time.Time) {
+	policy, _ := policies.Policy(series.Name)
+	if unchanged, ok := policy.(*unchangedPolicy); ok {
+		unchanged.forwarded(series, now)
+	}
+}
+
+// Flush is called after every scrape, for policies writing their state in
+// batches. Returns when the series of the scrape that was passed on the
+// longest time ago was last passed on, zero when none of them ever was.
+func (policies *Policies) Flush() time.Time {
+	var oldest int64
+	for _, policy := range policies.policies {
+		if unchanged, ok := policy.(*unchangedPolicy); ok {
+			if lastForwarded := unchanged.flush(); lastForwarded > 0 && (oldest == 0 || lastForwarded < oldest) {
+				oldest = lastForwarded
+			}
+		}
+	}
+	if oldest == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, oldest*int64(time.Millisecond))
+}
+
+// Unchanged tells how many scrapes in a row a series had the same value,
+// and the threshold above which its policy suppresses it. False when the
+// series doesn't have an unchanged policy.
+func (policies *Policies) Unchanged(series SeriesKey) (scrapes, threshold int64, ok bool) {
+	policy, _ := policies.Policy(series.Name)
+	unchanged, ok := policy.(*unchangedPolicy)
+	if !ok {
+		return 0, 0, false
+	}
+	state, _, _ := unchanged.store.Get(unchanged.target, series)
+	return state.Unchanged, unchanged.threshold, true
+}
+
+// Each calls fn for every series the unchanged policies keep state for
+func (policies *Policies) Each(fn func(SeriesKey, SeriesState)) {
+	for _, unchanged := range policies.distinctUnchanged() {
+		unchanged.store.Each(unchanged.target, func(series SeriesKey, state SeriesState) error {
+			fn(series, state)
+			return nil
+		})
+	}
+}
+
+// The unchanged policies, once for every store and target: policies
+// sharing a store see the same series
+func (policies *Policies) distinctUnchanged() []*unchangedPolicy {
+	type storeTarget struct {
+		store  StateStore
+		target string
+	}
+	seen := make(map[storeTarget]bool)
+	var distinct []*unchangedPolicy
+	for _, policy := range policies.policies {
+		unchanged, ok := policy.(*unchangedPolicy)
+		if !ok || seen[storeTarget{unchanged.store, unchanged.target}] {
+			continue
+		}
+		seen[storeTarget{unchanged.store, unchanged.target}] = true
+		distinct = append(distinct, unchanged)
+	}
+	return distinct
+}
+
+// SameRules tells whether both decide the same way. The rules of the
+// policies are built with the defaults of the target, so those count too.
+func (policies *Policies) SameRules(other *Policies) bool {
+	if len(policies.rules) != len(other.rules) {
+		return false
+	}
+	for i, rule := range policies.rules {
+		if !rule.equal(other.rules[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// MoveState hands the series state of the unchanged policies on to the
+// policies of next taking over their metric names. Series whose name now
+// has another kind of policy start over with it.
+func (policies *Policies) MoveState(next *Policies) {
+	moved := make(map[*unchangedPolicy]map[SeriesKey]SeriesState)
+	// Series of a store the new policies keep using, that now have another
+	// kind of policy
+	dropped := make(map[*unchangedPolicy][]SeriesKey)
+	for _, policy := range policies.policies {
+		unchanged, ok := policy.(*unchangedPolicy)
+		if !ok {
+			continue
+		}
+		err := unchanged.store.Each(unchanged.target, func(series SeriesKey, state SeriesState) error {
+			successor, _ := next.Policy(series.Name)
+			successorUnchanged, ok := successor.(*unchangedPolicy)
+			switch {
+			case ok && successorUnchanged.store != unchanged.store:
+				if moved[successorUnchanged] == nil {
+					moved[successorUnchanged] = make(map[SeriesKey]SeriesState)
+				}
+				moved[successorUnchanged][series] = state
+			case !ok && !unchanged.ownStore:
+				dropped[unchanged] = append(dropped[unchanged], series)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("%s: reading the series state: %v", unchanged.target, err)
+		}
+	}
+	// Written after reading, a bbolt store can't be written during a read
+	for successor, states := range moved {
+		if err := successor.store.Put(successor.target, states); err != nil {
+			log.Printf("%s: saving the series state: %v", successor.target, err)
+		}
+	}
+	for unchanged, series := range dropped {
+		if err := unchanged.store.Delete(unchanged.target, series); err != nil {
+			log.Printf("%s: forgetting the series state: %v", unchanged.target, err)
+		}
+	}
+}
+
+// Prune forgets the state of the series the unchanged policies keep, but
+// that aren't in seen. Returns how many were forgotten.
+func (policies *Policies) Prune(seen map[SeriesKey]bool) int {
+	var removed int
+	for _, unchanged := range policies.distinctUnchanged() {
+		var missing []SeriesKey
+		unchanged.store.Each(unchanged.target, func(series SeriesKey, state SeriesState) error {
+			if !seen[series] {
+				missing = append(missing, series)
+			}
+			return nil
+		})
+		if len(missing) == 0 {
+			continue
+		}
+		if err := unchanged.store.Delete(unchanged.target, missing); err != nil {
+			log.Printf("%s: forgetting the state of series no longer scraped: %v", policies.target, err)
+			continue
+		}
+		removed += len(missing)
+	}
+	return removed
+}
+
+// ShiftTimes moves the last seen and last forwarded times of every series
+// by a jump of the wall clock
+func (policies *Policies) ShiftTimes(jump time.Duration) {
+	jumpMs := int64(jump / time.Millisecond)
+	for _, unchanged := range policies.distinctUnchanged() {
+		shifted := make(map[SeriesKey]SeriesState)
+		unchanged.store.Each(unchanged.target, func(series SeriesKey, state SeriesState) error {
+			if state.LastSeen != 0 {
+				state.LastSeen += jumpMs
+			}
+			if state.LastForwarded != 0 {
+				state.LastForwarded += jumpMs
+			}
+			shifted[series] = state
+			return nil
+		})
+		// Written after reading, a bbolt store can't be written during a read
+		if err := unchanged.store.Put(unchanged.target, shifted); err != nil {
+			log.Printf("%s: saving the series state: %v", policies.target, err)
+		}
+	}
+}
+
+// Forget drops the state of the series last seen before cutoff. Series
+// saved before the time they were last seen was kept start counting now.
+// Returns how many were forgotten.
+func (policies *Policies) Forget(now, cutoff time.Time) int {
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+	cutoffMs := cutoff.UnixNano() / int64(time.Millisecond)
+	var forgotten int
+	for _, unchanged := range policies.distinctUnchanged() {
+		var vanished []SeriesKey
+		unseen := make(map[SeriesKey]SeriesState)
+		unchanged.store.Each(unchanged.target, func(series SeriesKey, state SeriesState) error {
+			switch {
+			case state.LastSeen == 0:
+				state.LastSeen = nowMs
+				unseen[series] = state
+			case state.LastSeen < cutoffMs:
+				vanished = append(vanished, series)
+			}
+			return nil
+		})
+		// Written after reading, a bbolt store can't be written during a read
+		if len(unseen) > 0 {
+			if err := unchanged.store.Put(unchanged.target, unseen); err != nil {
+				log.Printf("%s: saving the series state: %v", policies.target, err)
+			}
+		}
+		if len(vanished) == 0 {
+			continue
+		}
+		if err := unchanged.store.Delete(unchanged.target, vanished); err != nil {
+			log.Printf("%s: forgetting vanished series: %v", policies.target, err)
+			continue
+		}
+		forgotten += len(vanished)
+	}
+	return forgotten
+}
+
+// Close closes the policies, when the target goes away or got new ones
+func (policies *Policies) Close() {
+	for _, policy := range policies.policies {
+		policy.Close()
+	}
+}
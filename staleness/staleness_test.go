@@ -0,0 +1,227 @@
+package staleness
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Passes a series on every nth time it is observed, like a heartbeat
+type everyNthPolicy struct {
+	n        int
+	observed map[SeriesKey]int
+	closed   *bool
+}
+
+func registerEveryNth(closed *bool) {
+	Register(`every_nth`, func(params map[string]string) (Policy, error) {
+		n, err := strconv.Atoi(params[`n`])
+		if err != nil {
+			return nil, err
+		}
+		return &everyNthPolicy{n: n, observed: make(map[SeriesKey]int), closed: closed}, nil
+	})
+}
+
+func (policy *everyNthPolicy) Observe(series SeriesKey, sample Sample, now time.Time) Decision {
+	policy.observed[series]++
+	if policy.observed[series]%policy.n == 1 {
+		return Forward
+	}
+	return Suppress
+}
+
+func (policy *everyNthPolicy) Close() {
+	if policy.closed != nil {
+		*policy.closed = true
+	}
+}
+
+func rulesOf(t *testing.T, values ...string) Rules {
+	t.Helper()
+	var rules Rules
+	for _, value := range values {
+		if err := rules.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rules
+}
+
+// Decisions about a series over scrapes of the same value
+func decisions(policies *Policies, series SeriesKey, scrapes int) string {
+	var decided []byte
+	now := time.Unix(1622548800, 0)
+	for i := 0; i < scrapes; i++ {
+		decision := policies.Observe(series, Sample{Value: 1, Type: `gauge`}, now)
+		if decision == Forward {
+			policies.Forwarded(series, now)
+			decided = append(decided, 'F')
+		} else {
+			decided = append(decided, 'S')
+		}
+		policies.Flush()
+		now = now.Add(15 * time.Second)
+	}
+	return string(decided)
+}
+
+func TestPoliciesApplyByMetricPattern(t *testing.T) {
+	policies := New(`node`, rulesOf(t, `up=never`, `node_cpu_*=unchanged:threshold=1`), Defaults{Threshold: 3}, nil)
+	defer policies.Close()
+
+	for series, expected := range map[SeriesKey]string{
+		{Name: `up`}: `FFFFFF`,
+		{Name: `node_cpu_seconds_total`, Labels: `cpu="0"`}: `FFSSSS`,
+		{Name: `node_load1`}: `FFFFSS`,
+	} {
+		if got := decisions(policies, series, 6); got != expected {
+			t.Errorf(`%s: %s, expected %s`, series.Name, got, expected)
+		}
+	}
+	if rule := policies.Rule(`node_cpu_guest_seconds_total`); rule != `staleness:node_cpu_*=unchanged` {
+		t.Errorf(`rule %s`, rule)
+	}
+	if rule := policies.Rule(`node_load1`); rule != `staleness:*=unchanged` {
+		t.Errorf(`rule of a name matching no pattern %s`, rule)
+	}
+}
+
+func TestTheFirstMatchingRuleApplies(t *testing.T) {
+	policies := New(`node`, rulesOf(t, `node_cpu_seconds_total=never`, `node_*=unchanged:threshold=1`), Defaults{Threshold: 3}, nil)
+	defer policies.Close()
+	if _, name := policies.Policy(`node_cpu_seconds_total`); name != `never` {
+		t.Errorf(`policy %s`, name)
+	}
+	if _, name := policies.Policy(`node_load1`); name != `unchanged` {
+		t.Errorf(`policy %s`, name)
+	}
+	if scrapes, threshold, ok := policies.Unchanged(SeriesKey{Name: `node_load1`}); !ok || scrapes != 0 || threshold != 1 {
+		t.Errorf(`%d scrapes of threshold %d, %v`, scrapes, threshold, ok)
+	}
+}
+
+func TestCustomPoliciesCanBeRegistered(t *testing.T) {
+	var closed bool
+	registerEveryNth(&closed)
+	policies := New(`node`, rulesOf(t, `heartbeat_*=every_nth:n=3`), Defaults{Threshold: 10}, nil)
+
+	if got := decisions(policies, SeriesKey{Name: `heartbeat_total`}, 7); got != `FSSFSSF` {
+		t.Errorf(`custom policy decided %s`, got)
+	}
+	if got := decisions(policies, SeriesKey{Name: `node_load1`}, 7); got != `FFFFFFF` {
+		t.Errorf(`unchanged policy beside the custom one decided %s`, got)
+	}
+	if _, _, ok := policies.Unchanged(SeriesKey{Name: `heartbeat_total`}); ok {
+		t.Error(`the custom policy was taken for an unchanged policy`)
+	}
+	policies.Close()
+	if !closed {
+		t.Error(`the custom policy wasn't closed with the target`)
+	}
+}
+
+func TestRulesAreCheckedWhenParsed(t *testing.T) {
+	registerEveryNth(nil)
+	for _, value := range []string{
+		`up`,
+		`=never`,
+		`up=nonexistent`,
+		`up=never:threshold=1`,
+		`up=unchanged:threshold=many`,
+		`up=unchanged:color=blue`,
+		`up=unchanged:threshold`,
+		`heartbeat_*=every_nth`,
+		`[=never`,
+	} {
+		if _, err := ParseRule(value); err == nil {
+			t.Errorf(`%s was accepted`, value)
+		}
+	}
+	rule, err := ParseRule(`node_*=unchanged:threshold=20,start_stale=false`)
+	if err != nil || rule.ID() != `staleness:node_*=unchanged` || rule.params[`threshold`] != `20` || rule.params[`start_stale`] != `false` {
+		t.Errorf(`rule %+v: %v`, rule, err)
+	}
+}
+
+func TestSameRulesComparesTheParameters(t *testing.T) {
+	policies := New(`node`, rulesOf(t, `node_*=unchanged:threshold=1`), Defaults{Threshold: 3}, nil)
+	same := New(`node`, rulesOf(t, `node_*=unchanged:threshold=1`), Defaults{Threshold: 3}, nil)
+	other := New(`node`, rulesOf(t, `node_*=unchanged:threshold=2`), Defaults{Threshold: 3}, nil)
+	otherDefaults := New(`node`, rulesOf(t, `node_*=unchanged:threshold=1`), Defaults{Threshold: 4}, nil)
+	for _, p := range []*Policies{policies, same, other, otherDefaults} {
+		defer p.Close()
+	}
+	if !policies.SameRules(same) || policies.SameRules(other) || policies.SameRules(otherDefaults) {
+		t.Error(`SameRules told the rules apart wrong`)
+	}
+}
+
+func TestMoveStateKeepsTheUnchangedCount(t *testing.T) {
+	policies := New(`node`, nil, Defaults{Threshold: 3}, nil)
+	defer policies.Close()
+	decisions(policies, SeriesKey{Name: `node_load1`}, 3)
+	decisions(policies, SeriesKey{Name: `up`}, 3)
+
+	next := New(`node`, rulesOf(t, `up=never`), Defaults{Threshold: 3}, nil)
+	defer next.Close()
+	policies.MoveState(next)
+	if scrapes, _, ok := next.Unchanged(SeriesKey{Name: `node_load1`}); !ok || scrapes != 2 {
+		t.Errorf(`moved state counted %d scrapes`, scrapes)
+	}
+	if got := decisions(next, SeriesKey{Name: `node_load1`}, 2); got != `FS` {
+		t.Errorf(`after the move decided %s`, got)
+	}
+}
+
+// Decisions about a counter or gauge over scrapes of the values
+func decisionsOf(policies *Policies, metricType string, values ...float64) string {
+	var decided []byte
+	now := time.Unix(1622548800, 0)
+	series := SeriesKey{Name: `http_requests_total`}
+	for _, value := range values {
+		if policies.Observe(series, Sample{Value: value, Type: metricType}, now) == Forward {
+			policies.Forwarded(series, now)
+			decided = append(decided, 'F')
+		} else {
+			decided = append(decided, 'S')
+		}
+		policies.Flush()
+		now = now.Add(15 * time.Second)
+	}
+	return string(decided)
+}
+
+func TestCountersArePassedOnForAWarmUpAfterTheyComeBack(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		defaults   Defaults
+		metricType string
+		values     []float64
+		expected   string
+	}{
+		{`a flat counter`, Defaults{Threshold: 2, SuppressCounters: true}, `counter`, []float64{5, 5, 5, 5, 5}, `FFFSS`},
+		{`an increment after being suppressed`, Defaults{Threshold: 2, SuppressCounters: true, CounterWarmUp: 2}, `counter`, []float64{5, 5, 5, 5, 6, 6, 6, 6, 6, 6}, `FFFSFFFFFS`},
+		{`a reset after being suppressed`, Defaults{Threshold: 2, SuppressCounters: true, CounterWarmUp: 2}, `counter`, []float64{5, 5, 5, 5, 0, 0, 0, 0, 0, 0}, `FFFSFFFFFS`},
+		{`a reset while passed on`, Defaults{Threshold: 2, SuppressCounters: true, CounterWarmUp: 2}, `counter`, []float64{5, 5, 0, 0, 0, 0}, `FFFFFS`},
+		{`an increment without a warm-up`, Defaults{Threshold: 2, SuppressCounters: true}, `counter`, []float64{5, 5, 5, 5, 6, 6, 6, 6}, `FFFSFFFS`},
+		{`an increment before being suppressed`, Defaults{Threshold: 2, SuppressCounters: true, CounterWarmUp: 2}, `counter`, []float64{5, 5, 6, 6, 6, 6}, `FFFFFS`},
+		{`a gauge coming back`, Defaults{Threshold: 2, SuppressCounters: true, CounterWarmUp: 2}, `gauge`, []float64{5, 5, 5, 5, 6, 6, 6, 6}, `FFFSFFFS`},
+		{`a counter never suppressed`, Defaults{Threshold: 2}, `counter`, []float64{5, 5, 5, 5, 5, 5}, `FFFFFF`},
+		{`a gauge next to counters never suppressed`, Defaults{Threshold: 2}, `gauge`, []float64{5, 5, 5, 5, 5, 5}, `FFFSSS`},
+	} {
+		policies := New(`node`, nil, test.defaults, nil)
+		if decided := decisionsOf(policies, test.metricType, test.values...); decided != test.expected {
+			t.Errorf(`%s: %s, expected %s`, test.name, decided, test.expected)
+		}
+		policies.Close()
+	}
+}
+
+func TestCounterSuppressionCanBeSetByRule(t *testing.T) {
+	policies := New(`node`, rulesOf(t, `http_*=unchanged:suppress_counters=false`), Defaults{Threshold: 1, SuppressCounters: true}, nil)
+	defer policies.Close()
+	if decided := decisionsOf(policies, `counter`, 1, 1, 1, 1); decided != `FFFF` {
+		t.Errorf(`a counter of the rule: %s`, decided)
+	}
+}
@@ -0,0 +1,340 @@
+package staleness
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pdxiv/frugalpromproxy/parser"
+	bolt "go.etcd.io/bbolt"
+)
+
+// SeriesState is what the unchanged policy remembers about a series
+type SeriesState struct {
+	Value     SampleValue `json:"value"`
+	Unchanged int64       `json:"unchanged"` // Scrapes in a row with the same value
+	// Milliseconds the upstream gave with the value, 0 if it gave none
+	Timestamp int64 `json:"timestamp,omitempty"`
+	// Unix time in milliseconds the series was last passed on, 0 if never
+	LastForwarded int64 `json:"last_forwarded,omitempty"`
+	// Unix time in milliseconds of the last scrape the series was in
+	LastSeen int64 `json:"last_seen,omitempty"`
+	// A counter that changed after it was suppressed, passed on for the
+	// warm-up on top of the threshold
+	Revived bool `json:"revived,omitempty"`
+}
+
+// SampleValue is the value of a series, written to JSON as a number or as
+// one of the strings NaN, +Inf and -Inf, which JSON has no number for
+type SampleValue float64
+
+func (value SampleValue) MarshalJSON() ([]byte, error) {
+	switch number := float64(value); {
+	case math.IsNaN(number):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(number, 1):
+		return []byte(`"+Inf"`), nil
+	case math.IsInf(number, -1):
+		return []byte(`"-Inf"`), nil
+	default:
+		return json.Marshal(number)
+	}
+}
+
+func (value *SampleValue) UnmarshalJSON(data []byte) error {
+	var special string
+	if json.Unmarshal(data, &special) != nil {
+		var number float64
+		err := json.Unmarshal(data, &number)
+		*value = SampleValue(number)
+		return err
+	}
+	switch special {
+	case `NaN`:
+		*value = SampleValue(math.NaN())
+	case `+Inf`:
+		*value = SampleValue(math.Inf(1))
+	case `-Inf`:
+		*value = SampleValue(math.Inf(-1))
+	default:
+		return fmt.Errorf(`%q isn't a sample value`, special)
+	}
+	return nil
+}
+
+// StateStore keeps the state of the series of all targets using it. Put and
+// Delete get all changes of a scrape at once, so a store on disk can write
+// them in one transaction.
+type StateStore interface {
+	Get(target string, series SeriesKey) (SeriesState, bool, error)
+	Put(target string, states map[SeriesKey]SeriesState) error
+	Delete(target string, series []SeriesKey) error
+	// Each calls fn for every series of the target, stopping at the first
+	// error
+	Each(target string, fn func(SeriesKey, SeriesState) error) error
+	// Snapshot writes the state of all targets as JSON lines, one
+	// SnapshotRecord per series
+	Snapshot(w io.Writer) error
+	Close() error
+}
+
+// SnapshotRecord is a line of a snapshot, and the value of a record in bbolt
+type SnapshotRecord struct {
+	Target string `json:"target,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Labels string `json:"labels,omitempty"`
+	SeriesState
+}
+
+// MemoryStore is the default store, on the heap
+type MemoryStore struct {
+	mu      sync.RWMutex
+	targets map[string]map[SeriesKey]SeriesState
+}
+
+// NewMemoryStore creates an empty store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{targets: make(map[string]map[SeriesKey]SeriesState)}
+}
+
+func (store *MemoryStore) Get(target string, series SeriesKey) (SeriesState, bool, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	state, ok := store.targets[target][series]
+	return state, ok, nil
+}
+
+func (store *MemoryStore) Put(target string, states map[SeriesKey]SeriesState) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	stored, ok := store.targets[target]
+	if !ok {
+		stored = make(map[SeriesKey]SeriesState, len(states))
+		store.targets[target] = stored
+	}
+	for series, state := range states {
+		stored[series] = state
+	}
+	return nil
+}
+
+func (store *MemoryStore) Delete(target string, series []SeriesKey) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for _, key := range series {
+		delete(store.targets[target], key)
+	}
+	return nil
+}
+
+func (store *MemoryStore) Each(target string, fn func(SeriesKey, SeriesState) error) error {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	for series, state := range store.targets[target] {
+		if err := fn(series, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *MemoryStore) Snapshot(w io.Writer) error {
+	store.mu.RLock()
+	names := make([]string, 0, len(store.targets))
+	for target := range store.targets {
+		names = append(names, target)
+	}
+	store.mu.RUnlock()
+	sort.Strings(names)
+
+	encoder := json.NewEncoder(w)
+	for _, target := range names {
+		err := store.Each(target, func(series SeriesKey, state SeriesState) error {
+			return encoder.Encode(SnapshotRecord{Target: target, Name: series.Name, Labels: series.Labels, SeriesState: state})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *MemoryStore) Close() error {
+	store.mu.Lock()
+	store.targets = make(map[string]map[SeriesKey]SeriesState)
+	store.mu.Unlock()
+	return nil
+}
+
+// BoltStore keeps the state in a bbolt file, a bucket per target, trading
+// latency for memory. The state survives restarts.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens the bbolt file, creating it if it doesn't exist
+func OpenBoltStore(file string) (*BoltStore, error) {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	store := &BoltStore{db: db}
+	if err := store.sortLabels(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// Move the series saved with their labels in the order the upstream gave
+// them, before the parser sorted them by name, to their sorted key. A series
+// saved under both keeps the sorted one.
+func (store *BoltStore) sortLabels() error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(target []byte, bucket *bolt.Bucket) error {
+			moved := make(map[string][]byte) // Sorted key by the key it was saved under
+			bucket.ForEach(func(key, value []byte) error {
+				series := boltSeries(key)
+				_, parsed, ok := parser.ParseSeriesLine(series.Name + `{` + series.Labels + `} 0`)
+				if ok && parsed.Labels != series.Labels {
+					moved[string(key)] = boltKey(SeriesKey{Name: series.Name, Labels: parsed.Labels})
+				}
+				return nil
+			})
+			// Written after reading, a bucket can't be written during ForEach
+			for key, sorted := range moved {
+				value := bucket.Get([]byte(key))
+				if bucket.Get(sorted) == nil {
+					if err := bucket.Put(sorted, append([]byte(nil), value...)); err != nil {
+						return err
+					}
+				}
+				if err := bucket.Delete([]byte(key)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// Metric names can't contain a brace, so the key is unambiguous
+func boltKey(series SeriesKey) []byte {
+	return []byte(series.Name + `{` + series.Labels)
+}
+
+func boltSeries(key []byte) SeriesKey {
+	brace := strings.Index(string(key), `{`)
+	return SeriesKey{Name: string(key[:brace]), Labels: string(key[brace+1:])}
+}
+
+func (store *BoltStore) Get(target string, series SeriesKey) (SeriesState, bool, error) {
+	var record SnapshotRecord
+	var found bool
+	err := store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(target))
+		if bucket == nil {
+			return nil
+		}
+		value := bucket.Get(boltKey(series))
+		if value == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(value, &record)
+	})
+	return record.SeriesState, found, err
+}
+
+func (store *BoltStore) Put(target string, states map[SeriesKey]SeriesState) error {
+	if len(states) == 0 {
+		return nil
+	}
+	// Written in key order: bbolt splits its nodes only when the
+	// transaction commits, so inserting many new keys out of order takes
+	// time quadratic in their number
+	type record struct {
+		key   []byte
+		state SeriesState
+	}
+	records := make([]record, 0, len(states))
+	for series, state := range states {
+		records = append(records, record{boltKey(series), state})
+	}
+	sort.Slice(records, func(i, j int) bool { return bytes.Compare(records[i].key, records[j].key) < 0 })
+
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(target))
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			value, err := json.Marshal(SnapshotRecord{SeriesState: record.state})
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(record.key, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (store *BoltStore) Delete(target string, series []SeriesKey) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(target))
+		if bucket == nil {
+			return nil
+		}
+		for _, key := range series {
+			if err := bucket.Delete(boltKey(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (store *BoltStore) Each(target string, fn func(SeriesKey, SeriesState) error) error {
+	return store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(target))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key, value []byte) error {
+			var record SnapshotRecord
+			if err := json.Unmarshal(value, &record); err != nil {
+				return err
+			}
+			return fn(boltSeries(key), record.SeriesState)
+		})
+	})
+}
+
+func (store *BoltStore) Snapshot(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	return store.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(target []byte, bucket *bolt.Bucket) error {
+			return bucket.ForEach(func(key, value []byte) error {
+				var record SnapshotRecord
+				if err := json.Unmarshal(value, &record); err != nil {
+					return err
+				}
+				series := boltSeries(key)
+				record.Target, record.Name, record.Labels = string(target), series.Name, series.Labels
+				return encoder.Encode(record)
+			})
+		})
+	})
+}
+
+func (store *BoltStore) Close() error {
+	return store.db.Close()
+}
@@ -0,0 +1,355 @@
+package staleness
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The backends every store test runs against
+var storeBackends = []struct {
+	name string
+	open func(tb testing.TB) StateStore
+}{
+	{`memory`, func(tb testing.TB) StateStore {
+		store := NewMemoryStore()
+		tb.Cleanup(func() { store.Close() })
+		return store
+	}},
+	{`bbolt`, func(tb testing.TB) StateStore {
+		store, err := OpenBoltStore(filepath.Join(tb.TempDir(), `state.db`))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tb.Cleanup(func() { store.Close() })
+		return store
+	}},
+}
+
+func forEachBackend(t *testing.T, test func(t *testing.T, store StateStore)) {
+	for _, backend := range storeBackends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) { test(t, backend.open(t)) })
+	}
+}
+
+// Series with label values holding the characters a key could trip over
+var (
+	loadSeries   = SeriesKey{Name: `node_load1`}
+	escapedLabel = SeriesKey{Name: `app_last_message`, Labels: `text="a{b}, \"c\"\nd"`}
+)
+
+func stored(t *testing.T, store StateStore, target string) map[SeriesKey]SeriesState {
+	t.Helper()
+	states := make(map[SeriesKey]SeriesState)
+	if err := store.Each(target, func(series SeriesKey, state SeriesState) error {
+		states[series] = state
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return states
+}
+
+func TestStoreGetsWhatWasPut(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store StateStore) {
+		if _, ok, err := store.Get(`node`, loadSeries); ok || err != nil {
+			t.Errorf(`a series never put was found: %v`, err)
+		}
+		state := SeriesState{Value: 0.52, Unchanged: 3, Timestamp: 1622548800000, LastForwarded: 1622548815000, LastSeen: 1622548830000, Revived: true}
+		if err := store.Put(`node`, map[SeriesKey]SeriesState{loadSeries: state, escapedLabel: {Value: 1}}); err != nil {
+			t.Fatal(err)
+		}
+		if got, ok, err := store.Get(`node`, loadSeries); !ok || err != nil || got != state {
+			t.Errorf(`got %+v, %v: %v`, got, ok, err)
+		}
+		if got, ok, _ := store.Get(`node`, escapedLabel); !ok || got.Value != 1 {
+			t.Errorf(`series with escaped labels got %+v, %v`, got, ok)
+		}
+
+		state.Unchanged = 4
+		if err := store.Put(`node`, map[SeriesKey]SeriesState{loadSeries: state}); err != nil {
+			t.Fatal(err)
+		}
+		if got, _, _ := store.Get(`node`, loadSeries); got.Unchanged != 4 {
+			t.Errorf(`a series put again has %+v`, got)
+		}
+		if err := store.Put(`node`, nil); err != nil {
+			t.Errorf(`putting nothing: %v`, err)
+		}
+	})
+}
+
+func TestStoreKeepsNaNAndInfiniteValues(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store StateStore) {
+		nan, positive, negative := SeriesKey{Name: `nan`}, SeriesKey{Name: `positive`}, SeriesKey{Name: `negative`}
+		err := store.Put(`node`, map[SeriesKey]SeriesState{
+			nan:      {Value: SampleValue(math.NaN()), Unchanged: 1},
+			positive: {Value: SampleValue(math.Inf(1)), Unchanged: 2},
+			negative: {Value: SampleValue(math.Inf(-1)), Unchanged: 3},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		states := stored(t, store, `node`)
+		if !math.IsNaN(float64(states[nan].Value)) || !math.IsInf(float64(states[positive].Value), 1) || !math.IsInf(float64(states[negative].Value), -1) || states[negative].Unchanged != 3 {
+			t.Errorf(`stored %+v`, states)
+		}
+		var snapshot bytes.Buffer
+		if err := store.Snapshot(&snapshot); err != nil || !strings.Contains(snapshot.String(), `"name":"nan","value":"NaN","unchanged":1`) || !strings.Contains(snapshot.String(), `"value":"+Inf"`) || !strings.Contains(snapshot.String(), `"value":"-Inf"`) {
+			t.Errorf("snapshot %v\n%s", err, snapshot.String())
+		}
+	})
+}
+
+func TestSampleValuesAreReadFromJSON(t *testing.T) {
+	for _, test := range []struct {
+		json     string
+		expected float64
+	}{
+		{`0.52`, 0.52},
+		{`-3e+09`, -3e9},
+		{`"+Inf"`, math.Inf(1)},
+		{`"-Inf"`, math.Inf(-1)},
+	} {
+		var value SampleValue
+		if err := json.Unmarshal([]byte(test.json), &value); err != nil || float64(value) != test.expected {
+			t.Errorf(`%s read as %v, %v`, test.json, value, err)
+		}
+	}
+	var value SampleValue
+	if err := json.Unmarshal([]byte(`"NaN"`), &value); err != nil || !math.IsNaN(float64(value)) {
+		t.Errorf(`"NaN" read as %v, %v`, value, err)
+	}
+	for _, invalid := range []string{`"Inf"`, `"1"`, `true`} {
+		if err := json.Unmarshal([]byte(invalid), &value); err == nil {
+			t.Errorf(`%s was read as %v`, invalid, value)
+		}
+	}
+}
+
+func TestStoreKeepsTargetsApart(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store StateStore) {
+		store.Put(`node`, map[SeriesKey]SeriesState{loadSeries: {Value: 1}})
+		store.Put(`web-1`, map[SeriesKey]SeriesState{loadSeries: {Value: 2}, escapedLabel: {Value: 3}})
+		if got, _, _ := store.Get(`node`, loadSeries); got.Value != 1 {
+			t.Errorf(`node has %+v`, got)
+		}
+		if _, ok, _ := store.Get(`node`, escapedLabel); ok {
+			t.Error(`a series of web-1 was found for node`)
+		}
+		if states := stored(t, store, `web-1`); len(states) != 2 || states[loadSeries].Value != 2 {
+			t.Errorf(`web-1 has %+v`, states)
+		}
+		if states := stored(t, store, `missing`); len(states) != 0 {
+			t.Errorf(`a target never put has %+v`, states)
+		}
+	})
+}
+
+func TestStoreDeletes(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store StateStore) {
+		store.Put(`node`, map[SeriesKey]SeriesState{loadSeries: {Value: 1}, escapedLabel: {Value: 2}})
+		if err := store.Delete(`node`, []SeriesKey{escapedLabel, {Name: `never_put`}}); err != nil {
+			t.Fatal(err)
+		}
+		if states := stored(t, store, `node`); len(states) != 1 || states[loadSeries].Value != 1 {
+			t.Errorf(`left %+v`, states)
+		}
+		if err := store.Delete(`missing`, []SeriesKey{loadSeries}); err != nil {
+			t.Errorf(`deleting from a target never put: %v`, err)
+		}
+	})
+}
+
+func TestStoreEachStopsAtTheFirstError(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store StateStore) {
+		store.Put(`node`, map[SeriesKey]SeriesState{loadSeries: {}, escapedLabel: {}})
+		stop := errors.New(`stop`)
+		var calls int
+		err := store.Each(`node`, func(SeriesKey, SeriesState) error {
+			calls++
+			return stop
+		})
+		if err != stop || calls != 1 {
+			t.Errorf(`%d calls, error %v`, calls, err)
+		}
+	})
+}
+
+func TestStoreSnapshotsAreTheSameForBothBackends(t *testing.T) {
+	var snapshots []string
+	for _, backend := range storeBackends {
+		store := backend.open(t)
+		store.Put(`web-1`, map[SeriesKey]SeriesState{loadSeries: {Value: 2, Unchanged: 1}})
+		store.Put(`node`, map[SeriesKey]SeriesState{loadSeries: {Value: 1, LastSeen: 1622548800000}, escapedLabel: {Value: 3, Revived: true}})
+		var snapshot bytes.Buffer
+		if err := store.Snapshot(&snapshot); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(snapshot.String(), "\n"), "\n")
+		sort.Strings(lines)
+		snapshots = append(snapshots, strings.Join(lines, "\n"))
+	}
+	expected := `{"target":"node","name":"app_last_message","labels":"text=\"a{b}, \\\"c\\\"\\nd\"","value":3,"unchanged":0,"revived":true}` + "\n" +
+		`{"target":"node","name":"node_load1","value":1,"unchanged":0,"last_seen":1622548800000}` + "\n" +
+		`{"target":"web-1","name":"node_load1","value":2,"unchanged":1}`
+	for i, snapshot := range snapshots {
+		if snapshot != expected {
+			t.Errorf("%s snapshot\n%s\nexpected\n%s", storeBackends[i].name, snapshot, expected)
+		}
+	}
+}
+
+func TestPoliciesDecideTheSameWithEitherBackend(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store StateStore) {
+		policies := New(`node`, rulesOf(t, `up=never`), Defaults{Threshold: 2}, store)
+		defer policies.Close()
+		if got := decisions(policies, loadSeries, 5); got != `FFFSS` {
+			t.Errorf(`decided %s`, got)
+		}
+		if state, ok, _ := store.Get(`node`, loadSeries); !ok || state.Unchanged != 4 || state.LastForwarded != 1622548830000 {
+			t.Errorf(`stored %+v`, state)
+		}
+		decisions(policies, SeriesKey{Name: `up`}, 2)
+		if removed := policies.Prune(map[SeriesKey]bool{}); removed != 1 {
+			t.Errorf(`pruned %d series`, removed)
+		}
+		if states := stored(t, store, `node`); len(states) != 0 {
+			t.Errorf(`left after pruning %+v`, states)
+		}
+	})
+}
+
+func TestBoltStateSurvivesReopening(t *testing.T) {
+	file := filepath.Join(t.TempDir(), `state.db`)
+	store, err := OpenBoltStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Put(`node`, map[SeriesKey]SeriesState{loadSeries: {Value: 0.52, Unchanged: 7}})
+	store.Close()
+
+	if store, err = OpenBoltStore(file); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if state, ok, _ := store.Get(`node`, loadSeries); !ok || state.Unchanged != 7 {
+		t.Errorf(`after reopening %+v, %v`, state, ok)
+	}
+}
+
+func TestBoltStoreSortsTheLabelsOfOldFiles(t *testing.T) {
+	file := filepath.Join(t.TempDir(), `state.db`)
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket([]byte(`node`))
+		if err != nil {
+			return err
+		}
+		bucket.Put([]byte(`node_cpu_seconds_total{mode="idle",cpu="0"`), []byte(`{"value":1,"unchanged":5}`))
+		bucket.Put([]byte(`node_cpu_seconds_total{mode="user",cpu="0"`), []byte(`{"value":2,"unchanged":5}`))
+		// Saved sorted as well, which wins
+		bucket.Put([]byte(`node_cpu_seconds_total{cpu="0",mode="user"`), []byte(`{"value":3,"unchanged":1}`))
+		return nil
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenBoltStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	states := stored(t, store, `node`)
+	if len(states) != 2 ||
+		states[SeriesKey{Name: `node_cpu_seconds_total`, Labels: `cpu="0",mode="idle"`}].Unchanged != 5 ||
+		states[SeriesKey{Name: `node_cpu_seconds_total`, Labels: `cpu="0",mode="user"`}].Value != 3 {
+		t.Errorf(`after opening %+v`, states)
+	}
+}
+
+// Series of a large target, like kube-state-metrics of a big cluster
+const benchmarkSeries = 500000
+
+func benchmarkKeys() []SeriesKey {
+	keys := make([]SeriesKey, benchmarkSeries)
+	for i := range keys {
+		keys[i] = SeriesKey{Name: `kube_pod_status_phase`, Labels: `namespace="default",phase="Running",pod="web-` + strconv.Itoa(i) + `"`}
+	}
+	return keys
+}
+
+// A scrape of every series: each is read, then all are written at once
+func BenchmarkStoreScrape(b *testing.B) {
+	keys := benchmarkKeys()
+	for _, backend := range storeBackends {
+		b.Run(backend.name, func(b *testing.B) {
+			store := backend.open(b)
+			states := make(map[SeriesKey]SeriesState, len(keys))
+			for _, key := range keys {
+				states[key] = SeriesState{Value: 1, Unchanged: -1}
+			}
+			if err := store.Put(`ksm`, states); err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, key := range keys {
+					state, _, err := store.Get(`ksm`, key)
+					if err != nil {
+						b.Fatal(err)
+					}
+					state.Unchanged++
+					states[key] = state
+				}
+				if err := store.Put(`ksm`, states); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Walking the state of every series, like pruning and snapshots do
+func BenchmarkStoreEach(b *testing.B) {
+	keys := benchmarkKeys()
+	for _, backend := range storeBackends {
+		b.Run(backend.name, func(b *testing.B) {
+			store := backend.open(b)
+			states := make(map[SeriesKey]SeriesState, len(keys))
+			for _, key := range keys {
+				states[key] = SeriesState{Value: 1}
+			}
+			if err := store.Put(`ksm`, states); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var count int
+				store.Each(`ksm`, func(SeriesKey, SeriesState) error {
+					count++
+					return nil
+				})
+				if count != benchmarkSeries {
+					b.Fatalf(`walked %d series`, count)
+				}
+			}
+		})
+	}
+}